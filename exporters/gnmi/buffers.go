@@ -0,0 +1,279 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Queue lengths in bytes, from a few cells to the deep buffers of
+// Jericho-class switches
+var queueLengthBuckets = prometheus.ExponentialBuckets(4096, 4, 10)
+
+// queuePeakWindow is how long a peak is held: it is exported for one to two
+// windows, so every scrape at most this far apart sees it
+const queuePeakWindow = 10 * time.Second
+
+// peakGauge exports the highest value observed in the current and the
+// previous window, so that bursts between scrapes still show. Windows are
+// fixed, so any number of scrapers see the same peaks
+type peakGauge struct {
+	desc       *prometheus.Desc
+	labelNames []string
+	window     time.Duration
+	now        func() time.Time
+
+	mu     sync.Mutex
+	series map[string]*peakSeries
+}
+
+type peakSeries struct {
+	labels   []string
+	start    time.Time // Of the current window
+	current  float64
+	max      float64 // Of the current window
+	previous float64 // Of the previous window
+}
+
+func newPeakGauge(name, help string, labels []string, window time.Duration) *peakGauge {
+	return &peakGauge{
+		desc:       prometheus.NewDesc(name, help, labels, nil),
+		labelNames: labels,
+		window:     window,
+		now:        time.Now,
+		series:     make(map[string]*peakSeries),
+	}
+}
+
+// windows returns how many windows ended since the series' current one began
+func (g *peakGauge) windows(s *peakSeries, now time.Time) int64 {
+	if now.Before(s.start) {
+		return 0
+	}
+	return int64(now.Sub(s.start) / g.window)
+}
+
+// value is the peak of the current and previous window at now
+func (g *peakGauge) value(s *peakSeries, now time.Time) float64 {
+	switch g.windows(s, now) {
+	case 0:
+		return math.Max(s.max, s.previous)
+	case 1:
+		return math.Max(s.max, s.current)
+	default:
+		// Nothing observed for two windows: the value held throughout
+		return s.current
+	}
+}
+
+// rotate moves the series to the window at now; g.mu must be held
+func (g *peakGauge) rotate(s *peakSeries, now time.Time) {
+	n := g.windows(s, now)
+	if n == 0 {
+		return
+	}
+	if n == 1 {
+		s.previous = s.max
+	} else {
+		s.previous = s.current
+	}
+	s.max = s.current
+	s.start = s.start.Add(time.Duration(n) * g.window)
+}
+
+// Observe records the current value of a series
+func (g *peakGauge) Observe(labelValues []string, v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s := g.get(labelValues, v)
+	s.current = v
+	if v > s.max {
+		s.max = v
+	}
+}
+
+// Raise records a peak reached since the previous value, which is not the
+// current value
+func (g *peakGauge) Raise(labelValues []string, v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if s := g.get(labelValues, v); v > s.max {
+		s.max = v
+	}
+}
+
+// get returns a series moved to the current window, creating it with v as
+// its peak; g.mu must be held
+func (g *peakGauge) get(labelValues []string, v float64) *peakSeries {
+	now := g.now()
+	key := strings.Join(labelValues, "\xff")
+	s, ok := g.series[key]
+	if !ok {
+		s = &peakSeries{labels: append([]string(nil), labelValues...), start: now, max: v}
+		g.series[key] = s
+	}
+	g.rotate(s, now)
+	return s
+}
+
+// DeletePartialMatch drops the series matching labels
+func (g *peakGauge) DeletePartialMatch(labels prometheus.Labels) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for key, s := range g.series {
+		matches := true
+		for i, name := range g.labelNames {
+			if v, ok := labels[name]; ok && s.labels[i] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			delete(g.series, key)
+		}
+	}
+}
+
+func (g *peakGauge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *peakGauge) Collect(ch chan<- prometheus.Metric) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	for _, s := range g.series {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, g.value(s, now), s.labels...)
+	}
+}
+
+// queueKey is an egress queue of a switch
+type queueKey struct {
+	switchName, iface, queue string
+}
+
+// queueBuffer is the last buffer state reported for a queue
+type queueBuffer struct {
+	occupancy    float64
+	limit        float64 // 0 until reported
+	hasOccupancy bool
+}
+
+// bufferTelemetry turns the queue occupancy a switch streams (LANZ records,
+// sampled buffer statistics) into peaks, a length distribution and
+// utilization, which catch microbursts that 1s average rates hide
+type bufferTelemetry struct {
+	mu     sync.Mutex
+	queues map[queueKey]*queueBuffer
+
+	peak        *peakGauge
+	length      *prometheus.HistogramVec
+	limit       *prometheus.GaugeVec
+	utilization *prometheus.GaugeVec
+}
+
+func newBufferTelemetry(metrics *MetricSet) (*bufferTelemetry, error) {
+	b := &bufferTelemetry{queues: make(map[queueKey]*queueBuffer)}
+	labels := []string{"switch", "interface", "queue"}
+
+	var err error
+	if b.utilization, err = metrics.Gauge("st2110_switch_qos_buffer_utilization", "", labels); err != nil {
+		return nil, err
+	}
+	if b.limit, err = metrics.Gauge("st2110_switch_queue_limit_bytes", "Buffer the egress queue may use", labels); err != nil {
+		return nil, err
+	}
+	if b.peak, err = register(newPeakGauge("st2110_switch_queue_peak_occupancy_bytes",
+		"Highest egress queue occupancy over the last 10 to 20 seconds", labels, queuePeakWindow)); err != nil {
+		return nil, err
+	}
+	if b.length, err = register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "st2110_switch_queue_length_bytes",
+		Help:    "Egress queue lengths the switch reported",
+		Buckets: queueLengthBuckets,
+	}, labels)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *bufferTelemetry) queue(key queueKey) *queueBuffer {
+	q, ok := b.queues[key]
+	if !ok {
+		q = &queueBuffer{}
+		b.queues[key] = q
+	}
+	return q
+}
+
+// Occupancy records the current length of a queue in bytes
+func (b *bufferTelemetry) Occupancy(switchName, iface, queue string, bytes float64) {
+	labels := []string{switchName, iface, queue}
+	b.peak.Observe(labels, bytes)
+	b.length.WithLabelValues(labels...).Observe(bytes)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q := b.queue(queueKey{switchName, iface, queue})
+	q.occupancy, q.hasOccupancy = bytes, true
+	b.publish(labels, q)
+}
+
+// Peak records a watermark the switch kept itself, such as the peak of a
+// LANZ congestion record or a clear-on-read maximum
+func (b *bufferTelemetry) Peak(switchName, iface, queue string, bytes float64) {
+	b.peak.Raise([]string{switchName, iface, queue}, bytes)
+}
+
+// Limit records the buffer a queue may use in bytes
+func (b *bufferTelemetry) Limit(switchName, iface, queue string, bytes float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	labels := []string{switchName, iface, queue}
+	b.limit.WithLabelValues(labels...).Set(bytes)
+	q := b.queue(queueKey{switchName, iface, queue})
+	q.limit = bytes
+	b.publish(labels, q)
+}
+
+// publish sets the utilization of a queue once both its occupancy and
+// limit are known; b.mu must be held
+func (b *bufferTelemetry) publish(labels []string, q *queueBuffer) {
+	if q.hasOccupancy && q.limit > 0 {
+		b.utilization.WithLabelValues(labels...).Set(q.occupancy / q.limit * 100)
+	}
+}
+
+// Remove forgets the queues of an interface, or a single queue; empty values
+// match any
+func (b *bufferTelemetry) Remove(switchName, iface, queue string) {
+	labels := prometheus.Labels{"switch": switchName}
+	if iface != "" {
+		labels["interface"] = iface
+	}
+	if queue != "" {
+		labels["queue"] = queue
+	}
+	b.peak.DeletePartialMatch(labels)
+	b.length.DeletePartialMatch(labels)
+	b.limit.DeletePartialMatch(labels)
+	b.utilization.DeletePartialMatch(labels)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key := range b.queues {
+		if key.switchName == switchName && (iface == "" || key.iface == iface) && (queue == "" || key.queue == queue) {
+			delete(b.queues, key)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Default share of a port's speed that streams may reserve
+const defaultReservationLimit = 90.0
+
+// PortReservation is the bandwidth the configured streams commit on a switch
+// port in one direction
+type PortReservation struct {
+	Switch          string   `json:"switch"`
+	Interface       string   `json:"interface"`
+	Direction       string   `json:"direction"`
+	SpeedBps        float64  `json:"speed_bps,omitempty"`
+	CommittedBps    float64  `json:"committed_bps"`
+	HeadroomPercent *float64 `json:"headroom_percent,omitempty"` // Of the port speed, left under the limit
+	Oversubscribed  bool     `json:"oversubscribed"`
+	Streams         []string `json:"streams"`
+}
+
+// CapacityCheck tells whether a stream fits on the ports of its path, or on
+// the ports planned for it in streams.yaml while it is not routed
+type CapacityCheck struct {
+	StreamID   string             `json:"stream_id"`
+	BitrateBps float64            `json:"bitrate_bps"`
+	Routed     bool               `json:"routed"`
+	Fits       bool               `json:"fits"`
+	Ports      []*PortReservation `json:"ports"` // With the stream's bitrate included
+}
+
+func reservationKey(switchName, iface, direction string) string {
+	return strings.Join([]string{switchName, iface, direction}, "\xff")
+}
+
+// reservations sums the expected bitrate of the streams on every port of
+// their paths: egress ports transmit them, ingress ports (uplinks towards
+// the senders) receive them
+func (f *Fabric) reservations(paths []StreamPath) []*PortReservation {
+	bitrates := make(map[string]float64, len(f.streams))
+	for _, stream := range f.streams {
+		bitrates[stream.StreamID] = stream.ExpectedBitrate
+	}
+
+	ports := make(map[string]*PortReservation)
+	add := func(hop PathHop, port PathPort, direction, streamID string) {
+		key := reservationKey(hop.Switch, port.Interface, direction)
+		r, ok := ports[key]
+		if !ok {
+			r = &PortReservation{Switch: hop.Switch, Interface: port.Interface, Direction: direction, SpeedBps: port.SpeedBps, Streams: []string{}}
+			ports[key] = r
+		}
+		r.CommittedBps += bitrates[streamID]
+		r.Streams = append(r.Streams, streamID)
+	}
+	for _, path := range paths {
+		for _, hop := range path.Hops {
+			for _, port := range hop.Ingress {
+				add(hop, port, "ingress", path.StreamID)
+			}
+			for _, port := range hop.Egress {
+				add(hop, port, "egress", path.StreamID)
+			}
+		}
+	}
+
+	result := make([]*PortReservation, 0, len(ports))
+	for _, r := range ports {
+		if r.SpeedBps > 0 {
+			headroom := f.reservationLimit - r.CommittedBps/r.SpeedBps*100
+			r.HeadroomPercent = &headroom
+			r.Oversubscribed = headroom < 0
+		}
+		sort.Strings(r.Streams)
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Switch != b.Switch {
+			return a.Switch < b.Switch
+		}
+		if a.Interface != b.Interface {
+			return a.Interface < b.Interface
+		}
+		return a.Direction < b.Direction
+	})
+	return result
+}
+
+// warnOversubscribed logs ports that went over the limit since the previous
+// check, with the streams added to them since; f.mu must not be held
+func (f *Fabric) warnOversubscribed(reservations []*PortReservation) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	previous := f.oversubscribed
+	f.oversubscribed = make(map[string][]string)
+	for _, r := range reservations {
+		if !r.Oversubscribed {
+			continue
+		}
+		key := reservationKey(r.Switch, r.Interface, r.Direction)
+		f.oversubscribed[key] = r.Streams
+
+		before, was := previous[key]
+		added := newStreams(before, r.Streams)
+		if !was || len(added) > 0 {
+			log.Printf("⚠️  %s %s %s: streams commit %.2f Gbps of %.0f Gbps, over the %.0f%% reservation limit (added: %s)",
+				r.Switch, r.Interface, r.Direction, r.CommittedBps/1e9, r.SpeedBps/1e9, f.reservationLimit, strings.Join(added, ", "))
+		}
+	}
+}
+
+// plannedPath is the path of the ports streams.yaml plans for a stream
+func (f *Fabric) plannedPath(stream StreamConfig) StreamPath {
+	path := StreamPath{StreamID: stream.StreamID, Name: stream.Name, Group: stream.Group(), Source: stream.Source, Hops: []PathHop{}}
+	hops := make(map[string]int)
+	for _, port := range stream.Ports {
+		i, ok := hops[port.Switch]
+		if !ok {
+			i = len(path.Hops)
+			hops[port.Switch] = i
+			path.Hops = append(path.Hops, PathHop{Switch: port.Switch, Ingress: []PathPort{}, Egress: []PathPort{}})
+		}
+		hop := &path.Hops[i]
+		if port.Direction == "ingress" {
+			hop.Ingress = append(hop.Ingress, f.port(port.Switch, port.Interface, "", false))
+		} else {
+			hop.Egress = append(hop.Egress, f.port(port.Switch, port.Interface, "", true))
+		}
+	}
+	return path
+}
+
+// check evaluates a stream against the reservations of the current paths:
+// along its own path once routed, before that along its planned ports
+func (f *Fabric) check(stream StreamConfig, paths []StreamPath) *CapacityCheck {
+	check := &CapacityCheck{StreamID: stream.StreamID, BitrateBps: stream.ExpectedBitrate, Fits: true, Ports: []*PortReservation{}}
+
+	var path StreamPath
+	for _, p := range paths {
+		if p.StreamID == stream.StreamID {
+			path = p
+		}
+	}
+	check.Routed = len(path.Hops) > 0
+	if !check.Routed {
+		path = f.plannedPath(stream)
+		paths = append(append([]StreamPath(nil), paths...), path)
+	}
+
+	onPath := make(map[string]bool)
+	for _, hop := range path.Hops {
+		for _, port := range hop.Ingress {
+			onPath[reservationKey(hop.Switch, port.Interface, "ingress")] = true
+		}
+		for _, port := range hop.Egress {
+			onPath[reservationKey(hop.Switch, port.Interface, "egress")] = true
+		}
+	}
+	for _, r := range f.reservations(paths) {
+		if onPath[reservationKey(r.Switch, r.Interface, r.Direction)] {
+			check.Ports = append(check.Ports, r)
+			check.Fits = check.Fits && !r.Oversubscribed
+		}
+	}
+	return check
+}
+
+// warnUnfit logs the unrouted streams that would take a planned port over
+// the limit, once until they fit again; f.mu must not be held
+func (f *Fabric) warnUnfit(paths []StreamPath) {
+	unfit := make(map[string]bool)
+	for _, stream := range f.streams {
+		if len(stream.Ports) == 0 {
+			continue
+		}
+		check := f.check(stream, paths)
+		if check.Routed || check.Fits {
+			continue
+		}
+		unfit[stream.StreamID] = true
+
+		f.mu.Lock()
+		warned := f.unfit[stream.StreamID]
+		f.mu.Unlock()
+		if warned {
+			continue
+		}
+		var over []string
+		for _, r := range check.Ports {
+			if r.Oversubscribed {
+				over = append(over, fmt.Sprintf("%s %s %s (%.2f of %.0f Gbps)", r.Switch, r.Interface, r.Direction, r.CommittedBps/1e9, r.SpeedBps/1e9))
+			}
+		}
+		log.Printf("⚠️  Routing stream %s would take its planned ports over the %.0f%% reservation limit: %s",
+			stream.StreamID, f.reservationLimit, strings.Join(over, ", "))
+	}
+
+	f.mu.Lock()
+	f.unfit = unfit
+	f.mu.Unlock()
+}
+
+// newStreams returns the streams of after that are not in before; both sorted
+func newStreams(before, after []string) []string {
+	var added []string
+	i := 0
+	for _, s := range after {
+		for i < len(before) && before[i] < s {
+			i++
+		}
+		if i == len(before) || before[i] != s {
+			added = append(added, s)
+		}
+	}
+	return added
+}
+
+// CapacityHandler returns the port reservations as JSON, optionally of one
+// switch with ?switch= or only the oversubscribed ones with ?oversubscribed=true.
+// ?stream_id= checks whether one stream fits, ?unrouted=true every stream
+// not routed yet along its planned ports
+func (f *Fabric) CapacityHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		paths := make([]StreamPath, 0, len(f.streams))
+		for _, stream := range f.streams {
+			paths = append(paths, f.Path(stream))
+		}
+
+		if streamID := query.Get("stream_id"); streamID != "" {
+			for _, stream := range f.streams {
+				if stream.StreamID == streamID {
+					w.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(w).Encode(f.check(stream, paths))
+					return
+				}
+			}
+			http.Error(w, "unknown stream_id "+streamID, http.StatusNotFound)
+			return
+		}
+		if query.Get("unrouted") == "true" {
+			checks := []*CapacityCheck{}
+			for _, stream := range f.streams {
+				if check := f.check(stream, paths); !check.Routed {
+					checks = append(checks, check)
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(checks)
+			return
+		}
+
+		result := []*PortReservation{}
+		for _, reservation := range f.reservations(paths) {
+			if s := query.Get("switch"); s != "" && reservation.Switch != s {
+				continue
+			}
+			if query.Get("oversubscribed") == "true" && !reservation.Oversubscribed {
+				continue
+			}
+			result = append(result, reservation)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
@@ -0,0 +1,1307 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cisco-ie/nx-telemetry-proto/mdt_dialout"
+	"github.com/gosnmp/gosnmp"
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var sessions uint64
+
+// switchName is unique per run so that -count reruns, which share the default
+// registry, start from fresh series
+func switchName(base string) string {
+	return fmt.Sprintf("%s-%d", base, atomic.AddUint64(&sessions, 1))
+}
+
+// startCollector runs a supervised session against the fake target until the test ends
+func startCollector(t *testing.T, sw SwitchConfig, paths map[string]PathConfig, opts SessionOptions) (*GNMICollector, *MetricSet) {
+	t.Helper()
+	metrics := NewMetricSet()
+	specs, err := compilePaths(paths, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, err := NewVendorPlugin(sw.Vendor, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = time.Second
+	}
+	c := NewGNMICollector(sw, specs, plugin, NewSessionMetrics(), opts)
+	runSession(t, c)
+	return c, metrics
+}
+
+// runSession runs a collector's supervised session until the test ends
+func runSession(t *testing.T, c *GNMICollector) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func counterValue(t *testing.T, metrics *MetricSet, name string, labels ...string) float64 {
+	t.Helper()
+	metrics.mu.Lock()
+	counter, ok := metrics.counters[name]
+	metrics.mu.Unlock()
+	if !ok {
+		t.Fatalf("counter %s not mapped", name)
+	}
+	return testutil.ToFloat64(counter.vec.WithLabelValues(labels...))
+}
+
+func gaugeValue(t *testing.T, metrics *MetricSet, name string, labels ...string) float64 {
+	t.Helper()
+	metrics.mu.Lock()
+	gauge, ok := metrics.gauges[name]
+	metrics.mu.Unlock()
+	if !ok {
+		t.Fatalf("gauge %s not mapped", name)
+	}
+	return testutil.ToFloat64(gauge.WithLabelValues(labels...))
+}
+
+// seriesCount counts the series of a collector that belong to a switch
+func seriesCount(t *testing.T, c prometheus.Collector, switchName string) int {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 64)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	n := 0
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		for _, label := range m.GetLabel() {
+			if label.GetName() == "switch" && label.GetValue() == switchName {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// collectedValue collects c and returns the value of the series with these
+// labels
+func collectedValue(t *testing.T, c prometheus.Collector, labels prometheus.Labels) (float64, bool) {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 64)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var value float64
+	found := false
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		matches := len(m.GetLabel()) == len(labels)
+		for _, label := range m.GetLabel() {
+			if labels[label.GetName()] != label.GetValue() {
+				matches = false
+			}
+		}
+		if matches {
+			value, found = m.GetGauge().GetValue(), true
+		}
+	}
+	return value, found
+}
+
+func waitSynced(t *testing.T, c *GNMICollector) {
+	t.Helper()
+	eventually(t, "sync response", func() bool {
+		return testutil.ToFloat64(c.health.synced.WithLabelValues(c.name, c.target)) == 1
+	})
+}
+
+func TestCollectorOpenConfigAndArista(t *testing.T) {
+	name := switchName("arista")
+	target := newFakeTarget(t)
+	target.setGet(hostnamePath, notification("/system/state", stringUpdate("hostname", "leaf-a")))
+	target.setGet(componentsPath,
+		notification("/components/component[name=Chassis]", jsonUpdate("state",
+			`{"type":"openconfig-platform-types:CHASSIS","part-no":"DCS-7280SR3-48YC8","serial-no":"JPE123","software-version":"4.30.1F"}`)),
+		notification("/components/component[name=Linecard3]", jsonUpdate("state", `{"type":"openconfig-platform-types:LINECARD"}`)),
+		notification("/components/component[name=Linecard4]", jsonUpdate("state", `{"type":"openconfig-platform-types:LINECARD"}`)),
+	)
+	target.setScript(
+		openconfigCounters("Ethernet1", 1000, 2000, 3),
+		aristaQueueDrops("Ethernet1", "3", 0),
+		aristaPTPLock("locked"),
+	)
+
+	c, metrics := startCollector(t, target.switchConfig(name, "arista"), defaultPaths, SessionOptions{Inventory: true})
+	waitSynced(t, c)
+
+	if got := counterValue(t, metrics, "st2110_switch_interface_rx_bytes", name, "Ethernet1"); got != 1000 {
+		t.Errorf("rx bytes = %v, want 1000", got)
+	}
+	if got := counterValue(t, metrics, "st2110_switch_interface_rx_errors", name, "Ethernet1"); got != 3 {
+		t.Errorf("rx errors = %v, want 3", got)
+	}
+	if got := counterValue(t, metrics, "arista_hw_queue_drops_total", name, "Ethernet1", "3"); got != 0 {
+		t.Errorf("hardware queue drops = %v, want 0", got)
+	}
+	if got := gaugeValue(t, metrics, "arista_ptp_lock_status", name, "127"); got != 1 {
+		t.Errorf("PTP lock status = %v, want 1", got)
+	}
+
+	// Capabilities list JSON first, JSON_IETF is preferred
+	list := target.lastSubscription()
+	if list.GetEncoding() != gnmi.Encoding_JSON_IETF || len(list.GetSubscription()) != 11 {
+		t.Errorf("subscribed %d paths with %v, want 11 with JSON_IETF", len(list.GetSubscription()), list.GetEncoding())
+	}
+	info := c.health.info.WithLabelValues(name, target.addr, "0.7.0", "JSON_IETF", "leaf-a", "4.30.1F", "DCS-7280SR3-48YC8", "JPE123")
+	if testutil.ToFloat64(info) != 1 {
+		t.Error("target info not published with the discovered inventory")
+	}
+	if got := testutil.ToFloat64(c.health.lineCards.WithLabelValues(name, target.addr)); got != 2 {
+		t.Errorf("line cards = %v, want 2", got)
+	}
+
+	// Running totals keep counting; deleting the interface drops its series
+	target.send(openconfigCounters("Ethernet1", 1500, 2500, 3))
+	eventually(t, "second sample", func() bool {
+		return counterValue(t, metrics, "st2110_switch_interface_rx_bytes", name, "Ethernet1") == 1500
+	})
+	target.send(&gnmi.Notification{Delete: []*gnmi.Path{mustParsePath("/interfaces/interface[name=Ethernet1]")}})
+	eventually(t, "delete", func() bool {
+		return seriesCount(t, metrics.counters["st2110_switch_interface_tx_bytes"].vec, name) == 0
+	})
+}
+
+func TestCollectorReconnectsAfterReboot(t *testing.T) {
+	name := switchName("reboot")
+	target := newFakeTarget(t)
+	target.setScript(openconfigCounters("Ethernet1", 1000, 0, 0))
+
+	c, metrics := startCollector(t, target.switchConfig(name, "generic"), defaultPaths, SessionOptions{})
+	waitSynced(t, c)
+	target.send(openconfigCounters("Ethernet1", 1200, 0, 0))
+	eventually(t, "update before reboot", func() bool {
+		return counterValue(t, metrics, "st2110_switch_interface_rx_bytes", name, "Ethernet1") == 1200
+	})
+
+	// The switch comes back with cleared counters
+	target.setScript(openconfigCounters("Ethernet1", 100, 0, 0))
+	target.drop()
+	eventually(t, "reconnect", func() bool { return target.streamCount() == 2 })
+	waitSynced(t, c)
+
+	if got := counterValue(t, metrics, "st2110_switch_interface_rx_bytes", name, "Ethernet1"); got != 1300 {
+		t.Errorf("rx bytes after counter reset = %v, want 1300", got)
+	}
+	if got := testutil.ToFloat64(c.health.reconnects.WithLabelValues(name, target.addr, "error")); got != 1 {
+		t.Errorf("reconnects = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(c.health.state.WithLabelValues(name, target.addr)); got != sessionConnected {
+		t.Errorf("session state = %v, want connected", got)
+	}
+}
+
+func TestCollectorMulticastTables(t *testing.T) {
+	name := switchName("mcast")
+	target := newFakeTarget(t)
+	target.setScript(
+		aristaSnoopingVLAN("100", "10.1.0.1"),
+		aristaSnoopingVLAN("200", "0.0.0.0"),
+		aristaSnoopingMember("100", "239.1.1.1", "Ethernet1"),
+		aristaSnoopingMember("100", "239.1.1.1", "Ethernet2"),
+		aristaSnoopingMember("100", "239.1.1.2", "Ethernet1"),
+		aristaMroute("10.1.0.10", "239.1.1.1", "Vlan100", "Ethernet1", "Ethernet2"),
+	)
+
+	c, metrics := startCollector(t, target.switchConfig(name, "arista"), map[string]PathConfig{}, SessionOptions{})
+	waitSynced(t, c)
+
+	if got := gaugeValue(t, metrics, "st2110_igmp_active_groups", name, "100"); got != 2 {
+		t.Errorf("active groups = %v, want 2", got)
+	}
+	if gaugeValue(t, metrics, "st2110_igmp_querier_present", name, "100") != 1 || gaugeValue(t, metrics, "st2110_igmp_querier_present", name, "200") != 0 {
+		t.Error("querier presence does not follow querier-address")
+	}
+	if got := gaugeValue(t, metrics, "st2110_switch_igmp_snooping_port_groups", name, "100", "Ethernet1"); got != 2 {
+		t.Errorf("groups on Ethernet1 = %v, want 2", got)
+	}
+	if got := gaugeValue(t, metrics, "st2110_switch_mroute_outgoing_interfaces", name, "default", "10.1.0.10", "239.1.1.1", "Vlan100"); got != 2 {
+		t.Errorf("outgoing interfaces = %v, want 2", got)
+	}
+
+	// A leave and a pruned outgoing interface
+	target.send(&gnmi.Notification{Delete: []*gnmi.Path{
+		mustParsePath("arista:/eos/arista-exp-eos-igmpsnooping/igmp-snooping/vlans/vlan[vlan-id=100]/groups/group[address=239.1.1.2]"),
+		mustParsePath("arista:/eos/arista-exp-eos-multicast/multicast/vrfs/vrf[name=default]/routes/route[group=239.1.1.1][source=10.1.0.10]/outgoing-interfaces/interface[name=Ethernet2]"),
+	}})
+	eventually(t, "leave", func() bool {
+		return gaugeValue(t, metrics, "st2110_igmp_active_groups", name, "100") == 1 &&
+			gaugeValue(t, metrics, "st2110_switch_mroute_outgoing_interfaces", name, "default", "10.1.0.10", "239.1.1.1", "Vlan100") == 1
+	})
+
+	// After a reboot the switch no longer reports VLAN 200, the route or the querier of VLAN 100
+	target.setScript(
+		notification("arista:/eos/arista-exp-eos-igmpsnooping/igmp-snooping/vlans/vlan[vlan-id=100]/state", uintUpdate("group-count", 1)),
+		aristaSnoopingMember("100", "239.1.1.1", "Ethernet2"),
+	)
+	target.drop()
+	eventually(t, "stale entries swept", func() bool {
+		return seriesCount(t, c.vendor.(*aristaPlugin).multicast.routeEntries, name) == 0
+	})
+	if seriesCount(t, metrics.gauges["st2110_igmp_active_groups"], name) != 1 {
+		t.Error("VLAN 200 not removed after the switch stopped reporting it")
+	}
+	if gaugeValue(t, metrics, "st2110_igmp_querier_present", name, "100") != 0 {
+		t.Error("querier of VLAN 100 still present after the switch stopped reporting it")
+	}
+	if seriesCount(t, metrics.gauges["st2110_switch_igmp_snooping_port_groups"], name) != 1 {
+		t.Error("port groups of the previous stream not swept")
+	}
+}
+
+func TestFabricStreamPath(t *testing.T) {
+	name := switchName("fabric")
+	target := newFakeTarget(t)
+	target.setScript(
+		aristaMroute("10.1.0.10", "239.1.1.10", "Ethernet9", "Ethernet1"),
+		aristaSnoopingMember("100", "239.1.1.10", "Ethernet2"),
+		aristaMroute("10.1.0.11", "239.1.1.20", "Ethernet9", "Ethernet3"),
+		openconfigOperStatus("Ethernet1", "UP"),
+		openconfigOperStatus("Ethernet2", "DOWN"),
+		openconfigOperStatus("Ethernet9", "UP"),
+		openconfigPortSpeed("Ethernet1", "SPEED_100GB"),
+		openconfigPortSpeed("Ethernet2", "SPEED_1GB"),
+		openconfigCounters("Ethernet1", 0, 0, 0),
+	)
+
+	metrics := NewMetricSet()
+	plugin, err := NewVendorPlugin("arista", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interfaces, err := newInterfaceTable(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fabric := NewFabric([]StreamConfig{
+		{Name: "Camera 1", StreamID: name + "-cam1", Multicast: "239.1.1.10:20000", Source: "10.1.0.10", ExpectedBitrate: 2.2e9},
+		{Name: "Camera 9", StreamID: name + "-cam9", Multicast: "239.1.1.90:20000"},
+		// Not routed yet
+		{Name: "Camera 3", StreamID: name + "-cam3", Multicast: "239.1.1.30:20000", ExpectedBitrate: 1e8,
+			Ports: []StreamPort{{Switch: name, Interface: "Ethernet2", Direction: "egress"}}},
+		{Name: "Camera 4", StreamID: name + "-cam4", Multicast: "239.1.1.40:20000", ExpectedBitrate: 50e9,
+			Ports: []StreamPort{{Switch: name, Interface: "Ethernet1", Direction: "egress"}}},
+	}, defaultReservationLimit, interfaces)
+	var samples int64
+	start := time.Now()
+	interfaces.now = func() time.Time {
+		return start.Add(time.Duration(atomic.AddInt64(&samples, 1)) * 10 * time.Second)
+	}
+	sw := target.switchConfig(name, "arista")
+	fabric.AddSwitch(name, plugin)
+	c := NewGNMICollector(sw, nil, chainPlugins(plugin, interfaces), NewSessionMetrics(), SessionOptions{MaxBackoff: time.Second})
+	runSession(t, c)
+	waitSynced(t, c)
+
+	// 12.5 GB in 10s on a 100G port
+	target.send(openconfigCounters("Ethernet1", 0, 12500000000, 0))
+	eventually(t, "egress rate", func() bool {
+		port := fabric.port(name, "Ethernet1", "", true)
+		return port.UtilizationPercent != nil && *port.UtilizationPercent == 10
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/path", fabric)
+	mux.Handle("/capacity", fabric.CapacityHandler())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/path?stream_id=" + name + "-cam1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var path StreamPath
+	if err := json.NewDecoder(resp.Body).Decode(&path); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(path.Hops) != 1 {
+		t.Fatalf("path has %d hops, want 1: %+v", len(path.Hops), path)
+	}
+	hop := path.Hops[0]
+	if hop.Source != "10.1.0.10" || len(hop.Ingress) != 1 || hop.Ingress[0].Interface != "Ethernet9" {
+		t.Errorf("ingress = %+v from %q, want Ethernet9 from 10.1.0.10", hop.Ingress, hop.Source)
+	}
+	if len(hop.Egress) != 2 || hop.Egress[0].Interface != "Ethernet1" || hop.Egress[1].Interface != "Ethernet2" || hop.Egress[1].VLAN != "100" {
+		t.Errorf("egress = %+v, want Ethernet1 and Ethernet2 in VLAN 100", hop.Egress)
+	}
+
+	if resp, err := http.Get(server.URL + "/path?stream_id=missing"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown stream_id answered %v, %v", resp.Status, err)
+	}
+
+	fabric.publish()
+	if got := testutil.ToFloat64(fabric.pathSwitches.WithLabelValues(name + "-cam1")); got != 1 {
+		t.Errorf("path switches = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(fabric.pathSwitches.WithLabelValues(name + "-cam9")); got != 0 {
+		t.Errorf("path switches of a stream nobody forwards = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(fabric.portUp.WithLabelValues(name+"-cam1", name, "Ethernet2", "egress")); got != 0 {
+		t.Errorf("Ethernet2 up = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(fabric.utilization.WithLabelValues(name+"-cam1", name, "Ethernet1")); got != 10 {
+		t.Errorf("Ethernet1 utilization = %v, want 10", got)
+	}
+
+	// 2.2 Gbps reserved on a 100G and a 1G port under a 90% limit
+	if got := testutil.ToFloat64(fabric.committed.WithLabelValues(name, "Ethernet1", "egress")); got != 2.2e9 {
+		t.Errorf("committed on Ethernet1 = %v, want 2.2e9", got)
+	}
+	if got := testutil.ToFloat64(fabric.headroom.WithLabelValues(name, "Ethernet1", "egress")); math.Abs(got-87.8) > 1e-9 {
+		t.Errorf("headroom on Ethernet1 = %v, want 87.8", got)
+	}
+	if got := testutil.ToFloat64(fabric.overLimit.WithLabelValues(name, "Ethernet2", "egress")); got != 1 {
+		t.Errorf("Ethernet2 oversubscribed = %v, want 1", got)
+	}
+	resp, err = http.Get(server.URL + "/capacity?oversubscribed=true&switch=" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reservations []PortReservation
+	if err := json.NewDecoder(resp.Body).Decode(&reservations); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(reservations) != 1 || reservations[0].Interface != "Ethernet2" || reservations[0].Streams[0] != name+"-cam1" {
+		t.Errorf("oversubscribed ports = %+v, want Ethernet2 carrying cam1", reservations)
+	}
+
+	// Streams not routed yet are checked along their planned ports
+	capacityCheck := func(streamID string) CapacityCheck {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/capacity?stream_id=" + streamID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var check CapacityCheck
+		if err := json.NewDecoder(resp.Body).Decode(&check); err != nil {
+			t.Fatal(err)
+		}
+		return check
+	}
+	if check := capacityCheck(name + "-cam3"); check.Routed || check.Fits || len(check.Ports) != 1 || check.Ports[0].CommittedBps != 2.3e9 {
+		t.Errorf("cam3 on the full 1G port: %+v, want routed=false fits=false with 2.3 Gbps committed", check)
+	}
+	if check := capacityCheck(name + "-cam4"); check.Routed || !check.Fits || len(check.Ports) != 1 || check.Ports[0].CommittedBps != 52.2e9 {
+		t.Errorf("cam4 on the 100G port: %+v, want routed=false fits=true with 52.2 Gbps committed", check)
+	}
+	if check := capacityCheck(name + "-cam1"); !check.Routed || check.Fits || len(check.Ports) != 3 {
+		t.Errorf("cam1: %+v, want routed on 3 ports, not fitting Ethernet2", check)
+	}
+	resp, err = http.Get(server.URL + "/capacity?unrouted=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checks []CapacityCheck
+	if err := json.NewDecoder(resp.Body).Decode(&checks); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(checks) != 3 {
+		t.Errorf("%d unrouted streams, want cam9, cam3 and cam4", len(checks))
+	}
+	fabric.publish()
+	if !fabric.unfit[name+"-cam3"] || fabric.unfit[name+"-cam4"] {
+		t.Errorf("streams warned as not fitting: %v, want cam3 only", fabric.unfit)
+	}
+
+	// The receiver leaves: its port drops out of the path metrics
+	target.send(&gnmi.Notification{Delete: []*gnmi.Path{
+		mustParsePath("arista:/eos/arista-exp-eos-igmpsnooping/igmp-snooping/vlans/vlan[vlan-id=100]/groups/group[address=239.1.1.10]"),
+	}})
+	eventually(t, "leave", func() bool { return len(fabric.Path(fabric.streams[0]).Hops[0].Egress) == 1 })
+	fabric.publish()
+	if n := seriesCount(t, fabric.portUp, name); n != 2 {
+		t.Errorf("%d port_up series after the leave, want 2 (Ethernet9, Ethernet1)", n)
+	}
+	if n := seriesCount(t, fabric.committed, name); n != 2 {
+		t.Errorf("%d committed series after the leave, want 2", n)
+	}
+}
+
+func TestCollectorTopology(t *testing.T) {
+	leaf, spine := switchName("leaf"), switchName("spine")
+	leafTarget, spineTarget := newFakeTarget(t), newFakeTarget(t)
+	leafTarget.setScript(
+		notification("/system/state", stringUpdate("hostname", "rack1-leaf.studio.example")),
+		openconfigLLDPNeighbor("Ethernet49", "00:1c:73:00:00:02", spine+".studio.example", "Ethernet1", "to rack1-leaf"),
+		openconfigLLDPNeighbor("Ethernet1", "b8:ce:f6:00:00:10", "camera-1", "b8:ce:f6:00:00:10", "eth0"),
+		openconfigOperStatus("Ethernet49", "UP"),
+		openconfigOperStatus("Ethernet1", "DOWN"),
+		openconfigPortSpeed("Ethernet49", "SPEED_100GB"),
+	)
+	// The spine knows the leaf by its hostname only
+	spineTarget.setScript(
+		openconfigLLDPNeighbor("Ethernet1", "00:1c:73:00:00:01", "rack1-leaf", "Ethernet49", ""),
+	)
+
+	metrics := NewMetricSet()
+	interfaces, err := newInterfaceTable(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topology, err := newTopologyTable(interfaces, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var collectors []*GNMICollector
+	for _, sw := range []SwitchConfig{leafTarget.switchConfig(leaf, "openconfig"), spineTarget.switchConfig(spine, "openconfig")} {
+		topology.AddSwitch(sw.Name)
+		c := NewGNMICollector(sw, nil, chainPlugins(interfaces, topology), NewSessionMetrics(), SessionOptions{MaxBackoff: time.Second})
+		runSession(t, c)
+		waitSynced(t, c)
+		collectors = append(collectors, c)
+	}
+
+	graph := topology.Graph()
+	if len(graph.Nodes) != 3 || graph.Nodes[0].Name != "camera-1" || graph.Nodes[0].Type != "host" {
+		t.Fatalf("nodes = %+v, want camera-1 and both switches", graph.Nodes)
+	}
+	if len(graph.Links) != 2 {
+		t.Fatalf("links = %+v, want the camera and one leaf-spine link", graph.Links)
+	}
+	for _, link := range graph.Links {
+		switch link.A.Interface {
+		case "Ethernet1":
+			if link.A.Node != leaf || link.B != (TopologyEnd{Node: "camera-1", Interface: "eth0"}) || link.OperStatus != "DOWN" {
+				t.Errorf("camera link = %+v, want %s Ethernet1 down to camera-1 eth0", link, leaf)
+			}
+		case "Ethernet49":
+			if link.B != (TopologyEnd{Node: spine, Interface: "Ethernet1"}) || link.SpeedBps != 100e9 {
+				t.Errorf("uplink = %+v, want %s Ethernet1 at 100G", link, spine)
+			}
+		default:
+			t.Errorf("unexpected link %+v", link)
+		}
+	}
+
+	// Neighbor updates only reach the metrics when Run publishes
+	if n := seriesCount(t, metrics.gauges["st2110_topology_link_info"], leaf); n != 0 {
+		t.Errorf("%d link info series before the first publish, want 0", n)
+	}
+	topology.publish()
+	if got := gaugeValue(t, metrics, "st2110_topology_link_info", spine, "Ethernet1", leaf, "Ethernet49", "switch"); got != 1 {
+		t.Errorf("spine link info = %v, want 1", got)
+	}
+	if got := gaugeValue(t, metrics, "st2110_topology_link_up", leaf, "Ethernet1", "camera-1", "eth0"); got != 0 {
+		t.Errorf("camera link up = %v, want 0", got)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/topology", topology)
+	mux.Handle("/topology.dot", topology)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/topology")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TopologyGraph
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(decoded.Nodes) != 3 || len(decoded.Links) != 2 {
+		t.Errorf("JSON topology = %+v", decoded)
+	}
+	resp, err = http.Get(server.URL + "/topology.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		fmt.Sprintf("%q [shape=box];", spine),
+		`"camera-1" [shape=ellipse];`,
+		fmt.Sprintf(`%q -- "camera-1" [taillabel="Ethernet1", headlabel="eth0", color=red];`, leaf),
+	} {
+		if !strings.Contains(string(dot), want) {
+			t.Errorf("DOT output lacks %s:\n%s", want, dot)
+		}
+	}
+
+	// The camera is unplugged while the leaf reboots
+	leafTarget.setScript(
+		notification("/system/state", stringUpdate("hostname", "rack1-leaf.studio.example")),
+		openconfigLLDPNeighbor("Ethernet49", "00:1c:73:00:00:02", spine+".studio.example", "Ethernet1", "to rack1-leaf"),
+	)
+	leafTarget.drop()
+	eventually(t, "stale neighbor swept", func() bool { return len(topology.Graph().Links) == 1 })
+	topology.publish()
+	if n := seriesCount(t, metrics.gauges["st2110_topology_link_info"], leaf); n != 1 {
+		t.Errorf("%d link info series of the leaf after the reboot, want 1", n)
+	}
+
+	// The spine ages out the leaf; the leaf still sees the link
+	spineTarget.send(&gnmi.Notification{Delete: []*gnmi.Path{
+		mustParsePath("/lldp/interfaces/interface[name=Ethernet1]/neighbors/neighbor[id=00:1c:73:00:00:01]"),
+	}})
+	eventually(t, "neighbor delete", func() bool {
+		topology.publish()
+		return seriesCount(t, metrics.gauges["st2110_topology_link_info"], spine) == 0
+	})
+	if links := topology.Graph().Links; len(links) != 1 || links[0].A.Node != leaf {
+		t.Errorf("links after the delete = %+v, want the leaf's view of the uplink", links)
+	}
+}
+
+func TestCollectorOptics(t *testing.T) {
+	name := switchName("optics")
+	target := newFakeTarget(t)
+	target.setScript(
+		openconfigOpticLane("Xcvr1", "1", "-3.25", "1.10", "7.50"),
+		openconfigOpticLane("Xcvr1", "2", "-11.80", "1.05", "7.20"),
+		openconfigOpticThresholds("Xcvr1", "CRITICAL", "-12.00", "3.00"),
+		openconfigOpticThresholds("Xcvr1", "WARNING", "-10.00", "2.00"),
+		notification("/components/component[name=Xcvr1]/state/temperature", jsonUpdate("instant", `"41.5"`)),
+		notification("/components/component[name=Chassis]/state/temperature", jsonUpdate("instant", `"38.0"`)),
+		notification("/components/component[name=Xcvr1]/transceiver/state", jsonUpdate("supply-voltage", `{"instant":"3.29"}`)),
+		notification("/interfaces/interface[name=Ethernet1]/ethernet/state", jsonUpdate("counters",
+			`{"in-crc-errors":"12","in-symbol-error":"40","arista-intf-augments:in-fec-corrected-codewords":"9000","in-fec-uncorrected-codewords":"3"}`)),
+	)
+
+	metrics := NewMetricSet()
+	optics, err := newOpticsTable(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewGNMICollector(target.switchConfig(name, "openconfig"), nil, optics, NewSessionMetrics(), SessionOptions{MaxBackoff: time.Second})
+	runSession(t, c)
+	waitSynced(t, c)
+
+	// Until the switch names the interface, the transceiver labels its own readings
+	if got := gaugeValue(t, metrics, "st2110_switch_optic_rx_power_dbm", name, "Xcvr1", "2"); got != -11.8 {
+		t.Errorf("rx power of lane 2 = %v, want -11.8", got)
+	}
+	if n := seriesCount(t, metrics.gauges["st2110_switch_optic_temperature_celsius"], name); n != 1 {
+		t.Errorf("%d temperature series, want only the transceiver's", n)
+	}
+
+	target.send(openconfigTransceiverOf("Ethernet1", "Xcvr1"))
+	eventually(t, "interface label", func() bool {
+		return gaugeValue(t, metrics, "st2110_switch_optic_temperature_celsius", name, "Ethernet1") == 41.5
+	})
+	if n := seriesCount(t, metrics.gauges["st2110_switch_optic_rx_power_dbm"], name); n != 2 {
+		t.Errorf("%d rx power series after relabelling, want 2", n)
+	}
+	for _, tc := range []struct {
+		metric string
+		labels []string
+		want   float64
+	}{
+		{"st2110_switch_optic_tx_power_dbm", []string{"Ethernet1", "1"}, 1.1},
+		{"st2110_switch_optic_laser_bias_milliamps", []string{"Ethernet1", "1"}, 7.5},
+		{"st2110_switch_optic_supply_voltage_volts", []string{"Ethernet1"}, 3.29},
+		{"st2110_switch_optic_threshold", []string{"Ethernet1", "rx_power_dbm", "critical", "low"}, -12},
+		{"st2110_switch_optic_threshold", []string{"Ethernet1", "rx_power_dbm", "warning", "high"}, 2},
+		{"st2110_switch_optic_threshold", []string{"Ethernet1", "temperature_celsius", "critical", "high"}, 75},
+	} {
+		if got := gaugeValue(t, metrics, tc.metric, append([]string{name}, tc.labels...)...); got != tc.want {
+			t.Errorf("%s%v = %v, want %v", tc.metric, tc.labels, got, tc.want)
+		}
+	}
+	for metric, want := range map[string]float64{
+		"st2110_switch_interface_crc_errors_total":      12,
+		"st2110_switch_interface_symbol_errors_total":   40,
+		"st2110_switch_fec_corrected_codewords_total":   9000,
+		"st2110_switch_fec_uncorrected_codewords_total": 3,
+	} {
+		if got := counterValue(t, metrics, metric, name, "Ethernet1"); got != want {
+			t.Errorf("%s = %v, want %v", metric, got, want)
+		}
+	}
+
+	// While the session is down Xcvr1 is swapped for a single-lane module
+	// without thresholds: the readings of Xcvr1 go at the sync
+	target.setScript(
+		openconfigTransceiverOf("Ethernet1", "Xcvr3"),
+		openconfigOpticLane("Xcvr3", "1", "-2.00", "1.00", "7.00"),
+	)
+	target.drop()
+	eventually(t, "readings of the swapped transceiver swept", func() bool {
+		return seriesCount(t, metrics.gauges["st2110_switch_optic_rx_power_dbm"], name) == 1 &&
+			seriesCount(t, metrics.gauges["st2110_switch_optic_threshold"], name) == 0
+	})
+	if got := gaugeValue(t, metrics, "st2110_switch_optic_rx_power_dbm", name, "Ethernet1", "1"); got != -2 {
+		t.Errorf("rx power of Ethernet1 after the swap = %v, want -2", got)
+	}
+	if n := seriesCount(t, metrics.gauges["st2110_switch_optic_temperature_celsius"], name); n != 0 {
+		t.Errorf("%d temperature series after the swap, want none", n)
+	}
+
+	// The transceiver is pulled
+	target.send(&gnmi.Notification{Delete: []*gnmi.Path{mustParsePath("/components/component[name=Xcvr3]/transceiver")}})
+	eventually(t, "pulled transceiver", func() bool {
+		return seriesCount(t, metrics.gauges["st2110_switch_optic_rx_power_dbm"], name) == 0 &&
+			seriesCount(t, metrics.gauges["st2110_switch_optic_threshold"], name) == 0
+	})
+}
+
+func TestCollectorMicrobursts(t *testing.T) {
+	name := switchName("lanz")
+	target := newFakeTarget(t)
+	target.setScript(
+		aristaLANZ("Ethernet5", "3", 20000, 20000),
+		aristaLANZ("Ethernet5", "3", 600000, 750000),
+		aristaLANZ("Ethernet5", "3", 10000, 600000),
+		notification("arista:/eos/arista-exp-eos-qos/qos/interfaces/interface[name=Ethernet5]/queues/queue[queue-id=3]/state",
+			uintUpdate("ecn-marked-pkts", 42)),
+		notification("arista:/eos/arista-exp-eos-qos/qos/interfaces/interface[name=Ethernet5]/pfc/priorities/priority[priority=3]/state", uintUpdate("rx-pause-frames", 5), uintUpdate("tx-pause-frames", 0)),
+	)
+	c, metrics := startCollector(t, target.switchConfig(name, "arista"), map[string]PathConfig{}, SessionOptions{})
+	waitSynced(t, c)
+	buffers := c.vendor.(*aristaPlugin).buffers
+	queue := prometheus.Labels{"switch": name, "interface": "Ethernet5", "queue": "3"}
+
+	// The burst shows in the peak and the histogram, though the queue has drained
+	if got := gaugeValue(t, metrics, "st2110_switch_qos_buffer_utilization", name, "Ethernet5", "3"); got != 1 {
+		t.Errorf("buffer utilization = %v, want 1", got)
+	}
+	if got := gaugeValue(t, metrics, "st2110_switch_queue_limit_bytes", name, "Ethernet5", "3"); got != 1000000 {
+		t.Errorf("queue limit = %v, want 1000000", got)
+	}
+	if got, _ := collectedValue(t, buffers.peak, queue); got != 750000 {
+		t.Errorf("peak occupancy = %v, want 750000 from the LANZ record", got)
+	}
+	if got, _ := collectedValue(t, buffers.peak, queue); got != 750000 {
+		t.Errorf("peak occupancy at a second scrape = %v, want 750000 still", got)
+	}
+	if got := seriesCount(t, buffers.length, name); got != 1 {
+		t.Errorf("%d queue length histograms, want 1", got)
+	}
+	if got := counterValue(t, metrics, "st2110_switch_queue_ecn_marked_packets_total", name, "Ethernet5", "3"); got != 42 {
+		t.Errorf("ECN marked = %v, want 42", got)
+	}
+	if got := counterValue(t, metrics, "st2110_switch_pfc_rx_pause_frames_total", name, "Ethernet5", "3"); got != 5 {
+		t.Errorf("PFC rx pause frames = %v, want 5", got)
+	}
+
+	target.send(&gnmi.Notification{Delete: []*gnmi.Path{
+		mustParsePath("arista:/eos/arista-exp-eos-lanz/lanz/interfaces/interface[name=Ethernet5]"),
+	}})
+	eventually(t, "queue removed", func() bool {
+		_, found := collectedValue(t, buffers.peak, queue)
+		return !found && seriesCount(t, metrics.gauges["st2110_switch_qos_buffer_utilization"], name) == 0
+	})
+}
+
+func TestPeakGaugeWindows(t *testing.T) {
+	g := newPeakGauge("peak_test", "", []string{"queue"}, 10*time.Second)
+	start := time.Now()
+	g.now = func() time.Time { return start }
+	at := func(seconds int) {
+		g.now = func() time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	}
+	peak := func() float64 {
+		v, _ := collectedValue(t, g, prometheus.Labels{"queue": "3"})
+		return v
+	}
+
+	g.Observe([]string{"3"}, 1000)
+	at(3)
+	g.Raise([]string{"3"}, 90000) // Burst inside the first window
+	g.Observe([]string{"3"}, 2000)
+	if peak() != 90000 || peak() != 90000 {
+		t.Error("scraping changed the peak")
+	}
+
+	// The burst is held through the next window
+	at(12)
+	g.Observe([]string{"3"}, 3000)
+	if got := peak(); got != 90000 {
+		t.Errorf("peak in the next window = %v, want 90000", got)
+	}
+	at(22)
+	if got := peak(); got != 3000 {
+		t.Errorf("peak two windows later = %v, want 3000", got)
+	}
+	at(45)
+	if got := peak(); got != 3000 {
+		t.Errorf("peak of an idle queue = %v, want its current 3000", got)
+	}
+	g.Observe([]string{"3"}, 500)
+	if got := peak(); got != 3000 {
+		t.Errorf("peak after the queue drained = %v, want 3000 from the window start", got)
+	}
+}
+
+func TestSNMPCollector(t *testing.T) {
+	name := switchName("snmp")
+	agent := newFakeAgent()
+	agent.ifEntry(1, "Ethernet1", 1000, 5000, 2)
+	agent.ifEntry(2, "Ethernet2", 300, 0, 0)
+	agent.set(oidIfDescr+".100", gosnmp.OctetString, []byte("Vlan100"))
+	agent.set(oidIGMPInterfaceQuerier+".100", gosnmp.IPAddress, "10.1.0.1")
+	agent.set(oidIGMPCacheStatus+".239.1.1.1.100", gosnmp.Integer, 1)
+	agent.set(oidIGMPCacheStatus+".239.1.1.2.100", gosnmp.Integer, 1)
+	agent.set(oidIGMPCacheStatus+".239.1.1.3.100", gosnmp.Integer, 2) // notInService
+	queueDrops := snmpQueueDropOIDs["arista"]
+	agent.set(queueDrops+".1.2.3", gosnmp.Counter64, uint64(7))
+
+	metrics := NewMetricSet()
+	c := agent.collector(t, SwitchConfig{Name: name, Target: "192.0.2.1", Vendor: "arista", Protocol: protocolSNMP}, metrics)
+	ctx := context.Background()
+	c.poll(ctx)
+
+	if got := counterValue(t, metrics, "st2110_switch_interface_rx_bytes", name, "Ethernet1"); got != 1000 {
+		t.Errorf("rx bytes = %v, want 1000", got)
+	}
+	if got := counterValue(t, metrics, "st2110_switch_interface_rx_errors", name, "Ethernet1"); got != 2 {
+		t.Errorf("rx errors = %v, want 2", got)
+	}
+	if got := counterValue(t, metrics, "st2110_switch_qos_dropped_packets", name, "Ethernet1", "2.3"); got != 7 {
+		t.Errorf("queue drops = %v, want 7", got)
+	}
+	if got := gaugeValue(t, metrics, "st2110_igmp_active_groups", name, "100"); got != 2 {
+		t.Errorf("active groups = %v, want 2", got)
+	}
+	if got := gaugeValue(t, metrics, "st2110_igmp_querier_present", name, "100"); got != 1 {
+		t.Errorf("querier present = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(c.health.up.WithLabelValues(name, "192.0.2.1")); got != 1 {
+		t.Errorf("up = %v, want 1", got)
+	}
+
+	// Counters move on, a group leaves, the querier goes and Ethernet2 is removed
+	agent.ifEntry(1, "Ethernet1", 1500, 5000, 2)
+	for _, column := range []string{oidIfDescr, oidIfName, oidIfHCInOctets, oidIfHCOutOctets, oidIfInErrors, oidIfOutErrors, oidIfInDiscards, oidIfOutDiscards} {
+		agent.remove(column + ".2")
+	}
+	agent.remove(oidIGMPCacheStatus + ".239.1.1.2.100")
+	agent.set(oidIGMPInterfaceQuerier+".100", gosnmp.IPAddress, "0.0.0.0")
+	c.poll(ctx)
+
+	if got := counterValue(t, metrics, "st2110_switch_interface_rx_bytes", name, "Ethernet1"); got != 1500 {
+		t.Errorf("rx bytes = %v, want 1500", got)
+	}
+	if n := seriesCount(t, metrics.counters["st2110_switch_interface_rx_bytes"].vec, name); n != 1 {
+		t.Errorf("%d rx bytes series after Ethernet2 went away, want 1", n)
+	}
+	if got := gaugeValue(t, metrics, "st2110_igmp_active_groups", name, "100"); got != 1 {
+		t.Errorf("active groups after the leave = %v, want 1", got)
+	}
+	if got := gaugeValue(t, metrics, "st2110_igmp_querier_present", name, "100"); got != 0 {
+		t.Errorf("querier present after it went = %v, want 0", got)
+	}
+
+	// An unreachable switch keeps its last counters
+	agent.fail(errors.New("request timeout"))
+	c.poll(ctx)
+	if got := testutil.ToFloat64(c.health.up.WithLabelValues(name, "192.0.2.1")); got != 0 {
+		t.Errorf("up after a failed poll = %v, want 0", got)
+	}
+	if got := counterValue(t, metrics, "st2110_switch_interface_rx_bytes", name, "Ethernet1"); got != 1500 {
+		t.Errorf("rx bytes after a failed poll = %v, want 1500", got)
+	}
+
+	for _, tc := range []struct {
+		sw    SwitchConfig
+		valid bool
+	}{
+		{SwitchConfig{SNMP: SNMPConfig{Community: "public"}}, true},
+		{SwitchConfig{}, false},
+		{SwitchConfig{Username: "monitor", Password: "secret", SNMP: SNMPConfig{Version: "3", AuthProtocol: "sha256", PrivProtocol: "AES256"}}, true},
+		{SwitchConfig{Username: "monitor", SNMP: SNMPConfig{Version: "3"}}, false},
+		{SwitchConfig{Username: "monitor", Password: "secret", SNMP: SNMPConfig{Version: "3", PrivProtocol: "3DES"}}, false},
+		{SwitchConfig{SNMP: SNMPConfig{Version: "1", Community: "public"}}, false},
+	} {
+		if err := tc.sw.SNMP.validate(tc.sw); (err == nil) != tc.valid {
+			t.Errorf("%+v: validate = %v, want valid %v", tc.sw.SNMP, err, tc.valid)
+		}
+	}
+}
+
+func TestDialoutReceiver(t *testing.T) {
+	xr, sros := switchName("xr"), switchName("sros")
+	metrics := NewMetricSet()
+	paths := map[string]PathConfig{
+		"xr_counters": {
+			Path: "Cisco-IOS-XR-infra-statsd-oper:/infra-statistics/interfaces/interface[interface-name=*]/latest/generic-counters",
+			Metrics: []MetricConfig{
+				{Name: "st2110_switch_interface_rx_bytes", Leaf: "bytes-received", Type: metricCounter, Labels: map[string]string{"interface": "interface-name"}},
+				{Name: "st2110_switch_interface_rx_drops", Leaf: "input-drops", Type: metricCounter, Labels: map[string]string{"interface": "interface-name"}},
+			},
+		},
+		"interface_counters": defaultPaths["interface_counters"],
+	}
+	specs, err := compilePaths(paths, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health := NewSessionMetrics()
+	receiver := NewDialoutReceiver(DialoutConfig{Plaintext: true})
+	for _, sw := range []SwitchConfig{
+		{Name: xr, Target: "127.0.0.1", Username: "telemetry", Password: "secret", Protocol: protocolDialout},
+		{Name: sros, Target: "127.0.0.1", Username: "gnmi", Password: "other", Protocol: protocolDialout},
+	} {
+		receiver.AddDevice(sw, NewGNMICollector(sw, specs, nil, health, SessionOptions{}))
+	}
+	state := func(name string) float64 {
+		return testutil.ToFloat64(health.state.WithLabelValues(name, "127.0.0.1"))
+	}
+	if state(xr) != sessionDisconnected {
+		t.Errorf("state before connecting = %v, want disconnected", state(xr))
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go receiver.Serve(ctx, lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Cisco MDT, the message split in two chunks
+	mdt, err := mdt_dialout.NewGRPCMdtDialoutClient(conn).MdtDialout(metadata.AppendToOutgoingContext(ctx, "username", "telemetry", "password", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := mdtGenericCounters(t, "HundredGigE0/0/0/1", 12345)
+	for _, chunk := range [][]byte{data[:10], data[10:]} {
+		if err := mdt.Send(&mdt_dialout.MdtDialoutArgs{ReqId: 7, Data: chunk, TotalSize: int32(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "MDT counters", func() bool {
+		return counterValue(t, metrics, "st2110_switch_interface_rx_bytes", xr, "HundredGigE0/0/0/1") == 12345
+	})
+	if got := counterValue(t, metrics, "st2110_switch_interface_rx_drops", xr, "HundredGigE0/0/0/1"); got != 4 {
+		t.Errorf("input drops = %v, want 4", got)
+	}
+	if state(xr) != sessionConnected || state(sros) != sessionDisconnected {
+		t.Errorf("states = %v, %v, want only %s connected", state(xr), state(sros), xr)
+	}
+
+	// gNMI dial-out from the same address, told apart by its credentials
+	publish, err := conn.NewStream(metadata.AppendToOutgoingContext(ctx, "username", "gnmi", "password", "other"),
+		&gnmiDialoutServiceDesc.Streams[0], "/Nokia.SROS.DialoutTelemetry/Publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publish.SendMsg(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: openconfigCounters("1/1/c1/1", 500, 0, 0)}}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "gNMI dial-out counters", func() bool {
+		return counterValue(t, metrics, "st2110_switch_interface_rx_bytes", sros, "1/1/c1/1") == 500
+	})
+
+	// A device with the wrong password is refused
+	rejected := testutil.ToFloat64(receiver.rejected.WithLabelValues("credentials"))
+	bad, err := mdt_dialout.NewGRPCMdtDialoutClient(conn).MdtDialout(metadata.AppendToOutgoingContext(ctx, "username", "telemetry", "password", "guess"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bad.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("wrong password answered %v, want Unauthenticated", err)
+	}
+	if got := testutil.ToFloat64(receiver.rejected.WithLabelValues("credentials")); got != rejected+1 {
+		t.Errorf("credential rejections = %v, want %v", got, rejected+1)
+	}
+
+	// The switch hangs up
+	if err := mdt.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "MDT session closed", func() bool { return state(xr) == sessionDisconnected })
+	if state(sros) != sessionConnected {
+		t.Errorf("%s state = %v after the other switch hung up, want connected", sros, state(sros))
+	}
+}
+
+func TestDialoutSessionsOfOneDevice(t *testing.T) {
+	eos, nexus := switchName("eos-dialout"), switchName("nexus-dialout")
+	metrics := NewMetricSet()
+	arista, err := newAristaPlugin(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := newMulticastTables(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := &routePlugin{multicast: tables}
+	eosTables := multicastOf(arista)
+
+	health := NewSessionMetrics()
+	receiver := NewDialoutReceiver(DialoutConfig{Plaintext: true})
+	eosConfig := SwitchConfig{Name: eos, Target: "127.0.0.1", Username: "eos", Password: "secret", Protocol: protocolDialout}
+	nexusConfig := SwitchConfig{Name: nexus, Target: "127.0.0.1", Username: "nexus", Password: "secret", Protocol: protocolDialout}
+	receiver.AddDevice(eosConfig, NewGNMICollector(eosConfig, nil, chainPlugins(arista), health, SessionOptions{}))
+	receiver.AddDevice(nexusConfig, NewGNMICollector(nexusConfig, nil, chainPlugins(routes), health, SessionOptions{}))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go receiver.Serve(ctx, lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// One gNMI dial-out session per destination group: the sync of the
+	// second must not sweep the routes of the first
+	publish := func(responses ...*gnmi.SubscribeResponse) {
+		t.Helper()
+		stream, err := conn.NewStream(metadata.AppendToOutgoingContext(ctx, "username", "eos", "password", "secret"),
+			&gnmiDialoutServiceDesc.Streams[0], "/Nokia.SROS.DialoutTelemetry/Publish")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, response := range responses {
+			if err := stream.SendMsg(response); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	update := func(n *gnmi.Notification) *gnmi.SubscribeResponse {
+		return &gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: n}}
+	}
+	sync := &gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_SyncResponse{SyncResponse: true}}
+	publish(update(aristaMroute("10.1.0.10", "239.1.1.1", "Vlan100", "Ethernet1")), sync)
+	eventually(t, "first session's route", func() bool { return len(eosTables.Routes(eos, "239.1.1.1")) == 1 })
+	publish(update(aristaMroute("10.1.0.11", "239.1.1.2", "Vlan100", "Ethernet2")), sync)
+	eventually(t, "second session's route", func() bool { return len(eosTables.Routes(eos, "239.1.1.2")) == 1 })
+	if len(eosTables.Routes(eos, "239.1.1.1")) != 1 {
+		t.Error("sync of the second session swept the route of the first")
+	}
+
+	// Two MDT sessions of different sensor paths: entries age out after
+	// three of the longest sample interval, by message timestamp
+	mdt := func() mdt_dialout.GRPCMdtDialout_MdtDialoutClient {
+		t.Helper()
+		stream, err := mdt_dialout.NewGRPCMdtDialoutClient(conn).MdtDialout(metadata.AppendToOutgoingContext(ctx, "username", "nexus", "password", "secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stream
+	}
+	start := time.Now().Add(-time.Hour)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	send := func(stream mdt_dialout.GRPCMdtDialout_MdtDialoutClient, sensor string, seconds int, group string) {
+		t.Helper()
+		if err := stream.Send(&mdt_dialout.MdtDialoutArgs{ReqId: int64(seconds), Data: mdtRoute(t, sensor, at(seconds), group, "eth1/1")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, second := mdt(), mdt()
+	send(first, "st2110-test:routes-a/route", 0, "239.2.2.1")
+	send(first, "st2110-test:routes-a/route", 10, "239.2.2.1")
+	send(second, "st2110-test:routes-b/route", 10, "239.2.2.2")
+	eventually(t, "MDT routes", func() bool {
+		return len(tables.Routes(nexus, "239.2.2.1")) == 1 && len(tables.Routes(nexus, "239.2.2.2")) == 1
+	})
+
+	send(first, "st2110-test:routes-a/route", 20, "239.2.2.1")
+	send(first, "st2110-test:routes-a/route", 30, "239.2.2.1")
+	send(first, "st2110-test:routes-a/route", 40, "239.2.2.3")
+	eventually(t, "MDT route at 40s", func() bool { return len(tables.Routes(nexus, "239.2.2.3")) == 1 })
+	if len(tables.Routes(nexus, "239.2.2.2")) != 1 {
+		t.Error("route reported 30s ago expired before three 10s intervals")
+	}
+	send(first, "st2110-test:routes-a/route", 50, "239.2.2.1")
+	eventually(t, "unreported MDT route expired", func() bool { return len(tables.Routes(nexus, "239.2.2.2")) == 0 })
+	if len(tables.Routes(nexus, "239.2.2.1")) != 1 || len(tables.Routes(nexus, "239.2.2.3")) != 1 {
+		t.Error("routes reported within three intervals expired")
+	}
+
+	// After an hour offline the timing starts over: the gap doesn't stretch
+	// the interval, so the route the switch stopped reporting still expires
+	for _, stream := range []mdt_dialout.GRPCMdtDialout_MdtDialoutClient{first, second} {
+		if err := stream.CloseSend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "MDT sessions closed", func() bool {
+		return testutil.ToFloat64(health.state.WithLabelValues(nexus, "127.0.0.1")) == sessionDisconnected
+	})
+	third := mdt()
+	send(third, "st2110-test:routes-a/route", 3650, "239.2.2.1")
+	send(third, "st2110-test:routes-a/route", 3651, "239.2.2.1")
+	eventually(t, "route unreported since the outage expired", func() bool { return len(tables.Routes(nexus, "239.2.2.3")) == 0 })
+	if len(tables.Routes(nexus, "239.2.2.1")) != 1 {
+		t.Error("route reported after the reconnect expired")
+	}
+
+	// Without a session nothing reports the entries: they are cleared once
+	// the switch has been gone for three of its 1s intervals
+	if err := third.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "multicast entries of the idle switch cleared", func() bool { return len(tables.Routes(nexus, "239.2.2.1")) == 0 })
+}
+
+func TestCollectorRestartsStalledStream(t *testing.T) {
+	name := switchName("stall")
+	target := newFakeTarget(t)
+	target.setScript(openconfigCounters("Ethernet1", 1000, 0, 0))
+	paths := map[string]PathConfig{
+		"interface_counters": {Path: "/interfaces/interface[name=*]/state/counters", Interval: 50 * time.Millisecond},
+	}
+
+	c, _ := startCollector(t, target.switchConfig(name, "generic"), paths, SessionOptions{StallIntervals: 2})
+	eventually(t, "stall detection", func() bool {
+		return testutil.ToFloat64(c.health.reconnects.WithLabelValues(name, target.addr, "stalled")) >= 1
+	})
+}
+
+func TestCollectorSkipsUnsupportedPaths(t *testing.T) {
+	name := switchName("partial")
+	target := newFakeTarget(t)
+	ptpPath := "arista:/eos/arista-exp-eos-ptp/ptp/instances/instance[instance-id=default]/state"
+	target.refuse(PathString(mustParsePath(ptpPath)))
+	target.setScript(openconfigCounters("Ethernet2", 42, 0, 0))
+
+	c, metrics := startCollector(t, target.switchConfig(name, "arista"), defaultPaths, SessionOptions{})
+	waitSynced(t, c)
+
+	if n := len(target.lastSubscription().GetSubscription()); n != 10 {
+		t.Errorf("streaming %d paths, want 10 without the refused one", n)
+	}
+	active := func(path string) float64 {
+		return testutil.ToFloat64(c.health.subscriptionActive.WithLabelValues(name, target.addr, PathString(mustParsePath(path))))
+	}
+	if active(ptpPath) != 0 || active("/interfaces/interface[name=*]/state/counters") != 1 {
+		t.Error("subscription_active does not reflect the skipped path")
+	}
+	if got := counterValue(t, metrics, "st2110_switch_interface_rx_bytes", name, "Ethernet2"); got != 42 {
+		t.Errorf("rx bytes = %v, want 42", got)
+	}
+}
+
+func TestCollectorSkipsPathsInUnsupportedMode(t *testing.T) {
+	name := switchName("mode")
+	target := newFakeTarget(t)
+	ptpPath := "arista:/eos/arista-exp-eos-ptp/ptp/instances/instance[instance-id=default]/state"
+	target.refuseMode(PathString(mustParsePath(ptpPath)), gnmi.SubscriptionMode_ON_CHANGE)
+	target.setScript(openconfigCounters("Ethernet2", 42, 0, 0))
+
+	c, _ := startCollector(t, target.switchConfig(name, "arista"), defaultPaths, SessionOptions{})
+	waitSynced(t, c)
+
+	if n := len(target.lastSubscription().GetSubscription()); n != 10 {
+		t.Errorf("streaming %d paths, want 10 without the one refused on change", n)
+	}
+	if got := testutil.ToFloat64(c.health.subscriptionActive.WithLabelValues(name, target.addr, PathString(mustParsePath(ptpPath)))); got != 0 {
+		t.Error("path refused on change still active")
+	}
+}
+
+func TestCollectorSurvivesMalformedUpdates(t *testing.T) {
+	name := switchName("malformed")
+	target := newFakeTarget(t)
+	c, metrics := startCollector(t, target.switchConfig(name, "cisco"), defaultPaths, SessionOptions{})
+	waitSynced(t, c)
+
+	counters := "/interfaces/interface[name=Ethernet3]/state/counters"
+	target.send(notification("", &gnmi.Update{Path: mustParsePath(counters)}))
+	target.send(notification("", &gnmi.Update{Path: mustParsePath(counters),
+		Val: &gnmi.TypedValue{Value: &gnmi.TypedValue_JsonIetfVal{JsonIetfVal: []byte(`{"in-octets": `)}}}))
+	target.send(notification("", &gnmi.Update{Val: &gnmi.TypedValue{Value: &gnmi.TypedValue_UintVal{UintVal: 1}}}))
+	target.send(notification("", &gnmi.Update{Path: &gnmi.Path{Element: []string{"interfaces", "interface[name=Ethernet3", "state"}},
+		Val: &gnmi.TypedValue{Value: &gnmi.TypedValue_ProtoBytes{ProtoBytes: []byte{0xff, 0xff}}}}))
+	target.send(notification("/System/tcam-items/utilization-items", stringUpdate("", "not a number")))
+	target.send(&gnmi.Notification{Delete: []*gnmi.Path{nil, {}}})
+	target.send(notification("", jsonUpdate(counters, `{"in-octets":"77"}`)))
+
+	eventually(t, "valid update after malformed ones", func() bool {
+		return counterValue(t, metrics, "st2110_switch_interface_rx_bytes", name, "Ethernet3") == 77
+	})
+	if target.streamCount() != 1 {
+		t.Error("malformed updates restarted the stream")
+	}
+}
+
+func TestCollectorCiscoDME(t *testing.T) {
+	name := switchName("nexus")
+	target := newFakeTarget(t)
+	target.setCapabilities(nil) // NX-OS releases without Capabilities
+	target.setScript(
+		ciscoInterfaceCounters("eth1/1", 5000),
+		ciscoQoSDrops("ST2110-OUT", "VIDEO", 7),
+		ciscoQueueBuffer("eth1/1", "3", 100000, 380000, 12),
+	)
+	paths := map[string]PathConfig{
+		"interface_counters": {Path: "/System/intf-items/phys-items/PhysIf-list[id=*]/dbgIfIn-items"},
+	}
+
+	c, metrics := startCollector(t, target.switchConfig(name, "cisco"), paths, SessionOptions{Inventory: true})
+	waitSynced(t, c)
+
+	if got := counterValue(t, metrics, "st2110_switch_interface_rx_bytes", name, "eth1/1"); got != 5000 {
+		t.Errorf("DME rx bytes = %v, want 5000", got)
+	}
+	if got := counterValue(t, metrics, "cisco_nexus_qos_policy_drops_total", name, "ST2110-OUT", "VIDEO"); got != 7 {
+		t.Errorf("QoS policy drops = %v, want 7", got)
+	}
+	if got := gaugeValue(t, metrics, "st2110_switch_qos_buffer_utilization", name, "eth1/1", "3"); got != 25 {
+		t.Errorf("buffer utilization = %v, want 25", got)
+	}
+	if got, _ := collectedValue(t, c.vendor.(*ciscoPlugin).buffers.peak, prometheus.Labels{"switch": name, "interface": "eth1/1", "queue": "3"}); got != 380000 {
+		t.Errorf("peak occupancy = %v, want the clear-on-read 380000", got)
+	}
+	if got := counterValue(t, metrics, "st2110_switch_queue_ecn_marked_packets_total", name, "eth1/1", "3"); got != 12 {
+		t.Errorf("ECN marked = %v, want 12", got)
+	}
+	if got := target.lastSubscription().GetEncoding(); got != gnmi.Encoding_JSON_IETF {
+		t.Errorf("encoding without capabilities = %v, want JSON_IETF", got)
+	}
+}
+
+func TestCollectorJuniperMulticast(t *testing.T) {
+	name := switchName("qfx")
+	target := newFakeTarget(t)
+	igmp := "/network-instances/network-instance[name=default]/protocols/protocol[identifier=IGMP][name=IGMP]/igmp/interfaces/interface[interface-id=%s]"
+	target.setScript(
+		notification(fmt.Sprintf(igmp, "irb.100")+"/querier/state", stringUpdate("address", "10.1.0.1")),
+		notification(fmt.Sprintf(igmp, "ge-0/0/1.0")+"/querier/state", stringUpdate("address", "10.2.0.1")),
+		notification(fmt.Sprintf(igmp, "irb.100")+"/membership-groups/group[group=239.1.1.1]", stringUpdate("state/group", "239.1.1.1")),
+		notification(fmt.Sprintf(igmp, "vlan.200")+"/membership-groups/group[group=239.1.1.2]", stringUpdate("state/group", "239.1.1.2")),
+	)
+
+	c, metrics := startCollector(t, target.switchConfig(name, "juniper"), nil, SessionOptions{})
+	waitSynced(t, c)
+
+	// VLAN interfaces are labelled by VLAN ID, routed interfaces by name
+	for _, vlan := range []string{"100", "ge-0/0/1.0"} {
+		if got := gaugeValue(t, metrics, "st2110_igmp_querier_present", name, vlan); got != 1 {
+			t.Errorf("querier present on %s = %v, want 1", vlan, got)
+		}
+	}
+	for _, vlan := range []string{"100", "200"} {
+		if got := gaugeValue(t, metrics, "st2110_igmp_active_groups", name, vlan); got != 1 {
+			t.Errorf("active groups on VLAN %s = %v, want 1", vlan, got)
+		}
+	}
+	if n := seriesCount(t, metrics.gauges["st2110_igmp_querier_present"], name); n != 2 {
+		t.Errorf("%d querier series, want 2", n)
+	}
+
+	target.send(&gnmi.Notification{Delete: []*gnmi.Path{
+		mustParsePath(fmt.Sprintf(igmp, "irb.100") + "/membership-groups/group[group=239.1.1.1]"),
+	}})
+	eventually(t, "group delete", func() bool {
+		return gaugeValue(t, metrics, "st2110_igmp_active_groups", name, "100") == 0
+	})
+}
+
+func TestCollectorVerifiesTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, caFile := selfSignedCert(t, dir, "switch.test")
+	target := newFakeTarget(t, grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+
+	sw := target.switchConfig(switchName("tls"), "generic")
+	sw.TLS = TLSConfig{CAFile: caFile, ServerName: "switch.test"}
+	c, _ := startCollector(t, sw, defaultPaths, SessionOptions{})
+	waitSynced(t, c)
+
+	sw.TLS.CAFile = filepath.Join(dir, "missing.pem")
+	if _, err := transportOptions(sw); err == nil {
+		t.Error("accepted a missing CA bundle")
+	}
+}
+
+// selfSignedCert creates a certificate for name and writes it as a CA bundle
+func selfSignedCert(t *testing.T, dir, name string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type SwitchConfig struct {
+	Name         string    `yaml:"name"`
+	Target       string    `yaml:"target"`
+	Username     string    `yaml:"username"`
+	Password     string    `yaml:"password"`
+	PasswordFile string    `yaml:"password_file"` // e.g. a mounted Kubernetes secret, read on every connect
+	Vendor       string    `yaml:"vendor"`
+	TLS          TLSConfig `yaml:"tls"`
+
+	Protocol string     `yaml:"protocol"` // gnmi (default), snmp for switches without gNMI or dialout for switches that push telemetry
+	SNMP     SNMPConfig `yaml:"snmp"`
+}
+
+// SNMPConfig is how a switch with protocol snmp is polled; v3 authenticates
+// as the switch's username with its password
+type SNMPConfig struct {
+	Version       string        `yaml:"version"`         // 2c (default) or 3
+	Community     string        `yaml:"community"`       // v2c
+	AuthProtocol  string        `yaml:"auth_protocol"`   // v3: MD5, SHA (default), SHA224, SHA256, SHA384 or SHA512
+	PrivProtocol  string        `yaml:"priv_protocol"`   // v3: DES, AES (default), AES192 or AES256
+	PrivPassword  string        `yaml:"priv_password"`   // v3: privacy without it is off
+	Interval      time.Duration `yaml:"interval"`        // Poll interval (default 10s)
+	QueueDropsOID string        `yaml:"queue_drops_oid"` // Per-queue drop counters, indexed by ifIndex then queue; overrides the vendor's
+}
+
+const (
+	protocolGNMI    = "gnmi"
+	protocolSNMP    = "snmp"
+	protocolDialout = "dialout"
+)
+
+// TLSConfig is the transport security of a switch; the default verifies the
+// switch certificate against the system roots
+type TLSConfig struct {
+	CAFile     string `yaml:"ca_file"`     // CA bundle to verify the switch certificate
+	CertFile   string `yaml:"cert_file"`   // Client certificate for mTLS
+	KeyFile    string `yaml:"key_file"`    // Client key for mTLS
+	ServerName string `yaml:"server_name"` // Name expected in the switch certificate, when the target is an address
+
+	// Lab only, refused unless insecure mode is allowed
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"` // TLS without certificate verification
+	Plaintext          bool `yaml:"plaintext"`            // No TLS at all
+}
+
+func (t TLSConfig) insecure() bool {
+	return t.InsecureSkipVerify || t.Plaintext
+}
+
+type Config struct {
+	Switches  []SwitchConfig                   `yaml:"switches"`
+	GNMIPaths map[string]map[string]PathConfig `yaml:"gnmi_paths"` // vendor -> path name -> path
+	Dialout   DialoutConfig                    `yaml:"dialout"`
+}
+
+// DialoutConfig is the receiver that switches with protocol dialout connect
+// to; the switch target is the address they connect from
+type DialoutConfig struct {
+	Listen       string `yaml:"listen"`         // e.g. :57000; no receiver without
+	CertFile     string `yaml:"cert_file"`      // Receiver certificate
+	KeyFile      string `yaml:"key_file"`       // Receiver key
+	ClientCAFile string `yaml:"client_ca_file"` // Requires switch certificates signed by this CA
+
+	// Lab only, refused unless insecure mode is allowed
+	Plaintext bool `yaml:"plaintext"`
+}
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} references with the environment; other $ signs
+// are left alone
+func expandEnv(value string) string {
+	return envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			log.Printf("⚠️  Config references unset variable ${%s}", name)
+		}
+		return value
+	})
+}
+
+// expandEnvFields applies expandEnv to every string value of a decoded
+// config, so the environment can't change the YAML structure
+func expandEnvFields(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(expandEnv(v.String()))
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandEnvFields(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				expandEnvFields(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandEnvFields(v.Index(i))
+		}
+	case reflect.Map:
+		// Map values aren't addressable: expand a copy and store it back
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(iter.Value().Type()).Elem()
+			value.Set(iter.Value())
+			expandEnvFields(value)
+			v.SetMapIndex(iter.Key(), value)
+		}
+	}
+}
+
+// LoadConfig reads the switches configuration, expanding ${VAR} references
+// in its values; insecure transport is refused unless allowInsecure is set
+func LoadConfig(path string, allowInsecure bool) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	expandEnvFields(reflect.ValueOf(&config))
+
+	for i, sw := range config.Switches {
+		if sw.Name == "" || sw.Target == "" {
+			return nil, fmt.Errorf("switch %q needs a name and a target", sw.Name)
+		}
+		switch sw.Protocol {
+		case "":
+			config.Switches[i].Protocol = protocolGNMI
+		case protocolGNMI:
+		case protocolSNMP:
+			if err := sw.SNMP.validate(sw); err != nil {
+				return nil, fmt.Errorf("switch %s: %w", sw.Name, err)
+			}
+			continue
+		case protocolDialout:
+			if config.Dialout.Listen == "" {
+				return nil, fmt.Errorf("switch %s dials out but no dialout listen address is configured", sw.Name)
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("switch %s: unknown protocol %q", sw.Name, sw.Protocol)
+		}
+		if sw.TLS.Plaintext && (sw.TLS.CAFile != "" || sw.TLS.CertFile != "") {
+			return nil, fmt.Errorf("switch %s: plaintext excludes the TLS certificates", sw.Name)
+		}
+		if (sw.TLS.CertFile == "") != (sw.TLS.KeyFile == "") {
+			return nil, fmt.Errorf("switch %s: mTLS needs both cert_file and key_file", sw.Name)
+		}
+		if sw.TLS.insecure() {
+			if !allowInsecure {
+				return nil, fmt.Errorf("switch %s uses insecure transport; start with -allow-insecure to permit it", sw.Name)
+			}
+			log.Printf("⚠️  Switch %s uses insecure transport (lab only)", sw.Name)
+		}
+	}
+
+	if d := config.Dialout; d.Listen != "" {
+		if d.Plaintext {
+			if d.CertFile != "" || d.ClientCAFile != "" {
+				return nil, fmt.Errorf("dialout: plaintext excludes the TLS certificates")
+			}
+			if !allowInsecure {
+				return nil, fmt.Errorf("dialout receiver uses plaintext; start with -allow-insecure to permit it")
+			}
+			log.Printf("⚠️  Dial-out receiver uses plaintext (lab only)")
+		} else if d.CertFile == "" || d.KeyFile == "" {
+			return nil, fmt.Errorf("dialout: TLS needs cert_file and key_file")
+		}
+	}
+
+	return &config, nil
+}
+
+// StreamConfig is a stream of streams.yaml, as far as the path correlation
+// needs it
+type StreamConfig struct {
+	Name      string `yaml:"name"`
+	StreamID  string `yaml:"stream_id"`
+	Multicast string `yaml:"multicast"` // group:port
+	Source    string `yaml:"source"`    // Optional: sender address, to pick its (S,G) routes
+
+	ExpectedBitrate float64 `yaml:"expected_bitrate"` // bits/s, reserved on every port of the path
+
+	// Optional: where the stream will be forwarded, to check its bandwidth
+	// against the ports before it is routed
+	Ports []StreamPort `yaml:"ports"`
+}
+
+// StreamPort is a switch port a stream is planned to cross
+type StreamPort struct {
+	Switch    string `yaml:"switch"`
+	Interface string `yaml:"interface"`
+	Direction string `yaml:"direction"` // egress (default) or ingress
+}
+
+// Group is the multicast group address of the stream
+func (s StreamConfig) Group() string {
+	if host, _, err := net.SplitHostPort(s.Multicast); err == nil {
+		return host
+	}
+	return s.Multicast
+}
+
+// LoadStreams reads the stream definitions shared with the RTP exporter
+func LoadStreams(path string) ([]StreamConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Streams []StreamConfig `yaml:"streams"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	for i, stream := range config.Streams {
+		if stream.StreamID == "" || stream.Multicast == "" {
+			return nil, fmt.Errorf("stream %q needs a stream_id and a multicast address", stream.Name)
+		}
+		if ip := net.ParseIP(stream.Group()); ip == nil || !ip.IsMulticast() {
+			return nil, fmt.Errorf("stream %s: %q is not a multicast group", stream.StreamID, stream.Multicast)
+		}
+		if stream.ExpectedBitrate < 0 {
+			return nil, fmt.Errorf("stream %s: negative expected_bitrate", stream.StreamID)
+		}
+		for j, port := range stream.Ports {
+			if port.Switch == "" || port.Interface == "" {
+				return nil, fmt.Errorf("stream %s: planned ports need a switch and an interface", stream.StreamID)
+			}
+			switch port.Direction {
+			case "":
+				config.Streams[i].Ports[j].Direction = "egress"
+			case "egress", "ingress":
+			default:
+				return nil, fmt.Errorf("stream %s: unknown port direction %q", stream.StreamID, port.Direction)
+			}
+		}
+	}
+	return config.Streams, nil
+}
+
+// readSecret returns the trimmed content of a secret file
+func readSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("GNMI_TEST_USER", "prometheus")
+	t.Setenv("GNMI_TEST_EMPTY", "")
+	os.Unsetenv("GNMI_TEST_UNSET")
+
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"${GNMI_TEST_USER}", "prometheus"},
+		{"user-${GNMI_TEST_USER}-ro", "user-prometheus-ro"},
+		{"${GNMI_TEST_USER}${GNMI_TEST_USER}", "prometheusprometheus"},
+		{"${GNMI_TEST_EMPTY}", ""},
+		{"${GNMI_TEST_UNSET}", ""},
+		{"$GNMI_TEST_USER", "$GNMI_TEST_USER"}, // Only the braced form
+		{"pa$$word", "pa$$word"},
+		{"${not a name}", "${not a name}"},
+	} {
+		if got := expandEnv(tc.in); got != tc.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestLoadConfigExpandsValues(t *testing.T) {
+	// Secrets that would break the YAML if substituted into the file
+	secret := "p\"a\\ss\nadmin: true\n"
+	t.Setenv("GNMI_TEST_PASSWORD", secret)
+	t.Setenv("GNMI_TEST_COMMUNITY", "pub'lic: #1")
+
+	path := filepath.Join(t.TempDir(), "switches.yaml")
+	os.WriteFile(path, []byte(`
+# ${GNMI_TEST_COMMENTED} is not expanded
+switches:
+  - name: "leaf-1"
+    target: "192.0.2.1:6030"
+    username: "prometheus"
+    password: "${GNMI_TEST_PASSWORD}"
+  - name: "old-leaf"
+    target: "192.0.2.2"
+    protocol: snmp
+    snmp:
+      community: "${GNMI_TEST_COMMUNITY}"
+gnmi_paths:
+  arista:
+    queues:
+      path: "/queues/${GNMI_TEST_COMMUNITY}"
+`), 0o600)
+
+	config, err := LoadConfig(path, false)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if got := config.Switches[0].Password; got != secret {
+		t.Errorf("password = %q, want %q", got, secret)
+	}
+	if got := config.Switches[1].SNMP.Community; got != "pub'lic: #1" {
+		t.Errorf("community = %q", got)
+	}
+	if got := config.GNMIPaths["arista"]["queues"].Path; got != "/queues/pub'lic: #1" {
+		t.Errorf("path = %q", got)
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		content, want string
+	}{
+		{"s3cret\n", "s3cret"},
+		{"s3cret\r\n", "s3cret"},
+		{"s3cret", "s3cret"},
+		{" s3 cret \n\n", " s3 cret "}, // Only the line ending is trimmed
+		{"", ""},
+	} {
+		path := filepath.Join(dir, "secret")
+		os.WriteFile(path, []byte(tc.content), 0o600)
+		if got, err := readSecret(path); err != nil || got != tc.want {
+			t.Errorf("readSecret(%q) = %q, %v; want %q", tc.content, got, err, tc.want)
+		}
+	}
+
+	if _, err := readSecret(filepath.Join(dir, "missing")); err == nil {
+		t.Error("readSecret of a missing file succeeded")
+	}
+}
+
+func TestCompilePathsRejectsUnmappedEntries(t *testing.T) {
+	config, err := LoadConfig(filepath.Join("..", "..", "config", "switches.yaml.example"), false)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	metrics := NewMetricSet()
+	for vendor, paths := range config.GNMIPaths {
+		if _, err := compilePaths(paths, metrics); err != nil {
+			t.Errorf("example gnmi_paths of %s: %v", vendor, err)
+		}
+	}
+
+	// A plain path needs the built-in metrics of its entry name
+	_, err = compilePaths(map[string]PathConfig{
+		"interface_counters": defaultPaths["interface_counters"],
+		"tcam_utilization":   {Path: "/System/tcam-items/utilization-items"},
+	}, NewMetricSet())
+	if err == nil || !strings.Contains(err.Error(), "tcam_utilization") {
+		t.Errorf("unmapped entry compiled, err = %v", err)
+	}
+}
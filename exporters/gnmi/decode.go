@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// joinPath prepends the notification prefix to an update or delete path; the
+// prefix carries the origin unless the path sets its own
+func joinPath(prefix, path *gnmi.Path) *gnmi.Path {
+	joined := &gnmi.Path{
+		Origin: prefix.GetOrigin(),
+		Target: prefix.GetTarget(),
+	}
+	if path.GetOrigin() != "" {
+		joined.Origin = path.GetOrigin()
+	}
+	joined.Elem = append(joined.Elem, pathElems(prefix)...)
+	joined.Elem = append(joined.Elem, pathElems(path)...)
+	return joined
+}
+
+// pathElems returns the elems of a path, converting the deprecated string
+// elements some targets still send
+func pathElems(path *gnmi.Path) []*gnmi.PathElem {
+	if len(path.GetElem()) > 0 || len(path.GetElement()) == 0 {
+		return path.GetElem()
+	}
+	parsed, err := ParsePath(strings.Join(path.GetElement(), "/"))
+	if err != nil {
+		return nil
+	}
+	return parsed.Elem
+}
+
+// leafData flattens an update value into leaf paths relative to the spec,
+// keeping the decoded scalars (float64, string or bool)
+func leafData(relative []*gnmi.PathElem, last string, value *gnmi.TypedValue) map[string]interface{} {
+	names := make([]string, 0, len(relative))
+	for _, elem := range relative {
+		names = append(names, elem.Name)
+	}
+	base := strings.Join(names, "/")
+	leaf := leafName(base, last)
+	leaves := make(map[string]interface{})
+
+	var raw []byte
+	switch v := value.GetValue().(type) {
+	case *gnmi.TypedValue_JsonIetfVal:
+		raw = v.JsonIetfVal
+	case *gnmi.TypedValue_JsonVal:
+		raw = v.JsonVal
+	case *gnmi.TypedValue_UintVal:
+		leaves[leaf] = float64(v.UintVal)
+	case *gnmi.TypedValue_IntVal:
+		leaves[leaf] = float64(v.IntVal)
+	case *gnmi.TypedValue_DoubleVal:
+		leaves[leaf] = v.DoubleVal
+	case *gnmi.TypedValue_FloatVal:
+		leaves[leaf] = float64(v.FloatVal)
+	case *gnmi.TypedValue_DecimalVal:
+		leaves[leaf] = float64(v.DecimalVal.GetDigits()) / math.Pow10(int(v.DecimalVal.GetPrecision()))
+	case *gnmi.TypedValue_StringVal:
+		leaves[leaf] = v.StringVal
+	case *gnmi.TypedValue_AsciiVal:
+		leaves[leaf] = v.AsciiVal
+	case *gnmi.TypedValue_BoolVal:
+		leaves[leaf] = v.BoolVal
+	case *gnmi.TypedValue_ProtoBytes:
+		flattenProto(base, v.ProtoBytes, leaves)
+	case *gnmi.TypedValue_AnyVal:
+		flattenProto(base, v.AnyVal.GetValue(), leaves)
+	}
+	if raw != nil {
+		var data interface{}
+		if err := json.Unmarshal(raw, &data); err == nil {
+			flattenJSON(base, data, leaves)
+		}
+	}
+	return leaves
+}
+
+// leafValues keeps the numeric leaves of leafData
+func leafValues(leaves map[string]interface{}) map[string]float64 {
+	values := make(map[string]float64, len(leaves))
+	for leaf, v := range leaves {
+		if f, ok := numericValue(v); ok {
+			values[leaf] = f
+		}
+	}
+	return values
+}
+
+// numericValue converts a leaf to a number; JSON_IETF encodes 64-bit
+// integers as strings
+func numericValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// leafName is the path below the spec, or the spec's own leaf when the
+// subscription points at a leaf
+func leafName(base, last string) string {
+	if base == "" {
+		return last
+	}
+	return base
+}
+
+// flattenJSON collects the scalar leaves of a JSON container, dropping YANG
+// module prefixes (openconfig-interfaces:counters -> counters)
+func flattenJSON(prefix string, data interface{}, leaves map[string]interface{}) {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if i := strings.IndexByte(key, ':'); i >= 0 {
+				key = key[i+1:]
+			}
+			flattenJSON(joinLeaf(prefix, key), child, leaves)
+		}
+	case float64, string, bool:
+		leaves[prefix] = v
+	}
+}
+
+// flattenProto decodes protobuf bytes without their schema, naming each
+// scalar by its field numbers (e.g. 3/1): varints as integers, fixed64 as
+// double, fixed32 as float, and length-delimited fields as strings when they
+// are printable text, otherwise as nested messages
+func flattenProto(prefix string, b []byte, leaves map[string]interface{}) bool {
+	found := make(map[string]interface{})
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return false
+		}
+		b = b[n:]
+		field := joinLeaf(prefix, strconv.Itoa(int(num)))
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return false
+			}
+			found[field], b = float64(v), b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return false
+			}
+			found[field], b = math.Float64frombits(v), b[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return false
+			}
+			found[field], b = float64(math.Float32frombits(v)), b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return false
+			}
+			b = b[n:]
+			if printable(v) {
+				found[field] = string(v)
+			} else {
+				flattenProto(field, v, found)
+			}
+		default:
+			return false
+		}
+	}
+	for leaf, v := range found {
+		leaves[leaf] = v
+	}
+	return true
+}
+
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func joinLeaf(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
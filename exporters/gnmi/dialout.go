@@ -0,0 +1,594 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cisco-ie/nx-telemetry-proto/mdt_dialout"
+	"github.com/cisco-ie/nx-telemetry-proto/telemetry_bis"
+	"github.com/golang/protobuf/proto"
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// gNMI dial-out as SR OS and gnmic implement it: the switch publishes the
+// SubscribeResponses of its configured subscriptions
+type gnmiDialoutServer interface {
+	Publish(stream grpc.ServerStream) error
+}
+
+var gnmiDialoutServiceDesc = grpc.ServiceDesc{
+	ServiceName: "Nokia.SROS.DialoutTelemetry",
+	HandlerType: (*gnmiDialoutServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Publish",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(gnmiDialoutServer).Publish(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "sros_dialout.proto",
+}
+
+const (
+	// mdtExpiryIntervals is how many of a switch's longest MDT sample
+	// interval a multicast entry stays without being reported again
+	mdtExpiryIntervals = 3
+	// mdtIntervalSamples is how many recent gaps between the messages of a
+	// sensor path give its sample interval
+	mdtIntervalSamples = 5
+)
+
+// mdtSensor is the timing of the messages of one MDT sensor path
+type mdtSensor struct {
+	last time.Time
+	gaps []time.Duration // Most recent first
+}
+
+// record adds the timestamp of a message of the sensor path
+func (s *mdtSensor) record(at time.Time) {
+	if !s.last.IsZero() && at.After(s.last) {
+		s.gaps = append([]time.Duration{at.Sub(s.last)}, s.gaps...)
+		if len(s.gaps) > mdtIntervalSamples {
+			s.gaps = s.gaps[:mdtIntervalSamples]
+		}
+	}
+	if at.After(s.last) {
+		s.last = at
+	}
+}
+
+// interval is the median of the recent gaps, so that a single late message
+// doesn't stretch it; 0 until the sensor path has sent twice
+func (s *mdtSensor) interval() time.Duration {
+	if len(s.gaps) == 0 {
+		return 0
+	}
+	gaps := append([]time.Duration(nil), s.gaps...)
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	return gaps[len(gaps)/2]
+}
+
+// dialoutDevice is a switch that pushes telemetry, and the collector its
+// notifications go through
+type dialoutDevice struct {
+	config    SwitchConfig
+	collector *GNMICollector
+	multicast *multicastTables // Of its vendor plugin, nil without
+	sessions  int              // Open sessions, under the receiver's mu
+
+	// MDT sends every sensor path periodically, never a delete: multicast
+	// entries age out by message timestamp while sessions are open, and are
+	// cleared when none has been for the expiry time; under the receiver's mu
+	mdtSensors map[string]*mdtSensor // Since the sessions opened
+	idle       uint64                // Times the last session closed, to tell the current idle timer
+}
+
+// mdtMaxAge is how long a multicast entry of the device stays unreported:
+// mdtExpiryIntervals of the longest sample interval of its sensor paths, 0
+// until one has sent twice; r.mu must be held
+func (d *dialoutDevice) mdtMaxAge() time.Duration {
+	var longest time.Duration
+	for _, sensor := range d.mdtSensors {
+		if interval := sensor.interval(); interval > longest {
+			longest = interval
+		}
+	}
+	return mdtExpiryIntervals * longest
+}
+
+// DialoutReceiver accepts the telemetry sessions switches open towards the
+// collector, Cisco MDT and gNMI dial-out, and feeds them to the metric
+// pipeline of the switch they authenticate as
+type DialoutReceiver struct {
+	config DialoutConfig
+
+	mu      sync.Mutex
+	devices []*dialoutDevice
+
+	rejected *prometheus.CounterVec
+	dropped  *prometheus.CounterVec
+}
+
+func NewDialoutReceiver(config DialoutConfig) *DialoutReceiver {
+	r := &DialoutReceiver{
+		config: config,
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_dialout_rejected_sessions_total",
+				Help: "Dial-out sessions refused by reason (unknown_device, certificate, credentials)",
+			},
+			[]string{"reason"},
+		),
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_dialout_undecodable_messages_total",
+				Help: "Dial-out messages that could not be decoded, such as compact GPB",
+			},
+			[]string{"switch"},
+		),
+	}
+	r.rejected = mustRegister(r.rejected)
+	r.dropped = mustRegister(r.dropped)
+	return r
+}
+
+// AddDevice accepts sessions from a switch into its collector, which reports
+// it disconnected until it connects
+func (r *DialoutReceiver) AddDevice(sw SwitchConfig, collector *GNMICollector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.devices = append(r.devices, &dialoutDevice{
+		config:     sw,
+		collector:  collector,
+		multicast:  multicastOf(collector.vendor),
+		mdtSensors: make(map[string]*mdtSensor),
+	})
+	collector.dialout = true
+	collector.setState(sessionDisconnected)
+}
+
+// Serve accepts sessions on lis until ctx is cancelled
+func (r *DialoutReceiver) Serve(ctx context.Context, lis net.Listener) error {
+	var opts []grpc.ServerOption
+	if !r.config.Plaintext {
+		tlsConfig, err := r.tlsConfig()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	mdt_dialout.RegisterGRPCMdtDialoutServer(server, r)
+	server.RegisterService(&gnmiDialoutServiceDesc, r)
+
+	r.mu.Lock()
+	for _, device := range r.devices {
+		go device.collector.publishUpdateRate(ctx)
+	}
+	r.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		server.Stop()
+	}()
+	if err := server.Serve(lis); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// ListenAndServe accepts sessions on the configured address until ctx is
+// cancelled
+func (r *DialoutReceiver) ListenAndServe(ctx context.Context) error {
+	lis, err := net.Listen("tcp", r.config.Listen)
+	if err != nil {
+		return err
+	}
+	return r.Serve(ctx, lis)
+}
+
+func (r *DialoutReceiver) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("dialout certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if r.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("dialout client CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", r.config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// authenticate finds the switch a session comes from: a dial-out switch
+// whose target is the peer address, whose name (or tls.server_name) the
+// client certificate carries when there is one, and whose username and
+// password the session metadata carries when it has them
+func (r *DialoutReceiver) authenticate(ctx context.Context) (*dialoutDevice, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "no peer")
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	var cert *x509.Certificate
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+		cert = info.State.VerifiedChains[0][0]
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	r.mu.Lock()
+	devices := append([]*dialoutDevice(nil), r.devices...)
+	r.mu.Unlock()
+
+	reason := "unknown_device"
+	for _, device := range devices {
+		if !dialoutAddressMatches(device.config.Target, host) {
+			continue
+		}
+		if cert != nil {
+			name := device.config.TLS.ServerName
+			if name == "" {
+				name = device.config.Name
+			}
+			if cert.VerifyHostname(name) != nil {
+				reason = "certificate"
+				continue
+			}
+		}
+		if ok, err := dialoutCredentialsMatch(device.config, md); err != nil {
+			log.Printf("⚠️  Dial-out credentials of %s: %v", device.config.Name, err)
+			reason = "credentials"
+			continue
+		} else if !ok {
+			reason = "credentials"
+			continue
+		}
+		return device, nil
+	}
+
+	r.rejected.WithLabelValues(reason).Inc()
+	log.Printf("⚠️  Refused dial-out session from %s: %s", p.Addr, strings.Replace(reason, "_", " ", -1))
+	return nil, status.Errorf(codes.Unauthenticated, "dial-out session refused: %s", reason)
+}
+
+// dialoutAddressMatches reports whether a switch's target, an address or a
+// name, is the address a session comes from
+func dialoutAddressMatches(target, host string) bool {
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		target = h
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+	addrs, err := net.LookupHost(target)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if net.ParseIP(addr).Equal(net.ParseIP(host)) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialoutCredentialsMatch checks the username and password metadata of a
+// session against the switch's, when it has them
+func dialoutCredentialsMatch(sw SwitchConfig, md metadata.MD) (bool, error) {
+	password := sw.Password
+	if sw.PasswordFile != "" {
+		secret, err := readSecret(sw.PasswordFile)
+		if err != nil {
+			return false, fmt.Errorf("password file: %w", err)
+		}
+		password = secret
+	}
+	if sw.Username == "" && password == "" {
+		return true, nil
+	}
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(first("username")), []byte(sw.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(first("password")), []byte(password)) == 1
+	return userOK && passwordOK, nil
+}
+
+// open records a session of a device, reporting it connected; the returned
+// func closes it. Sessions don't start a sync of the plugin tables: a switch
+// may hold several, each streaming part of its state
+func (r *DialoutReceiver) open(device *dialoutDevice, kind string) func() {
+	r.mu.Lock()
+	device.sessions++
+	r.mu.Unlock()
+
+	c := device.collector
+	log.Printf("Dial-out %s session from %s (%s)", kind, c.name, c.target)
+	c.setState(sessionConnected)
+
+	return func() {
+		r.mu.Lock()
+		device.sessions--
+		last := device.sessions == 0
+		if last && len(device.mdtSensors) > 0 {
+			// The timing starts over with the next session; until one opens
+			// nothing ages the entries, so they go after their expiry time
+			maxAge := device.mdtMaxAge()
+			device.mdtSensors = make(map[string]*mdtSensor)
+			if device.multicast != nil {
+				device.idle++
+				idle := device.idle
+				time.AfterFunc(maxAge, func() { r.clearIdle(device, idle) })
+			}
+		}
+		r.mu.Unlock()
+
+		log.Printf("⚠️  Dial-out %s session from %s (%s) ended", kind, c.name, c.target)
+		if last {
+			c.setState(sessionDisconnected)
+			c.health.synced.WithLabelValues(c.name, c.target).Set(0)
+		}
+	}
+}
+
+// Publish receives a gNMI dial-out session
+func (r *DialoutReceiver) Publish(stream grpc.ServerStream) error {
+	device, err := r.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	defer r.open(device, "gNMI")()
+
+	for {
+		response := &gnmi.SubscribeResponse{}
+		if err := stream.RecvMsg(response); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		device.collector.handleUpdate(response)
+	}
+}
+
+// MdtDialout receives a Cisco model-driven telemetry session; messages
+// larger than the switch's gRPC limit arrive in chunks of the same ReqId
+func (r *DialoutReceiver) MdtDialout(stream mdt_dialout.GRPCMdtDialout_MdtDialoutServer) error {
+	device, err := r.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	defer r.open(device, "MDT")()
+
+	c := device.collector
+	chunks := make(map[int64][]byte)
+	for {
+		args, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if args.Errors != "" {
+			log.Printf("⚠️  %s reported a telemetry error: %s", c.name, args.Errors)
+		}
+
+		data := args.Data
+		if args.TotalSize > 0 && int(args.TotalSize) > len(data) {
+			data = append(chunks[args.ReqId], data...)
+			if len(data) < int(args.TotalSize) {
+				chunks[args.ReqId] = data
+				continue
+			}
+			delete(chunks, args.ReqId)
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		notification, err := mdtNotification(data)
+		if err != nil {
+			r.dropped.WithLabelValues(c.name).Inc()
+			continue
+		}
+		at := time.Unix(0, notification.Timestamp)
+		if device.multicast != nil {
+			device.multicast.Advance(c.name, at)
+		}
+		c.handleUpdate(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: notification}})
+		if maxAge := r.mdtMaxAge(device, notification, at); device.multicast != nil && maxAge > 0 {
+			device.multicast.Expire(c.name, maxAge)
+		}
+	}
+}
+
+// clearIdle drops the multicast entries of a device that has had no session
+// since its last one closed, the idle-th time, for their expiry time
+func (r *DialoutReceiver) clearIdle(device *dialoutDevice, idle uint64) {
+	r.mu.Lock()
+	current := device.sessions == 0 && device.idle == idle
+	r.mu.Unlock()
+
+	if current {
+		log.Printf("⚠️  No dial-out session from %s, clearing its multicast tables", device.config.Name)
+		device.multicast.Clear(device.config.Name)
+	}
+}
+
+// mdtMaxAge records the timestamp of an MDT message and returns how long a
+// multicast entry of the device stays unreported
+func (r *DialoutReceiver) mdtMaxAge(device *dialoutDevice, notification *gnmi.Notification, at time.Time) time.Duration {
+	if notification.Timestamp == 0 || len(notification.Update) == 0 {
+		return 0
+	}
+	schema := &gnmi.Path{Origin: notification.Update[0].Path.GetOrigin()}
+	for _, elem := range notification.Update[0].Path.GetElem() {
+		schema.Elem = append(schema.Elem, &gnmi.PathElem{Name: elem.Name})
+	}
+	key := PathString(schema)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sensor, ok := device.mdtSensors[key]
+	if !ok {
+		sensor = &mdtSensor{}
+		device.mdtSensors[key] = sensor
+	}
+	sensor.record(at)
+	return device.mdtMaxAge()
+}
+
+var errCompactGPB = errors.New("compact GPB needs the sensor path's .proto")
+
+// mdtNotification converts a self-describing (GPB-KV) telemetry message to
+// a gNMI notification: the encoding path becomes the update path with the
+// row's keys on its last element and its content as a JSON value, so that
+// gnmi_paths mappings and vendor plugins apply unchanged
+func mdtNotification(data []byte) (*gnmi.Notification, error) {
+	var telemetry telemetry_bis.Telemetry
+	if err := proto.Unmarshal(data, &telemetry); err != nil {
+		return nil, err
+	}
+	if telemetry.GetDataGpb() != nil && len(telemetry.GetDataGpbkv()) == 0 {
+		return nil, errCompactGPB
+	}
+	base, err := ParsePath(mdtPath(telemetry.GetEncodingPath()))
+	if err != nil {
+		return nil, err
+	}
+
+	notification := &gnmi.Notification{Timestamp: int64(telemetry.GetMsgTimestamp()) * int64(time.Millisecond)}
+	for _, row := range telemetry.GetDataGpbkv() {
+		keys, content := map[string]string{}, map[string]interface{}{}
+		structured := false
+		for _, field := range row.GetFields() {
+			switch field.GetName() {
+			case "keys":
+				structured = true
+				for _, key := range field.GetFields() {
+					keys[key.GetName()] = fmt.Sprint(mdtValue(key))
+				}
+			case "content":
+				structured = true
+				mdtFields(field.GetFields(), content)
+			}
+		}
+		if !structured {
+			mdtFields(row.GetFields(), content)
+		}
+
+		value, err := json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		path := proto.Clone(base).(*gnmi.Path)
+		if len(keys) > 0 && len(path.Elem) > 0 {
+			path.Elem[len(path.Elem)-1].Key = keys
+		}
+		notification.Update = append(notification.Update, &gnmi.Update{
+			Path: path,
+			Val:  &gnmi.TypedValue{Value: &gnmi.TypedValue_JsonVal{JsonVal: value}},
+		})
+	}
+	return notification, nil
+}
+
+// mdtPath turns an encoding path such as
+// Cisco-IOS-XR-infra-statsd-oper:infra-statistics/interfaces into a gNMI path
+// string with the YANG module as origin
+func mdtPath(encodingPath string) string {
+	if i := strings.IndexByte(encodingPath, ':'); i > 0 && !strings.ContainsAny(encodingPath[:i], "/[") {
+		return encodingPath[:i] + ":/" + strings.TrimPrefix(encodingPath[i+1:], "/")
+	}
+	return "/" + strings.TrimPrefix(encodingPath, "/")
+}
+
+// mdtFields adds fields to a JSON object: containers as objects, and
+// repeated names as arrays
+func mdtFields(fields []*telemetry_bis.TelemetryField, into map[string]interface{}) {
+	for _, field := range fields {
+		var value interface{}
+		if children := field.GetFields(); len(children) > 0 {
+			object := make(map[string]interface{})
+			mdtFields(children, object)
+			value = object
+		} else {
+			value = mdtValue(field)
+		}
+		name := field.GetName()
+		switch existing := into[name].(type) {
+		case nil:
+			into[name] = value
+		case []interface{}:
+			into[name] = append(existing, value)
+		default:
+			into[name] = []interface{}{existing, value}
+		}
+	}
+}
+
+// mdtValue is the scalar of a field; 64-bit integers as strings, as JSON_IETF
+// encodes them
+func mdtValue(field *telemetry_bis.TelemetryField) interface{} {
+	switch v := field.GetValueByType().(type) {
+	case *telemetry_bis.TelemetryField_BytesValue:
+		return string(v.BytesValue)
+	case *telemetry_bis.TelemetryField_StringValue:
+		return v.StringValue
+	case *telemetry_bis.TelemetryField_BoolValue:
+		return v.BoolValue
+	case *telemetry_bis.TelemetryField_Uint32Value:
+		return v.Uint32Value
+	case *telemetry_bis.TelemetryField_Uint64Value:
+		return fmt.Sprint(v.Uint64Value)
+	case *telemetry_bis.TelemetryField_Sint32Value:
+		return v.Sint32Value
+	case *telemetry_bis.TelemetryField_Sint64Value:
+		return fmt.Sprint(v.Sint64Value)
+	case *telemetry_bis.TelemetryField_DoubleValue:
+		return v.DoubleValue
+	case *telemetry_bis.TelemetryField_FloatValue:
+		return v.FloatValue
+	}
+	return nil
+}
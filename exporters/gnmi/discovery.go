@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const discoveryTimeout = 10 * time.Second
+
+// Encodings the decoder handles, in order of preference
+var encodingPreference = []gnmi.Encoding{gnmi.Encoding_JSON_IETF, gnmi.Encoding_JSON, gnmi.Encoding_PROTO}
+
+// Inventory read with Get at connect time
+const (
+	hostnamePath        = "/system/state/hostname"
+	softwareVersionPath = "/system/state/software-version"
+	componentsPath      = "/components/component[name=*]/state"
+)
+
+// targetInfo is what a switch reports about itself at connect time
+type targetInfo struct {
+	gnmiVersion     string
+	encoding        gnmi.Encoding
+	models          int
+	hostname        string
+	softwareVersion string
+	chassis         string
+	serialNumber    string
+	lineCards       int
+}
+
+// discover asks the target for its capabilities and, if enabled, its
+// inventory; targets without Capabilities get JSON_IETF
+func (c *GNMICollector) discover(ctx context.Context, client gnmi.GNMIClient) *targetInfo {
+	info := &targetInfo{encoding: gnmi.Encoding_JSON_IETF}
+
+	capCtx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+	caps, err := client.Capabilities(capCtx, &gnmi.CapabilityRequest{})
+	if err != nil {
+		log.Printf("⚠️  Capabilities of %s unavailable, assuming JSON_IETF: %v", c.name, err)
+	} else {
+		info.gnmiVersion = caps.GetGNMIVersion()
+		info.models = len(caps.GetSupportedModels())
+		if encoding, ok := chooseEncoding(caps.GetSupportedEncodings()); ok {
+			info.encoding = encoding
+		} else {
+			log.Printf("⚠️  %s supports none of JSON_IETF, JSON, PROTO (%v), trying JSON_IETF", c.name, caps.GetSupportedEncodings())
+		}
+		log.Printf("%s: gNMI %s, %d models, encoding %s", c.name, info.gnmiVersion, info.models, info.encoding)
+	}
+
+	if c.inventory {
+		c.getInventory(ctx, client, info)
+	}
+	return info
+}
+
+func chooseEncoding(supported []gnmi.Encoding) (gnmi.Encoding, bool) {
+	for _, preferred := range encodingPreference {
+		for _, encoding := range supported {
+			if encoding == preferred {
+				return encoding, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// getInventory reads hostname, software version, chassis and line cards;
+// paths the target does not know are left empty
+func (c *GNMICollector) getInventory(ctx context.Context, client gnmi.GNMIClient, info *targetInfo) {
+	get := func(path string, handle func(path *gnmi.Path, leaves map[string]interface{})) {
+		parsed, err := ParsePath(path)
+		if err != nil {
+			return
+		}
+		getCtx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+		defer cancel()
+		resp, err := client.Get(getCtx, &gnmi.GetRequest{
+			Path:     []*gnmi.Path{parsed},
+			Type:     gnmi.GetRequest_STATE,
+			Encoding: info.encoding,
+		})
+		if err != nil {
+			log.Printf("Inventory %s of %s unavailable: %v", path, c.name, err)
+			return
+		}
+		for _, notification := range resp.GetNotification() {
+			for _, update := range notification.GetUpdate() {
+				full := joinPath(notification.GetPrefix(), update.GetPath())
+				last := ""
+				if elems := full.GetElem(); len(elems) > 0 {
+					last = elems[len(elems)-1].Name
+				}
+				handle(full, leafData(nil, last, update.GetVal()))
+			}
+		}
+	}
+
+	get(hostnamePath, func(_ *gnmi.Path, leaves map[string]interface{}) {
+		if v, ok := leaves["hostname"].(string); ok {
+			info.hostname = v
+		}
+	})
+	get(softwareVersionPath, func(_ *gnmi.Path, leaves map[string]interface{}) {
+		if v, ok := leaves["software-version"].(string); ok {
+			info.softwareVersion = v
+		}
+	})
+	get(componentsPath, func(path *gnmi.Path, leaves map[string]interface{}) {
+		componentType, _ := leaves["type"].(string)
+		switch {
+		case strings.HasSuffix(componentType, "CHASSIS"):
+			info.chassis = firstString(leaves, "part-no", "description")
+			if info.chassis == "" {
+				if names := keyValues(path.GetElem(), "component", "name"); len(names) > 0 {
+					info.chassis = names[0]
+				}
+			}
+			info.serialNumber = firstString(leaves, "serial-no")
+			if info.softwareVersion == "" {
+				info.softwareVersion = firstString(leaves, "software-version")
+			}
+		case strings.HasSuffix(componentType, "LINECARD"):
+			info.lineCards++
+		}
+	})
+}
+
+func firstString(leaves map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		if v, ok := leaves[name].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// publishInfo replaces the switch's info series with what discovery found
+func (c *GNMICollector) publishInfo(info *targetInfo) {
+	c.health.info.DeletePartialMatch(map[string]string{"switch": c.name})
+	c.health.info.WithLabelValues(c.name, c.target, info.gnmiVersion, info.encoding.String(),
+		info.hostname, info.softwareVersion, info.chassis, info.serialNumber).Set(1)
+	c.health.models.WithLabelValues(c.name, c.target).Set(float64(info.models))
+	c.health.lineCards.WithLabelValues(c.name, c.target).Set(float64(info.lineCards))
+}
+
+// rejected reports whether an error means the target refused the request,
+// typically for a path or mode it does not support
+func rejected(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.Unimplemented, codes.FailedPrecondition:
+		return true
+	}
+	return false
+}
+
+// probe checks each subscription on its own, in its own mode and interval,
+// with a stream that asks for no data, returning those the target accepts
+func (c *GNMICollector) probe(ctx context.Context, client gnmi.GNMIClient, subscriptions []*gnmi.Subscription, encoding gnmi.Encoding) []*gnmi.Subscription {
+	var supported []*gnmi.Subscription
+	for _, subscription := range subscriptions {
+		err := c.probeOne(ctx, client, subscription, encoding)
+		if err == nil || !rejected(err) {
+			supported = append(supported, subscription)
+			continue
+		}
+		log.Printf("⚠️  %s does not support %s, skipping it: %v", c.name, PathString(subscription.Path), err)
+		c.health.subscriptionActive.WithLabelValues(c.name, c.target, PathString(subscription.Path)).Set(0)
+	}
+	return supported
+}
+
+func (c *GNMICollector) probeOne(ctx context.Context, client gnmi.GNMIClient, subscription *gnmi.Subscription, encoding gnmi.Encoding) error {
+	// Cancelling ends the stream once the target has accepted it
+	probeCtx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+
+	stream, err := client.Subscribe(probeCtx)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&gnmi.SubscribeRequest{
+		Request: &gnmi.SubscribeRequest_Subscribe{
+			Subscribe: &gnmi.SubscriptionList{
+				Mode:         gnmi.SubscriptionList_STREAM,
+				UpdatesOnly:  true,
+				Subscription: []*gnmi.Subscription{subscription},
+				Encoding:     encoding,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		response, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if response.GetSyncResponse() {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const pathPublishInterval = 10 * time.Second
+
+// PathPort is an interface a stream enters or leaves a switch through, with
+// the state the switch last reported for it
+type PathPort struct {
+	Interface          string   `json:"interface"`
+	VLAN               string   `json:"vlan,omitempty"` // Set for ports from the IGMP snooping table
+	OperStatus         string   `json:"oper_status,omitempty"`
+	SpeedBps           float64  `json:"speed_bps,omitempty"`
+	UtilizationPercent *float64 `json:"utilization_percent,omitempty"` // Egress, all traffic
+	QueueDropsPerSec   float64  `json:"queue_drops_per_second"`
+}
+
+// PathHop is one switch forwarding a stream
+type PathHop struct {
+	Switch  string     `json:"switch"`
+	VRF     string     `json:"vrf,omitempty"`
+	Source  string     `json:"source,omitempty"`
+	Ingress []PathPort `json:"ingress"`
+	Egress  []PathPort `json:"egress"`
+}
+
+// StreamPath is the expected forwarding path of a stream through the
+// fabric: every switch with a route or snooping members for its group
+type StreamPath struct {
+	StreamID string    `json:"stream_id"`
+	Name     string    `json:"name"`
+	Group    string    `json:"group"`
+	Source   string    `json:"source,omitempty"`
+	Hops     []PathHop `json:"hops"`
+}
+
+// Fabric correlates the streams of streams.yaml with the multicast and
+// interface state the collectors keep for every switch
+type Fabric struct {
+	streams    []StreamConfig
+	interfaces *interfaceTable
+
+	// Share of a port's speed the streams may reserve, in percent
+	reservationLimit float64
+
+	mu             sync.Mutex
+	switches       []string
+	multicast      map[string]*multicastTables // Per switch, from its vendor plugin
+	oversubscribed map[string][]string         // Streams of the ports over the limit at the last publish
+	unfit          map[string]bool             // Unrouted streams that did not fit their planned ports at the last publish
+
+	pathSwitches *prometheus.GaugeVec
+	portUp       *prometheus.GaugeVec
+	utilization  *prometheus.GaugeVec
+	queueDrops   *prometheus.GaugeVec
+	committed    *prometheus.GaugeVec
+	headroom     *prometheus.GaugeVec
+	overLimit    *prometheus.GaugeVec
+	published    map[*prometheus.GaugeVec]map[string][]string
+}
+
+func NewFabric(streams []StreamConfig, reservationLimit float64, interfaces *interfaceTable) *Fabric {
+	f := &Fabric{
+		streams:          streams,
+		interfaces:       interfaces,
+		reservationLimit: reservationLimit,
+		multicast:        make(map[string]*multicastTables),
+		pathSwitches: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_stream_path_switches",
+				Help: "Switches forwarding the stream's multicast group (0=no switch has a route or members)",
+			},
+			[]string{"stream_id"},
+		),
+		portUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_stream_path_port_up",
+				Help: "Oper status of a port on the stream's path (1=up, 0=down)",
+			},
+			[]string{"stream_id", "switch", "interface", "direction"},
+		),
+		utilization: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_stream_path_egress_utilization_percent",
+				Help: "Egress utilization of a port on the stream's path, all traffic",
+			},
+			[]string{"stream_id", "switch", "interface"},
+		),
+		queueDrops: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_stream_path_queue_drops_per_second",
+				Help: "Queue drops and output discards of an egress port on the stream's path",
+			},
+			[]string{"stream_id", "switch", "interface"},
+		),
+		committed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_switch_port_committed_bps",
+				Help: "Expected bitrate of the configured streams forwarded through the port",
+			},
+			[]string{"switch", "interface", "direction"},
+		),
+		headroom: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_switch_port_reservation_headroom_percent",
+				Help: "Share of the port speed still free for streams under the reservation limit (negative when over)",
+			},
+			[]string{"switch", "interface", "direction"},
+		),
+		overLimit: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_switch_port_oversubscribed",
+				Help: "Streams on the port commit more than the reservation limit (1=over, 0=within)",
+			},
+			[]string{"switch", "interface", "direction"},
+		),
+		published: make(map[*prometheus.GaugeVec]map[string][]string),
+	}
+	f.pathSwitches = mustRegister(f.pathSwitches)
+	f.portUp = mustRegister(f.portUp)
+	f.utilization = mustRegister(f.utilization)
+	f.queueDrops = mustRegister(f.queueDrops)
+	f.committed = mustRegister(f.committed)
+	f.headroom = mustRegister(f.headroom)
+	f.overLimit = mustRegister(f.overLimit)
+	return f
+}
+
+// AddSwitch includes a switch in the paths, with the multicast tables of
+// its vendor plugin if it keeps them
+func (f *Fabric) AddSwitch(switchName string, plugin VendorPlugin) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.switches = append(f.switches, switchName)
+	sort.Strings(f.switches)
+	if p, ok := plugin.(multicastPlugin); ok {
+		f.multicast[switchName] = p.multicastState()
+	}
+}
+
+// Path computes the current path of a stream
+func (f *Fabric) Path(stream StreamConfig) StreamPath {
+	f.mu.Lock()
+	switches := append([]string(nil), f.switches...)
+	f.mu.Unlock()
+
+	group := stream.Group()
+	path := StreamPath{StreamID: stream.StreamID, Name: stream.Name, Group: group, Source: stream.Source, Hops: []PathHop{}}
+	for _, switchName := range switches {
+		f.mu.Lock()
+		tables, ok := f.multicast[switchName]
+		f.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		hop := PathHop{Switch: switchName, Ingress: []PathPort{}, Egress: []PathPort{}}
+		ingress := make(map[string]bool)
+		egress := make(map[string]bool)
+		for _, route := range tables.Routes(switchName, group) {
+			if !sourceMatches(stream.Source, route.source) {
+				continue
+			}
+			hop.VRF = route.vrf
+			if !sharedTree(route.source) {
+				hop.Source = route.source
+			}
+			if route.incoming != "" && !ingress[route.incoming] {
+				ingress[route.incoming] = true
+				hop.Ingress = append(hop.Ingress, f.port(switchName, route.incoming, "", false))
+			}
+			for _, iface := range route.outgoing {
+				if !egress[iface] {
+					egress[iface] = true
+					hop.Egress = append(hop.Egress, f.port(switchName, iface, "", true))
+				}
+			}
+		}
+
+		members := tables.Members(switchName, group)
+		vlans := make([]string, 0, len(members))
+		for vlan := range members {
+			vlans = append(vlans, vlan)
+		}
+		sort.Strings(vlans)
+		for _, vlan := range vlans {
+			for _, port := range members[vlan] {
+				if !egress[port] {
+					egress[port] = true
+					hop.Egress = append(hop.Egress, f.port(switchName, port, vlan, true))
+				}
+			}
+		}
+
+		if len(hop.Ingress) > 0 || len(hop.Egress) > 0 || len(members) > 0 {
+			path.Hops = append(path.Hops, hop)
+		}
+	}
+	return path
+}
+
+// sharedTree reports whether a route source stands for any sender
+func sharedTree(source string) bool {
+	return source == "" || source == "*" || source == "0.0.0.0"
+}
+
+// sourceMatches keeps the routes of the stream's sender, and every route
+// when the stream names none
+func sourceMatches(want, source string) bool {
+	return want == "" || sharedTree(source) || strings.EqualFold(want, source)
+}
+
+func (f *Fabric) port(switchName, iface, vlan string, egress bool) PathPort {
+	port := PathPort{Interface: iface, VLAN: vlan}
+	state, ok := f.interfaces.Interface(switchName, iface)
+	if !ok {
+		return port
+	}
+	port.OperStatus = state.operStatus
+	port.SpeedBps = state.speed
+	if egress {
+		port.QueueDropsPerSec = state.dropRate
+		if state.speed > 0 {
+			utilization := state.txRate / state.speed * 100
+			port.UtilizationPercent = &utilization
+		}
+	}
+	return port
+}
+
+// Run publishes the path metrics of every stream until ctx is cancelled
+func (f *Fabric) Run(ctx context.Context) {
+	ticker := time.NewTicker(pathPublishInterval)
+	defer ticker.Stop()
+
+	for {
+		f.publish()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish sets the metrics of the current paths and port reservations and
+// removes the series of ports that left them
+func (f *Fabric) publish() {
+	current := make(map[*prometheus.GaugeVec]map[string][]string)
+	set := func(vec *prometheus.GaugeVec, value float64, labels ...string) {
+		if current[vec] == nil {
+			current[vec] = make(map[string][]string)
+		}
+		current[vec][strings.Join(labels, "\xff")] = labels
+		vec.WithLabelValues(labels...).Set(value)
+	}
+
+	paths := make([]StreamPath, 0, len(f.streams))
+	for _, stream := range f.streams {
+		path := f.Path(stream)
+		paths = append(paths, path)
+		set(f.pathSwitches, float64(len(path.Hops)), stream.StreamID)
+		for _, hop := range path.Hops {
+			for _, port := range hop.Ingress {
+				if port.OperStatus != "" {
+					set(f.portUp, boolToFloat(port.OperStatus == "UP"), stream.StreamID, hop.Switch, port.Interface, "ingress")
+				}
+			}
+			for _, port := range hop.Egress {
+				if port.OperStatus != "" {
+					set(f.portUp, boolToFloat(port.OperStatus == "UP"), stream.StreamID, hop.Switch, port.Interface, "egress")
+				}
+				if port.UtilizationPercent != nil {
+					set(f.utilization, *port.UtilizationPercent, stream.StreamID, hop.Switch, port.Interface)
+				}
+				set(f.queueDrops, port.QueueDropsPerSec, stream.StreamID, hop.Switch, port.Interface)
+			}
+		}
+	}
+
+	reservations := f.reservations(paths)
+	for _, r := range reservations {
+		set(f.committed, r.CommittedBps, r.Switch, r.Interface, r.Direction)
+		if r.HeadroomPercent != nil {
+			set(f.headroom, *r.HeadroomPercent, r.Switch, r.Interface, r.Direction)
+			set(f.overLimit, boolToFloat(r.Oversubscribed), r.Switch, r.Interface, r.Direction)
+		}
+	}
+	f.warnOversubscribed(reservations)
+	f.warnUnfit(paths)
+
+	for vec, series := range f.published {
+		for key, labels := range series {
+			if _, ok := current[vec][key]; !ok {
+				vec.DeleteLabelValues(labels...)
+			}
+		}
+	}
+	f.published = current
+}
+
+// ServeHTTP returns the path of the stream named by stream_id, or of every
+// stream without it, as JSON
+func (f *Fabric) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	streamID := r.URL.Query().Get("stream_id")
+
+	var result interface{}
+	if streamID == "" {
+		paths := make([]StreamPath, 0, len(f.streams))
+		for _, stream := range f.streams {
+			paths = append(paths, f.Path(stream))
+		}
+		result = paths
+	} else {
+		for _, stream := range f.streams {
+			if stream.StreamID == streamID {
+				result = f.Path(stream)
+				break
+			}
+		}
+		if result == nil {
+			http.Error(w, "unknown stream_id "+streamID, http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cisco-ie/nx-telemetry-proto/telemetry_bis"
+	"github.com/golang/protobuf/proto"
+	"github.com/gosnmp/gosnmp"
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeTarget is an in-memory gNMI target on a loopback port: it answers
+// Capabilities and Get from canned data, replays a script of notifications
+// to every STREAM subscription followed by a sync response, and lets a test
+// push more responses, refuse paths and drop the stream
+type fakeTarget struct {
+	gnmi.UnimplementedGNMIServer
+
+	addr   string
+	server *grpc.Server
+
+	mu           sync.Mutex
+	capabilities *gnmi.CapabilityResponse
+	get          map[string][]*gnmi.Notification  // PathString -> reply
+	script       []*gnmi.Notification             // Replayed at the start of every stream
+	unsupported  map[string]bool                  // Paths whose subscription is refused
+	refusedModes map[string]gnmi.SubscriptionMode // Paths refused in one subscription mode
+	subscribed   []*gnmi.SubscriptionList         // STREAM requests received
+	streams      int
+
+	push       chan *gnmi.SubscribeResponse
+	disconnect chan struct{}
+}
+
+func newFakeTarget(t *testing.T, opts ...grpc.ServerOption) *fakeTarget {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeTarget{
+		addr:   listener.Addr().String(),
+		server: grpc.NewServer(opts...),
+		capabilities: &gnmi.CapabilityResponse{
+			SupportedModels: []*gnmi.ModelData{
+				{Name: "openconfig-interfaces", Organization: "OpenConfig working group", Version: "3.0.0"},
+				{Name: "openconfig-platform", Organization: "OpenConfig working group", Version: "0.23.0"},
+			},
+			SupportedEncodings: []gnmi.Encoding{gnmi.Encoding_JSON, gnmi.Encoding_JSON_IETF},
+			GNMIVersion:        "0.7.0",
+		},
+		get:          make(map[string][]*gnmi.Notification),
+		unsupported:  make(map[string]bool),
+		refusedModes: make(map[string]gnmi.SubscriptionMode),
+		push:         make(chan *gnmi.SubscribeResponse, 16),
+		disconnect:   make(chan struct{}, 1),
+	}
+	gnmi.RegisterGNMIServer(f.server, f)
+	go f.server.Serve(listener)
+	t.Cleanup(f.server.Stop)
+	return f
+}
+
+// switchConfig points a collector at the target over plaintext
+func (f *fakeTarget) switchConfig(name, vendor string) SwitchConfig {
+	return SwitchConfig{Name: name, Target: f.addr, Username: "test", Password: "test", Vendor: vendor,
+		TLS: TLSConfig{Plaintext: true}}
+}
+
+func (f *fakeTarget) setCapabilities(capabilities *gnmi.CapabilityResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.capabilities = capabilities
+}
+
+func (f *fakeTarget) setScript(notifications ...*gnmi.Notification) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = notifications
+}
+
+func (f *fakeTarget) setGet(path string, notifications ...*gnmi.Notification) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get[path] = notifications
+}
+
+func (f *fakeTarget) refuse(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unsupported[path] = true
+}
+
+// refuseMode refuses the path in one subscription mode only, as switches
+// that can't stream a leaf ON_CHANGE do
+func (f *fakeTarget) refuseMode(path string, mode gnmi.SubscriptionMode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refusedModes[path] = mode
+}
+
+// send pushes a notification to the current stream
+func (f *fakeTarget) send(notification *gnmi.Notification) {
+	f.push <- &gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: notification}}
+}
+
+// drop ends the current stream as a switch reboot would
+func (f *fakeTarget) drop() {
+	f.disconnect <- struct{}{}
+}
+
+func (f *fakeTarget) streamCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams
+}
+
+func (f *fakeTarget) lastSubscription() *gnmi.SubscriptionList {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subscribed) == 0 {
+		return nil
+	}
+	return f.subscribed[len(f.subscribed)-1]
+}
+
+func (f *fakeTarget) Capabilities(ctx context.Context, req *gnmi.CapabilityRequest) (*gnmi.CapabilityResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.capabilities == nil {
+		return nil, status.Error(codes.Unimplemented, "capabilities not supported")
+	}
+	return f.capabilities, nil
+}
+
+func (f *fakeTarget) Get(ctx context.Context, req *gnmi.GetRequest) (*gnmi.GetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &gnmi.GetResponse{}
+	for _, path := range req.GetPath() {
+		notifications, ok := f.get[PathString(path)]
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "%s not found", PathString(path))
+		}
+		resp.Notification = append(resp.Notification, notifications...)
+	}
+	return resp, nil
+}
+
+func (f *fakeTarget) Subscribe(stream gnmi.GNMI_SubscribeServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	list := req.GetSubscribe()
+	if list == nil {
+		return status.Error(codes.InvalidArgument, "first request must be a subscription list")
+	}
+
+	f.mu.Lock()
+	for _, subscription := range list.GetSubscription() {
+		if f.unsupported[PathString(subscription.GetPath())] {
+			f.mu.Unlock()
+			return status.Errorf(codes.InvalidArgument, "unsupported path %s", PathString(subscription.GetPath()))
+		}
+		if mode, ok := f.refusedModes[PathString(subscription.GetPath())]; ok && subscription.GetMode() == mode {
+			f.mu.Unlock()
+			return status.Errorf(codes.InvalidArgument, "%s not supported for %s", mode, PathString(subscription.GetPath()))
+		}
+	}
+	if list.GetMode() == gnmi.SubscriptionList_ONCE {
+		f.mu.Unlock()
+		return stream.Send(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_SyncResponse{SyncResponse: true}})
+	}
+	if list.GetUpdatesOnly() {
+		// A probe: nothing to replay, and pushes stay with the real stream
+		f.mu.Unlock()
+		if err := stream.Send(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_SyncResponse{SyncResponse: true}}); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	f.subscribed = append(f.subscribed, list)
+	f.streams++
+	script := f.script
+	f.mu.Unlock()
+
+	for _, notification := range script {
+		if err := stream.Send(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: notification}}); err != nil {
+			return err
+		}
+	}
+	if err := stream.Send(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_SyncResponse{SyncResponse: true}}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case resp := <-f.push:
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		case <-f.disconnect:
+			return status.Error(codes.Unavailable, "target rebooting")
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// notification builds a notification under a prefix path string
+func notification(prefix string, updates ...*gnmi.Update) *gnmi.Notification {
+	n := &gnmi.Notification{Timestamp: time.Now().UnixNano(), Update: updates}
+	if prefix != "" {
+		n.Prefix = mustParsePath(prefix)
+	}
+	return n
+}
+
+func uintUpdate(path string, v uint64) *gnmi.Update {
+	return &gnmi.Update{Path: mustParsePath(path), Val: &gnmi.TypedValue{Value: &gnmi.TypedValue_UintVal{UintVal: v}}}
+}
+
+func stringUpdate(path, v string) *gnmi.Update {
+	return &gnmi.Update{Path: mustParsePath(path), Val: &gnmi.TypedValue{Value: &gnmi.TypedValue_StringVal{StringVal: v}}}
+}
+
+func jsonUpdate(path, json string) *gnmi.Update {
+	return &gnmi.Update{Path: mustParsePath(path), Val: &gnmi.TypedValue{Value: &gnmi.TypedValue_JsonIetfVal{JsonIetfVal: []byte(json)}}}
+}
+
+func mustParsePath(s string) *gnmi.Path {
+	path, err := ParsePath(s)
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
+
+// Canned notifications
+
+// openconfigCounters is an interface counters container as EOS and Junos send it
+func openconfigCounters(iface string, inOctets, outOctets, inErrors uint64) *gnmi.Notification {
+	return notification("openconfig:/interfaces/interface[name="+iface+"]/state",
+		jsonUpdate("counters", fmt.Sprintf(
+			`{"openconfig-interfaces:in-octets":"%d","out-octets":"%d","in-errors":"%d","in-discards":"0","out-errors":"0","out-discards":"0"}`,
+			inOctets, outOctets, inErrors)))
+}
+
+func openconfigOperStatus(iface, status string) *gnmi.Notification {
+	return notification("/interfaces/interface[name="+iface+"]/state", stringUpdate("oper-status", status))
+}
+
+func openconfigPortSpeed(iface, speed string) *gnmi.Notification {
+	return notification("/interfaces/interface[name="+iface+"]/ethernet/state",
+		stringUpdate("port-speed", "openconfig-if-ethernet:"+speed))
+}
+
+// openconfigOpticLane is the DOM of one transceiver lane, decimals as JSON_IETF strings
+func openconfigOpticLane(component, lane, rxPower, txPower, bias string) *gnmi.Notification {
+	return notification("/components/component[name="+component+"]/transceiver/physical-channels/channel[index="+lane+"]",
+		jsonUpdate("state", fmt.Sprintf(
+			`{"input-power":{"instant":"%s"},"output-power":{"instant":"%s"},"laser-bias-current":{"instant":"%s"}}`,
+			rxPower, txPower, bias)))
+}
+
+func openconfigOpticThresholds(component, severity, rxLow, rxHigh string) *gnmi.Notification {
+	return notification("/components/component[name="+component+"]/transceiver/thresholds/threshold[severity=openconfig-alarm-types:"+severity+"]",
+		jsonUpdate("state", fmt.Sprintf(
+			`{"severity":"openconfig-alarm-types:%s","input-power-lower":"%s","input-power-upper":"%s","module-temperature-upper":"75.0"}`,
+			severity, rxLow, rxHigh)))
+}
+
+func openconfigTransceiverOf(iface, component string) *gnmi.Notification {
+	return notification("/interfaces/interface[name="+iface+"]/state", stringUpdate("transceiver", component))
+}
+
+func openconfigLLDPNeighbor(iface, id, systemName, portID, portDescription string) *gnmi.Notification {
+	return notification("/lldp/interfaces/interface[name="+iface+"]/neighbors/neighbor[id="+id+"]",
+		jsonUpdate("state", fmt.Sprintf(
+			`{"openconfig-lldp:system-name":"%s","chassis-id":"%s","port-id":"%s","port-description":"%s"}`,
+			systemName, id, portID, portDescription)))
+}
+
+// mdtGenericCounters is an IOS XR interface counters message in GPB-KV
+func mdtGenericCounters(t *testing.T, iface string, bytesReceived uint64) []byte {
+	t.Helper()
+	data, err := proto.Marshal(&telemetry_bis.Telemetry{
+		NodeId:       &telemetry_bis.Telemetry_NodeIdStr{NodeIdStr: "xr-router"},
+		EncodingPath: "Cisco-IOS-XR-infra-statsd-oper:infra-statistics/interfaces/interface/latest/generic-counters",
+		MsgTimestamp: uint64(time.Now().UnixMilli()),
+		DataGpbkv: []*telemetry_bis.TelemetryField{{
+			Fields: []*telemetry_bis.TelemetryField{
+				{Name: "keys", Fields: []*telemetry_bis.TelemetryField{
+					{Name: "interface-name", ValueByType: &telemetry_bis.TelemetryField_StringValue{StringValue: iface}},
+				}},
+				{Name: "content", Fields: []*telemetry_bis.TelemetryField{
+					{Name: "bytes-received", ValueByType: &telemetry_bis.TelemetryField_Uint64Value{Uint64Value: bytesReceived}},
+					{Name: "input-drops", ValueByType: &telemetry_bis.TelemetryField_Uint32Value{Uint32Value: 4}},
+				}},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// mdtRoute is a GPB-KV message of a sensor path whose row is keyed by group
+// and outgoing interface
+func mdtRoute(t *testing.T, encodingPath string, at time.Time, group, iface string) []byte {
+	t.Helper()
+	data, err := proto.Marshal(&telemetry_bis.Telemetry{
+		NodeId:       &telemetry_bis.Telemetry_NodeIdStr{NodeIdStr: "nexus"},
+		EncodingPath: encodingPath,
+		MsgTimestamp: uint64(at.UnixMilli()),
+		DataGpbkv: []*telemetry_bis.TelemetryField{{
+			Fields: []*telemetry_bis.TelemetryField{
+				{Name: "keys", Fields: []*telemetry_bis.TelemetryField{
+					{Name: "group", ValueByType: &telemetry_bis.TelemetryField_StringValue{StringValue: group}},
+					{Name: "interface", ValueByType: &telemetry_bis.TelemetryField_StringValue{StringValue: iface}},
+				}},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// routePlugin records every update keyed by group as a route out of its
+// interface, as a vendor plugin decoding a multicast sensor path would
+type routePlugin struct {
+	multicast *multicastTables
+}
+
+func (p *routePlugin) Name() string                        { return "routes" }
+func (p *routePlugin) Subscriptions() []*gnmi.Subscription { return nil }
+func (p *routePlugin) HandleDelete(string, *gnmi.Path)     {}
+func (p *routePlugin) HandleStreamStart(switchName string) { p.multicast.StartSync(switchName) }
+func (p *routePlugin) HandleSync(switchName string)        { p.multicast.Sweep(switchName) }
+func (p *routePlugin) multicastState() *multicastTables    { return p.multicast }
+
+func (p *routePlugin) HandleUpdate(switchName string, path *gnmi.Path, value *gnmi.TypedValue) {
+	if len(path.Elem) == 0 {
+		return
+	}
+	keys := path.Elem[len(path.Elem)-1].Key
+	if keys["group"] != "" {
+		p.multicast.UpdateRoute(switchName, "default", "*", keys["group"], "", keys["interface"])
+	}
+}
+
+func aristaQueueDrops(iface, queue string, drops uint64) *gnmi.Notification {
+	return notification("arista:/eos/arista-exp-eos-qos/qos/interfaces/interface[name="+iface+"]/queues/queue[queue-id="+queue+"]/state",
+		uintUpdate("dropped-pkts", drops))
+}
+
+func aristaPTPLock(status string) *gnmi.Notification {
+	return notification("arista:/eos/arista-exp-eos-ptp/ptp/instances/instance[instance-id=default]/state",
+		uintUpdate("domain-number", 127), stringUpdate("lock-status", status))
+}
+
+func aristaSnoopingVLAN(vlan, querier string) *gnmi.Notification {
+	return notification("arista:/eos/arista-exp-eos-igmpsnooping/igmp-snooping/vlans/vlan[vlan-id="+vlan+"]/state",
+		stringUpdate("querier-address", querier))
+}
+
+func aristaSnoopingMember(vlan, group, port string) *gnmi.Notification {
+	return notification("arista:/eos/arista-exp-eos-igmpsnooping/igmp-snooping/vlans/vlan[vlan-id="+vlan+"]/groups/group[address="+group+"]/interfaces/interface[name="+port+"]",
+		stringUpdate("state/name", port))
+}
+
+// aristaMroute is a route with its incoming interface and outgoing interface list
+func aristaMroute(source, group, incoming string, outgoing ...string) *gnmi.Notification {
+	route := "arista:/eos/arista-exp-eos-multicast/multicast/vrfs/vrf[name=default]/routes/route[group=" + group + "][source=" + source + "]"
+	updates := []*gnmi.Update{stringUpdate("state/incoming-interface", incoming)}
+	for _, iface := range outgoing {
+		updates = append(updates, stringUpdate("outgoing-interfaces/interface[name="+iface+"]/state/name", iface))
+	}
+	return notification(route, updates...)
+}
+
+// ciscoInterfaceCounters is a DME dbgIfIn-items container
+func ciscoInterfaceCounters(iface string, inOctets uint64) *gnmi.Notification {
+	return notification("/System/intf-items/phys-items/PhysIf-list[id="+iface+"]",
+		&gnmi.Update{Path: mustParsePath("dbgIfIn-items"), Val: &gnmi.TypedValue{Value: &gnmi.TypedValue_JsonVal{
+			JsonVal: []byte(fmt.Sprintf(`{"inOctets":"%d","inErrors":"0","inDiscards":"0"}`, inOctets))}}})
+}
+
+func ciscoQoSDrops(policy, class string, drops uint64) *gnmi.Notification {
+	return notification(
+		"/System/ipqos-items/queuing-items/policy-items/out-items/sys-items/pmap-items/Name-list[name="+policy+"]/cmap-items/Name-list[name="+class+"]",
+		&gnmi.Update{Path: mustParsePath("stats-items"), Val: &gnmi.TypedValue{Value: &gnmi.TypedValue_JsonVal{
+			JsonVal: []byte(fmt.Sprintf(`{"dropPkts":"%d"}`, drops))}}})
+}
+
+// aristaLANZ is a LANZ congestion record of an egress queue
+func aristaLANZ(iface, queue string, size, max uint64) *gnmi.Notification {
+	return notification("arista:/eos/arista-exp-eos-lanz/lanz/interfaces/interface[name="+iface+"]/queues/queue[queue-id="+queue+"]/state",
+		uintUpdate("queue-size", size), uintUpdate("max-queue-size", max), uintUpdate("queue-limit", 1000000))
+}
+
+func ciscoQueueBuffer(iface, qosGroup string, current, peak, ecnMarked uint64) *gnmi.Notification {
+	return notification("/System/intf-items/phys-items/PhysIf-list[id="+iface+"]/buffer-items/queue-items/Queue-list[qosGrp="+qosGroup+"]",
+		jsonUpdate("", fmt.Sprintf(`{"currOccupancy":"%d","peakOccupancy":"%d","queueLimit":"400000","ecnMarkedPkts":"%d"}`, current, peak, ecnMarked)))
+}
+
+// fakeAgent is an in-memory SNMP agent: a MIB of OID -> PDU that walks
+// return in OID order, and an error to fail the next polls with
+type fakeAgent struct {
+	mu  sync.Mutex
+	mib map[string]gosnmp.SnmpPDU
+	err error
+}
+
+func newFakeAgent() *fakeAgent {
+	return &fakeAgent{mib: make(map[string]gosnmp.SnmpPDU)}
+}
+
+func (a *fakeAgent) set(oid string, typ gosnmp.Asn1BER, value interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.mib[oid] = gosnmp.SnmpPDU{Name: "." + oid, Type: typ, Value: value}
+}
+
+func (a *fakeAgent) remove(oid string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.mib, oid)
+}
+
+func (a *fakeAgent) fail(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.err = err
+}
+
+func (a *fakeAgent) BulkWalkAll(root string) ([]gosnmp.SnmpPDU, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return nil, a.err
+	}
+	var pdus []gosnmp.SnmpPDU
+	for oid, pdu := range a.mib {
+		if strings.HasPrefix(oid, root+".") {
+			pdus = append(pdus, pdu)
+		}
+	}
+	sort.Slice(pdus, func(i, j int) bool { return pdus[i].Name < pdus[j].Name })
+	return pdus, nil
+}
+
+// collector connects an SNMP collector to the agent
+func (a *fakeAgent) collector(t *testing.T, sw SwitchConfig, metrics *MetricSet) *SNMPCollector {
+	t.Helper()
+	c, err := NewSNMPCollector(sw, metrics, NewSNMPMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.connect = func(context.Context) (snmpWalker, func(), error) { return a, func() {}, nil }
+	return c
+}
+
+// ifEntry populates the IF-MIB row of an interface
+func (a *fakeAgent) ifEntry(index int, name string, inOctets, outOctets uint64, inErrors uint) {
+	a.set(fmt.Sprintf("%s.%d", oidIfDescr, index), gosnmp.OctetString, []byte(name+" description"))
+	a.set(fmt.Sprintf("%s.%d", oidIfName, index), gosnmp.OctetString, []byte(name))
+	a.set(fmt.Sprintf("%s.%d", oidIfHCInOctets, index), gosnmp.Counter64, inOctets)
+	a.set(fmt.Sprintf("%s.%d", oidIfHCOutOctets, index), gosnmp.Counter64, outOctets)
+	a.set(fmt.Sprintf("%s.%d", oidIfInErrors, index), gosnmp.Counter32, inErrors)
+	a.set(fmt.Sprintf("%s.%d", oidIfOutErrors, index), gosnmp.Counter32, uint(0))
+	a.set(fmt.Sprintf("%s.%d", oidIfInDiscards, index), gosnmp.Counter32, uint(0))
+	a.set(fmt.Sprintf("%s.%d", oidIfOutDiscards, index), gosnmp.Counter32, uint(0))
+}
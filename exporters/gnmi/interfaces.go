@@ -0,0 +1,226 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+)
+
+// Sample interval of the interface paths the path correlation subscribes to
+// itself; gnmi_paths entries for the same paths keep their own interval
+const interfaceSampleInterval = 10 * time.Second
+
+// OpenConfig port speeds, e.g. openconfig-if-ethernet:SPEED_100GB
+var portSpeed = regexp.MustCompile(`SPEED_(\d+)(MB|GB)$`)
+
+// rateSample turns successive totals into a per-second rate
+type rateSample struct {
+	total float64
+	at    time.Time
+	rate  float64
+}
+
+// observe records a total; a total lower than the previous one (reboot,
+// cleared counters) restarts the rate
+func (r *rateSample) observe(total float64, now time.Time) {
+	if !r.at.IsZero() && total >= r.total && now.After(r.at) {
+		r.rate = (total - r.total) / now.Sub(r.at).Seconds()
+	}
+	r.total, r.at = total, now
+}
+
+// interfaceState is what the path correlation needs of a switch interface
+type interfaceState struct {
+	operStatus string                 // UP, DOWN, ... ("" until reported)
+	speed      float64                // bits/s, 0 when unknown
+	octets     rateSample             // out-octets
+	drops      map[string]*rateSample // Queue drops per queue, output discards under ""
+}
+
+// interfaceView is a copy of an interface's state
+type interfaceView struct {
+	operStatus string
+	speed      float64 // bits/s
+	txRate     float64 // bits/s
+	dropRate   float64 // Packets/s
+}
+
+// interfaceTable keeps the oper status, speed and egress rates of every
+// switch interface from the OpenConfig interface and QoS models
+type interfaceTable struct {
+	*pathPlugin
+
+	mu       sync.Mutex
+	switches map[string]map[string]*interfaceState
+	now      func() time.Time
+}
+
+func newInterfaceTable(metrics *MetricSet) (*interfaceTable, error) {
+	t := &interfaceTable{
+		switches: make(map[string]map[string]*interfaceState),
+		now:      time.Now,
+	}
+
+	var err error
+	t.pathPlugin, err = newPathPlugin("interfaces", []vendorPath{
+		{
+			name:         "interface_status",
+			config:       PathConfig{Path: "/interfaces/interface[name=*]/state/oper-status", Mode: "on_change"},
+			handle:       t.handleStatus,
+			handleDelete: t.deleteInterface,
+		},
+		{
+			name:   "interface_speed",
+			config: PathConfig{Path: "/interfaces/interface[name=*]/ethernet/state/port-speed", Mode: "on_change"},
+			handle: t.handleSpeed,
+		},
+		{
+			name:   "interface_counters",
+			config: PathConfig{Path: "/interfaces/interface[name=*]/state/counters", Interval: interfaceSampleInterval},
+			handle: t.handleCounters,
+		},
+		{
+			name:   "qos_queues",
+			config: PathConfig{Path: "/qos/interfaces/interface[name=*]/output/queues/queue[name=*]/state", Interval: interfaceSampleInterval},
+			handle: t.handleQueue,
+		},
+	}, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// update runs fn on the state of the interface named in elems
+func (t *interfaceTable) update(switchName string, elems []*gnmi.PathElem, fn func(state *interfaceState)) {
+	name := keyValue(elems, "interface", "name")
+	if name == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	interfaces, ok := t.switches[switchName]
+	if !ok {
+		interfaces = make(map[string]*interfaceState)
+		t.switches[switchName] = interfaces
+	}
+	state, ok := interfaces[name]
+	if !ok {
+		state = &interfaceState{drops: make(map[string]*rateSample)}
+		interfaces[name] = state
+	}
+	fn(state)
+}
+
+func (t *interfaceTable) handleStatus(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	if status, ok := leaves["oper-status"].(string); ok {
+		t.update(switchName, elems, func(state *interfaceState) {
+			state.operStatus = strings.ToUpper(status)
+		})
+	}
+}
+
+func (t *interfaceTable) handleSpeed(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	speed, ok := leaves["port-speed"].(string)
+	if !ok {
+		return
+	}
+	t.update(switchName, elems, func(state *interfaceState) {
+		state.speed = parsePortSpeed(speed)
+	})
+}
+
+// parsePortSpeed converts an OpenConfig port speed to bits/s, 0 if unknown
+func parsePortSpeed(speed string) float64 {
+	m := portSpeed.FindStringSubmatch(speed)
+	if m == nil {
+		return 0
+	}
+	v, _ := strconv.ParseFloat(m[1], 64)
+	if m[2] == "GB" {
+		return v * 1e9
+	}
+	return v * 1e6
+}
+
+func (t *interfaceTable) handleCounters(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	values := leafValues(leaves)
+	octets, haveOctets := values["out-octets"]
+	discards, haveDiscards := values["out-discards"]
+	if !haveOctets && !haveDiscards {
+		return
+	}
+	now := t.now()
+	t.update(switchName, elems, func(state *interfaceState) {
+		if haveOctets {
+			state.octets.observe(octets, now)
+		}
+		if haveDiscards {
+			state.dropSample("").observe(discards, now)
+		}
+	})
+}
+
+func (t *interfaceTable) handleQueue(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	drops, ok := numericValue(leaves["dropped-pkts"])
+	queue := keyValue(elems, "queue", "name")
+	if !ok || queue == "" {
+		return
+	}
+	now := t.now()
+	t.update(switchName, elems, func(state *interfaceState) {
+		state.dropSample(queue).observe(drops, now)
+	})
+}
+
+func (s *interfaceState) dropSample(queue string) *rateSample {
+	sample, ok := s.drops[queue]
+	if !ok {
+		sample = &rateSample{}
+		s.drops[queue] = sample
+	}
+	return sample
+}
+
+// deleteInterface forgets an interface the switch removed
+func (t *interfaceTable) deleteInterface(switchName string, elems []*gnmi.PathElem, leaf string) {
+	name := keyValue(elems, "interface", "name")
+	if leaf != "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if name == "" {
+		delete(t.switches, switchName)
+	} else {
+		delete(t.switches[switchName], name)
+	}
+}
+
+// Interface returns a copy of an interface's state
+func (t *interfaceTable) Interface(switchName, name string) (interfaceView, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.switches[switchName][name]
+	if !ok {
+		return interfaceView{}, false
+	}
+	view := interfaceView{
+		operStatus: state.operStatus,
+		speed:      state.speed,
+		txRate:     state.octets.rate * 8,
+	}
+	for _, sample := range state.drops {
+		view.dropRate += sample.rate
+	}
+	return view, true
+}
@@ -2,398 +2,452 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/openconfig/gnmi/proto/gnmi"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"gopkg.in/yaml.v2"
 )
 
-type SwitchConfig struct {
-	Name     string `yaml:"name"`
-	Target   string `yaml:"target"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	Vendor   string `yaml:"vendor"`
-}
-
-type Config struct {
-	Switches []SwitchConfig `yaml:"switches"`
-}
-
 type GNMICollector struct {
-	target   string
-	username string
-	password string
-
-	// Prometheus metrics
-	interfaceRxBytes  *prometheus.GaugeVec
-	interfaceTxBytes  *prometheus.GaugeVec
-	interfaceRxErrors *prometheus.GaugeVec
-	interfaceTxErrors *prometheus.GaugeVec
-	interfaceRxDrops  *prometheus.GaugeVec
-	interfaceTxDrops  *prometheus.GaugeVec
-	qosBufferUtil     *prometheus.GaugeVec
-	qosDroppedPackets *prometheus.GaugeVec
-	multicastGroups   *prometheus.GaugeVec
+	name   string
+	target string
+	config SwitchConfig
+
+	// Subscribed paths and their metric mappings
+	paths []*pathSpec
+	// Vendor-specific subscriptions and parsers (nil for generic only)
+	vendor VendorPlugin
+
+	// Session supervision
+	health         *SessionMetrics
+	stallIntervals int           // Sample intervals without updates before the stream is restarted
+	maxBackoff     time.Duration // Longest wait between reconnects
+	inventory      bool          // Get the switch inventory at connect time
+	synced         int32         // Sync response received on the current stream, accessed atomically
+	updates        uint64        // Updates received, accessed atomically
+
+	// Sessions opened by the switch: several at a time and none replaying
+	// the whole state, so no stream brackets what plugins may sweep
+	dialout bool
 }
 
-func NewGNMICollector(target, username, password string) *GNMICollector {
-	collector := &GNMICollector{
-		target:   target,
-		username: username,
-		password: password,
-
-		interfaceRxBytes: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "st2110_switch_interface_rx_bytes",
-				Help: "Received bytes on switch interface",
-			},
-			[]string{"switch", "interface"},
-		),
-
-		interfaceTxBytes: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "st2110_switch_interface_tx_bytes",
-				Help: "Transmitted bytes on switch interface",
-			},
-			[]string{"switch", "interface"},
-		),
-
-		interfaceRxErrors: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "st2110_switch_interface_rx_errors",
-				Help: "Receive errors on switch interface",
-			},
-			[]string{"switch", "interface"},
-		),
-
-		interfaceTxErrors: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "st2110_switch_interface_tx_errors",
-				Help: "Transmit errors on switch interface",
-			},
-			[]string{"switch", "interface"},
-		),
-
-		interfaceRxDrops: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "st2110_switch_interface_rx_drops",
-				Help: "Dropped received packets on switch interface",
-			},
-			[]string{"switch", "interface"},
-		),
-
-		interfaceTxDrops: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "st2110_switch_interface_tx_drops",
-				Help: "Dropped transmitted packets on switch interface",
-			},
-			[]string{"switch", "interface"},
-		),
-
-		qosBufferUtil: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "st2110_switch_qos_buffer_utilization",
-				Help: "QoS buffer utilization percentage",
-			},
-			[]string{"switch", "interface", "queue"},
-		),
-
-		qosDroppedPackets: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "st2110_switch_qos_dropped_packets",
-				Help: "Packets dropped due to QoS",
-			},
-			[]string{"switch", "interface", "queue"},
-		),
-
-		multicastGroups: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "st2110_switch_multicast_groups",
-				Help: "Number of IGMP multicast groups",
-			},
-			[]string{"switch", "interface"},
-		),
-	}
-
-	// Register metrics
-	prometheus.MustRegister(collector.interfaceRxBytes)
-	prometheus.MustRegister(collector.interfaceTxBytes)
-	prometheus.MustRegister(collector.interfaceRxErrors)
-	prometheus.MustRegister(collector.interfaceTxErrors)
-	prometheus.MustRegister(collector.interfaceRxDrops)
-	prometheus.MustRegister(collector.interfaceTxDrops)
-	prometheus.MustRegister(collector.qosBufferUtil)
-	prometheus.MustRegister(collector.qosDroppedPackets)
-	prometheus.MustRegister(collector.multicastGroups)
-
-	return collector
-}
-
-func (c *GNMICollector) Connect() (gnmi.GNMIClient, error) {
-	// TLS configuration (skip verification for lab, use proper certs in production!)
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true, // ⚠️ Use proper certificates in production
+func NewGNMICollector(sw SwitchConfig, paths []*pathSpec, vendor VendorPlugin, health *SessionMetrics, opts SessionOptions) *GNMICollector {
+	return &GNMICollector{
+		name:           sw.Name,
+		target:         sw.Target,
+		config:         sw,
+		paths:          paths,
+		vendor:         vendor,
+		health:         health,
+		stallIntervals: opts.StallIntervals,
+		maxBackoff:     opts.MaxBackoff,
+		inventory:      opts.Inventory,
 	}
+}
 
+func (c *GNMICollector) Connect(ctx context.Context) (*grpc.ClientConn, error) {
 	// gRPC connection options
-	opts := []grpc.DialOption{
-		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
-		grpc.WithPerRPCCredentials(&loginCreds{
-			Username: c.username,
-			Password: c.password,
-		}),
-		grpc.WithBlock(),
-		grpc.WithTimeout(10 * time.Second),
+	opts, err := transportOptions(c.config)
+	if err != nil {
+		return nil, fmt.Errorf("transport for %s: %w", c.target, err)
 	}
+	opts = append(opts, grpc.WithBlock())
 
 	// Connect to gNMI target
-	conn, err := grpc.Dial(c.target, opts...)
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, c.target, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to %s: %w", c.target, err)
 	}
 
-	client := gnmi.NewGNMIClient(conn)
 	log.Printf("Connected to gNMI target: %s", c.target)
 
-	return client, nil
+	return conn, nil
 }
 
+// Subscribe discovers the target and runs one subscription stream until it
+// fails, stalls or ctx is cancelled; paths the target refuses are skipped
 func (c *GNMICollector) Subscribe(ctx context.Context) error {
-	client, err := c.Connect()
+	atomic.StoreInt32(&c.synced, 0)
+	conn, err := c.Connect(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
+	client := gnmi.NewGNMIClient(conn)
+
+	info := c.discover(ctx, client)
+	c.publishInfo(info)
 
-	// Create subscription request
+	subscriptions := c.subscriptions()
+	for _, subscription := range subscriptions {
+		c.health.subscriptionActive.WithLabelValues(c.name, c.target, PathString(subscription.Path)).Set(1)
+	}
+	for {
+		received, err := c.stream(ctx, client, subscriptions, info.encoding)
+		if received || !rejected(err) || ctx.Err() != nil {
+			return err
+		}
+		// Refused outright: find the paths the target does not support
+		supported := c.probe(ctx, client, subscriptions, info.encoding)
+		if len(supported) == 0 || len(supported) == len(subscriptions) {
+			return err
+		}
+		subscriptions = supported
+	}
+}
+
+// subscriptions are the configured and vendor paths, subscribing once to
+// paths both ask for
+func (c *GNMICollector) subscriptions() []*gnmi.Subscription {
+	subscriptions := make([]*gnmi.Subscription, 0, len(c.paths))
+	subscribed := make(map[string]bool)
+	add := func(subscription *gnmi.Subscription) {
+		if key := PathString(subscription.Path); !subscribed[key] {
+			subscribed[key] = true
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	for _, spec := range c.paths {
+		add(spec.subscription)
+	}
+	if c.vendor != nil {
+		for _, subscription := range c.vendor.Subscriptions() {
+			add(subscription)
+		}
+	}
+	return subscriptions
+}
+
+// stream runs one subscription stream; received reports whether the target
+// sent anything before the stream ended
+func (c *GNMICollector) stream(ctx context.Context, client gnmi.GNMIClient, subscriptions []*gnmi.Subscription, encoding gnmi.Encoding) (received bool, err error) {
 	subscribeReq := &gnmi.SubscribeRequest{
 		Request: &gnmi.SubscribeRequest_Subscribe{
 			Subscribe: &gnmi.SubscriptionList{
-				Mode: gnmi.SubscriptionList_STREAM,
-				Subscription: []*gnmi.Subscription{
-					// Interface counters
-					{
-						Path: &gnmi.Path{
-							Elem: []*gnmi.PathElem{
-								{Name: "interfaces"},
-								{Name: "interface", Key: map[string]string{"name": "*"}},
-								{Name: "state"},
-								{Name: "counters"},
-							},
-						},
-						Mode:           gnmi.SubscriptionMode_SAMPLE,
-						SampleInterval: 1000000000, // 1 second in nanoseconds
-					},
-					// QoS queue statistics
-					{
-						Path: &gnmi.Path{
-							Elem: []*gnmi.PathElem{
-								{Name: "qos"},
-								{Name: "interfaces"},
-								{Name: "interface", Key: map[string]string{"name": "*"}},
-								{Name: "output"},
-								{Name: "queues"},
-								{Name: "queue", Key: map[string]string{"name": "*"}},
-								{Name: "state"},
-							},
-						},
-						Mode:           gnmi.SubscriptionMode_SAMPLE,
-						SampleInterval: 1000000000, // 1 second
-					},
-				},
-				Encoding: gnmi.Encoding_JSON_IETF,
+				Mode:         gnmi.SubscriptionList_STREAM,
+				Subscription: subscriptions,
+				Encoding:     encoding,
 			},
 		},
 	}
 
 	// Start subscription stream
-	stream, err := client.Subscribe(ctx)
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.Subscribe(streamCtx)
 	if err != nil {
-		return fmt.Errorf("failed to subscribe: %w", err)
+		return false, fmt.Errorf("failed to subscribe: %w", err)
 	}
 
 	// Send subscription request
 	if err := stream.Send(subscribeReq); err != nil {
-		return fmt.Errorf("failed to send subscription: %w", err)
+		return false, fmt.Errorf("failed to send subscription: %w", err)
 	}
 
-	log.Println("Started gNMI subscription stream")
+	log.Printf("Started gNMI subscription stream to %s (%d paths)", c.target, len(subscriptions))
+	c.setState(sessionConnected)
+	if c.vendor != nil {
+		c.vendor.HandleStreamStart(c.name)
+	}
+
+	// Restart the stream when nothing arrives for stallIntervals sample intervals
+	var stalled int32
+	var watchdog *time.Timer
+	stallTimeout := time.Duration(c.stallIntervals) * minSampleInterval(subscriptions)
+	if stallTimeout > 0 {
+		watchdog = time.AfterFunc(stallTimeout, func() {
+			atomic.StoreInt32(&stalled, 1)
+			cancel()
+		})
+		defer watchdog.Stop()
+	}
 
 	// Receive updates
 	for {
 		response, err := stream.Recv()
 		if err != nil {
-			return fmt.Errorf("stream error: %w", err)
+			if atomic.LoadInt32(&stalled) == 1 {
+				return received, fmt.Errorf("%w: no updates within %v", errStalled, stallTimeout)
+			}
+			return received, fmt.Errorf("stream error: %w", err)
+		}
+		received = true
+		if watchdog != nil {
+			watchdog.Reset(stallTimeout)
 		}
 
 		c.handleUpdate(response)
 	}
 }
 
+// minSampleInterval is the shortest SAMPLE interval, 0 if every path is on change
+func minSampleInterval(subscriptions []*gnmi.Subscription) time.Duration {
+	var min time.Duration
+	for _, s := range subscriptions {
+		interval := time.Duration(s.SampleInterval)
+		if s.Mode == gnmi.SubscriptionMode_SAMPLE && interval > 0 && (min == 0 || interval < min) {
+			min = interval
+		}
+	}
+	return min
+}
+
 func (c *GNMICollector) handleUpdate(response *gnmi.SubscribeResponse) {
+	c.health.lastUpdate.WithLabelValues(c.name, c.target).SetToCurrentTime()
+
 	switch resp := response.Response.(type) {
 	case *gnmi.SubscribeResponse_Update:
 		notification := resp.Update
+		atomic.AddUint64(&c.updates, uint64(len(notification.Update)+len(notification.Delete)))
 
-		// Extract switch name from prefix
-		switchName := c.target
+		// Deletes of a notification apply before its updates
+		for _, deleted := range notification.Delete {
+			path := joinPath(notification.Prefix, deleted)
+			for _, spec := range c.paths {
+				spec.remove(c.name, path)
+			}
+			if c.vendor != nil {
+				c.vendor.HandleDelete(c.name, path)
+			}
+		}
 
 		for _, update := range notification.Update {
-			path := update.Path
-			value := update.Val
-
-			// Parse interface counters
-			if len(path.Elem) >= 4 && path.Elem[0].Name == "interfaces" {
-				ifaceName := path.Elem[1].Key["name"]
-
-				if path.Elem[2].Name == "state" && path.Elem[3].Name == "counters" {
-					// Parse counter values from JSON
-					if jsonVal := value.GetJsonIetfVal(); jsonVal != nil {
-						counters := parseCounters(jsonVal)
-						c.interfaceRxBytes.WithLabelValues(switchName, ifaceName).Set(float64(counters.InOctets))
-						c.interfaceTxBytes.WithLabelValues(switchName, ifaceName).Set(float64(counters.OutOctets))
-						c.interfaceRxErrors.WithLabelValues(switchName, ifaceName).Set(float64(counters.InErrors))
-						c.interfaceTxErrors.WithLabelValues(switchName, ifaceName).Set(float64(counters.OutErrors))
-						c.interfaceRxDrops.WithLabelValues(switchName, ifaceName).Set(float64(counters.InDiscards))
-						c.interfaceTxDrops.WithLabelValues(switchName, ifaceName).Set(float64(counters.OutDiscards))
-					}
-				}
+			path := joinPath(notification.Prefix, update.Path)
+			for _, spec := range c.paths {
+				spec.apply(c.name, path, update.Val)
 			}
-
-			// Parse QoS queue statistics
-			if len(path.Elem) >= 7 && path.Elem[0].Name == "qos" {
-				ifaceName := path.Elem[2].Key["name"]
-				queueName := path.Elem[5].Key["name"]
-
-				if jsonVal := value.GetJsonIetfVal(); jsonVal != nil {
-					qos := parseQoSStats(jsonVal)
-					c.qosBufferUtil.WithLabelValues(switchName, ifaceName, queueName).Set(qos.BufferUtilization)
-					c.qosDroppedPackets.WithLabelValues(switchName, ifaceName, queueName).Set(float64(qos.DroppedPackets))
-				}
+			if c.vendor != nil {
+				c.vendor.HandleUpdate(c.name, path, update.Val)
 			}
 		}
 
 	case *gnmi.SubscribeResponse_SyncResponse:
-		log.Println("Received sync response (initial sync complete)")
+		// Sent again after every reconnect once the target has replayed its state
+		log.Printf("Received sync response from %s (initial sync complete)", c.name)
+		atomic.StoreInt32(&c.synced, 1)
+		c.health.synced.WithLabelValues(c.name, c.target).Set(1)
+		if c.vendor != nil && !c.dialout {
+			c.vendor.HandleSync(c.name)
+		}
 	}
 }
 
-// Helper structures
-type InterfaceCounters struct {
-	InOctets    uint64
-	OutOctets   uint64
-	InErrors    uint64
-	OutErrors   uint64
-	InDiscards  uint64
-	OutDiscards uint64
-}
+func main() {
+	configFile := flag.String("config", "/etc/st2110/switches.yaml", "Path to switches configuration")
+	listenAddr := flag.String("listen", ":9273", "Prometheus exporter listen address")
+	stallIntervals := flag.Int("stall-intervals", 3, "Restart a stream after this many sample intervals without updates (0 disables)")
+	maxBackoff := flag.Duration("max-backoff", time.Minute, "Longest wait between reconnects to a switch")
+	allowInsecure := flag.Bool("allow-insecure", false, "Permit switches configured with plaintext or insecure_skip_verify (labs only)")
+	inventory := flag.Bool("inventory", true, "Get hostname, software version, chassis and line cards at connect time")
+	optics := flag.Bool("optics", true, "Collect transceiver DOM, thresholds and PHY error counters from the OpenConfig models")
+	streamsFile := flag.String("streams", "/etc/st2110/streams.yaml", "Stream definitions for path correlation (skipped if missing)")
+	topology := flag.Bool("topology", true, "Discover the fabric topology from the LLDP neighbors of every switch")
+	reservationLimit := flag.Float64("reservation-limit", defaultReservationLimit, "Percentage of a port's speed the streams of streams.yaml may reserve before it counts as oversubscribed")
+	flag.Parse()
 
-type QoSStats struct {
-	BufferUtilization float64
-	DroppedPackets    uint64
-}
+	// Override with environment variables if set
+	if envConfig := os.Getenv("CONFIG_FILE"); envConfig != "" {
+		*configFile = envConfig
+	}
+	if envListen := os.Getenv("LISTEN_ADDR"); envListen != "" {
+		*listenAddr = envListen
+	}
+	if envInsecure := os.Getenv("GNMI_ALLOW_INSECURE"); envInsecure == "true" {
+		*allowInsecure = true
+	}
+	if envStreams := os.Getenv("STREAMS_FILE"); envStreams != "" {
+		*streamsFile = envStreams
+	}
+
+	if *reservationLimit <= 0 {
+		log.Fatalf("-reservation-limit must be a positive percentage, got %v", *reservationLimit)
+	}
 
-func parseCounters(jsonData []byte) InterfaceCounters {
-	// Parse JSON to extract counters
-	// Implementation depends on your switch's YANG model
-	var counters InterfaceCounters
-	var data map[string]interface{}
-	if err := json.Unmarshal(jsonData, &data); err == nil {
-		// Extract counter values (implementation depends on YANG model structure)
-		// This is a placeholder - adapt to your switch's JSON structure
-		if inOctets, ok := data["in-octets"].(float64); ok {
-			counters.InOctets = uint64(inOctets)
+	// Load configuration
+	config, err := LoadConfig(*configFile, *allowInsecure)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// Subscriptions, metric mappings and plugin per vendor
+	metrics := NewMetricSet()
+	vendorPaths := make(map[string][]*pathSpec)
+	plugins := make(map[string]VendorPlugin)
+	for _, sw := range config.Switches {
+		if _, ok := vendorPaths[sw.Vendor]; ok || sw.Protocol == protocolSNMP {
+			continue
 		}
-		if outOctets, ok := data["out-octets"].(float64); ok {
-			counters.OutOctets = uint64(outOctets)
+		plugin, err := NewVendorPlugin(sw.Vendor, metrics)
+		if err != nil {
+			log.Fatalf("Failed to load vendor plugin: %v", err)
 		}
-	}
-	return counters
-}
+		if plugin == nil {
+			log.Printf("⚠️  No vendor plugin for %q, collecting the generic paths only", sw.Vendor)
+		}
+		plugins[sw.Vendor] = plugin
 
-func parseQoSStats(jsonData []byte) QoSStats {
-	// Parse QoS statistics
-	var qos QoSStats
-	var data map[string]interface{}
-	if err := json.Unmarshal(jsonData, &data); err == nil {
-		// Extract QoS values (implementation depends on YANG model structure)
-		if util, ok := data["buffer-utilization"].(float64); ok {
-			qos.BufferUtilization = util
+		paths, ok := config.GNMIPaths[sw.Vendor]
+		if !ok {
+			paths = defaultPaths
 		}
-		if drops, ok := data["dropped-packets"].(float64); ok {
-			qos.DroppedPackets = uint64(drops)
+		specs, err := compilePaths(paths, metrics)
+		if err != nil {
+			log.Fatalf("Invalid gnmi_paths for %s: %v", sw.Vendor, err)
 		}
+		vendorPaths[sw.Vendor] = specs
 	}
-	return qos
-}
-
-// gRPC credentials helper
-type loginCreds struct {
-	Username string
-	Password string
-}
-
-func (c *loginCreds) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
-	return map[string]string{
-		"username": c.Username,
-		"password": c.Password,
-	}, nil
-}
 
-func (c *loginCreds) RequireTransportSecurity() bool {
-	return true
-}
+	// Transceiver and PHY telemetry for every switch
+	var opticsPlugin VendorPlugin
+	if *optics {
+		table, err := newOpticsTable(metrics)
+		if err != nil {
+			log.Fatalf("Failed to set up optics collection: %v", err)
+		}
+		opticsPlugin = table
+	}
 
-func main() {
-	configFile := flag.String("config", "/etc/st2110/switches.yaml", "Path to switches configuration")
-	listenAddr := flag.String("listen", ":9273", "Prometheus exporter listen address")
-	flag.Parse()
+	// Stream path correlation over the multicast and interface state of every switch
+	streams, err := LoadStreams(*streamsFile)
+	correlate := true
+	switch {
+	case os.IsNotExist(err):
+		log.Printf("No stream definitions at %s, stream path correlation disabled", *streamsFile)
+		correlate = false
+	case err != nil:
+		log.Fatalf("Failed to load streams: %v", err)
+	}
 
-	// Load configuration
-	data, err := ioutil.ReadFile(*configFile)
-	if err != nil {
-		log.Fatalf("Failed to read config: %v", err)
+	// Interface state shared by stream paths and the topology
+	var interfaces *interfaceTable
+	var interfacesPlugin VendorPlugin
+	if correlate || *topology {
+		if interfaces, err = newInterfaceTable(metrics); err != nil {
+			log.Fatalf("Failed to set up interface state collection: %v", err)
+		}
+		interfacesPlugin = interfaces
 	}
 
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		log.Fatalf("Failed to parse config: %v", err)
+	var fabric *Fabric
+	if correlate {
+		fabric = NewFabric(streams, *reservationLimit, interfaces)
+		log.Printf("Correlating %d streams with switch forwarding state", len(streams))
 	}
 
-	// Expand password from environment if needed
-	for i := range config.Switches {
-		if config.Switches[i].Password == "${GNMI_PASSWORD}" {
-			config.Switches[i].Password = os.Getenv("GNMI_PASSWORD")
+	// Links between switches and hosts from LLDP
+	var topologyMap *topologyTable
+	var topologyPlugin VendorPlugin
+	if *topology {
+		if topologyMap, err = newTopologyTable(interfaces, metrics); err != nil {
+			log.Fatalf("Failed to set up topology discovery: %v", err)
 		}
+		topologyPlugin = topologyMap
 	}
 
-	// Start collectors for each switch
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Start a supervised session for each switch, or an SNMP poller for those without gNMI
+	health := NewSessionMetrics()
+	var snmpHealth *SNMPMetrics
+	var receiver *DialoutReceiver
+	if config.Dialout.Listen != "" {
+		receiver = NewDialoutReceiver(config.Dialout)
+	}
+	var wg sync.WaitGroup
 	for _, sw := range config.Switches {
-		collector := NewGNMICollector(sw.Target, sw.Username, sw.Password)
+		if sw.Protocol == protocolSNMP {
+			if snmpHealth == nil {
+				snmpHealth = NewSNMPMetrics()
+			}
+			poller, err := NewSNMPCollector(sw, metrics, snmpHealth)
+			if err != nil {
+				log.Fatalf("Failed to set up SNMP polling of %s: %v", sw.Name, err)
+			}
+			if topologyMap != nil {
+				topologyMap.AddSwitch(sw.Name)
+			}
+
+			wg.Add(1)
+			go func(p *SNMPCollector) {
+				defer wg.Done()
+				log.Printf("Starting SNMP poller for %s (%s)", p.name, p.target)
+				p.Run(ctx)
+			}(poller)
+			continue
+		}
+		if fabric != nil {
+			fabric.AddSwitch(sw.Name, plugins[sw.Vendor])
+		}
+		if topologyMap != nil {
+			topologyMap.AddSwitch(sw.Name)
+		}
+		collector := NewGNMICollector(sw, vendorPaths[sw.Vendor], chainPlugins(plugins[sw.Vendor], opticsPlugin, interfacesPlugin, topologyPlugin), health, SessionOptions{
+			StallIntervals: *stallIntervals,
+			MaxBackoff:     *maxBackoff,
+			Inventory:      *inventory,
+		})
+		if sw.Protocol == protocolDialout {
+			receiver.AddDevice(sw, collector)
+			continue
+		}
+
+		wg.Add(1)
+		go func(c *GNMICollector) {
+			defer wg.Done()
+			log.Printf("Starting gNMI collector for %s (%s)", c.name, c.target)
+			c.Run(ctx)
+		}(collector)
+	}
 
-		go func(c *GNMICollector, name string) {
-			ctx := context.Background()
-			log.Printf("Starting gNMI collector for %s (%s)", name, c.target)
-			if err := c.Subscribe(ctx); err != nil {
-				log.Printf("Subscription error for %s: %v", name, err)
+	// Accept the sessions of the switches that push telemetry
+	if receiver != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Printf("Starting dial-out receiver on %s", config.Dialout.Listen)
+			if err := receiver.ListenAndServe(ctx); err != nil {
+				log.Fatalf("Dial-out receiver: %v", err)
 			}
-		}(collector, sw.Name)
+		}()
 	}
 
-	// Expose Prometheus metrics
+	// Expose Prometheus metrics, stream paths and the topology
 	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Starting gNMI collector on %s", *listenAddr)
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+	if fabric != nil {
+		http.Handle("/streams/path", fabric)
+		http.Handle("/streams/capacity", fabric.CapacityHandler())
+		go fabric.Run(ctx)
+	}
+	if topologyMap != nil {
+		http.Handle("/topology", topologyMap)
+		http.Handle("/topology.dot", topologyMap)
+		go topologyMap.Run(ctx)
+	}
+	server := &http.Server{Addr: *listenAddr}
+	go func() {
+		log.Printf("Starting gNMI collector on %s", *listenAddr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down gNMI sessions")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+	wg.Wait()
 }
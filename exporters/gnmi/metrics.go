@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricGauge   = "gauge"
+	metricCounter = "counter"
+)
+
+// Help texts of the metrics the built-in path mappings produce
+var builtinMetricHelp = map[string]string{
+	"st2110_switch_interface_rx_bytes":      "Received bytes on switch interface",
+	"st2110_switch_interface_tx_bytes":      "Transmitted bytes on switch interface",
+	"st2110_switch_interface_rx_errors":     "Receive errors on switch interface",
+	"st2110_switch_interface_tx_errors":     "Transmit errors on switch interface",
+	"st2110_switch_interface_rx_drops":      "Dropped received packets on switch interface",
+	"st2110_switch_interface_tx_drops":      "Dropped transmitted packets on switch interface",
+	"st2110_switch_qos_buffer_utilization":  "QoS buffer utilization percentage",
+	"st2110_switch_qos_dropped_packets":     "Packets dropped due to QoS",
+	"st2110_switch_qos_transmitted_packets": "Packets transmitted from the queue",
+	"st2110_switch_multicast_groups":        "Number of IGMP multicast groups",
+}
+
+// MetricSet holds the metrics shared by every switch collector, created on
+// first use by the path mappings so that each name is registered once
+type MetricSet struct {
+	mu       sync.Mutex
+	gauges   map[string]*prometheus.GaugeVec
+	counters map[string]*DeviceCounter
+	labels   map[string][]string
+}
+
+func NewMetricSet() *MetricSet {
+	return &MetricSet{
+		gauges:   make(map[string]*prometheus.GaugeVec),
+		counters: make(map[string]*DeviceCounter),
+		labels:   make(map[string][]string),
+	}
+}
+
+// Gauge returns the gauge registered under name, creating it on first use;
+// every mapping of a name must use the same labels
+func (m *MetricSet) Gauge(name, help string, labels []string) (*prometheus.GaugeVec, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(name, metricGauge, labels); err != nil {
+		return nil, err
+	}
+	if gauge, ok := m.gauges[name]; ok {
+		return gauge, nil
+	}
+
+	gauge, err := register(prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: helpText(name, help)}, labels))
+	if err != nil {
+		return nil, fmt.Errorf("metric %s: %w", name, err)
+	}
+	m.gauges[name] = gauge
+	m.labels[name] = labels
+	return gauge, nil
+}
+
+// Counter returns the device counter registered under name, creating it on first use
+func (m *MetricSet) Counter(name, help string, labels []string) (*DeviceCounter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(name, metricCounter, labels); err != nil {
+		return nil, err
+	}
+	if counter, ok := m.counters[name]; ok {
+		return counter, nil
+	}
+
+	vec, err := register(prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: helpText(name, help)}, labels))
+	if err != nil {
+		return nil, fmt.Errorf("metric %s: %w", name, err)
+	}
+	counter := &DeviceCounter{
+		vec:    vec,
+		labels: labels,
+		last:   make(map[string]float64),
+	}
+	m.counters[name] = counter
+	m.labels[name] = labels
+	return counter, nil
+}
+
+// check rejects mapping an existing name with another type or other labels
+func (m *MetricSet) check(name, kind string, labels []string) error {
+	existing, ok := m.labels[name]
+	if !ok {
+		return nil
+	}
+	if _, isGauge := m.gauges[name]; isGauge != (kind == metricGauge) {
+		return fmt.Errorf("metric %s mapped both as gauge and counter", name)
+	}
+	if strings.Join(existing, ",") != strings.Join(labels, ",") {
+		return fmt.Errorf("metric %s mapped with labels %v and %v", name, existing, labels)
+	}
+	return nil
+}
+
+// register adds the collector to the default registry, or returns the one
+// already registered with the same description
+func register[T prometheus.Collector](c T) (T, error) {
+	if err := prometheus.Register(c); err != nil {
+		existing, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return c, err
+		}
+		if c, ok = existing.ExistingCollector.(T); !ok {
+			return c, fmt.Errorf("registered with another type")
+		}
+	}
+	return c, nil
+}
+
+func helpText(name, help string) string {
+	if help == "" {
+		help = builtinMetricHelp[name]
+	}
+	if help == "" {
+		help = "gNMI value " + name
+	}
+	return help
+}
+
+// DeviceCounter exports the running totals a switch reports as a Prometheus
+// counter: each sample adds its increase over the previous one, and a total
+// lower than the previous (reboot, clear counters) counts from zero again, so
+// the exported counter never goes backwards
+type DeviceCounter struct {
+	mu     sync.Mutex
+	vec    *prometheus.CounterVec
+	labels []string
+	last   map[string]float64 // Last total per series
+}
+
+// Observe records the switch's current total of a series
+func (d *DeviceCounter) Observe(labelValues []string, total float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	last, seen := d.last[key]
+	d.last[key] = total
+
+	increase := total
+	if seen && total >= last {
+		increase = total - last
+	}
+	if increase > 0 {
+		d.vec.WithLabelValues(labelValues...).Add(increase)
+	} else if !seen {
+		d.vec.WithLabelValues(labelValues...)
+	}
+}
+
+// DeletePartialMatch drops the series matching labels
+func (d *DeviceCounter) DeletePartialMatch(labels prometheus.Labels) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.vec.DeletePartialMatch(labels)
+	for key := range d.last {
+		values := strings.Split(key, "\xff")
+		matches := true
+		for i, name := range d.labels {
+			if v, ok := labels[name]; ok && values[i] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			delete(d.last, key)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stamp records when an entry was last reported: the stream's epoch and the
+// timestamp of the newest message applied to the switch
+type stamp struct {
+	epoch uint64
+	at    time.Time
+}
+
+// snoopingVLAN is the IGMP snooping state of one VLAN; the stamps record the
+// stream and message that last reported each entry
+type snoopingVLAN struct {
+	seen        stamp
+	querier     string
+	querierSeen stamp
+	hasQuerier  bool                        // The switch reports the querier of the VLAN
+	members     map[string]map[string]stamp // Group -> port -> stamp
+	ports       map[string]bool             // Ports published in the per-port series
+}
+
+// mroute is one (S,G) or (*,G) entry of a multicast routing table
+type mroute struct {
+	seen      stamp
+	incoming  string
+	outgoing  map[string]stamp // Interface -> stamp
+	published string           // Incoming interface of the published series
+}
+
+type mrouteKey struct {
+	vrf, source, group string
+}
+
+// switchMulticast holds one switch's tables; epoch advances with every
+// stream so that entries the target stopped reporting are swept at its sync,
+// and now with the messages of switches that never sync, to age entries out
+type switchMulticast struct {
+	epoch     uint64
+	now       time.Time
+	vlans     map[string]*snoopingVLAN
+	routes    map[mrouteKey]*mroute
+	vrfRoutes map[string]int
+}
+
+// multicastTables keeps the IGMP snooping, querier and multicast routing
+// tables that vendor plugins decode, and publishes them the same way for
+// every vendor
+type multicastTables struct {
+	mu       sync.Mutex
+	switches map[string]*switchMulticast
+
+	activeGroups   *prometheus.GaugeVec
+	querierPresent *prometheus.GaugeVec
+	portGroups     *prometheus.GaugeVec
+	routeEntries   *prometheus.GaugeVec
+	routeOutgoing  *prometheus.GaugeVec
+}
+
+func newMulticastTables(metrics *MetricSet) (*multicastTables, error) {
+	t := &multicastTables{switches: make(map[string]*switchMulticast)}
+
+	var err error
+	if t.activeGroups, err = metrics.Gauge("st2110_igmp_active_groups", "Multicast groups with members in the switch's IGMP snooping table", []string{"switch", "vlan"}); err != nil {
+		return nil, err
+	}
+	if t.querierPresent, err = metrics.Gauge("st2110_igmp_querier_present", "IGMP querier known to the switch on VLAN (1=present, 0=absent)", []string{"switch", "vlan"}); err != nil {
+		return nil, err
+	}
+	if t.portGroups, err = metrics.Gauge("st2110_switch_igmp_snooping_port_groups", "Multicast groups the switch forwards to a port", []string{"switch", "vlan", "port"}); err != nil {
+		return nil, err
+	}
+	if t.routeEntries, err = metrics.Gauge("st2110_switch_mroute_entries", "Multicast routing table entries", []string{"switch", "vrf"}); err != nil {
+		return nil, err
+	}
+	if t.routeOutgoing, err = metrics.Gauge("st2110_switch_mroute_outgoing_interfaces", "Outgoing interfaces of a multicast route",
+		[]string{"switch", "vrf", "source", "group", "incoming_interface"}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *multicastTables) state(switchName string) *switchMulticast {
+	s, ok := t.switches[switchName]
+	if !ok {
+		s = &switchMulticast{
+			vlans:     make(map[string]*snoopingVLAN),
+			routes:    make(map[mrouteKey]*mroute),
+			vrfRoutes: make(map[string]int),
+		}
+		t.switches[switchName] = s
+	}
+	return s
+}
+
+func (s *switchMulticast) vlan(id string) *snoopingVLAN {
+	v, ok := s.vlans[id]
+	if !ok {
+		v = &snoopingVLAN{
+			members: make(map[string]map[string]stamp),
+			ports:   make(map[string]bool),
+		}
+		s.vlans[id] = v
+	}
+	v.seen = s.stamp()
+	return v
+}
+
+func (s *switchMulticast) stamp() stamp {
+	return stamp{epoch: s.epoch, at: s.now}
+}
+
+// querierAbsent reports whether an address means no querier is elected
+func querierAbsent(address string) bool {
+	return address == "" || address == "0.0.0.0" || address == "::"
+}
+
+// SetQuerier records the querier of a VLAN; an empty or unspecified address
+// means there is none
+func (t *multicastTables) SetQuerier(switchName, vlan, address string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(switchName)
+	v := s.vlan(vlan)
+	t.setQuerier(switchName, vlan, v, address)
+	v.querierSeen, v.hasQuerier = s.stamp(), true
+	t.publishVLAN(switchName, vlan, v)
+}
+
+func (t *multicastTables) setQuerier(switchName, vlan string, v *snoopingVLAN, address string) {
+	if querierAbsent(address) {
+		address = ""
+	}
+	switch {
+	case address == v.querier:
+	case address == "":
+		log.Printf("⚠️  %s lost the IGMP querier on VLAN %s (was %s)", switchName, vlan, v.querier)
+	case v.querier != "":
+		log.Printf("%s IGMP querier on VLAN %s changed: %s -> %s", switchName, vlan, v.querier, address)
+	}
+	v.querier = address
+}
+
+// TouchVLAN records that the switch snoops on a VLAN
+func (t *multicastTables) TouchVLAN(switchName, vlan string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v := t.state(switchName).vlan(vlan)
+	t.publishVLAN(switchName, vlan, v)
+}
+
+// AddMember records a group joined on a port of a VLAN; port may be empty
+// when the switch only reports membership per VLAN
+func (t *multicastTables) AddMember(switchName, vlan, group, port string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(switchName)
+	v := s.vlan(vlan)
+	if v.members[group] == nil {
+		v.members[group] = make(map[string]stamp)
+	}
+	v.members[group][port] = s.stamp()
+	t.publishVLAN(switchName, vlan, v)
+}
+
+// RemoveSnooping drops snooping state; an empty port removes the whole
+// group, an empty group the whole VLAN and an empty VLAN every VLAN
+func (t *multicastTables) RemoveSnooping(switchName, vlan, group, port string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(switchName)
+	for id, v := range s.vlans {
+		if vlan != "" && id != vlan {
+			continue
+		}
+		if group == "" {
+			t.removeVLAN(switchName, s, id)
+			continue
+		}
+		if members, ok := v.members[group]; ok {
+			if port == "" {
+				delete(v.members, group)
+			} else if delete(members, port); len(members) == 0 {
+				delete(v.members, group)
+			}
+		}
+		t.publishVLAN(switchName, id, v)
+	}
+}
+
+// ClearQuerier records that a VLAN no longer reports a querier
+func (t *multicastTables) ClearQuerier(switchName, vlan string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(switchName)
+	if v, ok := s.vlans[vlan]; ok {
+		t.setQuerier(switchName, vlan, v, "")
+		v.hasQuerier = true
+		t.publishVLAN(switchName, vlan, v)
+	}
+}
+
+func (t *multicastTables) removeVLAN(switchName string, s *switchMulticast, vlan string) {
+	delete(s.vlans, vlan)
+	t.activeGroups.DeleteLabelValues(switchName, vlan)
+	t.querierPresent.DeleteLabelValues(switchName, vlan)
+	t.portGroups.DeletePartialMatch(prometheus.Labels{"switch": switchName, "vlan": vlan})
+}
+
+func (t *multicastTables) publishVLAN(switchName, vlan string, v *snoopingVLAN) {
+	ports := make(map[string]int)
+	for _, members := range v.members {
+		for port := range members {
+			if port != "" {
+				ports[port]++
+			}
+		}
+	}
+	t.activeGroups.WithLabelValues(switchName, vlan).Set(float64(len(v.members)))
+	if v.hasQuerier {
+		t.querierPresent.WithLabelValues(switchName, vlan).Set(boolToFloat(v.querier != ""))
+	}
+	for port := range v.ports {
+		if _, ok := ports[port]; !ok {
+			t.portGroups.DeleteLabelValues(switchName, vlan, port)
+			delete(v.ports, port)
+		}
+	}
+	for port, groups := range ports {
+		t.portGroups.WithLabelValues(switchName, vlan, port).Set(float64(groups))
+		v.ports[port] = true
+	}
+}
+
+// UpdateRoute records a multicast route (source * for a shared tree), with
+// its incoming interface and one outgoing interface when the update carries them
+func (t *multicastTables) UpdateRoute(switchName, vrf, source, group, incoming, outgoing string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(switchName)
+	key := mrouteKey{vrf, source, group}
+	r, ok := s.routes[key]
+	if !ok {
+		r = &mroute{outgoing: make(map[string]stamp)}
+		s.routes[key] = r
+		s.vrfRoutes[vrf]++
+		t.routeEntries.WithLabelValues(switchName, vrf).Set(float64(s.vrfRoutes[vrf]))
+	}
+	r.seen = s.stamp()
+	if incoming != "" {
+		r.incoming = incoming
+	}
+	if outgoing != "" {
+		r.outgoing[outgoing] = s.stamp()
+	}
+	t.publishRoute(switchName, key, r)
+}
+
+// RemoveRoute drops an outgoing interface of a route, or the route when
+// outgoing is empty; empty keys match every route
+func (t *multicastTables) RemoveRoute(switchName, vrf, source, group, outgoing string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(switchName)
+	for key, r := range s.routes {
+		if (vrf != "" && key.vrf != vrf) || (source != "" && key.source != source) || (group != "" && key.group != group) {
+			continue
+		}
+		if outgoing == "" {
+			t.removeRoute(switchName, s, key, r)
+			continue
+		}
+		delete(r.outgoing, outgoing)
+		t.publishRoute(switchName, key, r)
+	}
+}
+
+func (t *multicastTables) removeRoute(switchName string, s *switchMulticast, key mrouteKey, r *mroute) {
+	delete(s.routes, key)
+	t.routeOutgoing.DeleteLabelValues(switchName, key.vrf, key.source, key.group, r.published)
+	if s.vrfRoutes[key.vrf]--; s.vrfRoutes[key.vrf] == 0 {
+		delete(s.vrfRoutes, key.vrf)
+		t.routeEntries.DeleteLabelValues(switchName, key.vrf)
+	} else {
+		t.routeEntries.WithLabelValues(switchName, key.vrf).Set(float64(s.vrfRoutes[key.vrf]))
+	}
+}
+
+func (t *multicastTables) publishRoute(switchName string, key mrouteKey, r *mroute) {
+	if r.published != r.incoming {
+		t.routeOutgoing.DeleteLabelValues(switchName, key.vrf, key.source, key.group, r.published)
+		r.published = r.incoming
+	}
+	t.routeOutgoing.WithLabelValues(switchName, key.vrf, key.source, key.group, r.incoming).Set(float64(len(r.outgoing)))
+}
+
+// StartSync begins a new stream: entries it does not replay before its sync
+// response are gone from the switch
+func (t *multicastTables) StartSync(switchName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.state(switchName).epoch++
+}
+
+// Sweep drops the entries the current stream did not report before its sync
+func (t *multicastTables) Sweep(switchName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(switchName)
+	t.drop(switchName, s, func(seen stamp) bool { return seen.epoch < s.epoch })
+}
+
+// Advance moves the switch's clock to the timestamp of a message before it
+// is applied; messages older than the newest one do not move it back
+func (t *multicastTables) Advance(switchName string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s := t.state(switchName); now.After(s.now) {
+		s.now = now
+	}
+}
+
+// Expire drops the entries no message reported within maxAge of the newest,
+// for switches that neither sync nor delete
+func (t *multicastTables) Expire(switchName string, maxAge time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(switchName)
+	cutoff := s.now.Add(-maxAge)
+	t.drop(switchName, s, func(seen stamp) bool { return seen.at.Before(cutoff) })
+}
+
+// Clear drops every entry of the switch, when nothing tells any more which
+// are current
+func (t *multicastTables) Clear(switchName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.drop(switchName, t.state(switchName), func(stamp) bool { return true })
+}
+
+// drop removes the entries stale reports as gone; t.mu must be held
+func (t *multicastTables) drop(switchName string, s *switchMulticast, stale func(stamp) bool) {
+	for id, v := range s.vlans {
+		if stale(v.seen) {
+			t.removeVLAN(switchName, s, id)
+			continue
+		}
+		for group, members := range v.members {
+			for port, seen := range members {
+				if stale(seen) {
+					delete(members, port)
+				}
+			}
+			if len(members) == 0 {
+				delete(v.members, group)
+			}
+		}
+		if v.hasQuerier && stale(v.querierSeen) {
+			t.setQuerier(switchName, id, v, "")
+		}
+		t.publishVLAN(switchName, id, v)
+	}
+	for key, r := range s.routes {
+		if stale(r.seen) {
+			t.removeRoute(switchName, s, key, r)
+			continue
+		}
+		for iface, seen := range r.outgoing {
+			if stale(seen) {
+				delete(r.outgoing, iface)
+			}
+		}
+		t.publishRoute(switchName, key, r)
+	}
+}
+
+// multicastPlugin is implemented by the plugins that keep multicast tables
+type multicastPlugin interface {
+	multicastState() *multicastTables
+}
+
+// multicastOf returns the tables a plugin, or a plugin of a chain, keeps
+func multicastOf(plugin VendorPlugin) *multicastTables {
+	switch p := plugin.(type) {
+	case multicastPlugin:
+		return p.multicastState()
+	case pluginChain:
+		for _, plugin := range p {
+			if t := multicastOf(plugin); t != nil {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// routeEntry is a copy of a multicast route for readers outside the plugins
+type routeEntry struct {
+	vrf, source, group string
+	incoming           string
+	outgoing           []string
+}
+
+// Routes returns the switch's routes of a group
+func (t *multicastTables) Routes(switchName, group string) []routeEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var routes []routeEntry
+	s, ok := t.switches[switchName]
+	if !ok {
+		return nil
+	}
+	for key, r := range s.routes {
+		if key.group != group {
+			continue
+		}
+		entry := routeEntry{vrf: key.vrf, source: key.source, group: key.group, incoming: r.incoming}
+		for iface := range r.outgoing {
+			entry.outgoing = append(entry.outgoing, iface)
+		}
+		sort.Strings(entry.outgoing)
+		routes = append(routes, entry)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].vrf+"/"+routes[i].source < routes[j].vrf+"/"+routes[j].source
+	})
+	return routes
+}
+
+// Members returns the ports of each VLAN that joined a group; VLANs of
+// switches that report no ports have an empty list
+func (t *multicastTables) Members(switchName, group string) map[string][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	members := make(map[string][]string)
+	s, ok := t.switches[switchName]
+	if !ok {
+		return members
+	}
+	for id, v := range s.vlans {
+		ports, ok := v.members[group]
+		if !ok {
+			continue
+		}
+		members[id] = []string{}
+		for port := range ports {
+			if port != "" {
+				members[id] = append(members[id], port)
+			}
+		}
+		sort.Strings(members[id])
+	}
+	return members
+}
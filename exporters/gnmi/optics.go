@@ -0,0 +1,488 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sample interval of the transceiver DOM; optics drift slowly and many
+// switches read them from the module only every few seconds
+const opticsSampleInterval = 30 * time.Second
+
+// Prefix of the OpenConfig transceiver components
+const openconfigTransceiver = "/components/component[name=*]/transceiver"
+
+// Threshold leaves of openconfig-platform-transceiver, by the parameter
+// label they get, which is also the suffix of the reading's metric
+var opticThresholdLeaves = map[string]string{
+	"input-power":        "rx_power_dbm",
+	"output-power":       "tx_power_dbm",
+	"laser-bias-current": "laser_bias_milliamps",
+	"module-temperature": "temperature_celsius",
+	"supply-voltage":     "supply_voltage_volts",
+}
+
+// opticReading is one published value of a transceiver; labels are the
+// values after switch and interface, joined by \xff
+type opticReading struct {
+	metric    string
+	component string
+	labels    string
+}
+
+// switchOptics is the DOM state of one switch
+type switchOptics struct {
+	interfaces   map[string]string // Transceiver component -> interface it serves (first of a breakout)
+	transceivers map[string]bool   // Components known to be transceivers
+	readings     map[opticReading]float64
+
+	// What the previous stream reported and the current one has not yet;
+	// nil outside the initial sync
+	staleInterfaces   map[string]bool
+	staleTransceivers map[string]bool
+	staleReadings     map[opticReading]bool
+}
+
+// opticsTable publishes the DOM readings and alarm/warning thresholds of the
+// OpenConfig transceiver components under the interface they serve, with the
+// PHY error counters of the OpenConfig Ethernet model
+type opticsTable struct {
+	*pathPlugin
+
+	mu       sync.Mutex
+	switches map[string]*switchOptics
+	gauges   map[string]*prometheus.GaugeVec
+}
+
+func newOpticsTable(metrics *MetricSet) (*opticsTable, error) {
+	t := &opticsTable{
+		switches: make(map[string]*switchOptics),
+		gauges:   make(map[string]*prometheus.GaugeVec),
+	}
+
+	lane := []string{"switch", "interface", "lane"}
+	module := []string{"switch", "interface"}
+	for _, g := range []struct {
+		name, help string
+		labels     []string
+	}{
+		{"st2110_switch_optic_rx_power_dbm", "Optical receive power per lane", lane},
+		{"st2110_switch_optic_tx_power_dbm", "Optical transmit power per lane", lane},
+		{"st2110_switch_optic_laser_bias_milliamps", "Laser bias current per lane", lane},
+		{"st2110_switch_optic_temperature_celsius", "Transceiver module temperature", module},
+		{"st2110_switch_optic_supply_voltage_volts", "Transceiver supply voltage", module},
+		{"st2110_switch_optic_threshold", "Alarm and warning limits the transceiver reports, in the unit of the parameter's metric",
+			[]string{"switch", "interface", "parameter", "severity", "bound"}},
+	} {
+		gauge, err := metrics.Gauge(g.name, g.help, g.labels)
+		if err != nil {
+			return nil, err
+		}
+		t.gauges[strings.TrimPrefix(g.name, "st2110_switch_optic_")] = gauge
+	}
+
+	var err error
+	t.pathPlugin, err = newPathPlugin("optics", []vendorPath{
+		{
+			// Which transceiver serves which interface
+			name:         "interface_transceiver",
+			config:       PathConfig{Path: "/interfaces/interface[name=*]/state/transceiver", Mode: "on_change"},
+			handle:       t.handleInterface,
+			handleDelete: t.deleteInterface,
+		},
+		{
+			name:         "transceiver_state",
+			config:       PathConfig{Path: openconfigTransceiver + "/state", Interval: opticsSampleInterval},
+			handle:       t.handleModule,
+			handleDelete: t.deleteComponent,
+		},
+		{
+			name:         "transceiver_channels",
+			config:       PathConfig{Path: openconfigTransceiver + "/physical-channels/channel[index=*]/state", Interval: opticsSampleInterval},
+			handle:       t.handleChannel,
+			handleDelete: t.deleteChannel,
+		},
+		{
+			name:         "transceiver_thresholds",
+			config:       PathConfig{Path: openconfigTransceiver + "/thresholds/threshold[severity=*]/state", Mode: "on_change"},
+			handle:       t.handleThreshold,
+			handleDelete: t.deleteThreshold,
+		},
+		{
+			// Transceivers report their temperature as platform components
+			name:   "component_temperature",
+			config: PathConfig{Path: "/components/component[name=*]/state/temperature", Interval: opticsSampleInterval},
+			handle: t.handleTemperature,
+		},
+		{
+			// CRC, symbol and FEC errors; FEC codewords are augments on most switches
+			name: "ethernet_counters",
+			config: PathConfig{
+				Path:     "/interfaces/interface[name=*]/ethernet/state/counters",
+				Interval: interfaceSampleInterval,
+				Metrics: []MetricConfig{
+					{
+						Name:   "st2110_switch_interface_crc_errors_total",
+						Leaf:   "in-crc-errors",
+						Type:   metricCounter,
+						Help:   "Received frames with a bad FCS on switch interface",
+						Labels: map[string]string{"interface": "interface[name]"},
+					},
+					{
+						Name:   "st2110_switch_interface_symbol_errors_total",
+						Leaf:   "in-symbol-error|in-symbol-errors",
+						Type:   metricCounter,
+						Help:   "PCS symbol errors on switch interface",
+						Labels: map[string]string{"interface": "interface[name]"},
+					},
+					{
+						Name:   "st2110_switch_fec_corrected_codewords_total",
+						Leaf:   "in-fec-corrected-codewords|fec-corrected-codewords|in-fec-correctable-codewords",
+						Type:   metricCounter,
+						Help:   "FEC codewords received with errors the FEC corrected",
+						Labels: map[string]string{"interface": "interface[name]"},
+					},
+					{
+						Name:   "st2110_switch_fec_uncorrected_codewords_total",
+						Leaf:   "in-fec-uncorrected-codewords|fec-uncorrected-codewords|in-fec-uncorrectable-codewords",
+						Type:   metricCounter,
+						Help:   "FEC codewords received with errors beyond correction (lost frames)",
+						Labels: map[string]string{"interface": "interface[name]"},
+					},
+				},
+			},
+		},
+	}, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// state returns the DOM state of a switch; t.mu must be held
+func (t *opticsTable) state(switchName string) *switchOptics {
+	s, ok := t.switches[switchName]
+	if !ok {
+		s = &switchOptics{
+			interfaces:   make(map[string]string),
+			transceivers: make(map[string]bool),
+			readings:     make(map[opticReading]float64),
+		}
+		t.switches[switchName] = s
+	}
+	return s
+}
+
+// labelValues are the labels of a reading: the interface served by its
+// component, or the component until the switch reports one
+func (s *switchOptics) labelValues(switchName string, r opticReading) []string {
+	iface, ok := s.interfaces[r.component]
+	if !ok {
+		iface = r.component
+	}
+	values := []string{switchName, iface}
+	if r.labels != "" {
+		values = append(values, strings.Split(r.labels, "\xff")...)
+	}
+	return values
+}
+
+// set records a reading, published once its component is known to be a
+// transceiver; t.mu must be held
+func (t *opticsTable) set(switchName, metric, component string, value float64, labels ...string) {
+	s := t.state(switchName)
+	r := opticReading{metric: metric, component: component, labels: strings.Join(labels, "\xff")}
+	s.readings[r] = value
+	delete(s.staleReadings, r)
+	if s.transceivers[component] {
+		t.gauges[metric].WithLabelValues(s.labelValues(switchName, r)...).Set(value)
+	}
+}
+
+// forget removes the readings of a component that match, and their series;
+// t.mu must be held
+func (t *opticsTable) forget(switchName string, match func(r opticReading) bool) {
+	s, ok := t.switches[switchName]
+	if !ok {
+		return
+	}
+	for r := range s.readings {
+		if match(r) {
+			if s.transceivers[r.component] {
+				t.gauges[r.metric].DeleteLabelValues(s.labelValues(switchName, r)...)
+			}
+			delete(s.readings, r)
+		}
+	}
+}
+
+// relabel runs fn, which changes how a component is published, and moves the
+// component's series accordingly; t.mu must be held
+func (t *opticsTable) relabel(switchName, component string, fn func(s *switchOptics)) {
+	s := t.state(switchName)
+	for r := range s.readings {
+		if r.component == component && s.transceivers[component] {
+			t.gauges[r.metric].DeleteLabelValues(s.labelValues(switchName, r)...)
+		}
+	}
+	fn(s)
+	for r, value := range s.readings {
+		if r.component == component && s.transceivers[component] {
+			t.gauges[r.metric].WithLabelValues(s.labelValues(switchName, r)...).Set(value)
+		}
+	}
+}
+
+// transceiver marks a component as a transceiver; t.mu must be held
+func (t *opticsTable) transceiver(switchName, component string) {
+	delete(t.state(switchName).staleTransceivers, component)
+	if !t.state(switchName).transceivers[component] {
+		t.relabel(switchName, component, func(s *switchOptics) { s.transceivers[component] = true })
+	}
+}
+
+func (t *opticsTable) handleInterface(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	iface := keyValue(elems, "interface", "name")
+	component, ok := leaves["transceiver"].(string)
+	if !ok || iface == "" || component == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Breakout interfaces share their transceiver, which goes by the first
+	s := t.state(switchName)
+	if current, ok := s.interfaces[component]; ok && current <= iface {
+		if current == iface {
+			delete(s.staleInterfaces, component)
+			t.transceiver(switchName, component)
+		}
+		return
+	}
+	// An interface moves to another transceiver after breakout changes
+	for old, name := range s.interfaces {
+		if name == iface && old != component {
+			t.relabel(switchName, old, func(s *switchOptics) { delete(s.interfaces, old) })
+		}
+	}
+	t.relabel(switchName, component, func(s *switchOptics) { s.interfaces[component] = iface })
+	delete(s.staleInterfaces, component)
+	t.transceiver(switchName, component)
+}
+
+func (t *opticsTable) deleteInterface(switchName string, elems []*gnmi.PathElem, leaf string) {
+	iface := keyValue(elems, "interface", "name")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.switches[switchName]
+	if !ok {
+		return
+	}
+	for component, name := range s.interfaces {
+		if iface == "" || name == iface {
+			t.relabel(switchName, component, func(s *switchOptics) { delete(s.interfaces, component) })
+		}
+	}
+}
+
+// HandleStreamStart marks what the switch reported stale until the new
+// stream reports it again
+func (t *opticsTable) HandleStreamStart(switchName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(switchName)
+	s.staleInterfaces = make(map[string]bool, len(s.interfaces))
+	for component := range s.interfaces {
+		s.staleInterfaces[component] = true
+	}
+	s.staleTransceivers = make(map[string]bool, len(s.transceivers))
+	for component := range s.transceivers {
+		s.staleTransceivers[component] = true
+	}
+	s.staleReadings = make(map[opticReading]bool, len(s.readings))
+	for r := range s.readings {
+		s.staleReadings[r] = true
+	}
+}
+
+// HandleSync drops the transceivers, interface mappings and readings the
+// switch no longer reports, such as those of a module swapped while the
+// session was down
+func (t *opticsTable) HandleSync(switchName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.switches[switchName]
+	if !ok {
+		return
+	}
+	t.forget(switchName, func(r opticReading) bool { return s.staleReadings[r] })
+	for component := range s.staleInterfaces {
+		t.relabel(switchName, component, func(s *switchOptics) { delete(s.interfaces, component) })
+	}
+	for component := range s.staleTransceivers {
+		t.relabel(switchName, component, func(s *switchOptics) { delete(s.transceivers, component) })
+	}
+	s.staleInterfaces, s.staleTransceivers, s.staleReadings = nil, nil, nil
+}
+
+// handleModule takes the module-wide readings of a transceiver
+func (t *opticsTable) handleModule(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	component := keyValue(elems, "component", "name")
+	if component == "" {
+		return
+	}
+	values := leafValues(leaves)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.transceiver(switchName, component)
+	if v, ok := values["supply-voltage/instant"]; ok {
+		t.set(switchName, "supply_voltage_volts", component, v)
+	}
+	if v, ok := values["module-temperature/instant"]; ok {
+		t.set(switchName, "temperature_celsius", component, v)
+	}
+}
+
+// handleTemperature keeps the temperature of every component, published for
+// the transceivers among them
+func (t *opticsTable) handleTemperature(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	component := keyValue(elems, "component", "name")
+	v, ok := leafValues(leaves)["instant"]
+	if component == "" || !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.set(switchName, "temperature_celsius", component, v)
+}
+
+func (t *opticsTable) handleChannel(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	component := keyValue(elems, "component", "name")
+	lane := keyValue(elems, "channel", "index")
+	if component == "" || lane == "" {
+		return
+	}
+	values := leafValues(leaves)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.transceiver(switchName, component)
+	for leaf, metric := range map[string]string{
+		"input-power/instant":        "rx_power_dbm",
+		"output-power/instant":       "tx_power_dbm",
+		"laser-bias-current/instant": "laser_bias_milliamps",
+	} {
+		if v, ok := values[leaf]; ok {
+			t.set(switchName, metric, component, v, lane)
+		}
+	}
+}
+
+// handleThreshold takes the -upper and -lower limits of one severity
+func (t *opticsTable) handleThreshold(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	component := keyValue(elems, "component", "name")
+	severity := thresholdSeverity(keyValue(elems, "threshold", "severity"))
+	if component == "" || severity == "" {
+		return
+	}
+	values := leafValues(leaves)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.transceiver(switchName, component)
+	for leaf, v := range values {
+		for prefix, parameter := range opticThresholdLeaves {
+			switch leaf {
+			case prefix + "-upper":
+				t.set(switchName, "threshold", component, v, parameter, severity, "high")
+			case prefix + "-lower":
+				t.set(switchName, "threshold", component, v, parameter, severity, "low")
+			}
+		}
+	}
+}
+
+// thresholdSeverity is the openconfig-alarm-types severity of a threshold
+// in lower case: critical for alarm limits, warning for warning limits
+func thresholdSeverity(severity string) string {
+	if i := strings.IndexByte(severity, ':'); i >= 0 {
+		severity = severity[i+1:]
+	}
+	return strings.ToLower(severity)
+}
+
+// deleteComponent forgets a transceiver that was removed
+func (t *opticsTable) deleteComponent(switchName string, elems []*gnmi.PathElem, leaf string) {
+	component := keyValue(elems, "component", "name")
+	if leaf != "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.forget(switchName, func(r opticReading) bool {
+		return component == "" || r.component == component
+	})
+	if s, ok := t.switches[switchName]; ok {
+		if component == "" {
+			s.transceivers = make(map[string]bool)
+		} else {
+			delete(s.transceivers, component)
+		}
+	}
+}
+
+func (t *opticsTable) deleteChannel(switchName string, elems []*gnmi.PathElem, leaf string) {
+	component := keyValue(elems, "component", "name")
+	lane := keyValue(elems, "channel", "index")
+	if leaf != "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.forget(switchName, func(r opticReading) bool {
+		if component != "" && r.component != component {
+			return false
+		}
+		switch r.metric {
+		case "rx_power_dbm", "tx_power_dbm", "laser_bias_milliamps":
+			return lane == "" || r.labels == lane
+		}
+		return false
+	})
+}
+
+func (t *opticsTable) deleteThreshold(switchName string, elems []*gnmi.PathElem, leaf string) {
+	component := keyValue(elems, "component", "name")
+	severity := thresholdSeverity(keyValue(elems, "threshold", "severity"))
+	if leaf != "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.forget(switchName, func(r opticReading) bool {
+		if r.metric != "threshold" || (component != "" && r.component != component) {
+			return false
+		}
+		return severity == "" || strings.Split(r.labels, "\xff")[1] == severity
+	})
+}
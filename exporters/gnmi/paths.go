@@ -0,0 +1,452 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultSampleInterval = 1 * time.Second
+
+// PathConfig is one entry of gnmi_paths: either a plain path string or a
+// mapping with the subscription mode and the metrics to extract
+type PathConfig struct {
+	Path     string         `yaml:"path"`
+	Mode     string         `yaml:"mode"`     // sample (default), on_change or target_defined
+	Interval time.Duration  `yaml:"interval"` // Sample interval (default 1s)
+	Metrics  []MetricConfig `yaml:"metrics"`  // Defaults to the built-in mapping of the entry name
+}
+
+func (p *PathConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		*p = PathConfig{Path: path}
+		return nil
+	}
+	type plain PathConfig
+	return unmarshal((*plain)(p))
+}
+
+// MetricConfig maps a leaf below the subscribed path to a gauge, or to a
+// counter for running totals such as packet counts
+type MetricConfig struct {
+	Name string `yaml:"name"`
+	Leaf string `yaml:"leaf"` // Relative to the subscribed path, e.g. in-octets; alternatives separated by |
+	Type string `yaml:"type"` // gauge (default) or counter
+	Help string `yaml:"help"`
+	// Label name -> path key, as key or elem[key], e.g. interface: "interface[name]|PhysIf-list[id]"
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Metrics of the well-known gnmi_paths entries, covering OpenConfig and NX-OS DME leaf names
+var builtinPathMetrics = map[string][]MetricConfig{
+	"interface_counters": interfaceCounterMetrics(),
+	"qos_queues": {
+		{Name: "st2110_switch_qos_dropped_packets", Leaf: "dropped-pkts", Type: metricCounter, Labels: queueLabels("queue[name]")},
+		{Name: "st2110_switch_qos_transmitted_packets", Leaf: "transmit-pkts", Type: metricCounter, Labels: queueLabels("queue[name]")},
+	},
+	"hw_queue_drops": {
+		{Name: "st2110_switch_qos_dropped_packets", Leaf: "dropped-pkts", Type: metricCounter, Labels: queueLabels("queue[queue-id]")},
+	},
+}
+
+func interfaceCounterMetrics() []MetricConfig {
+	labels := map[string]string{"interface": "interface[name]|PhysIf-list[id]"}
+	return []MetricConfig{
+		{Name: "st2110_switch_interface_rx_bytes", Leaf: "in-octets|inOctets", Type: metricCounter, Labels: labels},
+		{Name: "st2110_switch_interface_tx_bytes", Leaf: "out-octets|outOctets", Type: metricCounter, Labels: labels},
+		{Name: "st2110_switch_interface_rx_errors", Leaf: "in-errors|inErrors", Type: metricCounter, Labels: labels},
+		{Name: "st2110_switch_interface_tx_errors", Leaf: "out-errors|outErrors", Type: metricCounter, Labels: labels},
+		{Name: "st2110_switch_interface_rx_drops", Leaf: "in-discards|inDiscards", Type: metricCounter, Labels: labels},
+		{Name: "st2110_switch_interface_tx_drops", Leaf: "out-discards|outDiscards", Type: metricCounter, Labels: labels},
+	}
+}
+
+// pfcMetrics maps the per-priority PFC pause frame counters of a vendor model
+func pfcMetrics(rxLeaf, txLeaf string, labels map[string]string) []MetricConfig {
+	return []MetricConfig{
+		{Name: "st2110_switch_pfc_rx_pause_frames_total", Leaf: rxLeaf, Type: metricCounter, Help: "PFC pause frames received per priority", Labels: labels},
+		{Name: "st2110_switch_pfc_tx_pause_frames_total", Leaf: txLeaf, Type: metricCounter, Help: "PFC pause frames sent per priority", Labels: labels},
+	}
+}
+
+func queueLabels(queue string) map[string]string {
+	return map[string]string{"interface": "interface[name]", "queue": queue}
+}
+
+// Paths subscribed for switches whose vendor has no gnmi_paths entry
+var defaultPaths = map[string]PathConfig{
+	"interface_counters": {Path: "/interfaces/interface[name=*]/state/counters"},
+	"qos_queues":         {Path: "/qos/interfaces/interface[name=*]/output/queues/queue[name=*]/state"},
+}
+
+// ParsePath parses a gNMI path string such as
+// openconfig:/interfaces/interface[name=Ethernet1/1]/state/counters
+func ParsePath(s string) (*gnmi.Path, error) {
+	path := &gnmi.Path{}
+	if i := strings.Index(s, ":/"); i > 0 && !strings.ContainsAny(s[:i], "/[") {
+		path.Origin, s = s[:i], s[i+1:]
+	}
+	s = strings.TrimPrefix(s, "/")
+	if s == "" {
+		return path, nil
+	}
+
+	elem := &gnmi.PathElem{}
+	var name strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '/':
+			if name.Len() == 0 {
+				return nil, fmt.Errorf("empty element in path %q", s)
+			}
+			elem.Name = name.String()
+			path.Elem = append(path.Elem, elem)
+			elem, name = &gnmi.PathElem{}, strings.Builder{}
+		case '[':
+			key, value, end, err := parseKey(s, i+1)
+			if err != nil {
+				return nil, err
+			}
+			if elem.Key == nil {
+				elem.Key = make(map[string]string)
+			}
+			elem.Key[key] = value
+			i = end
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+			name.WriteByte(s[i])
+		default:
+			name.WriteByte(c)
+		}
+	}
+	if name.Len() == 0 {
+		return nil, fmt.Errorf("empty element in path %q", s)
+	}
+	elem.Name = name.String()
+	path.Elem = append(path.Elem, elem)
+	return path, nil
+}
+
+// parseKey reads key=value] starting at i; values may contain / and escaped ]
+func parseKey(s string, i int) (key, value string, end int, err error) {
+	eq := strings.IndexByte(s[i:], '=')
+	if eq < 1 {
+		return "", "", 0, fmt.Errorf("malformed key in path %q", s)
+	}
+	key = s[i : i+eq]
+	var v strings.Builder
+	for j := i + eq + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			if j+1 < len(s) {
+				j++
+			}
+			v.WriteByte(s[j])
+		case ']':
+			return key, v.String(), j, nil
+		default:
+			v.WriteByte(s[j])
+		}
+	}
+	return "", "", 0, fmt.Errorf("unterminated key in path %q", s)
+}
+
+// PathString formats a path the way ParsePath reads it
+func PathString(path *gnmi.Path) string {
+	var b strings.Builder
+	if path.GetOrigin() != "" {
+		b.WriteString(path.GetOrigin() + ":")
+	}
+	for _, elem := range path.GetElem() {
+		b.WriteString("/" + elem.Name)
+		keys := make([]string, 0, len(elem.Key))
+		for k := range elem.Key {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.WriteString("[" + k + "=" + strings.ReplaceAll(elem.Key[k], "]", `\]`) + "]")
+		}
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
+
+func subscriptionMode(mode string) (gnmi.SubscriptionMode, error) {
+	switch strings.ToLower(mode) {
+	case "", "sample":
+		return gnmi.SubscriptionMode_SAMPLE, nil
+	case "on_change":
+		return gnmi.SubscriptionMode_ON_CHANGE, nil
+	case "target_defined":
+		return gnmi.SubscriptionMode_TARGET_DEFINED, nil
+	}
+	return 0, fmt.Errorf("unknown subscription mode %q", mode)
+}
+
+// labelSource is one alternative of a label mapping: a key, optionally of a named elem
+type labelSource struct {
+	elem string // empty matches any elem
+	key  string
+}
+
+type metricMapping struct {
+	leaves     []string
+	labelNames []string        // sorted, after "switch"
+	sources    [][]labelSource // per label name
+	apply      func(labelValues []string, value float64)
+	remove     func(labels prometheus.Labels)
+}
+
+// pathSpec is a compiled gnmi_paths entry or vendor subscription
+type pathSpec struct {
+	name         string
+	path         *gnmi.Path
+	pattern      *gnmi.Path // Update paths handled, the subscribed path unless the target reports elsewhere
+	subscription *gnmi.Subscription
+	metrics      []*metricMapping
+	handle       func(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{})
+	handleDelete func(switchName string, elems []*gnmi.PathElem, leaf string)
+}
+
+// compilePaths builds the subscriptions and metric mappings of a vendor's gnmi_paths
+func compilePaths(paths map[string]PathConfig, metrics *MetricSet) ([]*pathSpec, error) {
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var specs []*pathSpec
+	for _, name := range names {
+		config := paths[name]
+		if len(config.Metrics) == 0 {
+			config.Metrics = builtinPathMetrics[name]
+		}
+		if len(config.Metrics) == 0 {
+			// The vendor's entries replace the default paths, so a
+			// dropped entry would silently lose its subscription
+			return nil, fmt.Errorf("gnmi_paths %s: no metrics, and no built-in metrics for that entry name", name)
+		}
+		spec, err := compilePath(name, config, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("gnmi_paths %s: %w", name, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// compilePath builds the subscription and metric mappings of one path
+func compilePath(name string, config PathConfig, metrics *MetricSet) (*pathSpec, error) {
+	path, err := ParsePath(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(path.Elem) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	mode, err := subscriptionMode(config.Mode)
+	if err != nil {
+		return nil, err
+	}
+	interval := config.Interval
+	if interval == 0 {
+		interval = defaultSampleInterval
+	}
+
+	spec := &pathSpec{
+		name:    name,
+		path:    path,
+		pattern: path,
+		subscription: &gnmi.Subscription{
+			Path: path,
+			Mode: mode,
+		},
+	}
+	if mode == gnmi.SubscriptionMode_SAMPLE {
+		spec.subscription.SampleInterval = uint64(interval.Nanoseconds())
+	}
+	for _, mc := range config.Metrics {
+		mapping, err := compileMetric(mc, metrics)
+		if err != nil {
+			return nil, err
+		}
+		spec.metrics = append(spec.metrics, mapping)
+	}
+	return spec, nil
+}
+
+func compileMetric(mc MetricConfig, metrics *MetricSet) (*metricMapping, error) {
+	if mc.Name == "" || mc.Leaf == "" {
+		return nil, fmt.Errorf("metric needs a name and a leaf")
+	}
+	mapping := &metricMapping{leaves: strings.Split(mc.Leaf, "|")}
+	for label := range mc.Labels {
+		mapping.labelNames = append(mapping.labelNames, label)
+	}
+	sort.Strings(mapping.labelNames)
+	for _, label := range mapping.labelNames {
+		var sources []labelSource
+		for _, alternative := range strings.Split(mc.Labels[label], "|") {
+			source := labelSource{key: alternative}
+			if i := strings.IndexByte(alternative, '['); i > 0 && strings.HasSuffix(alternative, "]") {
+				source = labelSource{elem: alternative[:i], key: alternative[i+1 : len(alternative)-1]}
+			}
+			sources = append(sources, source)
+		}
+		mapping.sources = append(mapping.sources, sources)
+	}
+
+	labels := append([]string{"switch"}, mapping.labelNames...)
+	switch mc.Type {
+	case "", metricGauge:
+		gauge, err := metrics.Gauge(mc.Name, mc.Help, labels)
+		if err != nil {
+			return nil, err
+		}
+		mapping.apply = func(labelValues []string, value float64) {
+			gauge.WithLabelValues(labelValues...).Set(value)
+		}
+		mapping.remove = func(labels prometheus.Labels) { gauge.DeletePartialMatch(labels) }
+	case metricCounter:
+		counter, err := metrics.Counter(mc.Name, mc.Help, labels)
+		if err != nil {
+			return nil, err
+		}
+		mapping.apply = counter.Observe
+		mapping.remove = counter.DeletePartialMatch
+	default:
+		return nil, fmt.Errorf("metric %s: unknown type %q", mc.Name, mc.Type)
+	}
+	return mapping, nil
+}
+
+// match returns the elems of path below the spec's pattern, or false if path
+// is not under it; wildcard (*) names and keys match anything
+func (s *pathSpec) match(path *gnmi.Path) ([]*gnmi.PathElem, bool) {
+	elems := path.GetElem()
+	if len(elems) < len(s.pattern.Elem) {
+		return nil, false
+	}
+	for i, want := range s.pattern.Elem {
+		got := elems[i]
+		if want.Name != "*" && want.Name != got.Name {
+			return nil, false
+		}
+		for k, v := range want.Key {
+			if v != "*" && got.Key[k] != v {
+				return nil, false
+			}
+		}
+	}
+	return elems[len(s.pattern.Elem):], true
+}
+
+// labelValues resolves the mapping's labels from the keys of the update path
+func (m *metricMapping) labelValues(switchName string, elems []*gnmi.PathElem) []string {
+	values := []string{switchName}
+	for i := range m.sources {
+		value, _ := m.labelValue(i, elems)
+		values = append(values, value)
+	}
+	return values
+}
+
+func (m *metricMapping) labelValue(i int, elems []*gnmi.PathElem) (string, bool) {
+	for _, source := range m.sources[i] {
+		for _, elem := range elems {
+			if source.elem != "" && source.elem != elem.Name {
+				continue
+			}
+			if v, ok := elem.Key[source.key]; ok {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// remove drops the series of the mappings that a deleted path covers: every
+// series below the deleted container, or the series of a deleted leaf
+func (s *pathSpec) remove(switchName string, path *gnmi.Path) {
+	elems := path.GetElem()
+	for i := 0; i < len(elems) && i < len(s.pattern.Elem); i++ {
+		want, got := s.pattern.Elem[i], elems[i]
+		if want.Name != "*" && want.Name != got.Name {
+			return
+		}
+		for k, v := range want.Key {
+			if gv, ok := got.Key[k]; ok && v != "*" && gv != v {
+				return
+			}
+		}
+	}
+
+	var leaf string
+	if len(elems) > len(s.pattern.Elem) {
+		names := make([]string, 0, len(elems)-len(s.pattern.Elem))
+		for _, elem := range elems[len(s.pattern.Elem):] {
+			names = append(names, elem.Name)
+		}
+		leaf = strings.Join(names, "/")
+	}
+	if s.handleDelete != nil {
+		s.handleDelete(switchName, elems, leaf)
+	}
+
+	for _, m := range s.metrics {
+		if leaf != "" && !m.covers(leaf) {
+			continue
+		}
+		labels := prometheus.Labels{"switch": switchName}
+		for i, name := range m.labelNames {
+			if value, ok := m.labelValue(i, elems); ok {
+				labels[name] = value
+			}
+		}
+		m.remove(labels)
+	}
+}
+
+// covers reports whether one of the mapping's leaves is at or below leaf
+func (m *metricMapping) covers(leaf string) bool {
+	for _, l := range m.leaves {
+		if l == leaf || strings.HasPrefix(l, leaf+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// apply exports the values of one update that fall under the spec
+func (s *pathSpec) apply(switchName string, path *gnmi.Path, value *gnmi.TypedValue) bool {
+	relative, ok := s.match(path)
+	if !ok {
+		return false
+	}
+	last := s.pattern.Elem[len(s.pattern.Elem)-1].Name
+	leaves := leafData(relative, last, value)
+	if s.handle != nil {
+		s.handle(switchName, path.GetElem(), leaves)
+	}
+	values := leafValues(leaves)
+	for _, m := range s.metrics {
+		for _, leaf := range m.leaves {
+			if v, ok := values[leaf]; ok {
+				m.apply(m.labelValues(switchName, path.GetElem()), v)
+				break
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	sessionDisconnected = 0
+	sessionConnecting   = 1
+	sessionConnected    = 2
+
+	minBackoff         = 1 * time.Second
+	updateRateInterval = 10 * time.Second
+)
+
+// errStalled ends a stream that delivered nothing for too long
+var errStalled = errors.New("stream stalled")
+
+// SessionMetrics reports the health of the gNMI session to every switch
+type SessionMetrics struct {
+	state      *prometheus.GaugeVec
+	reconnects *prometheus.CounterVec
+	lastUpdate *prometheus.GaugeVec
+	synced     *prometheus.GaugeVec
+	updateRate *prometheus.GaugeVec
+
+	// Discovered at connect time
+	info               *prometheus.GaugeVec
+	models             *prometheus.GaugeVec
+	lineCards          *prometheus.GaugeVec
+	subscriptionActive *prometheus.GaugeVec
+}
+
+// SessionOptions tune the supervision of every switch session
+type SessionOptions struct {
+	StallIntervals int           // Sample intervals without updates before the stream is restarted (0 disables)
+	MaxBackoff     time.Duration // Longest wait between reconnects
+	Inventory      bool          // Get hostname, software version and components at connect time
+}
+
+func NewSessionMetrics() *SessionMetrics {
+	labels := []string{"switch", "target"}
+
+	m := &SessionMetrics{
+		state: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_gnmi_connection_state",
+				Help: "gNMI session state (0=disconnected, 1=connecting, 2=connected)",
+			},
+			labels,
+		),
+		reconnects: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_gnmi_reconnects_total",
+				Help: "gNMI session restarts by reason (error, stalled)",
+			},
+			[]string{"switch", "target", "reason"},
+		),
+		lastUpdate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_gnmi_last_update_timestamp_seconds",
+				Help: "Unix time of the last subscription response",
+			},
+			labels,
+		),
+		synced: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_gnmi_sync_received",
+				Help: "Sync response received on the current stream (1=initial state complete)",
+			},
+			labels,
+		),
+		updateRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_gnmi_update_rate",
+				Help: "Updates received per second",
+			},
+			labels,
+		),
+		info: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_gnmi_target_info",
+				Help: "Capabilities and inventory the switch reported at connect time (always 1)",
+			},
+			[]string{"switch", "target", "gnmi_version", "encoding", "hostname", "software_version", "chassis", "serial_number"},
+		),
+		models: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_gnmi_supported_models",
+				Help: "YANG models the switch advertises in its capabilities",
+			},
+			labels,
+		),
+		lineCards: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_gnmi_line_cards",
+				Help: "Line card components in the switch inventory",
+			},
+			labels,
+		),
+		subscriptionActive: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_gnmi_subscription_active",
+				Help: "Subscribed path state (1=streaming, 0=skipped as unsupported by the switch)",
+			},
+			[]string{"switch", "target", "path"},
+		),
+	}
+
+	m.state = mustRegister(m.state)
+	m.reconnects = mustRegister(m.reconnects)
+	m.lastUpdate = mustRegister(m.lastUpdate)
+	m.synced = mustRegister(m.synced)
+	m.updateRate = mustRegister(m.updateRate)
+	m.info = mustRegister(m.info)
+	m.models = mustRegister(m.models)
+	m.lineCards = mustRegister(m.lineCards)
+	m.subscriptionActive = mustRegister(m.subscriptionActive)
+
+	return m
+}
+
+func mustRegister[T prometheus.Collector](c T) T {
+	c, err := register(c)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Run keeps the subscription alive until ctx is cancelled, reconnecting with
+// exponential backoff and jitter; a session that synced resets the backoff
+func (c *GNMICollector) Run(ctx context.Context) {
+	go c.publishUpdateRate(ctx)
+
+	backoff := minBackoff
+	for {
+		c.setState(sessionConnecting)
+		err := c.Subscribe(ctx)
+		c.setState(sessionDisconnected)
+		c.health.synced.WithLabelValues(c.name, c.target).Set(0)
+		if ctx.Err() != nil {
+			return
+		}
+
+		reason := "error"
+		if errors.Is(err, errStalled) {
+			reason = "stalled"
+		}
+		if atomic.LoadInt32(&c.synced) == 1 {
+			backoff = minBackoff
+		}
+		delay := jitter(backoff)
+		log.Printf("⚠️  gNMI session to %s (%s) ended: %v, reconnecting in %v", c.name, c.target, err, delay.Round(time.Millisecond))
+		c.health.reconnects.WithLabelValues(c.name, c.target, reason).Inc()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+func (c *GNMICollector) setState(state int) {
+	c.health.state.WithLabelValues(c.name, c.target).Set(float64(state))
+}
+
+// publishUpdateRate turns the update count into a per-second rate
+func (c *GNMICollector) publishUpdateRate(ctx context.Context) {
+	ticker := time.NewTicker(updateRateInterval)
+	defer ticker.Stop()
+
+	var last uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			count := atomic.LoadUint64(&c.updates)
+			c.health.updateRate.WithLabelValues(c.name, c.target).Set(float64(count-last) / updateRateInterval.Seconds())
+			last = count
+		}
+	}
+}
+
+// jitter spreads reconnects of switches that failed together between d/2 and d
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
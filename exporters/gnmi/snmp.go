@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultSNMPInterval = 10 * time.Second
+	snmpTimeout         = 5 * time.Second
+
+	// IF-MIB
+	oidIfDescr       = "1.3.6.1.2.1.2.2.1.2"
+	oidIfInDiscards  = "1.3.6.1.2.1.2.2.1.13"
+	oidIfInErrors    = "1.3.6.1.2.1.2.2.1.14"
+	oidIfOutDiscards = "1.3.6.1.2.1.2.2.1.19"
+	oidIfOutErrors   = "1.3.6.1.2.1.2.2.1.20"
+	oidIfName        = "1.3.6.1.2.1.31.1.1.1.1"
+	oidIfHCInOctets  = "1.3.6.1.2.1.31.1.1.1.6"
+	oidIfHCOutOctets = "1.3.6.1.2.1.31.1.1.1.10"
+
+	// IGMP-STD-MIB
+	oidIGMPInterfaceQuerier = "1.3.6.1.2.1.85.1.1.1.5" // Indexed by ifIndex
+	oidIGMPCacheStatus      = "1.3.6.1.2.1.85.1.2.1.7" // Indexed by group address and ifIndex
+)
+
+// IF-MIB columns polled into the interface counters of the gNMI mapping
+var snmpInterfaceCounters = []struct {
+	oid, metric string
+}{
+	{oidIfHCInOctets, "st2110_switch_interface_rx_bytes"},
+	{oidIfHCOutOctets, "st2110_switch_interface_tx_bytes"},
+	{oidIfInErrors, "st2110_switch_interface_rx_errors"},
+	{oidIfOutErrors, "st2110_switch_interface_tx_errors"},
+	{oidIfInDiscards, "st2110_switch_interface_rx_drops"},
+	{oidIfOutDiscards, "st2110_switch_interface_tx_drops"},
+}
+
+// Per-queue drop counters of the vendor MIBs, indexed by ifIndex then the
+// queue; switches.yaml can name another column with snmp.queue_drops_oid
+var snmpQueueDropOIDs = map[string]string{
+	// ARISTA-QUEUE-MIB aristaEgressQueuePktsDropped, the queue as traffic
+	// type (1=unicast, 2=multicast) and queue index
+	"arista": "1.3.6.1.4.1.30065.3.6.1.2.1.4",
+}
+
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"MD5":    gosnmp.MD5,
+	"SHA":    gosnmp.SHA,
+	"SHA224": gosnmp.SHA224,
+	"SHA256": gosnmp.SHA256,
+	"SHA384": gosnmp.SHA384,
+	"SHA512": gosnmp.SHA512,
+}
+
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"DES":    gosnmp.DES,
+	"AES":    gosnmp.AES,
+	"AES192": gosnmp.AES192,
+	"AES256": gosnmp.AES256,
+}
+
+func (s SNMPConfig) validate(sw SwitchConfig) error {
+	switch s.Version {
+	case "", "2c":
+		if s.Community == "" {
+			return fmt.Errorf("SNMP v2c needs a community")
+		}
+	case "3":
+		if sw.Username == "" || (sw.Password == "" && sw.PasswordFile == "") {
+			return fmt.Errorf("SNMP v3 needs a username and a password")
+		}
+		if _, ok := snmpAuthProtocols[strings.ToUpper(s.AuthProtocol)]; s.AuthProtocol != "" && !ok {
+			return fmt.Errorf("unknown SNMP auth_protocol %q", s.AuthProtocol)
+		}
+		if _, ok := snmpPrivProtocols[strings.ToUpper(s.PrivProtocol)]; s.PrivProtocol != "" && !ok {
+			return fmt.Errorf("unknown SNMP priv_protocol %q", s.PrivProtocol)
+		}
+	default:
+		return fmt.Errorf("unknown SNMP version %q", s.Version)
+	}
+	if s.Interval < 0 {
+		return fmt.Errorf("negative SNMP interval")
+	}
+	return nil
+}
+
+// snmpWalker walks a subtree of a switch's MIB
+type snmpWalker interface {
+	BulkWalkAll(rootOid string) ([]gosnmp.SnmpPDU, error)
+}
+
+// SNMPMetrics reports the polls of the switches without gNMI
+type SNMPMetrics struct {
+	up       *prometheus.GaugeVec
+	duration *prometheus.GaugeVec
+	failures *prometheus.CounterVec
+}
+
+func NewSNMPMetrics() *SNMPMetrics {
+	labels := []string{"switch", "target"}
+
+	m := &SNMPMetrics{
+		up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_snmp_up",
+				Help: "Last SNMP poll of the switch succeeded (1=yes, 0=no)",
+			},
+			labels,
+		),
+		duration: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_snmp_poll_duration_seconds",
+				Help: "Duration of the last SNMP poll",
+			},
+			labels,
+		),
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_snmp_poll_failures_total",
+				Help: "SNMP polls that failed",
+			},
+			labels,
+		),
+	}
+
+	m.up = mustRegister(m.up)
+	m.duration = mustRegister(m.duration)
+	m.failures = mustRegister(m.failures)
+	return m
+}
+
+// SNMPCollector polls a switch without gNMI over SNMP into the same
+// st2110_switch_* metrics the gNMI mappings produce
+type SNMPCollector struct {
+	name     string
+	target   string
+	config   SwitchConfig
+	interval time.Duration
+	queueOID string // Vendor queue drop counters, "" without
+
+	// Opens a session for one poll
+	connect func(ctx context.Context) (snmpWalker, func(), error)
+
+	counters   map[string]*DeviceCounter
+	queueDrops *DeviceCounter
+	multicast  *multicastTables
+	health     *SNMPMetrics
+
+	interfaces map[string]bool // Published interfaces
+	queues     map[string][]string
+	up         bool
+}
+
+func NewSNMPCollector(sw SwitchConfig, metrics *MetricSet, health *SNMPMetrics) (*SNMPCollector, error) {
+	c := &SNMPCollector{
+		name:       sw.Name,
+		target:     sw.Target,
+		config:     sw,
+		interval:   sw.SNMP.Interval,
+		queueOID:   strings.TrimPrefix(snmpQueueDropOIDs[sw.Vendor], "."),
+		counters:   make(map[string]*DeviceCounter),
+		health:     health,
+		interfaces: make(map[string]bool),
+		queues:     make(map[string][]string),
+	}
+	if c.interval == 0 {
+		c.interval = defaultSNMPInterval
+	}
+	if sw.SNMP.QueueDropsOID != "" {
+		c.queueOID = strings.TrimPrefix(sw.SNMP.QueueDropsOID, ".")
+	}
+	c.connect = c.dial
+
+	var err error
+	for _, counter := range snmpInterfaceCounters {
+		if c.counters[counter.metric], err = metrics.Counter(counter.metric, "", []string{"switch", "interface"}); err != nil {
+			return nil, err
+		}
+	}
+	if c.queueDrops, err = metrics.Counter("st2110_switch_qos_dropped_packets", "", []string{"switch", "interface", "queue"}); err != nil {
+		return nil, err
+	}
+	if c.multicast, err = newMulticastTables(metrics); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial opens an SNMP session to the switch; the password file is read on
+// every poll so rotated secrets take effect
+func (c *SNMPCollector) dial(ctx context.Context) (snmpWalker, func(), error) {
+	host, port := c.target, uint16(161)
+	if h, p, err := net.SplitHostPort(c.target); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("target port: %w", err)
+		}
+		host, port = h, uint16(n)
+	}
+
+	client := &gosnmp.GoSNMP{
+		Target:  host,
+		Port:    port,
+		Timeout: snmpTimeout,
+		Retries: 1,
+		Context: ctx,
+	}
+	snmp := c.config.SNMP
+	if snmp.Version == "3" {
+		password := c.config.Password
+		if c.config.PasswordFile != "" {
+			secret, err := readSecret(c.config.PasswordFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("password file: %w", err)
+			}
+			password = secret
+		}
+		auth, ok := snmpAuthProtocols[strings.ToUpper(snmp.AuthProtocol)]
+		if !ok {
+			auth = gosnmp.SHA
+		}
+		params := &gosnmp.UsmSecurityParameters{
+			UserName:                 c.config.Username,
+			AuthenticationProtocol:   auth,
+			AuthenticationPassphrase: password,
+			PrivacyProtocol:          gosnmp.NoPriv,
+		}
+		client.MsgFlags = gosnmp.AuthNoPriv
+		if snmp.PrivPassword != "" {
+			priv, ok := snmpPrivProtocols[strings.ToUpper(snmp.PrivProtocol)]
+			if !ok {
+				priv = gosnmp.AES
+			}
+			params.PrivacyProtocol, params.PrivacyPassphrase = priv, snmp.PrivPassword
+			client.MsgFlags = gosnmp.AuthPriv
+		}
+		client.Version = gosnmp.Version3
+		client.SecurityModel = gosnmp.UserSecurityModel
+		client.SecurityParameters = params
+	} else {
+		client.Version = gosnmp.Version2c
+		client.Community = snmp.Community
+	}
+
+	if err := client.Connect(); err != nil {
+		return nil, nil, err
+	}
+	return client, func() { client.Conn.Close() }, nil
+}
+
+// Run polls the switch every interval until ctx is cancelled
+func (c *SNMPCollector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll runs one poll and records its outcome; failures are logged when the
+// switch stops answering
+func (c *SNMPCollector) poll(ctx context.Context) {
+	start := time.Now()
+	err := c.collect(ctx)
+	c.health.duration.WithLabelValues(c.name, c.target).Set(time.Since(start).Seconds())
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		if c.up {
+			log.Printf("⚠️  SNMP poll of %s (%s) failed: %v", c.name, c.target, err)
+		}
+		c.up = false
+		c.health.up.WithLabelValues(c.name, c.target).Set(0)
+		c.health.failures.WithLabelValues(c.name, c.target).Inc()
+		return
+	}
+	if !c.up {
+		log.Printf("Polling %s (%s) over SNMP", c.name, c.target)
+	}
+	c.up = true
+	c.health.up.WithLabelValues(c.name, c.target).Set(1)
+}
+
+// collect walks IF-MIB, IGMP-STD-MIB and the vendor queue MIB once
+func (c *SNMPCollector) collect(ctx context.Context) error {
+	walker, done, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	names, err := c.interfaceNames(walker)
+	if err != nil {
+		return err
+	}
+
+	// Walk everything before publishing, so a failed poll leaves the last state
+	columns := make(map[string][]gosnmp.SnmpPDU, len(snmpInterfaceCounters))
+	for _, counter := range snmpInterfaceCounters {
+		if columns[counter.oid], err = walker.BulkWalkAll(counter.oid); err != nil {
+			return fmt.Errorf("%s: %w", counter.metric, err)
+		}
+	}
+	queriers, err := walker.BulkWalkAll(oidIGMPInterfaceQuerier)
+	if err != nil {
+		return fmt.Errorf("IGMP interfaces: %w", err)
+	}
+	cache, err := walker.BulkWalkAll(oidIGMPCacheStatus)
+	if err != nil {
+		return fmt.Errorf("IGMP cache: %w", err)
+	}
+	var queues []gosnmp.SnmpPDU
+	if c.queueOID != "" {
+		if queues, err = walker.BulkWalkAll(c.queueOID); err != nil {
+			return fmt.Errorf("queue drops: %w", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, counter := range snmpInterfaceCounters {
+		for _, pdu := range columns[counter.oid] {
+			name, ok := names[oidIndex(pdu.Name, counter.oid)]
+			value, numeric := snmpValue(pdu)
+			if !ok || !numeric {
+				continue
+			}
+			c.counters[counter.metric].Observe([]string{c.name, name}, value)
+			seen[name] = true
+		}
+	}
+	for name := range c.interfaces {
+		if !seen[name] {
+			for _, counter := range c.counters {
+				counter.DeletePartialMatch(prometheus.Labels{"switch": c.name, "interface": name})
+			}
+		}
+	}
+	c.interfaces = seen
+
+	c.publishIGMP(names, queriers, cache)
+	c.publishQueues(names, queues)
+	return nil
+}
+
+// interfaceNames maps ifIndex to ifName, or ifDescr where ifName is empty
+func (c *SNMPCollector) interfaceNames(walker snmpWalker) (map[string]string, error) {
+	names := make(map[string]string)
+	for _, oid := range []string{oidIfDescr, oidIfName} {
+		pdus, err := walker.BulkWalkAll(oid)
+		if err != nil {
+			return nil, fmt.Errorf("interface names: %w", err)
+		}
+		for _, pdu := range pdus {
+			if name := snmpString(pdu); name != "" {
+				names[oidIndex(pdu.Name, oid)] = name
+			}
+		}
+	}
+	return names, nil
+}
+
+// publishIGMP feeds the IGMP querier and group cache into the multicast
+// tables, which drop what this poll no longer returned
+func (c *SNMPCollector) publishIGMP(names map[string]string, queriers, cache []gosnmp.SnmpPDU) {
+	c.multicast.StartSync(c.name)
+	for _, pdu := range queriers {
+		name, ok := names[oidIndex(pdu.Name, oidIGMPInterfaceQuerier)]
+		if !ok {
+			continue
+		}
+		c.multicast.SetQuerier(c.name, snmpVLAN(name), snmpString(pdu))
+	}
+	for _, pdu := range cache {
+		// Only active rows (RowStatus 1)
+		if status, ok := snmpValue(pdu); !ok || status != 1 {
+			continue
+		}
+		index := strings.Split(oidIndex(pdu.Name, oidIGMPCacheStatus), ".")
+		if len(index) != 5 {
+			continue
+		}
+		name, ok := names[index[4]]
+		if !ok {
+			continue
+		}
+		c.multicast.AddMember(c.name, snmpVLAN(name), strings.Join(index[:4], "."), "")
+	}
+	c.multicast.Sweep(c.name)
+}
+
+// publishQueues records the vendor queue drop counters
+func (c *SNMPCollector) publishQueues(names map[string]string, pdus []gosnmp.SnmpPDU) {
+	seen := make(map[string][]string)
+	for _, pdu := range pdus {
+		index := strings.SplitN(oidIndex(pdu.Name, c.queueOID), ".", 2)
+		if len(index) != 2 {
+			continue
+		}
+		name, ok := names[index[0]]
+		value, numeric := snmpValue(pdu)
+		if !ok || !numeric {
+			continue
+		}
+		labels := []string{c.name, name, index[1]}
+		c.queueDrops.Observe(labels, value)
+		seen[strings.Join(labels, "\xff")] = labels
+	}
+	for key, labels := range c.queues {
+		if _, ok := seen[key]; !ok {
+			c.queueDrops.DeletePartialMatch(prometheus.Labels{"switch": labels[0], "interface": labels[1], "queue": labels[2]})
+		}
+	}
+	c.queues = seen
+}
+
+// snmpVLAN is the VLAN label of an IGMP interface: the VLAN ID of a VLAN
+// interface, the interface name otherwise
+func snmpVLAN(name string) string {
+	if len(name) > 4 && strings.EqualFold(name[:4], "vlan") {
+		if id := strings.TrimSpace(name[4:]); id != "" {
+			if _, err := strconv.Atoi(id); err == nil {
+				return id
+			}
+		}
+	}
+	return name
+}
+
+// oidIndex returns the index of a column instance, without the column OID
+func oidIndex(name, column string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(name, "."), column+".")
+}
+
+// snmpValue converts an integer, counter or gauge PDU to a number
+func snmpValue(pdu gosnmp.SnmpPDU) (float64, bool) {
+	switch pdu.Type {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Counter64, gosnmp.Gauge32, gosnmp.Uinteger32, gosnmp.TimeTicks:
+		f, _ := new(big.Float).SetInt(gosnmp.ToBigInt(pdu.Value)).Float64()
+		return f, true
+	}
+	return 0, false
+}
+
+// snmpString converts an octet string or IP address PDU to a string
+func snmpString(pdu gosnmp.SnmpPDU) string {
+	switch v := pdu.Value.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return ""
+}
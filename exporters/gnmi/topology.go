@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lldpKey is an LLDP neighbor seen on a local interface
+type lldpKey struct {
+	iface string
+	id    string
+}
+
+// lldpNeighbor is what a switch learned about a neighbor, leaf by leaf
+type lldpNeighbor struct {
+	systemName        string
+	chassisID         string
+	portID            string
+	portDescription   string
+	managementAddress string
+}
+
+// switchLLDP is the LLDP table of one switch
+type switchLLDP struct {
+	hostname  string
+	neighbors map[lldpKey]*lldpNeighbor
+	stale     map[lldpKey]bool // Not reported again since the stream restarted
+}
+
+// TopologyNode is a switch of switches.yaml or a host one of them sees
+type TopologyNode struct {
+	Name              string `json:"name"`
+	Type              string `json:"type"` // switch or host
+	ChassisID         string `json:"chassis_id,omitempty"`
+	ManagementAddress string `json:"management_address,omitempty"`
+}
+
+// TopologyEnd is one end of a link
+type TopologyEnd struct {
+	Node      string `json:"node"`
+	Interface string `json:"interface"`
+}
+
+// TopologyLink is a link seen by LLDP from one or both ends
+type TopologyLink struct {
+	A                  TopologyEnd `json:"a"`
+	B                  TopologyEnd `json:"b"`
+	OperStatus         string      `json:"oper_status,omitempty"` // Of A's interface
+	SpeedBps           float64     `json:"speed_bps,omitempty"`
+	UtilizationPercent *float64    `json:"utilization_percent,omitempty"` // A to B
+}
+
+// TopologyGraph is the fabric as LLDP sees it
+type TopologyGraph struct {
+	Nodes []TopologyNode `json:"nodes"`
+	Links []TopologyLink `json:"links"`
+}
+
+// topologyTable builds the fabric topology from the OpenConfig LLDP
+// neighbor tables of every switch
+type topologyTable struct {
+	*pathPlugin
+	interfaces *interfaceTable // Link state, nil without it
+
+	mu       sync.Mutex
+	switches []string
+	lldp     map[string]*switchLLDP
+
+	linkInfo        *prometheus.GaugeVec
+	linkUp          *prometheus.GaugeVec
+	linkUtilization *prometheus.GaugeVec
+	published       map[*prometheus.GaugeVec]map[string][]string
+}
+
+func newTopologyTable(interfaces *interfaceTable, metrics *MetricSet) (*topologyTable, error) {
+	t := &topologyTable{
+		interfaces: interfaces,
+		lldp:       make(map[string]*switchLLDP),
+		published:  make(map[*prometheus.GaugeVec]map[string][]string),
+	}
+
+	labels := []string{"switch", "interface", "neighbor", "neighbor_interface"}
+	var err error
+	if t.linkInfo, err = metrics.Gauge("st2110_topology_link_info", "LLDP neighbor on a switch interface (always 1)", append(labels, "neighbor_type")); err != nil {
+		return nil, err
+	}
+	if t.linkUp, err = metrics.Gauge("st2110_topology_link_up", "Oper status of the switch end of a link (1=up, 0=down)", labels); err != nil {
+		return nil, err
+	}
+	if t.linkUtilization, err = metrics.Gauge("st2110_topology_link_utilization_percent", "Utilization of a link towards the neighbor, all traffic", labels); err != nil {
+		return nil, err
+	}
+
+	t.pathPlugin, err = newPathPlugin("topology", []vendorPath{
+		{
+			name:         "lldp_neighbors",
+			config:       PathConfig{Path: "/lldp/interfaces/interface[name=*]/neighbors/neighbor[id=*]/state", Mode: "on_change"},
+			handle:       t.handleNeighbor,
+			handleDelete: t.deleteNeighbor,
+		},
+		{
+			// The name the switch's neighbors know it by
+			name:   "system_hostname",
+			config: PathConfig{Path: hostnamePath, Mode: "on_change"},
+			handle: t.handleHostname,
+		},
+	}, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// AddSwitch includes a switch of switches.yaml in the topology
+func (t *topologyTable) AddSwitch(switchName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.switches = append(t.switches, switchName)
+	sort.Strings(t.switches)
+}
+
+// state returns the LLDP table of a switch; t.mu must be held
+func (t *topologyTable) state(switchName string) *switchLLDP {
+	s, ok := t.lldp[switchName]
+	if !ok {
+		s = &switchLLDP{neighbors: make(map[lldpKey]*lldpNeighbor)}
+		t.lldp[switchName] = s
+	}
+	return s
+}
+
+func (t *topologyTable) handleNeighbor(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	key := lldpKey{iface: keyValue(elems, "interface", "name"), id: keyValue(elems, "neighbor", "id")}
+	if key.iface == "" || key.id == "" {
+		return
+	}
+
+	t.mu.Lock()
+	s := t.state(switchName)
+	n, ok := s.neighbors[key]
+	if !ok {
+		n = &lldpNeighbor{}
+		s.neighbors[key] = n
+	}
+	delete(s.stale, key)
+	for leaf, field := range map[string]*string{
+		"system-name":        &n.systemName,
+		"chassis-id":         &n.chassisID,
+		"port-id":            &n.portID,
+		"port-description":   &n.portDescription,
+		"management-address": &n.managementAddress,
+	} {
+		if v, ok := leaves[leaf].(string); ok {
+			*field = v
+		}
+	}
+	t.mu.Unlock()
+}
+
+func (t *topologyTable) deleteNeighbor(switchName string, elems []*gnmi.PathElem, leaf string) {
+	if leaf != "" {
+		return
+	}
+	iface := keyValue(elems, "interface", "name")
+	id := keyValue(elems, "neighbor", "id")
+
+	t.mu.Lock()
+	if s, ok := t.lldp[switchName]; ok {
+		for key := range s.neighbors {
+			if (iface == "" || key.iface == iface) && (id == "" || key.id == id) {
+				delete(s.neighbors, key)
+			}
+		}
+	}
+	t.mu.Unlock()
+}
+
+func (t *topologyTable) handleHostname(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	hostname, ok := leaves["hostname"].(string)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	t.state(switchName).hostname = hostname
+	t.mu.Unlock()
+}
+
+// HandleStreamStart marks the neighbors of a switch stale until the new
+// stream reports them again
+func (t *topologyTable) HandleStreamStart(switchName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(switchName)
+	s.stale = make(map[lldpKey]bool, len(s.neighbors))
+	for key := range s.neighbors {
+		s.stale[key] = true
+	}
+}
+
+// HandleSync drops the neighbors the switch no longer reports
+func (t *topologyTable) HandleSync(switchName string) {
+	t.mu.Lock()
+	if s, ok := t.lldp[switchName]; ok {
+		for key := range s.stale {
+			delete(s.neighbors, key)
+		}
+		s.stale = nil
+	}
+	t.mu.Unlock()
+}
+
+// resolve names a neighbor: the configured switch whose name or hostname it
+// reports, or its own system name (chassis ID without one); t.mu must be held
+func (t *topologyTable) resolve(n *lldpNeighbor) (name string, isSwitch bool) {
+	if n.systemName != "" {
+		short := strings.ToLower(strings.SplitN(n.systemName, ".", 2)[0])
+		for _, sw := range t.switches {
+			hostname := ""
+			if s, ok := t.lldp[sw]; ok {
+				hostname = s.hostname
+			}
+			if strings.EqualFold(n.systemName, sw) || strings.EqualFold(n.systemName, hostname) ||
+				short == strings.ToLower(sw) || (hostname != "" && short == strings.ToLower(strings.SplitN(hostname, ".", 2)[0])) {
+				return sw, true
+			}
+		}
+		return n.systemName, false
+	}
+	return n.chassisID, false
+}
+
+// remotePort is the neighbor's interface: its port ID, or the description
+// when the ID is a MAC address as hosts often send
+func remotePort(n *lldpNeighbor) string {
+	if n.portDescription != "" && (n.portID == "" || strings.Count(n.portID, ":") == 5) {
+		return n.portDescription
+	}
+	return n.portID
+}
+
+// Graph returns the current topology; a link both ends report appears once
+func (t *topologyTable) Graph() TopologyGraph {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	graph := TopologyGraph{Nodes: []TopologyNode{}, Links: []TopologyLink{}}
+	nodes := make(map[string]*TopologyNode)
+	for _, sw := range t.switches {
+		nodes[sw] = &TopologyNode{Name: sw, Type: "switch"}
+	}
+	links := make(map[string]bool)
+	for _, sw := range t.switches {
+		s, ok := t.lldp[sw]
+		if !ok {
+			continue
+		}
+		for key, n := range s.neighbors {
+			name, isSwitch := t.resolve(n)
+			if name == "" {
+				continue
+			}
+			node, ok := nodes[name]
+			if !ok {
+				node = &TopologyNode{Name: name, Type: "host"}
+				nodes[name] = node
+			}
+			if isSwitch || node.ChassisID == "" {
+				node.ChassisID = n.chassisID
+			}
+			if n.managementAddress != "" {
+				node.ManagementAddress = n.managementAddress
+			}
+
+			link := TopologyLink{A: TopologyEnd{Node: sw, Interface: key.iface}, B: TopologyEnd{Node: name, Interface: remotePort(n)}}
+			ends := []string{link.A.Node + "\xff" + link.A.Interface, link.B.Node + "\xff" + link.B.Interface}
+			sort.Strings(ends)
+			if id := strings.Join(ends, "\xff\xff"); !links[id] {
+				links[id] = true
+				t.linkState(&link)
+				graph.Links = append(graph.Links, link)
+			}
+		}
+	}
+
+	for _, node := range nodes {
+		graph.Nodes = append(graph.Nodes, *node)
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].Name < graph.Nodes[j].Name })
+	sort.Slice(graph.Links, func(i, j int) bool {
+		a, b := graph.Links[i], graph.Links[j]
+		if a.A.Node != b.A.Node {
+			return a.A.Node < b.A.Node
+		}
+		return a.A.Interface < b.A.Interface
+	})
+	return graph
+}
+
+// linkState fills in the state of the link's A end
+func (t *topologyTable) linkState(link *TopologyLink) {
+	if t.interfaces == nil {
+		return
+	}
+	state, ok := t.interfaces.Interface(link.A.Node, link.A.Interface)
+	if !ok {
+		return
+	}
+	link.OperStatus = state.operStatus
+	link.SpeedBps = state.speed
+	if state.speed > 0 {
+		utilization := state.txRate / state.speed * 100
+		link.UtilizationPercent = &utilization
+	}
+}
+
+// Run publishes the link metrics until ctx is cancelled; neighbor changes
+// show at the next tick rather than rebuilding the table on every update
+func (t *topologyTable) Run(ctx context.Context) {
+	ticker := time.NewTicker(interfaceSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.publish()
+		}
+	}
+}
+
+// publish sets the link metrics from every switch's point of view and removes
+// the series of links that are gone
+func (t *topologyTable) publish() {
+	// One lock across building and deleting, so an older snapshot never
+	// removes the series a newer one set
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	type seen struct {
+		labels       []string
+		neighborType string
+	}
+	var links []seen
+	for _, sw := range t.switches {
+		s, ok := t.lldp[sw]
+		if !ok {
+			continue
+		}
+		for key, n := range s.neighbors {
+			name, isSwitch := t.resolve(n)
+			neighborType := "host"
+			if isSwitch {
+				neighborType = "switch"
+			}
+			links = append(links, seen{labels: []string{sw, key.iface, name, remotePort(n)}, neighborType: neighborType})
+		}
+	}
+
+	current := make(map[*prometheus.GaugeVec]map[string][]string)
+	set := func(vec *prometheus.GaugeVec, value float64, labels ...string) {
+		if current[vec] == nil {
+			current[vec] = make(map[string][]string)
+		}
+		current[vec][strings.Join(labels, "\xff")] = labels
+		vec.WithLabelValues(labels...).Set(value)
+	}
+	for _, link := range links {
+		set(t.linkInfo, 1, append(link.labels, link.neighborType)...)
+		end := TopologyLink{A: TopologyEnd{Node: link.labels[0], Interface: link.labels[1]}}
+		t.linkState(&end)
+		if end.OperStatus != "" {
+			set(t.linkUp, boolToFloat(end.OperStatus == "UP"), link.labels...)
+		}
+		if end.UtilizationPercent != nil {
+			set(t.linkUtilization, *end.UtilizationPercent, link.labels...)
+		}
+	}
+
+	for vec, series := range t.published {
+		for key, labels := range series {
+			if _, ok := current[vec][key]; !ok {
+				vec.DeleteLabelValues(labels...)
+			}
+		}
+	}
+	t.published = current
+}
+
+// ServeHTTP returns the topology as JSON, or as Graphviz DOT with
+// ?format=dot
+func (t *topologyTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	graph := t.Graph()
+	if r.URL.Query().Get("format") == "dot" || strings.HasSuffix(r.URL.Path, ".dot") {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		writeDOT(w, graph)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(graph)
+}
+
+// writeDOT renders the topology: switches as boxes, hosts as ellipses, links
+// labelled with their interfaces and red when down
+func writeDOT(w http.ResponseWriter, graph TopologyGraph) {
+	fmt.Fprintln(w, "graph fabric {")
+	fmt.Fprintln(w, "  node [fontname=Helvetica];")
+	for _, node := range graph.Nodes {
+		shape := "ellipse"
+		if node.Type == "switch" {
+			shape = "box"
+		}
+		fmt.Fprintf(w, "  %q [shape=%s];\n", node.Name, shape)
+	}
+	for _, link := range graph.Links {
+		attrs := fmt.Sprintf("taillabel=%q, headlabel=%q", link.A.Interface, link.B.Interface)
+		if link.OperStatus != "" && link.OperStatus != "UP" {
+			attrs += ", color=red"
+		}
+		fmt.Fprintf(w, "  %q -- %q [%s];\n", link.A.Node, link.B.Node, attrs)
+	}
+	fmt.Fprintln(w, "}")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+)
+
+// VendorPlugin adds a switch vendor's own subscriptions and parsers to the
+// generic collection; they share the switch's connection and stream
+type VendorPlugin interface {
+	Name() string
+	Subscriptions() []*gnmi.Subscription
+	HandleUpdate(switchName string, path *gnmi.Path, value *gnmi.TypedValue)
+	HandleDelete(switchName string, path *gnmi.Path)
+	// HandleStreamStart and HandleSync bracket the state a target replays on
+	// every new stream, so that plugins keeping tables can drop what is gone
+	HandleStreamStart(switchName string)
+	HandleSync(switchName string)
+}
+
+// Plugins by SwitchConfig.Vendor; one instance serves every switch of the vendor
+var vendorPlugins = map[string]func(metrics *MetricSet) (VendorPlugin, error){
+	"arista":  newAristaPlugin,
+	"cisco":   newCiscoPlugin,
+	"juniper": newJuniperPlugin,
+}
+
+// NewVendorPlugin returns the plugin of a vendor, or nil if it has none
+func NewVendorPlugin(vendor string, metrics *MetricSet) (VendorPlugin, error) {
+	factory, ok := vendorPlugins[strings.ToLower(vendor)]
+	if !ok {
+		return nil, nil
+	}
+	plugin, err := factory(metrics)
+	if err != nil {
+		return nil, fmt.Errorf("%s plugin: %w", vendor, err)
+	}
+	return plugin, nil
+}
+
+// pluginChain runs several plugins on one switch session
+type pluginChain []VendorPlugin
+
+// chainPlugins combines the plugins that are not nil
+func chainPlugins(plugins ...VendorPlugin) VendorPlugin {
+	var chain pluginChain
+	for _, plugin := range plugins {
+		if plugin != nil {
+			chain = append(chain, plugin)
+		}
+	}
+	switch len(chain) {
+	case 0:
+		return nil
+	case 1:
+		return chain[0]
+	}
+	return chain
+}
+
+func (c pluginChain) Name() string {
+	names := make([]string, 0, len(c))
+	for _, plugin := range c {
+		names = append(names, plugin.Name())
+	}
+	return strings.Join(names, "+")
+}
+
+func (c pluginChain) Subscriptions() []*gnmi.Subscription {
+	var subscriptions []*gnmi.Subscription
+	for _, plugin := range c {
+		subscriptions = append(subscriptions, plugin.Subscriptions()...)
+	}
+	return subscriptions
+}
+
+func (c pluginChain) HandleUpdate(switchName string, path *gnmi.Path, value *gnmi.TypedValue) {
+	for _, plugin := range c {
+		plugin.HandleUpdate(switchName, path, value)
+	}
+}
+
+func (c pluginChain) HandleDelete(switchName string, path *gnmi.Path) {
+	for _, plugin := range c {
+		plugin.HandleDelete(switchName, path)
+	}
+}
+
+func (c pluginChain) HandleStreamStart(switchName string) {
+	for _, plugin := range c {
+		plugin.HandleStreamStart(switchName)
+	}
+}
+
+func (c pluginChain) HandleSync(switchName string) {
+	for _, plugin := range c {
+		plugin.HandleSync(switchName)
+	}
+}
+
+// vendorPath is a vendor subscription with the metrics mapped from it and an
+// optional parser for what a mapping cannot express
+type vendorPath struct {
+	name   string
+	config PathConfig
+	match  string // Update paths, when the target reports them outside the subscribed path
+	handle func(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{})
+	// Called for deletes covering the subscribed path or below it, with the
+	// deleted leaf relative to it ("" when the whole path is gone)
+	handleDelete func(switchName string, elems []*gnmi.PathElem, leaf string)
+}
+
+// pathPlugin implements VendorPlugin over a set of compiled vendor paths
+type pathPlugin struct {
+	name  string
+	paths []*pathSpec
+}
+
+func newPathPlugin(name string, paths []vendorPath, metrics *MetricSet) (*pathPlugin, error) {
+	p := &pathPlugin{name: name}
+	for _, vp := range paths {
+		spec, err := compilePath(vp.name, vp.config, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", vp.name, err)
+		}
+		if vp.match != "" {
+			if spec.pattern, err = ParsePath(vp.match); err != nil {
+				return nil, fmt.Errorf("%s: %w", vp.name, err)
+			}
+		}
+		spec.handle = vp.handle
+		spec.handleDelete = vp.handleDelete
+		p.paths = append(p.paths, spec)
+	}
+	return p, nil
+}
+
+func (p *pathPlugin) Name() string {
+	return p.name
+}
+
+func (p *pathPlugin) Subscriptions() []*gnmi.Subscription {
+	subscriptions := make([]*gnmi.Subscription, 0, len(p.paths))
+	for _, spec := range p.paths {
+		subscriptions = append(subscriptions, spec.subscription)
+	}
+	return subscriptions
+}
+
+func (p *pathPlugin) HandleUpdate(switchName string, path *gnmi.Path, value *gnmi.TypedValue) {
+	for _, spec := range p.paths {
+		spec.apply(switchName, path, value)
+	}
+}
+
+func (p *pathPlugin) HandleDelete(switchName string, path *gnmi.Path) {
+	for _, spec := range p.paths {
+		spec.remove(switchName, path)
+	}
+}
+
+func (p *pathPlugin) HandleStreamStart(switchName string) {}
+
+func (p *pathPlugin) HandleSync(switchName string) {}
+
+// keyValues returns the values of key on every elem named name, outermost first
+func keyValues(elems []*gnmi.PathElem, name, key string) []string {
+	var values []string
+	for _, elem := range elems {
+		if elem.Name == name {
+			values = append(values, elem.Key[key])
+		}
+	}
+	return values
+}
+
+// keyValue returns the value of key on the first elem named name, or ""
+func keyValue(elems []*gnmi.PathElem, name, key string) string {
+	if values := keyValues(elems, name, key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
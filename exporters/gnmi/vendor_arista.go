@@ -0,0 +1,329 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// aristaPTPState is the last PTP state an EOS boundary clock reported, which
+// arrives leaf by leaf on change
+type aristaPTPState struct {
+	domain   string
+	locked   float64
+	haveLock bool
+}
+
+// Prefixes of the EOS multicast models
+const (
+	aristaIGMPSnooping = "arista:/eos/arista-exp-eos-igmpsnooping/igmp-snooping/vlans/vlan[vlan-id=*]"
+	aristaMroutes      = "arista:/eos/arista-exp-eos-multicast/multicast/vrfs/vrf[name=*]/routes/route[source=*][group=*]"
+)
+
+// Prefix of the EOS QoS model
+const aristaQoS = "arista:/eos/arista-exp-eos-qos/qos/interfaces/interface[name=*]"
+
+// aristaPlugin collects EOS hardware queue drops, LANZ queue lengths, ECN and
+// PFC counters, PTP boundary clock lock, IGMP snooping, multicast routes and
+// hardware multicast table usage from the arista-exp-eos models
+type aristaPlugin struct {
+	*pathPlugin
+
+	mu    sync.Mutex
+	drops map[string]float64 // Last hardware drop count per switch/interface/queue
+	ptp   map[string]*aristaPTPState
+
+	ptpLockStatus *prometheus.GaugeVec
+	multicast     *multicastTables
+	buffers       *bufferTelemetry
+}
+
+func newAristaPlugin(metrics *MetricSet) (VendorPlugin, error) {
+	p := &aristaPlugin{
+		drops: make(map[string]float64),
+		ptp:   make(map[string]*aristaPTPState),
+	}
+
+	var err error
+	p.ptpLockStatus, err = metrics.Gauge("arista_ptp_lock_status", "PTP lock status (1=locked, 0=unlocked)", []string{"switch", "domain"})
+	if err != nil {
+		return nil, err
+	}
+	if p.multicast, err = newMulticastTables(metrics); err != nil {
+		return nil, err
+	}
+	if p.buffers, err = newBufferTelemetry(metrics); err != nil {
+		return nil, err
+	}
+
+	p.pathPlugin, err = newPathPlugin("arista", []vendorPath{
+		{
+			name: "hw_queue_drops",
+			config: PathConfig{
+				Path: aristaQoS + "/queues/queue[queue-id=*]/state/dropped-pkts",
+				Metrics: []MetricConfig{{
+					Name:   "arista_hw_queue_drops_total",
+					Leaf:   "dropped-pkts",
+					Type:   metricCounter,
+					Help:   "Hardware queue drops (critical for ST 2110)",
+					Labels: map[string]string{"interface": "interface[name]", "queue": "queue[queue-id]"},
+				}},
+			},
+			handle: p.handleQueueDrops,
+		},
+		{
+			// LANZ congestion records: the switch streams a queue's length while
+			// it is above the LANZ threshold, down to microsecond bursts
+			name: "lanz_queues",
+			config: PathConfig{
+				Path: "arista:/eos/arista-exp-eos-lanz/lanz/interfaces/interface[name=*]/queues/queue[queue-id=*]/state",
+				Mode: "on_change",
+			},
+			handle:       p.handleLANZ,
+			handleDelete: p.deleteLANZ,
+		},
+		{
+			name: "ecn_marked",
+			config: PathConfig{
+				Path: aristaQoS + "/queues/queue[queue-id=*]/state/ecn-marked-pkts",
+				Metrics: []MetricConfig{{
+					Name:   "st2110_switch_queue_ecn_marked_packets_total",
+					Leaf:   "ecn-marked-pkts",
+					Type:   metricCounter,
+					Help:   "Packets the egress queue marked with ECN congestion experienced",
+					Labels: map[string]string{"interface": "interface[name]", "queue": "queue[queue-id]"},
+				}},
+			},
+		},
+		{
+			name: "pfc",
+			config: PathConfig{
+				Path:    aristaQoS + "/pfc/priorities/priority[priority=*]/state",
+				Metrics: pfcMetrics("rx-pause-frames", "tx-pause-frames", map[string]string{"interface": "interface[name]", "priority": "priority[priority]"}),
+			},
+		},
+		{
+			// PTP status (if using Arista as PTP Boundary Clock)
+			name: "ptp_status",
+			config: PathConfig{
+				Path: "arista:/eos/arista-exp-eos-ptp/ptp/instances/instance[instance-id=default]/state",
+				Mode: "on_change",
+			},
+			handle: p.handlePTP,
+		},
+		{
+			// Snooping VLANs with their group count and querier
+			name: "igmp_snooping",
+			config: PathConfig{
+				Path: aristaIGMPSnooping + "/state",
+				Mode: "on_change",
+				Metrics: []MetricConfig{{
+					Name:   "arista_igmp_snooping_groups",
+					Leaf:   "group-count",
+					Help:   "IGMP snooping multicast groups per VLAN",
+					Labels: map[string]string{"vlan": "vlan[vlan-id]"},
+				}},
+			},
+			handle:       p.handleSnoopingVLAN,
+			handleDelete: p.deleteSnoopingVLAN,
+		},
+		{
+			// Ports that joined each group
+			name: "igmp_snooping_members",
+			config: PathConfig{
+				Path: aristaIGMPSnooping + "/groups/group[address=*]/interfaces/interface[name=*]",
+				Mode: "on_change",
+			},
+			handle:       p.handleSnoopingMember,
+			handleDelete: p.deleteSnoopingMember,
+		},
+		{
+			name: "mroutes",
+			config: PathConfig{
+				Path: aristaMroutes,
+				Mode: "on_change",
+			},
+			handle:       p.handleMroute,
+			handleDelete: p.deleteMroute,
+		},
+		{
+			// Hardware multicast forwarding table usage
+			name: "multicast_hw_table",
+			config: PathConfig{
+				Path:     "arista:/eos/arista-exp-eos-hardware/hardware/multicast/tables/table[name=*]/state",
+				Interval: 10 * defaultSampleInterval,
+				Metrics: []MetricConfig{
+					{
+						Name:   "st2110_switch_multicast_hw_entries",
+						Leaf:   "used-entries",
+						Help:   "Entries used in a hardware multicast forwarding table",
+						Labels: map[string]string{"table": "table[name]"},
+					},
+					{
+						Name:   "st2110_switch_multicast_hw_capacity",
+						Leaf:   "max-entries",
+						Help:   "Entries a hardware multicast forwarding table holds",
+						Labels: map[string]string{"table": "table[name]"},
+					},
+				},
+			},
+		},
+	}, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// handleQueueDrops warns when hardware drops increase (should be ZERO for ST 2110!)
+func (p *aristaPlugin) handleQueueDrops(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	drops, ok := numericValue(leaves["dropped-pkts"])
+	if !ok {
+		return
+	}
+	iface := keyValues(elems, "interface", "name")
+	queue := keyValues(elems, "queue", "queue-id")
+	if len(iface) == 0 || len(queue) == 0 {
+		return
+	}
+	key := switchName + "/" + iface[0] + "/" + queue[0]
+
+	p.mu.Lock()
+	last, seen := p.drops[key]
+	p.drops[key] = drops
+	p.mu.Unlock()
+
+	if seen && drops > last {
+		log.Printf("⚠️  Hardware queue drops on %s interface %s queue %s: %.0f packets",
+			switchName, iface[0], queue[0], drops-last)
+	}
+}
+
+// handleLANZ takes the queue length of a LANZ record, with the peak EOS
+// kept since the previous one and the queue's limit, all in bytes
+func (p *aristaPlugin) handleLANZ(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	iface := keyValue(elems, "interface", "name")
+	queue := keyValue(elems, "queue", "queue-id")
+	if iface == "" || queue == "" {
+		return
+	}
+	values := leafValues(leaves)
+	if v, ok := values["queue-size"]; ok {
+		p.buffers.Occupancy(switchName, iface, queue, v)
+	}
+	if v, ok := values["max-queue-size"]; ok {
+		p.buffers.Peak(switchName, iface, queue, v)
+	}
+	if v, ok := values["queue-limit"]; ok {
+		p.buffers.Limit(switchName, iface, queue, v)
+	}
+}
+
+func (p *aristaPlugin) deleteLANZ(switchName string, elems []*gnmi.PathElem, leaf string) {
+	if leaf == "" {
+		p.buffers.Remove(switchName, keyValue(elems, "interface", "name"), keyValue(elems, "queue", "queue-id"))
+	}
+}
+
+func (p *aristaPlugin) handlePTP(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.ptp[switchName]
+	if !ok {
+		state = &aristaPTPState{domain: "0"}
+		p.ptp[switchName] = state
+	}
+	if domain, ok := numericValue(leaves["domain-number"]); ok {
+		if d := formatNumber(domain); d != state.domain {
+			p.ptpLockStatus.DeleteLabelValues(switchName, state.domain)
+			state.domain = d
+		}
+	}
+	switch lock := leaves["lock-status"].(type) {
+	case string:
+		state.locked, state.haveLock = boolToFloat(lock == "locked"), true
+	case bool:
+		state.locked, state.haveLock = boolToFloat(lock), true
+	}
+	if state.haveLock {
+		p.ptpLockStatus.WithLabelValues(switchName, state.domain).Set(state.locked)
+	}
+}
+
+func (p *aristaPlugin) HandleStreamStart(switchName string) {
+	p.multicast.StartSync(switchName)
+}
+
+func (p *aristaPlugin) HandleSync(switchName string) {
+	p.multicast.Sweep(switchName)
+}
+
+func (p *aristaPlugin) multicastState() *multicastTables {
+	return p.multicast
+}
+
+// handleSnoopingVLAN tracks the querier, which EOS reports as querier-address
+// in the VLAN state (0.0.0.0 when none is elected)
+func (p *aristaPlugin) handleSnoopingVLAN(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	vlan := keyValue(elems, "vlan", "vlan-id")
+	if vlan == "" {
+		return
+	}
+	if querier, ok := leaves["querier-address"].(string); ok {
+		p.multicast.SetQuerier(switchName, vlan, querier)
+	} else {
+		p.multicast.TouchVLAN(switchName, vlan)
+	}
+}
+
+func (p *aristaPlugin) deleteSnoopingVLAN(switchName string, elems []*gnmi.PathElem, leaf string) {
+	switch leaf {
+	case "":
+		p.multicast.RemoveSnooping(switchName, keyValue(elems, "vlan", "vlan-id"), "", "")
+	case "querier-address":
+		p.multicast.ClearQuerier(switchName, keyValue(elems, "vlan", "vlan-id"))
+	}
+}
+
+func (p *aristaPlugin) handleSnoopingMember(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	vlan := keyValue(elems, "vlan", "vlan-id")
+	group := keyValue(elems, "group", "address")
+	port := keyValue(elems, "interface", "name")
+	if vlan != "" && group != "" && port != "" {
+		p.multicast.AddMember(switchName, vlan, group, port)
+	}
+}
+
+func (p *aristaPlugin) deleteSnoopingMember(switchName string, elems []*gnmi.PathElem, leaf string) {
+	group := keyValue(elems, "group", "address")
+	if leaf != "" || group == "" {
+		return // VLANs are removed with their state
+	}
+	p.multicast.RemoveSnooping(switchName, keyValue(elems, "vlan", "vlan-id"), group, keyValue(elems, "interface", "name"))
+}
+
+// handleMroute reads the incoming interface from the route state and the
+// outgoing interfaces from their list
+func (p *aristaPlugin) handleMroute(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	vrf := keyValue(elems, "vrf", "name")
+	source := keyValue(elems, "route", "source")
+	group := keyValue(elems, "route", "group")
+	if vrf == "" || group == "" {
+		return
+	}
+	incoming, _ := leaves["state/incoming-interface"].(string)
+	p.multicast.UpdateRoute(switchName, vrf, source, group, incoming, keyValue(elems, "interface", "name"))
+}
+
+// deleteMroute removes a route, or one of its outgoing interfaces
+func (p *aristaPlugin) deleteMroute(switchName string, elems []*gnmi.PathElem, leaf string) {
+	outgoing := keyValue(elems, "interface", "name")
+	if leaf != "" && outgoing == "" {
+		return
+	}
+	p.multicast.RemoveRoute(switchName, keyValue(elems, "vrf", "name"), keyValue(elems, "route", "source"),
+		keyValue(elems, "route", "group"), outgoing)
+}
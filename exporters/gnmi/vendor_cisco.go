@@ -0,0 +1,270 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prefixes of the DME multicast models
+const (
+	ciscoIGMPSnooping = "/System/igmpsnoop-items/inst-items/dom-items/Dom-list[name=*]/vlan-items/Vlan-list[id=*]"
+	ciscoMroutes      = "/System/mrib-items/inst-items/dom-items/Dom-list[name=*]/route-items/Route-list[src=*][grp=*]"
+)
+
+// Queue entries below buffer-items, as leaf paths relative to it
+const ciscoBufferQueue = "queue-items/Queue-list"
+
+// ciscoPlugin collects NX-OS queuing policy drops, TCAM utilization,
+// interface buffer drops and queue occupancy, ECN and PFC counters, CRC
+// errors, IGMP snooping and multicast routes from the DME
+// (Data Management Engine) model
+type ciscoPlugin struct {
+	*pathPlugin
+
+	tcamUtilization *prometheus.GaugeVec
+	qosPolicyDrops  *DeviceCounter
+	multicast       *multicastTables
+	buffers         *bufferTelemetry
+}
+
+func newCiscoPlugin(metrics *MetricSet) (VendorPlugin, error) {
+	p := &ciscoPlugin{}
+
+	var err error
+	p.tcamUtilization, err = metrics.Gauge("cisco_nexus_tcam_utilization_percent", "TCAM utilization for multicast routing", []string{"switch", "table_type"})
+	if err != nil {
+		return nil, err
+	}
+	p.qosPolicyDrops, err = metrics.Counter("cisco_nexus_qos_policy_drops_total", "QoS policy drops (by class-map)", []string{"switch", "policy", "class"})
+	if err != nil {
+		return nil, err
+	}
+	if p.multicast, err = newMulticastTables(metrics); err != nil {
+		return nil, err
+	}
+	if p.buffers, err = newBufferTelemetry(metrics); err != nil {
+		return nil, err
+	}
+
+	p.pathPlugin, err = newPathPlugin("cisco", []vendorPath{
+		{
+			// Output queuing statistics of every policy-map and class-map
+			name: "qos_policy",
+			config: PathConfig{
+				Path: "/System/ipqos-items/queuing-items/policy-items/out-items/sys-items/pmap-items/Name-list[name=*]/cmap-items/Name-list[name=*]/stats-items",
+			},
+			handle: p.handleQoSPolicy,
+		},
+		{
+			// Hardware TCAM usage (multicast routing)
+			name: "tcam_utilization",
+			config: PathConfig{
+				Path:     "/System/tcam-items/utilization-items",
+				Interval: 10 * defaultSampleInterval,
+			},
+			handle: p.handleTCAM,
+		},
+		{
+			// Buffer statistics (critical for ST 2110): interface drops, and per
+			// queue the occupancy, clear-on-read peak, limit and ECN marks
+			name: "buffer_stats",
+			config: PathConfig{
+				Path: "/System/intf-items/phys-items/PhysIf-list[id=*]/buffer-items",
+				Metrics: []MetricConfig{
+					{
+						Name:   "cisco_nexus_buffer_drops_total",
+						Leaf:   "dropPkts|totalDropPkts",
+						Type:   metricCounter,
+						Help:   "Interface buffer drops",
+						Labels: map[string]string{"interface": "PhysIf-list[id]"},
+					},
+					{
+						Name:   "st2110_switch_queue_ecn_marked_packets_total",
+						Leaf:   ciscoBufferQueue + "/ecnMarkedPkts",
+						Type:   metricCounter,
+						Help:   "Packets the egress queue marked with ECN congestion experienced",
+						Labels: map[string]string{"interface": "PhysIf-list[id]", "queue": "Queue-list[qosGrp]"},
+					},
+				},
+			},
+			handle:       p.handleBuffer,
+			handleDelete: p.deleteBuffer,
+		},
+		{
+			name: "pfc",
+			config: PathConfig{
+				Path:    "/System/intf-items/phys-items/PhysIf-list[id=*]/pfc-items/Cos-list[cos=*]",
+				Metrics: pfcMetrics("rxPauseFrames", "txPauseFrames", map[string]string{"interface": "PhysIf-list[id]", "priority": "Cos-list[cos]"}),
+			},
+		},
+		{
+			// RMON Ethernet statistics, for switches without the OpenConfig Ethernet counters
+			name: "ether_stats",
+			config: PathConfig{
+				Path:     "/System/intf-items/phys-items/PhysIf-list[id=*]/dbgEtherStats-items",
+				Interval: interfaceSampleInterval,
+				Metrics: []MetricConfig{{
+					Name:   "st2110_switch_interface_crc_errors_total",
+					Leaf:   "cRCAlignErrors",
+					Type:   metricCounter,
+					Help:   "Received frames with a bad FCS on switch interface",
+					Labels: map[string]string{"interface": "PhysIf-list[id]"},
+				}},
+			},
+		},
+		{
+			name: "igmp_snooping_querier",
+			config: PathConfig{
+				Path: ciscoIGMPSnooping + "/querier-items",
+				Mode: "on_change",
+			},
+			handle:       p.handleQuerier,
+			handleDelete: p.deleteQuerier,
+		},
+		{
+			name: "igmp_snooping_members",
+			config: PathConfig{
+				Path: ciscoIGMPSnooping + "/group-items/Group-list[addr=*]/oif-items/Oif-list[id=*]",
+				Mode: "on_change",
+			},
+			handle:       p.handleSnoopingMember,
+			handleDelete: p.deleteSnoopingMember,
+		},
+		{
+			name: "mroutes",
+			config: PathConfig{
+				Path: ciscoMroutes,
+				Mode: "on_change",
+			},
+			handle:       p.handleMroute,
+			handleDelete: p.deleteMroute,
+		},
+	}, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// handleQoSPolicy labels drops with the policy-map and class-map, which are
+// both Name-list elems in DME
+func (p *ciscoPlugin) handleQoSPolicy(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	names := keyValues(elems, "Name-list", "name")
+	if len(names) != 2 {
+		return
+	}
+	for _, leaf := range []string{"dropPkts", "droppedPkts"} {
+		if drops, ok := numericValue(leaves[leaf]); ok {
+			p.qosPolicyDrops.Observe([]string{switchName, names[0], names[1]}, drops)
+			return
+		}
+	}
+}
+
+// handleBuffer takes the occupancy, the peak NX-OS kept since the previous
+// read and the limit of a queue, all in bytes
+func (p *ciscoPlugin) handleBuffer(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	iface := keyValue(elems, "PhysIf-list", "id")
+	queue := keyValue(elems, "Queue-list", "qosGrp")
+	if iface == "" || queue == "" {
+		return
+	}
+	values := leafValues(leaves)
+	if v, ok := values[ciscoBufferQueue+"/currOccupancy"]; ok {
+		p.buffers.Occupancy(switchName, iface, queue, v)
+	}
+	if v, ok := values[ciscoBufferQueue+"/peakOccupancy"]; ok {
+		p.buffers.Peak(switchName, iface, queue, v)
+	}
+	if v, ok := values[ciscoBufferQueue+"/queueLimit"]; ok {
+		p.buffers.Limit(switchName, iface, queue, v)
+	}
+}
+
+func (p *ciscoPlugin) deleteBuffer(switchName string, elems []*gnmi.PathElem, leaf string) {
+	if leaf == "" || leaf == "queue-items" || leaf == ciscoBufferQueue {
+		p.buffers.Remove(switchName, keyValue(elems, "PhysIf-list", "id"), keyValue(elems, "Queue-list", "qosGrp"))
+	}
+}
+
+// handleTCAM exports every numeric attribute of utilization-items, one per TCAM region
+func (p *ciscoPlugin) handleTCAM(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	for leaf, value := range leafValues(leaves) {
+		p.tcamUtilization.WithLabelValues(switchName, strings.ReplaceAll(leaf, "/", "_")).Set(value)
+	}
+}
+
+func (p *ciscoPlugin) HandleStreamStart(switchName string) {
+	p.multicast.StartSync(switchName)
+}
+
+func (p *ciscoPlugin) HandleSync(switchName string) {
+	p.multicast.Sweep(switchName)
+}
+
+func (p *ciscoPlugin) multicastState() *multicastTables {
+	return p.multicast
+}
+
+func (p *ciscoPlugin) handleQuerier(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	vlan := keyValue(elems, "Vlan-list", "id")
+	if vlan == "" {
+		return
+	}
+	if querier, ok := leaves["addr"].(string); ok {
+		p.multicast.SetQuerier(switchName, vlan, querier)
+	} else {
+		p.multicast.TouchVLAN(switchName, vlan)
+	}
+}
+
+// deleteQuerier clears the querier when its items go, and removes the VLAN
+// when the VLAN itself is deleted
+func (p *ciscoPlugin) deleteQuerier(switchName string, elems []*gnmi.PathElem, leaf string) {
+	vlan := keyValue(elems, "Vlan-list", "id")
+	switch {
+	case leaf == "addr" || (leaf == "" && len(elems) > 0 && elems[len(elems)-1].Name == "querier-items"):
+		p.multicast.ClearQuerier(switchName, vlan)
+	case leaf == "":
+		p.multicast.RemoveSnooping(switchName, vlan, "", "")
+	}
+}
+
+func (p *ciscoPlugin) handleSnoopingMember(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	vlan := keyValue(elems, "Vlan-list", "id")
+	group := keyValue(elems, "Group-list", "addr")
+	port := keyValue(elems, "Oif-list", "id")
+	if vlan != "" && group != "" && port != "" {
+		p.multicast.AddMember(switchName, vlan, group, port)
+	}
+}
+
+func (p *ciscoPlugin) deleteSnoopingMember(switchName string, elems []*gnmi.PathElem, leaf string) {
+	group := keyValue(elems, "Group-list", "addr")
+	if leaf != "" || group == "" {
+		return // VLANs are removed with their querier items
+	}
+	p.multicast.RemoveSnooping(switchName, keyValue(elems, "Vlan-list", "id"), group, keyValue(elems, "Oif-list", "id"))
+}
+
+// handleMroute reads the route's iif attribute and its oif-items list
+func (p *ciscoPlugin) handleMroute(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	vrf := keyValue(elems, "Dom-list", "name")
+	group := keyValue(elems, "Route-list", "grp")
+	if vrf == "" || group == "" {
+		return
+	}
+	incoming, _ := leaves["iif"].(string)
+	p.multicast.UpdateRoute(switchName, vrf, keyValue(elems, "Route-list", "src"), group, incoming, keyValue(elems, "Oif-list", "id"))
+}
+
+func (p *ciscoPlugin) deleteMroute(switchName string, elems []*gnmi.PathElem, leaf string) {
+	outgoing := keyValue(elems, "Oif-list", "id")
+	if leaf != "" && outgoing == "" {
+		return
+	}
+	p.multicast.RemoveRoute(switchName, keyValue(elems, "Dom-list", "name"), keyValue(elems, "Route-list", "src"),
+		keyValue(elems, "Route-list", "grp"), outgoing)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+)
+
+// Labels of the Junos egress queue counters
+var juniperQueueLabels = map[string]string{"interface": "interface[name]", "queue": "out-queue[queue-number]"}
+
+// Interfaces of the OpenConfig IGMP model, e.g. irb.100 for VLAN 100
+const juniperIGMP = "/network-instances/network-instance[name=*]/protocols/protocol[identifier=IGMP][name=*]/igmp/interfaces/interface[interface-id=*]"
+
+// juniperPlugin collects the egress queue drops and buffer occupancy of the
+// Junos linecard interface sensor, which reports them below the OpenConfig
+// interface counters, and IGMP groups and queriers per IGMP interface
+type juniperPlugin struct {
+	*pathPlugin
+
+	multicast *multicastTables
+}
+
+func newJuniperPlugin(metrics *MetricSet) (VendorPlugin, error) {
+	p := &juniperPlugin{}
+
+	var err error
+	if p.multicast, err = newMulticastTables(metrics); err != nil {
+		return nil, err
+	}
+
+	p.pathPlugin, err = newPathPlugin("juniper", []vendorPath{
+		{
+			name: "queue_stats",
+			config: PathConfig{
+				Path: "/junos/system/linecard/interface",
+				Metrics: []MetricConfig{
+					{
+						Name:   "juniper_queue_tail_drops_total",
+						Leaf:   "tail-drop-pkts",
+						Type:   metricCounter,
+						Help:   "Egress queue tail drops",
+						Labels: juniperQueueLabels,
+					},
+					{
+						Name:   "juniper_queue_red_drops_total",
+						Leaf:   "red-drop-pkts",
+						Type:   metricCounter,
+						Help:   "Egress queue RED/WRED drops",
+						Labels: juniperQueueLabels,
+					},
+					{
+						Name:   "juniper_queue_peak_buffer_occupancy_bytes",
+						Leaf:   "peak-buffer-occupancy",
+						Help:   "Peak egress queue buffer occupancy",
+						Labels: juniperQueueLabels,
+					},
+				},
+			},
+			match: "/interfaces/interface[name=*]/state/counters/out-queue[queue-number=*]",
+		},
+		{
+			name: "igmp_querier",
+			config: PathConfig{
+				Path: juniperIGMP + "/querier/state",
+				Mode: "on_change",
+			},
+			handle:       p.handleQuerier,
+			handleDelete: p.deleteQuerier,
+		},
+		{
+			// Membership per IGMP interface; Junos reports no snooping ports here
+			name: "igmp_groups",
+			config: PathConfig{
+				Path: juniperIGMP + "/membership-groups/group[group=*]",
+				Mode: "on_change",
+			},
+			handle:       p.handleGroup,
+			handleDelete: p.deleteGroup,
+		},
+	}, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *juniperPlugin) HandleStreamStart(switchName string) {
+	p.multicast.StartSync(switchName)
+}
+
+func (p *juniperPlugin) HandleSync(switchName string) {
+	p.multicast.Sweep(switchName)
+}
+
+func (p *juniperPlugin) multicastState() *multicastTables {
+	return p.multicast
+}
+
+func (p *juniperPlugin) handleQuerier(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	iface := juniperVLAN(keyValue(elems, "interface", "interface-id"))
+	if iface == "" {
+		return
+	}
+	if querier, ok := leaves["address"].(string); ok {
+		p.multicast.SetQuerier(switchName, iface, querier)
+	} else {
+		p.multicast.TouchVLAN(switchName, iface)
+	}
+}
+
+// deleteQuerier clears the querier when its state goes, and removes the
+// interface when the interface itself is deleted
+func (p *juniperPlugin) deleteQuerier(switchName string, elems []*gnmi.PathElem, leaf string) {
+	iface := juniperVLAN(keyValue(elems, "interface", "interface-id"))
+	switch {
+	case leaf == "address" || (leaf == "" && len(elems) > 0 && elems[len(elems)-1].Name != "interface" && iface != ""):
+		p.multicast.ClearQuerier(switchName, iface)
+	case leaf == "":
+		p.multicast.RemoveSnooping(switchName, iface, "", "")
+	}
+}
+
+func (p *juniperPlugin) handleGroup(switchName string, elems []*gnmi.PathElem, leaves map[string]interface{}) {
+	iface := juniperVLAN(keyValue(elems, "interface", "interface-id"))
+	group := keyValue(elems, "group", "group")
+	if iface != "" && group != "" {
+		p.multicast.AddMember(switchName, iface, group, "")
+	}
+}
+
+func (p *juniperPlugin) deleteGroup(switchName string, elems []*gnmi.PathElem, leaf string) {
+	group := keyValue(elems, "group", "group")
+	if leaf != "" || group == "" {
+		return // Interfaces are removed with their querier state
+	}
+	p.multicast.RemoveSnooping(switchName, juniperVLAN(keyValue(elems, "interface", "interface-id")), group, "")
+}
+
+// juniperVLAN labels the IGMP interface of a VLAN, irb.100 or vlan.100, by
+// its VLAN ID like the other vendors; other interfaces keep their name
+func juniperVLAN(iface string) string {
+	for _, prefix := range []string{"irb.", "vlan."} {
+		if id := strings.TrimPrefix(iface, prefix); id != iface && id != "" {
+			if _, err := strconv.Atoi(id); err == nil {
+				return id
+			}
+		}
+	}
+	return iface
+}
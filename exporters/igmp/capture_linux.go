@@ -0,0 +1,99 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Kernel-side filter so the socket only wakes up for IGMP and MLD, not for
+// the gigabits of ST 2110 media on the same interface
+var igmpMLDFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 12, Size: 2},                                 // EtherType
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 2},         // IPv4?
+	bpf.LoadAbsolute{Off: 23, Size: 1},                                 // IPv4 protocol
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 2, SkipTrue: 4, SkipFalse: 3}, // IGMP
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 2},         // IPv6?
+	bpf.LoadAbsolute{Off: 20, Size: 1},                                 // IPv6 next header
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 1},               // Hop-by-hop (MLD carries router alert)
+	bpf.RetConstant{Val: 0},
+	bpf.RetConstant{Val: 65535},
+}
+
+type captureSocket struct {
+	fd int
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// openCapture opens an AF_PACKET socket on the interface filtered to IGMP/MLD.
+// With allMulti set the NIC also accepts reports for groups this host has not joined.
+func openCapture(ifaceName string, allMulti bool) (*captureSocket, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %w", ifaceName, err)
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket (CAP_NET_RAW required): %w", err)
+	}
+
+	if err := attachFilter(fd, igmpMLDFilter); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ALL),
+		Ifindex:  iface.Index,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind to %s: %w", ifaceName, err)
+	}
+
+	if allMulti {
+		mreq := &unix.PacketMreq{
+			Ifindex: int32(iface.Index),
+			Type:    unix.PACKET_MR_ALLMULTI,
+		}
+		if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to enable allmulti on %s: %w", ifaceName, err)
+		}
+	}
+
+	return &captureSocket{fd: fd}, nil
+}
+
+func attachFilter(fd int, program []bpf.Instruction) error {
+	raw, err := bpf.Assemble(program)
+	if err != nil {
+		return fmt.Errorf("failed to assemble BPF filter: %w", err)
+	}
+
+	filter := make([]unix.SockFilter, len(raw))
+	for i, ins := range raw {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	prog := &unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog); err != nil {
+		return fmt.Errorf("failed to attach BPF filter: %w", err)
+	}
+	return nil
+}
+
+func (c *captureSocket) ReadPacket(buf []byte) (int, error) {
+	n, _, err := unix.Recvfrom(c.fd, buf, 0)
+	return n, err
+}
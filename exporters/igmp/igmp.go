@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Protocol defaults from RFC 3376 (IGMPv3) section 8 and RFC 3810 (MLDv2) section 9.
+// They are replaced by the values the elected querier advertises where possible.
+const (
+	defaultRobustness       = 2
+	defaultQueryInterval    = 125 * time.Second
+	defaultMaxResponseTime  = 10 * time.Second
+	lastMemberQueryInterval = 1 * time.Second
+)
+
+type groupState struct {
+	lastReport    time.Time
+	leaveDeadline time.Time // Zero unless a leave is waiting for the last member query to expire
+}
+
+// protocolState tracks the querier and group membership for one protocol (IGMP or MLD) on one interface
+type protocolState struct {
+	name string
+	seen bool // Any message of this protocol observed on the interface
+
+	querier          net.IP
+	querierVersion   int
+	lastQuery        time.Time
+	lastGeneralQuery time.Time
+
+	advertisedInterval time.Duration // IGMPv3 QQIC / MLDv2 QQIC
+	observedInterval   time.Duration // Time between the last two general queries
+	robustness         int
+	maxResponse        time.Duration
+
+	groups map[string]*groupState
+}
+
+func newProtocolState(name string) *protocolState {
+	return &protocolState{
+		name:        name,
+		robustness:  defaultRobustness,
+		maxResponse: defaultMaxResponseTime,
+		groups:      make(map[string]*groupState),
+	}
+}
+
+func (p *protocolState) queryInterval() time.Duration {
+	if p.advertisedInterval > 0 {
+		return p.advertisedInterval
+	}
+	if p.observedInterval > 0 {
+		return p.observedInterval
+	}
+	return defaultQueryInterval
+}
+
+// Other Querier Present Interval (RFC 3376 8.5)
+func (p *protocolState) otherQuerierPresentInterval() time.Duration {
+	return time.Duration(p.robustness)*p.queryInterval() + p.maxResponse/2
+}
+
+// Group Membership Interval (RFC 3376 8.4) - 260s with default timers
+func (p *protocolState) groupMembershipInterval() time.Duration {
+	return time.Duration(p.robustness)*p.queryInterval() + p.maxResponse
+}
+
+func (p *protocolState) querierAlive(now time.Time) bool {
+	return !p.lastQuery.IsZero() && now.Sub(p.lastQuery) <= p.otherQuerierPresentInterval()
+}
+
+type monitoredInterface struct {
+	name string
+	vlan string
+	igmp *protocolState
+	mld  *protocolState
+}
+
+type IGMPMonitor struct {
+	mu         sync.Mutex
+	interfaces map[string]*monitoredInterface
+	started    time.Time
+
+	// Prometheus metrics
+	querierPresent     *prometheus.GaugeVec
+	querierInfo        *prometheus.GaugeVec
+	queryInterval      *prometheus.GaugeVec
+	activeGroups       *prometheus.GaugeVec
+	reports            *prometheus.CounterVec
+	leaves             *prometheus.CounterVec
+	membershipTimeouts *prometheus.CounterVec
+}
+
+func NewIGMPMonitor() *IGMPMonitor {
+	monitor := &IGMPMonitor{
+		interfaces: make(map[string]*monitoredInterface),
+		started:    time.Now(),
+
+		querierPresent: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_igmp_querier_present",
+				Help: "Elected IGMP/MLD querier present on VLAN (1=present, 0=absent)",
+			},
+			[]string{"interface", "vlan", "protocol"},
+		),
+
+		querierInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_igmp_querier_info",
+				Help: "Address and protocol version of the elected querier (always 1)",
+			},
+			[]string{"interface", "vlan", "protocol", "querier", "version"},
+		),
+
+		queryInterval: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_igmp_query_interval_seconds",
+				Help: "General query interval of the elected querier (advertised or observed)",
+			},
+			[]string{"interface", "vlan", "protocol"},
+		),
+
+		activeGroups: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_igmp_active_groups",
+				Help: "Number of multicast groups with active membership on VLAN",
+			},
+			[]string{"interface", "vlan", "protocol"},
+		),
+
+		reports: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_igmp_reports_total",
+				Help: "Membership reports observed per multicast group",
+			},
+			[]string{"interface", "vlan", "multicast_group"},
+		),
+
+		leaves: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_igmp_leaves_total",
+				Help: "Leave/Done messages observed per multicast group",
+			},
+			[]string{"interface", "vlan", "multicast_group"},
+		),
+
+		membershipTimeouts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_igmp_membership_timeout_total",
+				Help: "Group memberships that expired without a report within the group membership interval",
+			},
+			[]string{"interface", "vlan", "multicast_group"},
+		),
+	}
+
+	prometheus.MustRegister(monitor.querierPresent)
+	prometheus.MustRegister(monitor.querierInfo)
+	prometheus.MustRegister(monitor.queryInterval)
+	prometheus.MustRegister(monitor.activeGroups)
+	prometheus.MustRegister(monitor.reports)
+	prometheus.MustRegister(monitor.leaves)
+	prometheus.MustRegister(monitor.membershipTimeouts)
+
+	return monitor
+}
+
+// AddInterface opens a capture socket on the interface and starts decoding IGMP/MLD from it
+func (m *IGMPMonitor) AddInterface(config InterfaceConfig) error {
+	capture, err := openCapture(config.Name, config.AllMulti)
+	if err != nil {
+		return err
+	}
+
+	iface := &monitoredInterface{
+		name: config.Name,
+		vlan: config.VLAN,
+		igmp: newProtocolState("igmp"),
+		mld:  newProtocolState("mld"),
+	}
+
+	m.mu.Lock()
+	m.interfaces[config.Name] = iface
+	m.mu.Unlock()
+
+	go m.captureLoop(iface, capture)
+	return nil
+}
+
+// VLAN returns the VLAN label configured for a monitored interface
+func (m *IGMPMonitor) VLAN(ifaceName string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if iface, ok := m.interfaces[ifaceName]; ok {
+		return iface.vlan
+	}
+	return ""
+}
+
+func (m *IGMPMonitor) captureLoop(iface *monitoredInterface, capture *captureSocket) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := capture.ReadPacket(buf)
+		if err != nil {
+			log.Printf("Capture error on %s: %v", iface.name, err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		m.handlePacket(iface, buf[:n], time.Now())
+	}
+}
+
+func (m *IGMPMonitor) handlePacket(iface *monitoredInterface, data []byte, now time.Time) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		p := iface.igmp
+		p.seen = true
+
+		switch msg := packet.Layer(layers.LayerTypeIGMP).(type) {
+		case *layers.IGMPv1or2:
+			switch msg.Type {
+			case layers.IGMPMembershipQuery:
+				m.onQuery(iface, p, ip4.SrcIP, msg.GroupAddress, int(msg.Version), msg.MaxResponseTime, 0, 0, now)
+			case layers.IGMPMembershipReportV1, layers.IGMPMembershipReportV2:
+				m.onReport(iface, p, msg.GroupAddress, now)
+			case layers.IGMPLeaveGroup:
+				m.onLeave(iface, p, msg.GroupAddress, now)
+			}
+
+		case *layers.IGMP:
+			switch msg.Type {
+			case layers.IGMPMembershipQuery:
+				// The layers package decodes QQIC in 100ms units; it is specified in seconds
+				var qqi time.Duration
+				if len(ip4.Payload) >= 12 {
+					qqi = decodeQQIC(ip4.Payload[9])
+				}
+				m.onQuery(iface, p, ip4.SrcIP, msg.GroupAddress, 3, msg.MaxResponseTime, qqi, int(msg.RobustnessValue), now)
+			case layers.IGMPMembershipReportV3:
+				for _, record := range msg.GroupRecords {
+					if isLeaveRecord(uint8(record.Type), len(record.SourceAddresses)) {
+						m.onLeave(iface, p, record.MulticastAddress, now)
+					} else if record.Type != layers.IGMPBlock {
+						m.onReport(iface, p, record.MulticastAddress, now)
+					}
+				}
+			}
+		}
+		return
+	}
+
+	ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok {
+		return
+	}
+	p := iface.mld
+
+	if query, ok := packet.Layer(layers.LayerTypeMLDv2MulticastListenerQuery).(*layers.MLDv2MulticastListenerQueryMessage); ok {
+		p.seen = true
+		m.onQuery(iface, p, ip6.SrcIP, query.MulticastAddress, 2,
+			mldv2MaxResponseDelay(query.MaximumResponseCode), decodeQQIC(query.QueriersQueryIntervalCode),
+			int(query.QueriersRobustnessVariable), now)
+		return
+	}
+	if query, ok := packet.Layer(layers.LayerTypeMLDv1MulticastListenerQuery).(*layers.MLDv1MulticastListenerQueryMessage); ok {
+		p.seen = true
+		m.onQuery(iface, p, ip6.SrcIP, query.MulticastAddress, 1, query.MaximumResponseDelay, 0, 0, now)
+		return
+	}
+	if report, ok := packet.Layer(layers.LayerTypeMLDv1MulticastListenerReport).(*layers.MLDv1MulticastListenerReportMessage); ok {
+		p.seen = true
+		m.onReport(iface, p, report.MulticastAddress, now)
+		return
+	}
+	if done, ok := packet.Layer(layers.LayerTypeMLDv1MulticastListenerDone).(*layers.MLDv1MulticastListenerDoneMessage); ok {
+		p.seen = true
+		m.onLeave(iface, p, done.MulticastAddress, now)
+		return
+	}
+	if report, ok := packet.Layer(layers.LayerTypeMLDv2MulticastListenerReport).(*layers.MLDv2MulticastListenerReportMessage); ok {
+		p.seen = true
+		for _, record := range report.MulticastAddressRecords {
+			if isLeaveRecord(uint8(record.RecordType), len(record.SourceAddresses)) {
+				m.onLeave(iface, p, record.MulticastAddress, now)
+			} else if record.RecordType != layers.MLDv2MulticastAddressRecordTypeBlockOldSources {
+				m.onReport(iface, p, record.MulticastAddress, now)
+			}
+		}
+	}
+}
+
+// mldv2MaxResponseDelay decodes the Maximum Response Code (RFC 3810 section 5.1.3).
+// The layers package helper returns small codes in nanoseconds instead of milliseconds.
+func mldv2MaxResponseDelay(code uint16) time.Duration {
+	if code < 0x8000 {
+		return time.Duration(code) * time.Millisecond
+	}
+	exp := (code >> 12) & 0x07
+	mant := code & 0x0FFF
+	return time.Duration(uint32(mant|0x1000)<<(exp+3)) * time.Millisecond
+}
+
+// decodeQQIC decodes the Querier's Query Interval Code shared by IGMPv3 and MLDv2
+// (RFC 3376 section 4.1.7, RFC 3810 section 5.1.9)
+func decodeQQIC(code uint8) time.Duration {
+	if code < 0x80 {
+		return time.Duration(code) * time.Second
+	}
+	exp := (code >> 4) & 0x07
+	mant := code & 0x0F
+	return time.Duration(uint32(mant|0x10)<<(exp+3)) * time.Second
+}
+
+// isLeaveRecord reports whether an IGMPv3/MLDv2 group record ends membership:
+// an INCLUDE record with an empty source list (RFC 3376 section 5.1, RFC 3810 section 6.1).
+// IGMPv3 and MLDv2 share the record type numbering.
+func isLeaveRecord(recordType uint8, sources int) bool {
+	return sources == 0 &&
+		(recordType == uint8(layers.IGMPIsIn) || recordType == uint8(layers.IGMPToIn))
+}
+
+func (m *IGMPMonitor) onQuery(iface *monitoredInterface, p *protocolState, src, group net.IP, version int,
+	maxResponse, qqi time.Duration, qrv int, now time.Time) {
+
+	// Querier election: the lowest address wins (RFC 3376 section 6.6.2)
+	if p.querier == nil || !p.querierAlive(now) || bytes.Compare(src.To16(), p.querier.To16()) < 0 {
+		if p.querier != nil && !p.querier.Equal(src) {
+			log.Printf("%s querier on %s (VLAN %s) changed: %s -> %s",
+				p.name, iface.name, iface.vlan, p.querier, src)
+			// The old querier's timers say nothing about the new one
+			p.lastGeneralQuery = time.Time{}
+			p.observedInterval = 0
+			p.advertisedInterval = 0
+		}
+		p.querier = src
+	}
+
+	// Queries from a non-elected router do not refresh querier state
+	if !p.querier.Equal(src) {
+		return
+	}
+	p.querierVersion = version
+	p.lastQuery = now
+
+	if group == nil || group.IsUnspecified() {
+		if !p.lastGeneralQuery.IsZero() {
+			p.observedInterval = now.Sub(p.lastGeneralQuery)
+		}
+		p.lastGeneralQuery = now
+
+		if maxResponse > 0 {
+			p.maxResponse = maxResponse
+		}
+		if qqi > 0 {
+			p.advertisedInterval = qqi
+		}
+		if qrv > 0 {
+			p.robustness = qrv
+		}
+	}
+}
+
+func (m *IGMPMonitor) onReport(iface *monitoredInterface, p *protocolState, group net.IP, now time.Time) {
+	key := group.String()
+	state, ok := p.groups[key]
+	if !ok {
+		state = &groupState{}
+		p.groups[key] = state
+	}
+	state.lastReport = now
+	state.leaveDeadline = time.Time{}
+
+	m.reports.WithLabelValues(iface.name, iface.vlan, key).Inc()
+}
+
+func (m *IGMPMonitor) onLeave(iface *monitoredInterface, p *protocolState, group net.IP, now time.Time) {
+	key := group.String()
+	m.leaves.WithLabelValues(iface.name, iface.vlan, key).Inc()
+
+	// Other members answer the querier's group-specific queries; the group is
+	// only gone if nobody reports within the last member query time
+	if state, ok := p.groups[key]; ok {
+		state.leaveDeadline = now.Add(time.Duration(p.robustness) * lastMemberQueryInterval)
+	}
+}
+
+// Expire ages out group memberships and querier state and refreshes the gauges
+func (m *IGMPMonitor) Expire(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, iface := range m.interfaces {
+		m.expireProtocol(iface, iface.igmp, now)
+		// Only report MLD on VLANs that actually carry IPv6 multicast
+		if iface.mld.seen {
+			m.expireProtocol(iface, iface.mld, now)
+		}
+	}
+}
+
+func (m *IGMPMonitor) expireProtocol(iface *monitoredInterface, p *protocolState, now time.Time) {
+	membershipInterval := p.groupMembershipInterval()
+	for key, state := range p.groups {
+		if !state.leaveDeadline.IsZero() {
+			if now.After(state.leaveDeadline) {
+				delete(p.groups, key)
+			}
+			continue
+		}
+		if now.Sub(state.lastReport) > membershipInterval {
+			log.Printf("⚠️  Membership timeout for %s on %s (VLAN %s): no report for %s",
+				key, iface.name, iface.vlan, membershipInterval)
+			m.membershipTimeouts.WithLabelValues(iface.name, iface.vlan, key).Inc()
+			delete(p.groups, key)
+		}
+	}
+	m.activeGroups.WithLabelValues(iface.name, iface.vlan, p.name).Set(float64(len(p.groups)))
+
+	m.querierInfo.DeletePartialMatch(prometheus.Labels{
+		"interface": iface.name,
+		"vlan":      iface.vlan,
+		"protocol":  p.name,
+	})
+
+	if p.querierAlive(now) {
+		m.querierPresent.WithLabelValues(iface.name, iface.vlan, p.name).Set(1)
+		m.querierInfo.WithLabelValues(iface.name, iface.vlan, p.name,
+			p.querier.String(), fmt.Sprintf("%d", p.querierVersion)).Set(1)
+		m.queryInterval.WithLabelValues(iface.name, iface.vlan, p.name).Set(p.queryInterval().Seconds())
+		return
+	}
+
+	// Give the querier one full interval after startup before declaring it absent
+	if p.lastQuery.IsZero() && now.Sub(m.started) <= p.otherQuerierPresentInterval() {
+		return
+	}
+	m.querierPresent.WithLabelValues(iface.name, iface.vlan, p.name).Set(0)
+}
+
+func (m *IGMPMonitor) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			m.Expire(time.Now())
+		}
+	}()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// The metrics are registered globally, so all tests share one monitor and
+// keep apart by interface name
+var testMonitor = NewIGMPMonitor()
+
+// newTestInterface returns an interface whose series start from zero
+func newTestInterface(name string) *monitoredInterface {
+	labels := prometheus.Labels{"interface": name}
+	testMonitor.reports.DeletePartialMatch(labels)
+	testMonitor.leaves.DeletePartialMatch(labels)
+	testMonitor.membershipTimeouts.DeletePartialMatch(labels)
+	return &monitoredInterface{
+		name: name,
+		vlan: "100",
+		igmp: newProtocolState("igmp"),
+		mld:  newProtocolState("mld"),
+	}
+}
+
+// igmpPacket wraps an IGMP message in Ethernet and IPv4 headers
+func igmpPacket(src, dst string, igmp []byte) []byte {
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(igmp)))
+	ip[8] = 1 // TTL
+	ip[9] = 2 // IGMP
+	copy(ip[12:16], net.ParseIP(src).To4())
+	copy(ip[16:20], net.ParseIP(dst).To4())
+
+	eth := []byte{0x01, 0x00, 0x5e, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x08, 0x00}
+	return append(append(eth, ip...), igmp...)
+}
+
+func TestDecodeQQIC(t *testing.T) {
+	for _, tc := range []struct {
+		code uint8
+		want time.Duration
+	}{
+		{0, 0},
+		{125, 125 * time.Second},
+		{0x7F, 127 * time.Second},
+		{0x80, 128 * time.Second},   // Mantissa 0, exponent 0
+		{0x9A, 416 * time.Second},   // (0x1A) << 4
+		{0xFF, 31744 * time.Second}, // (0x1F) << 10
+	} {
+		if got := decodeQQIC(tc.code); got != tc.want {
+			t.Errorf("decodeQQIC(%#x) = %v, want %v", tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestMLDv2MaxResponseDelay(t *testing.T) {
+	for _, tc := range []struct {
+		code uint16
+		want time.Duration
+	}{
+		{0, 0},
+		{10000, 10 * time.Second},
+		{0x7FFF, 32767 * time.Millisecond},
+		{0x8000, 32768 * time.Millisecond},   // Mantissa 0, exponent 0
+		{0xFFFF, 8387584 * time.Millisecond}, // (0x1FFF) << 10
+	} {
+		if got := mldv2MaxResponseDelay(tc.code); got != tc.want {
+			t.Errorf("mldv2MaxResponseDelay(%#x) = %v, want %v", tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestIsLeaveRecord(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		recordType layers.IGMPv3GroupRecordType
+		sources    int
+		want       bool
+	}{
+		{"IS_IN{}", layers.IGMPIsIn, 0, true},
+		{"TO_IN{}", layers.IGMPToIn, 0, true},
+		{"TO_IN{S}", layers.IGMPToIn, 1, false},
+		{"IS_IN{S}", layers.IGMPIsIn, 2, false},
+		{"IS_EX{}", layers.IGMPIsEx, 0, false},
+		{"TO_EX{}", layers.IGMPToEx, 0, false},
+		{"ALLOW{}", layers.IGMPAllow, 0, false},
+		{"BLOCK{}", layers.IGMPBlock, 0, false},
+	} {
+		if got := isLeaveRecord(uint8(tc.recordType), tc.sources); got != tc.want {
+			t.Errorf("isLeaveRecord(%s) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestQuerierElection(t *testing.T) {
+	iface := newTestInterface("election-test")
+	p := iface.igmp
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	query := func(src string, now time.Time) {
+		testMonitor.onQuery(iface, p, net.ParseIP(src), net.IPv4zero, 2, 10*time.Second, 0, 0, now)
+	}
+
+	query("10.0.0.2", at(0))
+	query("10.0.0.1", at(1))
+	if !p.querier.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("querier = %v, want the lower address 10.0.0.1", p.querier)
+	}
+
+	// A higher address neither wins nor keeps the elected querier alive
+	query("10.0.0.3", at(200))
+	if !p.querier.Equal(net.ParseIP("10.0.0.1")) || !p.lastQuery.Equal(at(1)) {
+		t.Errorf("higher address took over: querier %v, last query %v", p.querier, p.lastQuery)
+	}
+
+	// Once the elected querier is silent for the other querier present
+	// interval (2*125s + 10s/2), anyone may take over
+	query("10.0.0.3", at(1+256))
+	if !p.querier.Equal(net.ParseIP("10.0.0.3")) {
+		t.Errorf("querier = %v after the elected one went silent, want 10.0.0.3", p.querier)
+	}
+	if !p.querierAlive(at(1 + 256)) {
+		t.Error("new querier not alive")
+	}
+}
+
+func TestMembershipExpiry(t *testing.T) {
+	iface := newTestInterface("expiry-test")
+	p := iface.igmp
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	group := net.ParseIP("239.1.1.1")
+	timeouts := func() float64 {
+		return testutil.ToFloat64(testMonitor.membershipTimeouts.WithLabelValues("expiry-test", "100", "239.1.1.1"))
+	}
+
+	// Group membership interval with default timers: 2*125s + 10s
+	testMonitor.onReport(iface, p, group, at(0))
+	testMonitor.expireProtocol(iface, p, at(259))
+	if len(p.groups) != 1 {
+		t.Fatalf("group expired early: %d groups", len(p.groups))
+	}
+	testMonitor.expireProtocol(iface, p, at(261))
+	if len(p.groups) != 0 || timeouts() != 1 {
+		t.Errorf("after the membership interval: %d groups, %v timeouts", len(p.groups), timeouts())
+	}
+
+	// A leave answered by another member within the last member query time
+	// keeps the group
+	testMonitor.onReport(iface, p, group, at(300))
+	testMonitor.onLeave(iface, p, group, at(310))
+	testMonitor.onReport(iface, p, group, at(311))
+	testMonitor.expireProtocol(iface, p, at(313))
+	if len(p.groups) != 1 {
+		t.Errorf("answered leave removed the group")
+	}
+
+	// An unanswered leave removes it after robustness * 1s, without a timeout
+	testMonitor.onLeave(iface, p, group, at(320))
+	testMonitor.expireProtocol(iface, p, at(321))
+	if len(p.groups) != 1 {
+		t.Errorf("group removed before the last member query time")
+	}
+	testMonitor.expireProtocol(iface, p, at(323))
+	if len(p.groups) != 0 || timeouts() != 1 {
+		t.Errorf("after an unanswered leave: %d groups, %v timeouts", len(p.groups), timeouts())
+	}
+	if got := testutil.ToFloat64(testMonitor.activeGroups.WithLabelValues("expiry-test", "100", "igmp")); got != 0 {
+		t.Errorf("active groups = %v, want 0", got)
+	}
+}
+
+func TestHandleIGMPv3(t *testing.T) {
+	iface := newTestInterface("igmpv3-test")
+	now := time.Now()
+
+	// General query: max response 10s, QRV 3, QQIC 60s
+	query := []byte{0x11, 100, 0, 0, 0, 0, 0, 0, 0x03, 60, 0, 0}
+	testMonitor.handlePacket(iface, igmpPacket("10.0.0.1", "224.0.0.1", query), now)
+	p := iface.igmp
+	if !p.querier.Equal(net.ParseIP("10.0.0.1")) || p.querierVersion != 3 {
+		t.Fatalf("querier = %v version %d", p.querier, p.querierVersion)
+	}
+	if p.advertisedInterval != 60*time.Second || p.robustness != 3 || p.maxResponse != 10*time.Second {
+		t.Errorf("query timers: interval %v, robustness %d, max response %v", p.advertisedInterval, p.robustness, p.maxResponse)
+	}
+
+	// Report: TO_EX{} joins 239.1.1.1, TO_IN{} leaves 239.1.1.2
+	report := []byte{0x22, 0, 0, 0, 0, 0, 0, 2,
+		byte(layers.IGMPToEx), 0, 0, 0, 239, 1, 1, 1,
+		byte(layers.IGMPToIn), 0, 0, 0, 239, 1, 1, 2,
+	}
+	testMonitor.handlePacket(iface, igmpPacket("10.0.0.10", "224.0.0.22", report), now)
+	if got := testutil.ToFloat64(testMonitor.reports.WithLabelValues("igmpv3-test", "100", "239.1.1.1")); got != 1 {
+		t.Errorf("239.1.1.1 reports = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(testMonitor.leaves.WithLabelValues("igmpv3-test", "100", "239.1.1.2")); got != 1 {
+		t.Errorf("239.1.1.2 leaves = %v, want 1", got)
+	}
+	if _, ok := p.groups["239.1.1.1"]; !ok || len(p.groups) != 1 {
+		t.Errorf("groups = %v, want only 239.1.1.1", p.groups)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/ipv4"
+)
+
+type joinProbe struct {
+	config JoinConfig
+	group  *net.UDPAddr
+	source net.IP
+	iface  *net.Interface
+	vlan   string
+}
+
+// JoinProber periodically joins configured groups and measures the time
+// from our own join until the first media packet arrives
+type JoinProber struct {
+	monitor  *IGMPMonitor
+	probes   []*joinProbe
+	interval time.Duration
+	timeout  time.Duration
+
+	joinLatency  *prometheus.GaugeVec
+	joinFailures *prometheus.CounterVec
+}
+
+func NewJoinProber(monitor *IGMPMonitor, interval, timeout time.Duration) *JoinProber {
+	prober := &JoinProber{
+		monitor:  monitor,
+		interval: interval,
+		timeout:  timeout,
+
+		joinLatency: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_igmp_join_latency_microseconds",
+				Help: "Time from IGMP join to first media packet in microseconds",
+			},
+			[]string{"interface", "vlan", "multicast_group"},
+		),
+
+		joinFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_igmp_join_failures_total",
+				Help: "Joins that received no media packet within the join timeout",
+			},
+			[]string{"interface", "vlan", "multicast_group"},
+		),
+	}
+
+	prometheus.MustRegister(prober.joinLatency)
+	prometheus.MustRegister(prober.joinFailures)
+
+	return prober
+}
+
+func (p *JoinProber) AddJoin(config JoinConfig) error {
+	group, err := net.ResolveUDPAddr("udp4", config.Multicast)
+	if err != nil {
+		return fmt.Errorf("invalid multicast address: %w", err)
+	}
+	if !group.IP.IsMulticast() {
+		return fmt.Errorf("%s is not a multicast address", group.IP)
+	}
+
+	iface, err := net.InterfaceByName(config.Interface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", config.Interface, err)
+	}
+
+	probe := &joinProbe{
+		config: config,
+		group:  group,
+		iface:  iface,
+		vlan:   p.monitor.VLAN(config.Interface),
+	}
+	if config.Source != "" {
+		probe.source = net.ParseIP(config.Source)
+		if probe.source == nil {
+			return fmt.Errorf("invalid source address %q", config.Source)
+		}
+	}
+
+	p.probes = append(p.probes, probe)
+	return nil
+}
+
+// probe joins the group, waits for the first packet and leaves again
+func (p *JoinProber) probe(probe *joinProbe) (time.Duration, error) {
+	conn, err := net.ListenPacket("udp4", probe.group.String())
+	if err != nil {
+		return 0, fmt.Errorf("failed to listen: %w", err)
+	}
+	defer conn.Close()
+
+	pc := ipv4.NewPacketConn(conn)
+	group := &net.UDPAddr{IP: probe.group.IP}
+
+	start := time.Now()
+	if probe.source != nil {
+		err = pc.JoinSourceSpecificGroup(probe.iface, group, &net.UDPAddr{IP: probe.source})
+	} else {
+		err = pc.JoinGroup(probe.iface, group)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to join: %w", err)
+	}
+	defer func() {
+		if probe.source != nil {
+			pc.LeaveSourceSpecificGroup(probe.iface, group, &net.UDPAddr{IP: probe.source})
+		} else {
+			pc.LeaveGroup(probe.iface, group)
+		}
+	}()
+
+	if err := conn.SetReadDeadline(start.Add(p.timeout)); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 9000)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		return time.Since(start), fmt.Errorf("no media packet within %s: %w", p.timeout, err)
+	}
+
+	return time.Since(start), nil
+}
+
+func (p *JoinProber) run(probe *joinProbe) {
+	groupLabel := probe.group.IP.String()
+
+	for {
+		latency, err := p.probe(probe)
+		// A failed join still reports the time waited so the slow join alert fires
+		p.joinLatency.WithLabelValues(probe.config.Interface, probe.vlan, groupLabel).Set(float64(latency.Microseconds()))
+		if err != nil {
+			log.Printf("Join probe for %s on %s failed: %v", probe.config.Multicast, probe.config.Interface, err)
+			p.joinFailures.WithLabelValues(probe.config.Interface, probe.vlan, groupLabel).Inc()
+		}
+
+		if p.interval <= 0 {
+			return
+		}
+		time.Sleep(p.interval)
+	}
+}
+
+func (p *JoinProber) Start() {
+	for _, probe := range p.probes {
+		go p.run(probe)
+	}
+}
@@ -0,0 +1,93 @@
+// IGMP Exporter - Monitors IGMP/MLD multicast group membership and querier state
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v2"
+)
+
+// InterfaceConfig describes one VLAN interface to sniff IGMP/MLD on
+type InterfaceConfig struct {
+	Name     string `yaml:"name"`
+	VLAN     string `yaml:"vlan"`
+	AllMulti bool   `yaml:"allmulti"` // Receive reports for groups we have not joined ourselves
+}
+
+// JoinConfig describes a multicast group the exporter joins to measure join latency
+type JoinConfig struct {
+	Multicast string `yaml:"multicast"` // group:port, same format as streams.yaml
+	Source    string `yaml:"source"`    // Optional: source address for SSM (IGMPv3) joins
+	Interface string `yaml:"interface"`
+}
+
+type Config struct {
+	Interfaces []InterfaceConfig `yaml:"interfaces"`
+	Joins      []JoinConfig      `yaml:"joins"`
+}
+
+func main() {
+	configFile := flag.String("config", "/etc/st2110/igmp.yaml", "Path to IGMP monitoring configuration")
+	listenAddr := flag.String("listen", ":9300", "Prometheus exporter listen address")
+	joinInterval := flag.Duration("join-interval", 60*time.Second, "Interval between join latency probes (0 = probe once)")
+	joinTimeout := flag.Duration("join-timeout", 5*time.Second, "Maximum time to wait for the first media packet after a join")
+	flag.Parse()
+
+	// Allow override from environment
+	if envConfig := os.Getenv("CONFIG_FILE"); envConfig != "" {
+		configFile = &envConfig
+	}
+	if envListen := os.Getenv("LISTEN_ADDR"); envListen != "" {
+		listenAddr = &envListen
+	}
+
+	// Load configuration
+	data, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to read config: %v", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		log.Fatalf("Failed to parse config: %v", err)
+	}
+
+	monitor := NewIGMPMonitor()
+
+	// Start a sniffer per configured VLAN interface
+	for _, ifaceConfig := range config.Interfaces {
+		if err := monitor.AddInterface(ifaceConfig); err != nil {
+			log.Printf("Failed to monitor interface %s: %v", ifaceConfig.Name, err)
+			continue
+		}
+		log.Printf("Monitoring IGMP/MLD on %s (VLAN %s)", ifaceConfig.Name, ifaceConfig.VLAN)
+	}
+	monitor.Start(1 * time.Second)
+
+	// Start join latency probes
+	prober := NewJoinProber(monitor, *joinInterval, *joinTimeout)
+	for _, join := range config.Joins {
+		if err := prober.AddJoin(join); err != nil {
+			log.Printf("Failed to add join probe for %s: %v", join.Multicast, err)
+			continue
+		}
+		log.Printf("Added join probe: %s on %s", join.Multicast, join.Interface)
+	}
+	prober.Start()
+
+	log.Printf("Starting IGMP exporter on %s", *listenAddr)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "OK\n")
+	})
+
+	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+}
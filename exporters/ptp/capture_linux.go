@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Kernel-side filter so the socket only wakes up for PTP (L2 or UDP 319/320),
+// not for the ST 2110 media on the same interface
+var ptpFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 12, Size: 2},                                              // 0: EtherType
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypePTP, SkipTrue: 16},                // 1: PTP over Ethernet
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 8},                      // 2: IPv4?
+	bpf.LoadAbsolute{Off: 23, Size: 1},                                              // 3: IPv4 protocol
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 17, SkipFalse: 12},                         // 4: UDP
+	bpf.LoadAbsolute{Off: 20, Size: 2},                                              // 5: flags/fragment offset
+	bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 10},                    // 6: not the first fragment
+	bpf.LoadMemShift{Off: 14},                                                       // 7: X = IPv4 header length
+	bpf.LoadIndirect{Off: 16, Size: 2},                                              // 8: UDP destination port
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: ptpEventPort, SkipTrue: 8},                 // 9
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: ptpGeneralPort, SkipTrue: 7, SkipFalse: 6}, // 10
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 5},                      // 11: IPv6?
+	bpf.LoadAbsolute{Off: 20, Size: 1},                                              // 12: IPv6 next header
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 17, SkipFalse: 3},                          // 13: UDP
+	bpf.LoadAbsolute{Off: 56, Size: 2},                                              // 14: UDP destination port
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: ptpEventPort, SkipTrue: 2},                 // 15
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: ptpGeneralPort, SkipTrue: 1},               // 16
+	bpf.RetConstant{Val: 0},                                                         // 17
+	bpf.RetConstant{Val: 65535},                                                     // 18
+}
+
+// Destination MACs of the PTP multicast addresses: 224.0.1.129, 224.0.0.107
+// (peer delay), ff0e::181, and the IEEE 802.3 forwardable/non-forwardable groups
+var ptpMulticastMACs = []net.HardwareAddr{
+	{0x01, 0x00, 0x5e, 0x00, 0x01, 0x81},
+	{0x01, 0x00, 0x5e, 0x00, 0x00, 0x6b},
+	{0x33, 0x33, 0x00, 0x00, 0x01, 0x81},
+	{0x01, 0x1b, 0x19, 0x00, 0x00, 0x00},
+	{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e},
+}
+
+type captureSocket struct {
+	fd int
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// openCapture opens an AF_PACKET socket on the interface filtered to PTP and
+// subscribes the NIC to the PTP multicast MACs, so the sniffer also works on a
+// host that does not run ptp4l itself
+func openCapture(ifaceName string) (*captureSocket, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %w", ifaceName, err)
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket (CAP_NET_RAW required): %w", err)
+	}
+
+	if err := attachFilter(fd, ptpFilter); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ALL),
+		Ifindex:  iface.Index,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind to %s: %w", ifaceName, err)
+	}
+
+	for _, mac := range ptpMulticastMACs {
+		mreq := &unix.PacketMreq{
+			Ifindex: int32(iface.Index),
+			Type:    unix.PACKET_MR_MULTICAST,
+			Alen:    uint16(len(mac)),
+		}
+		copy(mreq.Address[:], mac)
+		if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to join %s on %s: %w", mac, ifaceName, err)
+		}
+	}
+
+	return &captureSocket{fd: fd}, nil
+}
+
+func attachFilter(fd int, program []bpf.Instruction) error {
+	raw, err := bpf.Assemble(program)
+	if err != nil {
+		return fmt.Errorf("failed to assemble BPF filter: %w", err)
+	}
+
+	filter := make([]unix.SockFilter, len(raw))
+	for i, ins := range raw {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	prog := &unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog); err != nil {
+		return fmt.Errorf("failed to attach BPF filter: %w", err)
+	}
+	return nil
+}
+
+func (c *captureSocket) ReadPacket(buf []byte) (int, error) {
+	n, _, err := unix.Recvfrom(c.fd, buf, 0)
+	return n, err
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestPTPFilter(t *testing.T) {
+	vm, err := bpf.NewVM(ptpFilter)
+	if err != nil {
+		t.Fatalf("invalid filter: %v", err)
+	}
+
+	payload := encodePTPMessage(msgSync, 0, sniffMaster, -3, make([]byte, 10))
+
+	l2 := make([]byte, 14+len(payload))
+	binary.BigEndian.PutUint16(l2[12:14], etherTypePTP)
+	copy(l2[14:], payload)
+
+	udp6 := make([]byte, 14+40+8+len(payload))
+	binary.BigEndian.PutUint16(udp6[12:14], 0x86dd)
+	udp6[14+6] = 17
+	binary.BigEndian.PutUint16(udp6[14+40+2:], ptpGeneralPort)
+
+	fragment := udp4Frame(ptpEventPort, payload)
+	binary.BigEndian.PutUint16(fragment[14+6:], 0x0010)
+
+	options := udp4Frame(ptpGeneralPort, payload)
+	options = append(options[:34], append(make([]byte, 4), options[34:]...)...)
+	options[14] = 0x46
+
+	for _, tc := range []struct {
+		name   string
+		frame  []byte
+		accept bool
+	}{
+		{"L2", l2, true},
+		{"UDP/IPv4 event", udp4Frame(ptpEventPort, payload), true},
+		{"UDP/IPv4 general", udp4Frame(ptpGeneralPort, payload), true},
+		{"UDP/IPv4 with options", options, true},
+		{"UDP/IPv6 general", udp6, true},
+		{"RTP media", udp4Frame(5004, payload), false},
+		{"non-first fragment", fragment, false},
+	} {
+		n, err := vm.Run(tc.frame)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if (n > 0) != tc.accept {
+			t.Errorf("%s: filter returned %d, want accept=%v", tc.name, n, tc.accept)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+type captureSocket struct{}
+
+func openCapture(ifaceName string) (*captureSocket, error) {
+	return nil, errors.New("PTP capture requires Linux AF_PACKET sockets")
+}
+
+func (c *captureSocket) ReadPacket(buf []byte) (int, error) {
+	return 0, errors.New("capture not supported")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	directionForward = "forward" // Sync (+ Follow_Up), master to slaves
+	directionReverse = "reverse" // Delay_Req as returned in Delay_Resp, slaves to master
+
+	// Sync messages waiting for their Follow_Up per master
+	maxPendingSyncs = 64
+)
+
+// correctionNanoseconds converts a correctionField (ns scaled by 2^16)
+func correctionNanoseconds(field int64) float64 {
+	return float64(field) / 65536
+}
+
+type correctionPathKey struct {
+	domain uint8
+	master PortIdentity
+}
+
+type correctionPath struct {
+	samples      map[string][]float64       // direction -> correction of this window
+	reverse      map[PortIdentity][]float64 // slave -> reverse correction of this window
+	pendingSyncs map[uint16]float64         // two-step Sync correction by sequenceId
+	suspect      map[string]bool            // direction -> flagged as not correcting
+}
+
+// CorrectionAnalyzer follows the correctionField that transparent clocks add
+// along each master's path: Sync/Follow_Up carry the forward residence time,
+// Delay_Resp returns the residence accumulated by each slave's Delay_Req
+type CorrectionAnalyzer struct {
+	mu            sync.Mutex
+	instance      string
+	interfaceName string
+	paths         map[correctionPathKey]*correctionPath
+
+	residence     *prometheus.GaugeVec
+	nonZeroRatio  *prometheus.GaugeVec
+	asymmetry     *prometheus.GaugeVec
+	notCorrecting *prometheus.GaugeVec
+}
+
+func NewCorrectionAnalyzer(instance, iface string) *CorrectionAnalyzer {
+	labels := []string{"ptp_instance", "interface", "domain", "master", "direction"}
+
+	a := &CorrectionAnalyzer{
+		instance:      instance,
+		interfaceName: iface,
+		paths:         make(map[correctionPathKey]*correctionPath),
+
+		residence: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_correction_residence_nanoseconds",
+				Help: "correctionField accumulated by transparent clocks over the last window (min, max, mean, stddev, p50, p90, p99)",
+			},
+			[]string{"ptp_instance", "interface", "domain", "master", "direction", "stat"},
+		),
+		nonZeroRatio: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_correction_nonzero_ratio",
+				Help: "Fraction of messages with a non-zero correctionField over the last window",
+			},
+			labels,
+		),
+		asymmetry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_correction_asymmetry_nanoseconds",
+				Help: "Mean forward minus mean reverse residence time of a master-slave path over the last window",
+			},
+			[]string{"ptp_instance", "interface", "domain", "master", "slave"},
+		),
+		notCorrecting: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_correction_not_correcting",
+				Help: "Path carries no correction while the reverse direction or other masters in the domain do (1=a hop appears not to be correcting)",
+			},
+			labels,
+		),
+	}
+
+	a.residence = register(a.residence)
+	a.nonZeroRatio = register(a.nonZeroRatio)
+	a.asymmetry = register(a.asymmetry)
+	a.notCorrecting = register(a.notCorrecting)
+
+	return a
+}
+
+func (a *CorrectionAnalyzer) path(key correctionPathKey) *correctionPath {
+	path, ok := a.paths[key]
+	if !ok {
+		path = &correctionPath{
+			samples:      make(map[string][]float64),
+			reverse:      make(map[PortIdentity][]float64),
+			pendingSyncs: make(map[uint16]float64),
+			suspect:      make(map[string]bool),
+		}
+		a.paths[key] = path
+	}
+	return path
+}
+
+// HandleMessage records the correction of Sync, Follow_Up and Delay_Resp messages
+func (a *CorrectionAnalyzer) HandleMessage(msg *PTPMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	h := msg.Header
+	key := correctionPathKey{domain: h.DomainNumber, master: h.SourcePortIdentity}
+	correction := correctionNanoseconds(h.CorrectionField)
+
+	switch h.MessageType {
+	case msgSync:
+		path := a.path(key)
+		if h.Flags&flagTwoStep == 0 {
+			path.samples[directionForward] = append(path.samples[directionForward], correction)
+			return
+		}
+		// Two-step: transparent clocks may correct either the Sync or its Follow_Up
+		if len(path.pendingSyncs) >= maxPendingSyncs {
+			path.pendingSyncs = make(map[uint16]float64)
+		}
+		path.pendingSyncs[h.SequenceID] = correction
+	case msgFollowUp:
+		path := a.path(key)
+		if sync, ok := path.pendingSyncs[h.SequenceID]; ok {
+			delete(path.pendingSyncs, h.SequenceID)
+			path.samples[directionForward] = append(path.samples[directionForward], sync+correction)
+		}
+	case msgDelayResp:
+		// Every slave's Delay_Resp is multicast, each took its own reverse path
+		path := a.path(key)
+		slave := msg.RequestingPortIdentity
+		path.samples[directionReverse] = append(path.samples[directionReverse], correction)
+		path.reverse[slave] = append(path.reverse[slave], correction)
+	}
+}
+
+// Publish exports the statistics of the window that just ended and starts a new one
+func (a *CorrectionAnalyzer) Publish() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Directions of each domain where some master's path is corrected
+	corrected := make(map[uint8]map[string]bool)
+	for key, path := range a.paths {
+		for direction, samples := range path.samples {
+			if countNonZero(samples) > 0 {
+				if corrected[key.domain] == nil {
+					corrected[key.domain] = make(map[string]bool)
+				}
+				corrected[key.domain][direction] = true
+			}
+		}
+	}
+
+	for key, path := range a.paths {
+		domain := strconv.Itoa(int(key.domain))
+		master := key.master.String()
+		means := make(map[string]float64)
+
+		for direction, samples := range path.samples {
+			if len(samples) == 0 {
+				continue
+			}
+			summary := summarize(samples)
+			means[direction] = summary.Mean
+			for stat, value := range map[string]float64{
+				"min": summary.Min, "max": summary.Max, "mean": summary.Mean, "stddev": summary.StdDev,
+				"p50": summary.P50, "p90": summary.P90, "p99": summary.P99,
+			} {
+				a.residence.WithLabelValues(a.instance, a.interfaceName, domain, master, direction, stat).Set(value)
+			}
+
+			nonZero := countNonZero(samples)
+			a.nonZeroRatio.WithLabelValues(a.instance, a.interfaceName, domain, master, direction).Set(float64(nonZero) / float64(len(samples)))
+
+			other := directionReverse
+			if direction == directionReverse {
+				other = directionForward
+			}
+			suspect := nonZero == 0 && (countNonZero(path.samples[other]) > 0 || corrected[key.domain][direction])
+			a.notCorrecting.WithLabelValues(a.instance, a.interfaceName, domain, master, direction).Set(boolToFloat(suspect))
+			if suspect && !path.suspect[direction] {
+				log.Printf("⚠️  PTP %s path of %s in domain %d on %s carries no correction", direction, master, key.domain, a.interfaceName)
+			}
+			path.suspect[direction] = suspect
+		}
+
+		if forward, ok := means[directionForward]; ok {
+			for slave, samples := range path.reverse {
+				if len(samples) > 0 {
+					a.asymmetry.WithLabelValues(a.instance, a.interfaceName, domain, master, slave.String()).Set(forward - summarize(samples).Mean)
+				}
+			}
+		}
+
+		for direction := range path.samples {
+			path.samples[direction] = path.samples[direction][:0]
+		}
+		// A slave without Delay_Req in the window has left the segment
+		for slave, samples := range path.reverse {
+			if len(samples) == 0 {
+				delete(path.reverse, slave)
+				a.asymmetry.DeleteLabelValues(a.instance, a.interfaceName, domain, master, slave.String())
+				continue
+			}
+			path.reverse[slave] = samples[:0]
+		}
+	}
+}
+
+// Forget drops the series of a master that left the segment
+func (a *CorrectionAnalyzer) Forget(domain uint8, master PortIdentity) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := correctionPathKey{domain: domain, master: master}
+	if _, ok := a.paths[key]; !ok {
+		return
+	}
+	delete(a.paths, key)
+	labels := prometheus.Labels{"ptp_instance": a.instance, "interface": a.interfaceName,
+		"domain": strconv.Itoa(int(domain)), "master": master.String()}
+	for _, vec := range []*prometheus.GaugeVec{a.residence, a.nonZeroRatio, a.asymmetry, a.notCorrecting} {
+		vec.DeletePartialMatch(labels)
+	}
+}
+
+func countNonZero(values []float64) int {
+	n := 0
+	for _, v := range values {
+		if v != 0 {
+			n++
+		}
+	}
+	return n
+}
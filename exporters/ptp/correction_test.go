@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCorrectionAnalyzer(t *testing.T) {
+	analyzer := NewCorrectionAnalyzer("correction-test", "eth0")
+	slaveNear := PortIdentity{ClockIdentity: ClockIdentity{0x02, 0, 0, 0xff, 0xfe, 0, 1, 1}, PortNumber: 1}
+	slaveFar := PortIdentity{ClockIdentity: ClockIdentity{0x02, 0, 0, 0xff, 0xfe, 0, 1, 2}, PortNumber: 1}
+	message := func(messageType uint8, source PortIdentity, sequence uint16, flags uint16, correctionNs int64) *PTPMessage {
+		return &PTPMessage{Header: PTPHeader{MessageType: messageType, DomainNumber: 127, Flags: flags,
+			SourcePortIdentity: source, SequenceID: sequence, CorrectionField: correctionNs << 16}}
+	}
+
+	for seq := uint16(0); seq < 4; seq++ {
+		// Corrected two-step master: residence split between Sync and Follow_Up
+		analyzer.HandleMessage(message(msgSync, sniffMaster, seq, flagTwoStep, 100))
+		analyzer.HandleMessage(message(msgFollowUp, sniffMaster, seq, 0, 400+int64(seq)*100))
+		// Two slaves behind different hops
+		for slave, correction := range map[PortIdentity]int64{slaveNear: 300, slaveFar: 100} {
+			resp := message(msgDelayResp, sniffMaster, seq, 0, correction)
+			resp.RequestingPortIdentity = slave
+			analyzer.HandleMessage(resp)
+		}
+
+		// One-step master behind a hop that does not correct
+		analyzer.HandleMessage(message(msgSync, sniffRogue, seq, 0, 0))
+	}
+	analyzer.Publish()
+
+	master, rogue := sniffMaster.String(), sniffRogue.String()
+
+	if got := testutil.ToFloat64(analyzer.residence.WithLabelValues("correction-test", "eth0", "127", master, directionForward, "max")); got != 800 {
+		t.Errorf("forward max residence = %v, want 800", got)
+	}
+	if got := testutil.ToFloat64(analyzer.asymmetry.WithLabelValues("correction-test", "eth0", "127", master, slaveNear.String())); got != 350 {
+		t.Errorf("near slave asymmetry = %v, want 350 (mean 650 forward - 300 reverse)", got)
+	}
+	if got := testutil.ToFloat64(analyzer.asymmetry.WithLabelValues("correction-test", "eth0", "127", master, slaveFar.String())); got != 550 {
+		t.Errorf("far slave asymmetry = %v, want 550 (mean 650 forward - 100 reverse)", got)
+	}
+	if got := testutil.ToFloat64(analyzer.notCorrecting.WithLabelValues("correction-test", "eth0", "127", master, directionForward)); got != 0 {
+		t.Errorf("corrected master flagged as not correcting")
+	}
+	if got := testutil.ToFloat64(analyzer.notCorrecting.WithLabelValues("correction-test", "eth0", "127", rogue, directionForward)); got != 1 {
+		t.Errorf("uncorrected path not flagged")
+	}
+	if got := testutil.ToFloat64(analyzer.nonZeroRatio.WithLabelValues("correction-test", "eth0", "127", rogue, directionForward)); got != 0 {
+		t.Errorf("non-zero ratio of the uncorrected path = %v, want 0", got)
+	}
+
+	// The far slave stops sending Delay_Req: its path goes after a window
+	// without samples
+	analyzer.HandleMessage(message(msgSync, sniffMaster, 4, 0, 700))
+	resp := message(msgDelayResp, sniffMaster, 4, 0, 200)
+	resp.RequestingPortIdentity = slaveNear
+	analyzer.HandleMessage(resp)
+	analyzer.Publish()
+	if got := testutil.ToFloat64(analyzer.asymmetry.WithLabelValues("correction-test", "eth0", "127", master, slaveNear.String())); got != 500 {
+		t.Errorf("near slave asymmetry = %v, want 500", got)
+	}
+	if n := testutil.CollectAndCount(analyzer.asymmetry, "st2110_ptp_correction_asymmetry_nanoseconds"); n != 1 {
+		t.Errorf("%d asymmetry series after the far slave left, want 1", n)
+	}
+
+	analyzer.Forget(127, sniffRogue)
+	if n := testutil.CollectAndCount(analyzer.notCorrecting, "st2110_ptp_correction_not_correcting"); n != 2 {
+		t.Errorf("%d not_correcting series after Forget, want 2", n)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event is a timestamped change observed on the PTP clock (grandmaster change, parent change, ...)
+type Event struct {
+	Time      time.Time `json:"time"`
+	Device    string    `json:"device"`
+	Instance  string    `json:"instance,omitempty"`
+	Interface string    `json:"interface"`
+	Type      string    `json:"type"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// EventLog keeps the most recent events in memory for the JSON endpoint
+type EventLog struct {
+	mu       sync.Mutex
+	events   []Event
+	capacity int
+}
+
+func NewEventLog(capacity int) *EventLog {
+	return &EventLog{capacity: capacity}
+}
+
+func (l *EventLog) Add(event Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, event)
+	if len(l.events) > l.capacity {
+		l.events = l.events[len(l.events)-l.capacity:]
+	}
+}
+
+// Recent returns the stored events of the given type (all types if empty), oldest first
+func (l *EventLog) Recent(eventType string) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := make([]Event, 0, len(l.events))
+	for _, event := range l.events {
+		if eventType == "" || event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// ServeHTTP lists recent events as JSON, optionally filtered with ?type=
+func (l *EventLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.Recent(r.URL.Query().Get("type")))
+}
+
+// Filter serves only the given event types, e.g. the state transition
+// timeline, optionally narrowed to one instance with ?instance=
+func (l *EventLog) Filter(eventTypes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instance := r.URL.Query().Get("instance")
+		events := []Event{}
+		for _, event := range l.Recent("") {
+			if instance != "" && event.Instance != instance {
+				continue
+			}
+			for _, eventType := range eventTypes {
+				if event.Type == eventType {
+					events = append(events, event)
+					break
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	})
+}
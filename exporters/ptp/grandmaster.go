@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	eventGrandmasterChange = "grandmaster_change"
+	eventParentChange      = "parent_change"
+)
+
+// GrandmasterTracker exposes the grandmaster and time properties from
+// PARENT_DATA_SET / TIME_PROPERTIES_DATA_SET and records BMCA decisions
+type GrandmasterTracker struct {
+	device        string
+	instance      string
+	interfaceName string
+	events        *EventLog
+
+	grandmaster ClockIdentity
+	parent      PortIdentity
+	known       bool
+
+	grandmasterInfo         *prometheus.GaugeVec
+	priority1               *prometheus.GaugeVec
+	priority2               *prometheus.GaugeVec
+	clockClass              *prometheus.GaugeVec
+	clockAccuracy           *prometheus.GaugeVec
+	offsetScaledLogVariance *prometheus.GaugeVec
+	timeSource              *prometheus.GaugeVec
+	utcOffset               *prometheus.GaugeVec
+	utcOffsetValid          *prometheus.GaugeVec
+	timeTraceable           *prometheus.GaugeVec
+	frequencyTraceable      *prometheus.GaugeVec
+	grandmasterChanges      *prometheus.CounterVec
+	parentChanges           *prometheus.CounterVec
+}
+
+func NewGrandmasterTracker(device, instance, iface string, events *EventLog) *GrandmasterTracker {
+	labels := []string{"device", "ptp_instance", "interface"}
+
+	gauge := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	}
+
+	tracker := &GrandmasterTracker{
+		device:        device,
+		instance:      instance,
+		interfaceName: iface,
+		events:        events,
+
+		grandmasterInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_grandmaster_info",
+				Help: "Current grandmaster clock identity and parent port (always 1)",
+			},
+			[]string{"device", "ptp_instance", "interface", "grandmaster", "parent_port"},
+		),
+		priority1:               gauge("st2110_ptp_grandmaster_priority1", "Grandmaster priority1"),
+		priority2:               gauge("st2110_ptp_grandmaster_priority2", "Grandmaster priority2"),
+		clockClass:              gauge("st2110_ptp_grandmaster_clock_class", "Grandmaster clockClass (6=locked to primary reference, 7=holdover, 248=default)"),
+		clockAccuracy:           gauge("st2110_ptp_grandmaster_clock_accuracy", "Grandmaster clockAccuracy enumeration (0x20=25ns ... 0xFE=unknown)"),
+		offsetScaledLogVariance: gauge("st2110_ptp_grandmaster_offset_scaled_log_variance", "Grandmaster offsetScaledLogVariance"),
+		timeSource:              gauge("st2110_ptp_time_source", "Grandmaster timeSource enumeration (0x10=ATOMIC_CLOCK, 0x20=GPS, 0xA0=INTERNAL_OSCILLATOR)"),
+		utcOffset:               gauge("st2110_ptp_utc_offset_seconds", "currentUtcOffset announced by the grandmaster (TAI - UTC)"),
+		utcOffsetValid:          gauge("st2110_ptp_utc_offset_valid", "currentUtcOffsetValid flag (1=valid)"),
+		timeTraceable:           gauge("st2110_ptp_time_traceable", "timeTraceable flag (1=traceable to a primary reference)"),
+		frequencyTraceable:      gauge("st2110_ptp_frequency_traceable", "frequencyTraceable flag (1=traceable to a primary reference)"),
+
+		grandmasterChanges: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_ptp_grandmaster_changes_total",
+				Help: "Number of grandmaster changes selected by the BMCA",
+			},
+			labels,
+		),
+		parentChanges: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_ptp_parent_changes_total",
+				Help: "Number of parent port changes (grandmaster or path through the fabric)",
+			},
+			labels,
+		),
+	}
+
+	tracker.grandmasterInfo = register(tracker.grandmasterInfo)
+	tracker.priority1 = register(tracker.priority1)
+	tracker.priority2 = register(tracker.priority2)
+	tracker.clockClass = register(tracker.clockClass)
+	tracker.clockAccuracy = register(tracker.clockAccuracy)
+	tracker.offsetScaledLogVariance = register(tracker.offsetScaledLogVariance)
+	tracker.timeSource = register(tracker.timeSource)
+	tracker.utcOffset = register(tracker.utcOffset)
+	tracker.utcOffsetValid = register(tracker.utcOffsetValid)
+	tracker.timeTraceable = register(tracker.timeTraceable)
+	tracker.frequencyTraceable = register(tracker.frequencyTraceable)
+	tracker.grandmasterChanges = register(tracker.grandmasterChanges)
+	tracker.parentChanges = register(tracker.parentChanges)
+
+	// Export the counters at zero so increase() based alerts work from the start
+	tracker.grandmasterChanges.WithLabelValues(device, instance, iface)
+	tracker.parentChanges.WithLabelValues(device, instance, iface)
+
+	return tracker
+}
+
+// Grandmaster returns the current grandmaster identity, or "unknown" before the first update
+func (t *GrandmasterTracker) Grandmaster() string {
+	if !t.known {
+		return "unknown"
+	}
+	return t.grandmaster.String()
+}
+
+// Update records the parent data set and reports whether the grandmaster changed
+func (t *GrandmasterTracker) Update(parent *ParentDataSet, now time.Time) bool {
+	gmChanged := t.known && parent.GrandmasterIdentity != t.grandmaster
+	parentChanged := t.known && parent.ParentPortIdentity != t.parent
+
+	quality := parent.GrandmasterClockQuality
+	detail := fmt.Sprintf("priority1=%d priority2=%d clockClass=%d clockAccuracy=0x%02x offsetScaledLogVariance=0x%04x",
+		parent.GrandmasterPriority1, parent.GrandmasterPriority2,
+		quality.ClockClass, quality.ClockAccuracy, quality.OffsetScaledLogVariance)
+
+	if gmChanged {
+		log.Printf("⚠️  Grandmaster changed on %s/%s (%s): %s -> %s (%s)",
+			t.device, t.instance, t.interfaceName, t.grandmaster, parent.GrandmasterIdentity, detail)
+		t.grandmasterChanges.WithLabelValues(t.device, t.instance, t.interfaceName).Inc()
+		t.events.Add(Event{
+			Time:      now,
+			Device:    t.device,
+			Instance:  t.instance,
+			Interface: t.interfaceName,
+			Type:      eventGrandmasterChange,
+			From:      t.grandmaster.String(),
+			To:        parent.GrandmasterIdentity.String(),
+			Detail:    detail,
+		})
+	}
+	if parentChanged {
+		log.Printf("Parent port changed on %s/%s (%s): %s -> %s",
+			t.device, t.instance, t.interfaceName, t.parent, parent.ParentPortIdentity)
+		t.parentChanges.WithLabelValues(t.device, t.instance, t.interfaceName).Inc()
+		t.events.Add(Event{
+			Time:      now,
+			Device:    t.device,
+			Instance:  t.instance,
+			Interface: t.interfaceName,
+			Type:      eventParentChange,
+			From:      t.parent.String(),
+			To:        parent.ParentPortIdentity.String(),
+		})
+	}
+
+	if !t.known || gmChanged || parentChanged {
+		t.grandmasterInfo.DeletePartialMatch(prometheus.Labels{"device": t.device, "ptp_instance": t.instance})
+	}
+	t.grandmaster = parent.GrandmasterIdentity
+	t.parent = parent.ParentPortIdentity
+	t.known = true
+
+	t.grandmasterInfo.WithLabelValues(t.device, t.instance, t.interfaceName, t.grandmaster.String(), t.parent.String()).Set(1)
+	t.priority1.WithLabelValues(t.device, t.instance, t.interfaceName).Set(float64(parent.GrandmasterPriority1))
+	t.priority2.WithLabelValues(t.device, t.instance, t.interfaceName).Set(float64(parent.GrandmasterPriority2))
+	t.clockClass.WithLabelValues(t.device, t.instance, t.interfaceName).Set(float64(quality.ClockClass))
+	t.clockAccuracy.WithLabelValues(t.device, t.instance, t.interfaceName).Set(float64(quality.ClockAccuracy))
+	t.offsetScaledLogVariance.WithLabelValues(t.device, t.instance, t.interfaceName).Set(float64(quality.OffsetScaledLogVariance))
+
+	return gmChanged
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (t *GrandmasterTracker) UpdateTimeProperties(tp *TimePropertiesDataSet) {
+	t.timeSource.WithLabelValues(t.device, t.instance, t.interfaceName).Set(float64(tp.TimeSource))
+	t.utcOffset.WithLabelValues(t.device, t.instance, t.interfaceName).Set(float64(tp.CurrentUTCOffset))
+	t.utcOffsetValid.WithLabelValues(t.device, t.instance, t.interfaceName).Set(boolToFloat(tp.CurrentUTCOffsetValid))
+	t.timeTraceable.WithLabelValues(t.device, t.instance, t.interfaceName).Set(boolToFloat(tp.TimeTraceable))
+	t.frequencyTraceable.WithLabelValues(t.device, t.instance, t.interfaceName).Set(boolToFloat(tp.FrequencyTraceable))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGrandmasterTrackerChanges(t *testing.T) {
+	events := NewEventLog(20)
+	tracker := NewGrandmasterTracker("gm-test", "red", "eth1", events)
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	counts := func() (gm, parent float64) {
+		return testutil.ToFloat64(tracker.grandmasterChanges.WithLabelValues("gm-test", "red", "eth1")),
+			testutil.ToFloat64(tracker.parentChanges.WithLabelValues("gm-test", "red", "eth1"))
+	}
+	primary := PortIdentity{ClockIdentity: ClockIdentity{0xec, 0x46, 0x70, 0xff, 0xfe, 0x00, 0x01, 0x02}, PortNumber: 1}
+	backup := PortIdentity{ClockIdentity: ClockIdentity{0x00, 0x11, 0x22, 0xff, 0xfe, 0x33, 0x44, 0x55}, PortNumber: 1}
+	// The fabric's boundary clocks: the slave sees the grandmaster through
+	// one of two switch ports
+	viaLeaf1 := PortIdentity{ClockIdentity: ClockIdentity{0x02, 0, 0, 0xff, 0xfe, 0, 0, 1}, PortNumber: 3}
+	viaLeaf2 := PortIdentity{ClockIdentity: ClockIdentity{0x02, 0, 0, 0xff, 0xfe, 0, 0, 2}, PortNumber: 3}
+	parent := func(gm PortIdentity, via PortIdentity, clockClass uint8) *ParentDataSet {
+		return &ParentDataSet{
+			ParentPortIdentity:      via,
+			GrandmasterPriority1:    128,
+			GrandmasterPriority2:    128,
+			GrandmasterClockQuality: ClockQuality{ClockClass: clockClass, ClockAccuracy: 0x21, OffsetScaledLogVariance: 0x4e5d},
+			GrandmasterIdentity:     gm.ClockIdentity,
+		}
+	}
+
+	if tracker.Grandmaster() != "unknown" {
+		t.Errorf("grandmaster before the first update = %s", tracker.Grandmaster())
+	}
+	if tracker.Update(parent(primary, viaLeaf1, 6), at(0)) {
+		t.Error("first parent data set reported as a grandmaster change")
+	}
+	if gm, p := counts(); gm != 0 || p != 0 {
+		t.Errorf("after the first update: %v grandmaster, %v parent changes", gm, p)
+	}
+
+	// Same grandmaster, new path through the fabric
+	if tracker.Update(parent(primary, viaLeaf2, 6), at(1)) {
+		t.Error("parent change reported as a grandmaster change")
+	}
+	// The BMCA selects the backup grandmaster, then flaps back
+	if !tracker.Update(parent(backup, viaLeaf2, 7), at(2)) {
+		t.Error("grandmaster change not reported")
+	}
+	if tracker.Grandmaster() != backup.ClockIdentity.String() {
+		t.Errorf("grandmaster = %s, want %s", tracker.Grandmaster(), backup.ClockIdentity)
+	}
+	tracker.Update(parent(primary, viaLeaf1, 6), at(3))
+	tracker.Update(parent(primary, viaLeaf1, 6), at(4))
+
+	if gm, p := counts(); gm != 2 || p != 2 {
+		t.Errorf("grandmaster changes = %v (want 2), parent changes = %v (want 2)", gm, p)
+	}
+	if n := testutil.CollectAndCount(tracker.grandmasterInfo, "st2110_ptp_grandmaster_info"); n != 1 {
+		t.Errorf("%d grandmaster_info series, want only the current one", n)
+	}
+	if got := testutil.ToFloat64(tracker.clockClass.WithLabelValues("gm-test", "red", "eth1")); got != 6 {
+		t.Errorf("clock class = %v, want 6", got)
+	}
+
+	gmEvents := events.Recent(eventGrandmasterChange)
+	if len(gmEvents) != 2 ||
+		gmEvents[0].From != primary.ClockIdentity.String() || gmEvents[0].To != backup.ClockIdentity.String() ||
+		gmEvents[1].To != primary.ClockIdentity.String() || !gmEvents[1].Time.Equal(at(3)) {
+		t.Errorf("unexpected grandmaster change events: %+v", gmEvents)
+	}
+	parentEvents := events.Recent(eventParentChange)
+	if len(parentEvents) != 2 || parentEvents[0].From != viaLeaf1.String() || parentEvents[0].To != viaLeaf2.String() {
+		t.Errorf("unexpected parent change events: %+v", parentEvents)
+	}
+}
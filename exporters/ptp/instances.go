@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+const eventTimeSourceChange = "time_source_change"
+
+// InstanceConfig describes one ptp4l instance (e.g. the red and blue networks)
+type InstanceConfig struct {
+	Name      string `yaml:"name"`
+	Role      string `yaml:"role"` // e.g. primary / secondary, exported as a label
+	Interface string `yaml:"interface"`
+	Socket    string `yaml:"socket"` // ptp4l uds_address
+	UDP       string `yaml:"udp"`    // Optional: management over UDP (host:320) instead of the socket
+	Domain    uint8  `yaml:"domain"`
+	PHC       string `yaml:"phc"`   // auto (default), /dev/ptpN or none
+	Sniff     string `yaml:"sniff"` // Interface for -mode sniff/both (defaults to interface)
+	Log       string `yaml:"log"`   // Optional: ptp4l log for the servo state
+}
+
+type Config struct {
+	Device    string           `yaml:"device"`
+	Instances []InstanceConfig `yaml:"instances"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if config.Device == "" {
+		config.Device = "default"
+	}
+	if len(config.Instances) == 0 {
+		return nil, fmt.Errorf("no ptp4l instances in %s", path)
+	}
+
+	names := make(map[string]bool)
+	for i := range config.Instances {
+		instance := &config.Instances[i]
+		if instance.Interface == "" {
+			return nil, fmt.Errorf("instance %d has no interface", i)
+		}
+		if instance.Name == "" {
+			instance.Name = instance.Interface
+		}
+		if names[instance.Name] {
+			return nil, fmt.Errorf("duplicate instance name %q", instance.Name)
+		}
+		names[instance.Name] = true
+		if instance.Socket == "" {
+			instance.Socket = "/var/run/ptp4l"
+		}
+		switch instance.PHC {
+		case "":
+			instance.PHC = "auto"
+		case "none":
+			instance.PHC = ""
+		}
+		if instance.Sniff == "" {
+			instance.Sniff = instance.Interface
+		}
+	}
+	return &config, nil
+}
+
+// register adds the collector to the default registry, or returns the one
+// already registered under the same name so every ptp4l instance shares it
+func register[T prometheus.Collector](c T) T {
+	if err := prometheus.Register(c); err != nil {
+		if existing, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return existing.ExistingCollector.(T)
+		}
+		panic(err)
+	}
+	return c
+}
+
+// phc2sys -a logs the clock it follows, e.g. "selecting eth1 as the master clock"
+// or "selecting /dev/ptp1 as domain source clock" in newer releases
+var phc2sysSelectRe = regexp.MustCompile(`selecting (\S+) as (?:the master|.*source) clock`)
+
+// TimeSourceSelector exposes which ptp4l instance currently disciplines the
+// system clock: the one phc2sys reports selecting, otherwise the locked
+// instance whose PHC is closest to the system clock
+type TimeSourceSelector struct {
+	mu        sync.Mutex
+	device    string
+	exporters []*PTPExporter
+	events    *EventLog
+
+	phc2sysChoice string
+	selected      string
+
+	instanceInfo *prometheus.GaugeVec
+	selectedVec  *prometheus.GaugeVec
+	changes      *prometheus.CounterVec
+}
+
+func NewTimeSourceSelector(device string, exporters []*PTPExporter, events *EventLog) *TimeSourceSelector {
+	selector := &TimeSourceSelector{
+		device:    device,
+		exporters: exporters,
+		events:    events,
+
+		instanceInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_instance_info",
+				Help: "Configured ptp4l instance (always 1)",
+			},
+			[]string{"device", "ptp_instance", "interface", "role"},
+		),
+		selectedVec: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_instance_selected",
+				Help: "ptp4l instance chosen as the system time source (1=selected)",
+			},
+			[]string{"device", "ptp_instance", "role", "reason"},
+		),
+		changes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_ptp_instance_selection_changes_total",
+				Help: "Number of switches of the system time source between ptp4l instances",
+			},
+			[]string{"device"},
+		),
+	}
+
+	selector.instanceInfo = register(selector.instanceInfo)
+	selector.selectedVec = register(selector.selectedVec)
+	selector.changes = register(selector.changes)
+
+	selector.changes.WithLabelValues(device)
+	for _, e := range exporters {
+		selector.instanceInfo.WithLabelValues(device, e.instance, e.interfaceName, e.role).Set(1)
+	}
+
+	return selector
+}
+
+// SetPhc2sysSelection records the clock phc2sys reported selecting as its source
+func (s *TimeSourceSelector) SetPhc2sysSelection(line string) {
+	m := phc2sysSelectRe.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	s.mu.Lock()
+	s.phc2sysChoice = m[1]
+	s.mu.Unlock()
+}
+
+// choose returns the selected instance and why it was selected
+func (s *TimeSourceSelector) choose() (*PTPExporter, string) {
+	if s.phc2sysChoice != "" {
+		for _, e := range s.exporters {
+			if s.phc2sysChoice == e.interfaceName ||
+				(e.phc != nil && filepath.Base(s.phc2sysChoice) == filepath.Base(e.phc.phcPath)) {
+				return e, "phc2sys"
+			}
+		}
+	}
+
+	var best *PTPExporter
+	bestOffset := math.Inf(1)
+	for _, e := range s.exporters {
+		if !e.locked.Load() {
+			continue
+		}
+		offset := math.Inf(1)
+		if e.phc != nil {
+			if v, ok := e.phc.LastOffset(); ok {
+				offset = math.Abs(float64(v))
+			}
+		}
+		// Config order breaks ties, so the first locked instance wins without PHC readings
+		if best == nil || offset < bestOffset {
+			best, bestOffset = e, offset
+		}
+	}
+	if best == nil {
+		return nil, ""
+	}
+	if math.IsInf(bestOffset, 1) {
+		return best, "locked"
+	}
+	return best, "phc_offset"
+}
+
+func (s *TimeSourceSelector) Update(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chosen, reason := s.choose()
+	name := ""
+	if chosen != nil {
+		name = chosen.instance
+	}
+
+	if name != s.selected {
+		log.Printf("⚠️  System time source changed on %s: %q -> %q (%s)", s.device, s.selected, name, reason)
+		if s.selected != "" {
+			s.changes.WithLabelValues(s.device).Inc()
+		}
+		s.events.Add(Event{
+			Time:     now,
+			Device:   s.device,
+			Instance: name,
+			Type:     eventTimeSourceChange,
+			From:     s.selected,
+			To:       name,
+			Detail:   "reason=" + reason,
+		})
+		s.selected = name
+	}
+
+	s.selectedVec.DeletePartialMatch(prometheus.Labels{"device": s.device})
+	for _, e := range s.exporters {
+		if e == chosen {
+			s.selectedVec.WithLabelValues(s.device, e.instance, e.role, reason).Set(1)
+		} else {
+			s.selectedVec.WithLabelValues(s.device, e.instance, e.role, "").Set(0)
+		}
+	}
+}
+
+func (s *TimeSourceSelector) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for now := range ticker.C {
+			s.Update(now)
+		}
+	}()
+}
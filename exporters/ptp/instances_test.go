@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ptp.yaml")
+	os.WriteFile(path, []byte(`
+device: camera-1
+instances:
+  - name: red
+    role: primary
+    interface: eth1
+    socket: /var/run/ptp4l-red
+    domain: 127
+  - interface: eth2
+    phc: none
+`), 0644)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	red, blue := config.Instances[0], config.Instances[1]
+	if config.Device != "camera-1" || red.Name != "red" || red.Domain != 127 || red.PHC != "auto" || red.Sniff != "eth1" {
+		t.Errorf("unexpected red instance: %+v", red)
+	}
+	if blue.Name != "eth2" || blue.Socket != "/var/run/ptp4l" || blue.PHC != "" {
+		t.Errorf("unexpected defaults: %+v", blue)
+	}
+
+	os.WriteFile(path, []byte("instances:\n  - interface: eth1\n  - interface: eth1\n"), 0644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("accepted duplicate instance names")
+	}
+}
+
+func TestTimeSourceSelector(t *testing.T) {
+	newInstance := func(name, iface, role, phc string) *PTPExporter {
+		return &PTPExporter{instance: name, interfaceName: iface, role: role,
+			phc: NewPHCMonitor("selector-test", name, iface, phc)}
+	}
+	red := newInstance("red", "eth1", "primary", "/dev/ptp0")
+	blue := newInstance("blue", "eth2", "secondary", "/dev/ptp1")
+	events := NewEventLog(10)
+	selector := NewTimeSourceSelector("selector-test", []*PTPExporter{red, blue}, events)
+	now := time.Now()
+
+	selected := func(e *PTPExporter, reason string) float64 {
+		return testutil.ToFloat64(selector.selectedVec.WithLabelValues("selector-test", e.instance, e.role, reason))
+	}
+
+	// Only blue is locked
+	blue.locked.Store(true)
+	selector.Update(now)
+	if selected(blue, "locked") != 1 || selected(red, "") != 0 {
+		t.Errorf("expected blue selected as the only locked instance")
+	}
+
+	// Both locked: the PHC closest to the system clock wins
+	red.locked.Store(true)
+	red.phc.lastOffset.Store(-20)
+	red.phc.haveOffset.Store(true)
+	blue.phc.lastOffset.Store(5000)
+	blue.phc.haveOffset.Store(true)
+	selector.Update(now.Add(time.Second))
+	if selected(red, "phc_offset") != 1 {
+		t.Errorf("expected red selected by PHC offset")
+	}
+
+	// phc2sys reporting its source overrides the offsets
+	selector.SetPhc2sysSelection("phc2sys[1234.567]: selecting /dev/ptp1 as the master clock")
+	selector.Update(now.Add(2 * time.Second))
+	if selected(blue, "phc2sys") != 1 {
+		t.Errorf("expected blue selected by phc2sys")
+	}
+
+	if got := testutil.ToFloat64(selector.changes.WithLabelValues("selector-test")); got != 2 {
+		t.Errorf("selection changes = %v, want 2", got)
+	}
+	if recent := events.Recent(eventTimeSourceChange); len(recent) != 3 || recent[2].To != "blue" {
+		t.Errorf("unexpected time source events: %+v", recent)
+	}
+}
@@ -2,14 +2,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
-	"regexp"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -21,112 +21,229 @@ type PTPExporter struct {
 	meanPathDelay    *prometheus.GaugeVec
 	clockState       *prometheus.GaugeVec
 	stepsRemoved     *prometheus.GaugeVec
+	portMessages     *prometheus.CounterVec
 	device           string
+	instance         string
+	role             string
 	interfaceName    string
+	locked           atomic.Bool
+
+	dial      func() (*PMCClient, error)
+	client    *PMCClient
+	portStats map[uint16]*PortStatsNP // Last PORT_STATS_NP per port
+
+	timeStatusUnsupported bool // The target rejected TIME_STATUS_NP, a linuxptp extension
+
+	grandmaster *GrandmasterTracker
+	state       *StateTracker
+	conformance *ST2059Checker
+	stats       *TimingStats // nil when high-rate sampling is disabled
+	phc         *PHCMonitor  // nil without a PTP hardware clock
 }
 
-func NewPTPExporter(device string, iface string) *PTPExporter {
+func NewPTPExporter(device string, instance InstanceConfig, dial func() (*PMCClient, error), events *EventLog, conformance *ST2059Checker) *PTPExporter {
 	exporter := &PTPExporter{
 		device:        device,
-		interfaceName: iface,
+		instance:      instance.Name,
+		role:          instance.Role,
+		interfaceName: instance.Interface,
+		dial:          dial,
+		portStats:     make(map[uint16]*PortStatsNP),
+		grandmaster:   NewGrandmasterTracker(device, instance.Name, instance.Interface, events),
+		conformance:   conformance,
 		offsetFromMaster: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "st2110_ptp_offset_nanoseconds",
 				Help: "Offset from PTP master clock in nanoseconds",
 			},
-			[]string{"device", "interface", "master"},
+			[]string{"device", "ptp_instance", "interface", "master"},
 		),
 		meanPathDelay: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "st2110_ptp_mean_path_delay_nanoseconds",
 				Help: "Mean path delay to PTP master in nanoseconds",
 			},
-			[]string{"device", "interface", "master"},
+			[]string{"device", "ptp_instance", "interface", "master"},
 		),
 		clockState: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "st2110_ptp_clock_state",
-				Help: "PTP clock state (0=FREERUN, 1=LOCKED, 2=HOLDOVER)",
+				Help: "PTP clock state (0=FREERUN, 1=LOCKED, 2=HOLDOVER within the time error budget)",
 			},
-			[]string{"device", "interface"},
+			[]string{"device", "ptp_instance", "interface"},
 		),
 		stepsRemoved: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "st2110_ptp_steps_removed",
 				Help: "Steps removed from grandmaster clock",
 			},
-			[]string{"device", "interface"},
+			[]string{"device", "ptp_instance", "interface"},
+		),
+		portMessages: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_ptp_port_messages_total",
+				Help: "PTP messages received and sent by a ptp4l port (PORT_STATS_NP)",
+			},
+			[]string{"device", "ptp_instance", "interface", "port", "direction", "message_type"},
 		),
 	}
 
-	prometheus.MustRegister(exporter.offsetFromMaster)
-	prometheus.MustRegister(exporter.meanPathDelay)
-	prometheus.MustRegister(exporter.clockState)
-	prometheus.MustRegister(exporter.stepsRemoved)
+	exporter.offsetFromMaster = register(exporter.offsetFromMaster)
+	exporter.meanPathDelay = register(exporter.meanPathDelay)
+	exporter.clockState = register(exporter.clockState)
+	exporter.stepsRemoved = register(exporter.stepsRemoved)
+	exporter.portMessages = register(exporter.portMessages)
 
 	return exporter
 }
 
-// Parse ptp4l output using pmc (PTP Management Client)
+// connect (re)opens the management client; ptp4l restarts invalidate the socket
+func (e *PTPExporter) connect() (*PMCClient, error) {
+	if e.client != nil {
+		return e.client, nil
+	}
+	client, err := e.dial()
+	if err != nil {
+		return nil, err
+	}
+	e.client = client
+	return client, nil
+}
+
+func (e *PTPExporter) disconnect() {
+	if e.client != nil {
+		e.client.Close()
+		e.client = nil
+	}
+}
+
+// Query ptp4l through its management socket (IEEE 1588 management messages)
 func (e *PTPExporter) CollectPTPMetrics() {
-	// Execute ptp4l management query
-	// Note: This requires ptp4l to be running and pmc to be installed
-	cmd := exec.Command("pmc", "-u", "-b", "0", "GET", "CURRENT_DATA_SET")
-	output, err := cmd.CombinedOutput()
+	now := time.Now()
+	client, err := e.connect()
 	if err != nil {
-		log.Printf("Failed to query PTP (is ptp4l running?): %v", err)
-		// Set clock state to FREERUN (0) if query fails
-		e.clockState.WithLabelValues(e.device, e.interfaceName).Set(0)
+		log.Printf("Failed to query PTP instance %s (is ptp4l running?): %v", e.instance, err)
+		e.setClockState(false, false, 0, now)
 		return
 	}
 
-	// Parse output (example format):
-	// CURRENT_DATA_SET
-	//   offsetFromMaster     125
-	//   meanPathDelay        523
-	//   stepsRemoved         1
+	current, err := client.GetCurrentDataSet()
+	if err != nil {
+		log.Printf("Failed to query PTP instance %s (is ptp4l running?): %v", e.instance, err)
+		e.disconnect()
+		e.setClockState(false, false, 0, now)
+		return
+	}
 
-	outputStr := string(output)
+	// Label offset and path delay with the grandmaster they were measured against
+	parent, err := client.GetParentDataSet()
+	if err != nil {
+		log.Printf("Failed to query PARENT_DATA_SET: %v", err)
+	} else if e.grandmaster.Update(parent, now) {
+		labels := prometheus.Labels{"device": e.device, "ptp_instance": e.instance}
+		e.offsetFromMaster.DeletePartialMatch(labels)
+		e.meanPathDelay.DeletePartialMatch(labels)
+		// The time error series restarts against the new grandmaster
+		if e.stats != nil {
+			e.stats.Reset()
+		}
+	}
+	master := e.grandmaster.Grandmaster()
 
-	offsetRegex := regexp.MustCompile(`offsetFromMaster\s+(-?\d+)`)
-	delayRegex := regexp.MustCompile(`meanPathDelay\s+(\d+)`)
-	stepsRegex := regexp.MustCompile(`stepsRemoved\s+(\d+)`)
-	stateRegex := regexp.MustCompile(`clockState\s+(\w+)`)
+	e.offsetFromMaster.WithLabelValues(e.device, e.instance, e.interfaceName, master).Set(current.OffsetFromMaster)
+	e.meanPathDelay.WithLabelValues(e.device, e.instance, e.interfaceName, master).Set(current.MeanPathDelay)
+	e.stepsRemoved.WithLabelValues(e.device, e.instance, e.interfaceName).Set(float64(current.StepsRemoved))
 
-	if matches := offsetRegex.FindStringSubmatch(outputStr); len(matches) > 1 {
-		if offset, err := strconv.ParseFloat(matches[1], 64); err == nil {
-			e.offsetFromMaster.WithLabelValues(e.device, e.interfaceName, "grandmaster").Set(offset)
+	if tp, err := client.GetTimePropertiesDataSet(); err != nil {
+		log.Printf("Failed to query TIME_PROPERTIES_DATA_SET: %v", err)
+	} else {
+		e.grandmaster.UpdateTimeProperties(tp)
+		if e.phc != nil && tp.CurrentUTCOffsetValid {
+			if tp.PTPTimescale {
+				e.phc.SetUTCOffset(int(tp.CurrentUTCOffset))
+			} else {
+				e.phc.SetUTCOffset(0)
+			}
 		}
 	}
 
-	if matches := delayRegex.FindStringSubmatch(outputStr); len(matches) > 1 {
-		if delay, err := strconv.ParseFloat(matches[1], 64); err == nil {
-			e.meanPathDelay.WithLabelValues(e.device, e.interfaceName, "grandmaster").Set(delay)
+	e.collectPorts(client, now)
+
+	// Without a grandmaster ptp4l is free running on its own oscillator
+	status, err := client.GetTimeStatusNP()
+	var mgmtErr *ManagementError
+	switch {
+	case errors.As(err, &mgmtErr):
+		// TIME_STATUS_NP is linuxptp's own: other targets have a grandmaster
+		// when PARENT_DATA_SET names one, and lock once a port is SLAVE to it
+		if !e.timeStatusUnsupported {
+			log.Printf("PTP instance %s does not support TIME_STATUS_NP (%v), following PARENT_DATA_SET and the port states", e.instance, err)
+			e.timeStatusUnsupported = true
 		}
+		e.setClockState(true, parent != nil, current.OffsetFromMaster, now)
+	case err != nil:
+		// Don't keep reporting the last state; without it no grandmaster is known
+		log.Printf("Failed to query TIME_STATUS_NP: %v", err)
+		e.setClockState(true, false, current.OffsetFromMaster, now)
+	default:
+		e.setClockState(true, status.GMPresent, current.OffsetFromMaster, now)
+	}
+}
+
+func (e *PTPExporter) setClockState(reachable, gmPresent bool, offset float64, now time.Time) {
+	state := e.state.Update(reachable, gmPresent, offset, now)
+	e.locked.Store(state == clockStateLocked)
+	e.clockState.WithLabelValues(e.device, e.instance, e.interfaceName).Set(float64(state))
+}
+
+// collectPorts follows the port states and validates the configured domain
+// and port intervals against ST 2059-2
+func (e *PTPExporter) collectPorts(client *PMCClient, now time.Time) {
+	def, err := client.GetDefaultDataSet()
+	if err != nil {
+		log.Printf("Failed to query DEFAULT_DATA_SET: %v", err)
+		return
 	}
+	for port := uint16(1); port <= def.NumberPorts; port++ {
+		pds, err := client.GetPortDataSet(port)
+		if err != nil {
+			log.Printf("Failed to query PORT_DATA_SET for port %d: %v", port, err)
+			continue
+		}
+		e.state.UpdatePort(port, pds.PortState, now)
+		e.conformance.CheckPortDataSet(e.instance, e.interfaceName, def.DomainNumber, pds)
 
-	if matches := stepsRegex.FindStringSubmatch(outputStr); len(matches) > 1 {
-		if steps, err := strconv.ParseFloat(matches[1], 64); err == nil {
-			e.stepsRemoved.WithLabelValues(e.device, e.interfaceName).Set(steps)
+		if stats, err := client.GetPortStatsNP(port); err != nil {
+			log.Printf("Failed to query PORT_STATS_NP for port %d: %v", port, err)
+		} else {
+			e.countPortMessages(port, stats)
 		}
 	}
+}
+
+// counterDelta is the increase of a counter that restarts from zero
+func counterDelta(last, current uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
 
-	// Parse clock state
-	if matches := stateRegex.FindStringSubmatch(outputStr); len(matches) > 1 {
-		state := matches[1]
-		var stateValue float64
-		switch state {
-		case "LOCKED":
-			stateValue = 1
-		case "HOLDOVER":
-			stateValue = 2
-		default:
-			stateValue = 0 // FREERUN
+// countPortMessages adds what ptp4l counted since the last query; its
+// counters start over when ptp4l restarts
+func (e *PTPExporter) countPortMessages(port uint16, stats *PortStatsNP) {
+	last := e.portStats[port]
+	e.portStats[port] = stats
+
+	portLabel := strconv.Itoa(int(port))
+	for msgType, name := range messageTypeNames {
+		rx, tx := stats.RxMsgType[msgType], stats.TxMsgType[msgType]
+		if last != nil {
+			rx = counterDelta(last.RxMsgType[msgType], rx)
+			tx = counterDelta(last.TxMsgType[msgType], tx)
 		}
-		e.clockState.WithLabelValues(e.device, e.interfaceName).Set(stateValue)
-	} else {
-		// Default to LOCKED if state not found but query succeeded
-		e.clockState.WithLabelValues(e.device, e.interfaceName).Set(1)
+		e.portMessages.WithLabelValues(e.device, e.instance, e.interfaceName, portLabel, "rx", name).Add(float64(rx))
+		e.portMessages.WithLabelValues(e.device, e.instance, e.interfaceName, portLabel, "tx", name).Add(float64(tx))
 	}
 }
 
@@ -143,13 +260,33 @@ func (e *PTPExporter) Start(interval time.Duration) {
 }
 
 func main() {
+	configFile := flag.String("config", "", "YAML file listing the ptp4l instances (overrides the single-instance flags below)")
 	device := flag.String("device", "default", "Device name identifier")
+	instanceName := flag.String("instance", "default", "ptp4l instance name (single-instance mode)")
 	iface := flag.String("interface", "eth0", "Network interface name")
 	listenAddr := flag.String("listen", ":9200", "Prometheus exporter listen address")
 	interval := flag.Duration("interval", 1*time.Second, "PTP metrics collection interval")
+	socketPath := flag.String("ptp4l-socket", "/var/run/ptp4l", "ptp4l management Unix domain socket")
+	udpAddr := flag.String("ptp4l-udp", "", "Query management over UDP instead (host:320)")
+	domain := flag.Uint("domain", 0, "PTP domain number for management messages")
+	timeout := flag.Duration("pmc-timeout", 500*time.Millisecond, "Management response timeout")
+	mode := flag.String("mode", "ptp4l", "ptp4l (query the local ptp4l), sniff (decode PTP traffic on the wire) or both")
+	sniffInterface := flag.String("sniff-interface", "", "Interface to capture PTP traffic on (defaults to -interface)")
+	sniffWindow := flag.Duration("sniff-window", 10*time.Second, "Window for the sniffed message rates")
+	sniffTimeout := flag.Duration("sniff-timeout", 30*time.Second, "Forget clocks that have been silent this long")
+	sampleInterval := flag.Duration("sample-interval", 125*time.Millisecond, "Offset/path delay sampling interval for distribution and MTIE/TDEV metrics (0 disables)")
+	statsWindow := flag.Duration("stats-window", 60*time.Second, "Window for offset/path delay statistics")
+	phcDevice := flag.String("phc-device", "auto", "PTP hardware clock to compare with the system clock (auto = the PHC of -interface, empty disables)")
+	phc2sysLog := flag.String("phc2sys-log", "", "phc2sys log file to follow for its servo state and offset")
+	ptp4lLog := flag.String("ptp4l-log", "", "ptp4l log file to follow for the servo state (single-instance mode)")
+	holdoverBudget := flag.Duration("holdover-budget", 1*time.Microsecond, "Time error budget for the holdover estimate")
+	holdoverDrift := flag.Float64("holdover-drift", 10, "Assumed oscillator drift in holdover, ppb (ns/s)")
 	flag.Parse()
 
 	// Allow override from environment
+	if envConfig := os.Getenv("CONFIG_FILE"); envConfig != "" {
+		configFile = &envConfig
+	}
 	if envDevice := os.Getenv("DEVICE"); envDevice != "" {
 		device = &envDevice
 	}
@@ -160,11 +297,113 @@ func main() {
 		listenAddr = &envListen
 	}
 
-	exporter := NewPTPExporter(*device, *iface)
-	exporter.Start(*interval)
+	if envSocket := os.Getenv("PTP4L_SOCKET"); envSocket != "" {
+		socketPath = &envSocket
+	}
+	if envMode := os.Getenv("PTP_MODE"); envMode != "" {
+		mode = &envMode
+	}
+	if envLog := os.Getenv("PHC2SYS_LOG"); envLog != "" {
+		phc2sysLog = &envLog
+	}
+	if envLog := os.Getenv("PTP4L_LOG"); envLog != "" {
+		ptp4lLog = &envLog
+	}
+	if *holdoverDrift <= 0 {
+		log.Fatalf("Invalid -holdover-drift %v (must be positive)", *holdoverDrift)
+	}
+	if *sniffInterface == "" {
+		sniffInterface = iface
+	}
+	if *mode != "ptp4l" && *mode != "sniff" && *mode != "both" {
+		log.Fatalf("Invalid -mode %q (ptp4l, sniff or both)", *mode)
+	}
+
+	// Without a config file the flags describe a single ptp4l instance
+	config := &Config{
+		Device: *device,
+		Instances: []InstanceConfig{{
+			Name:      *instanceName,
+			Interface: *iface,
+			Socket:    *socketPath,
+			UDP:       *udpAddr,
+			Domain:    uint8(*domain),
+			PHC:       *phcDevice,
+			Sniff:     *sniffInterface,
+			Log:       *ptp4lLog,
+		}},
+	}
+	if *configFile != "" {
+		var err error
+		if config, err = LoadConfig(*configFile); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
+	events := NewEventLog(1000)
+	conformance := NewST2059Checker()
+	var exporters []*PTPExporter
+
+	for _, instance := range config.Instances {
+		instance := instance
+		dial := func() (*PMCClient, error) {
+			if instance.UDP != "" {
+				return DialUDP(instance.UDP, instance.Domain, *timeout)
+			}
+			return DialUDS(instance.Socket, instance.Domain, *timeout)
+		}
+
+		if *mode != "sniff" {
+			exporter := NewPTPExporter(config.Device, instance, dial, events, conformance)
+			exporter.state = NewStateTracker(config.Device, instance.Name, instance.Interface, events, *holdoverBudget, *holdoverDrift)
+			if instance.Log != "" {
+				exporter.state.Start(instance.Log)
+			}
+			if *sampleInterval > 0 {
+				exporter.stats = NewTimingStats(config.Device, instance.Name, instance.Interface, *sampleInterval)
+				exporter.stats.Start(dial, *statsWindow)
+			}
+			if instance.PHC != "" {
+				path := instance.PHC
+				var err error
+				if path == "auto" {
+					path, err = findPHC(instance.Interface)
+				}
+				if err == nil {
+					exporter.phc = NewPHCMonitor(config.Device, instance.Name, instance.Interface, path)
+					err = exporter.phc.Start(*interval)
+				}
+				if err != nil {
+					log.Printf("⚠️  PHC to system clock monitoring disabled for %s: %v", instance.Name, err)
+				}
+			}
+			exporter.Start(*interval)
+			exporters = append(exporters, exporter)
+			log.Printf("Collecting from ptp4l instance %s (%s, interface %s, domain %d)",
+				instance.Name, instance.Role, instance.Interface, instance.Domain)
+		}
+
+		if *mode != "ptp4l" {
+			sniffer := NewPTPSniffer(instance.Name, instance.Sniff, *sniffTimeout, events, conformance)
+			if err := sniffer.Start(*sniffWindow); err != nil {
+				log.Fatalf("Failed to start PTP sniffer: %v", err)
+			}
+		}
+	}
+
+	if *mode != "sniff" {
+		selector := NewTimeSourceSelector(config.Device, exporters, events)
+		phc2sys := NewPhc2sysMonitor(config.Device, *phc2sysLog)
+		phc2sys.onSelect = selector.SetPhc2sysSelection
+		phc2sys.Start(*interval)
+		selector.Start(*interval)
+	}
 
-	log.Printf("Starting PTP exporter on %s (device: %s, interface: %s)", *listenAddr, *device, *iface)
+	log.Printf("Starting PTP exporter on %s (device: %s, %d instance(s), mode: %s)",
+		*listenAddr, config.Device, len(config.Instances), *mode)
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/events", events)
+	http.Handle("/transitions", events.Filter(eventPortStateChange, eventServoStateChange, eventHoldoverStart, eventHoldoverEnd))
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "OK\n")
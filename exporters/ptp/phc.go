@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	phcMethodPrecise  = "precise"
+	phcMethodExtended = "extended"
+	phcMethodBasic    = "basic"
+
+	// TAI - UTC until the next leap second; refreshed from ptp4l's TIME_PROPERTIES_DATA_SET
+	defaultUTCOffset = 37
+)
+
+type phcOffsetSample struct {
+	Offset int64 // PHC - CLOCK_REALTIME in nanoseconds
+	Delay  int64 // width of the system clock readings around the PHC reading
+}
+
+// selectPHCOffset picks the (system, PHC, system) reading with the narrowest
+// window and takes the PHC against the midpoint, as phc2sys does
+func selectPHCOffset(readings [][3]int64) phcOffsetSample {
+	best := phcOffsetSample{Delay: -1}
+	for _, r := range readings {
+		delay := r[2] - r[0]
+		if delay < 0 {
+			continue
+		}
+		if best.Delay < 0 || delay < best.Delay {
+			best = phcOffsetSample{Offset: r[1] - (r[0] + delay/2), Delay: delay}
+		}
+	}
+	return best
+}
+
+// findPHC returns the /dev/ptpN clock of a network interface
+func findPHC(iface string) (string, error) {
+	matches, _ := filepath.Glob(filepath.Join("/sys/class/net", iface, "device/ptp/ptp*"))
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no PTP hardware clock found for %s", iface)
+	}
+	return filepath.Join("/dev", filepath.Base(matches[0])), nil
+}
+
+// PHCMonitor measures the offset between the PTP hardware clock disciplined
+// by ptp4l and the system clock disciplined by phc2sys
+type PHCMonitor struct {
+	device        string
+	instance      string
+	interfaceName string
+	phcPath       string
+	utcOffset     atomic.Int32
+	lastOffset    atomic.Int64
+	haveOffset    atomic.Bool
+
+	offset           *prometheus.GaugeVec
+	measurementDelay *prometheus.GaugeVec
+	phcInfo          *prometheus.GaugeVec
+	readErrors       *prometheus.CounterVec
+}
+
+func NewPHCMonitor(device, instance, iface, phcPath string) *PHCMonitor {
+	labels := []string{"device", "ptp_instance", "interface", "phc"}
+
+	monitor := &PHCMonitor{
+		device:        device,
+		instance:      instance,
+		interfaceName: iface,
+		phcPath:       phcPath,
+
+		offset: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_phc_sys_offset_nanoseconds",
+				Help: "Offset of the PTP hardware clock from the system clock (PHC - CLOCK_REALTIME - UTC offset)",
+			},
+			labels,
+		),
+		measurementDelay: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_phc_sys_measurement_delay_nanoseconds",
+				Help: "Width of the system clock readings around the PHC reading (0 for hardware cross timestamps)",
+			},
+			labels,
+		),
+		phcInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_phc_info",
+				Help: "PTP hardware clock and offset measurement method (precise, extended, basic; always 1)",
+			},
+			[]string{"device", "ptp_instance", "interface", "phc", "method"},
+		),
+		readErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_phc_read_errors_total",
+				Help: "Failed PHC offset measurements",
+			},
+			labels,
+		),
+	}
+	monitor.utcOffset.Store(defaultUTCOffset)
+
+	monitor.offset = register(monitor.offset)
+	monitor.measurementDelay = register(monitor.measurementDelay)
+	monitor.phcInfo = register(monitor.phcInfo)
+	monitor.readErrors = register(monitor.readErrors)
+
+	monitor.readErrors.WithLabelValues(device, instance, iface, phcPath)
+
+	return monitor
+}
+
+// SetUTCOffset updates TAI - UTC; ptp4l keeps the PHC on the PTP (TAI)
+// timescale while the system clock runs on UTC
+func (m *PHCMonitor) SetUTCOffset(seconds int) {
+	m.utcOffset.Store(int32(seconds))
+}
+
+// LastOffset returns the latest PHC - system clock offset in nanoseconds
+func (m *PHCMonitor) LastOffset() (int64, bool) {
+	return m.lastOffset.Load(), m.haveOffset.Load()
+}
+
+func (m *PHCMonitor) Start(interval time.Duration) error {
+	phc, err := openPHC(m.phcPath)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			sample, err := phc.ReadOffset()
+			if err != nil {
+				log.Printf("Failed to read PHC offset from %s: %v", m.phcPath, err)
+				m.readErrors.WithLabelValues(m.device, m.instance, m.interfaceName, m.phcPath).Inc()
+				continue
+			}
+			offset := sample.Offset - int64(m.utcOffset.Load())*int64(time.Second)
+			m.lastOffset.Store(offset)
+			m.haveOffset.Store(true)
+			m.offset.WithLabelValues(m.device, m.instance, m.interfaceName, m.phcPath).Set(float64(offset))
+			m.measurementDelay.WithLabelValues(m.device, m.instance, m.interfaceName, m.phcPath).Set(float64(sample.Delay))
+			m.phcInfo.WithLabelValues(m.device, m.instance, m.interfaceName, m.phcPath, phc.method).Set(1)
+		}
+	}()
+
+	log.Printf("Monitoring PHC %s of %s against the system clock", m.phcPath, m.interfaceName)
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// phc2sys has no management server of its own, so its servo is followed
+// through its log output (-m / syslog), e.g.
+//
+//	phc2sys[1234.567]: CLOCK_REALTIME phc offset       -12 s2 freq  +12345 delay    510
+//	phc2sys[1234.567]: CLOCK_REALTIME rms   10 max   25 freq +12345 +/-   5 delay   510 +/-   2
+var (
+	phc2sysOffsetRe  = regexp.MustCompile(`phc2sys.*?:\s+(?:\[[^\]]*\]\s+)?(\S+) (?:phc|sys) offset\s+(-?\d+) s(\d) freq\s+([-+]?\d+)(?:\s+delay\s+(\d+))?`)
+	phc2sysSummaryRe = regexp.MustCompile(`phc2sys.*?:\s+(?:\[[^\]]*\]\s+)?(\S+) rms\s+(\d+) max\s+(\d+) freq\s+([-+]?\d+) \+/-\s+\d+(?:\s+delay\s+(\d+) \+/-\s+\d+)?`)
+)
+
+type phc2sysUpdate struct {
+	Clock      string
+	Offset     float64 // last offset, or rms for summary lines
+	MaxOffset  float64 // summary lines only
+	ServoState int     // -1 for summary lines
+	Frequency  float64 // ppb
+	Delay      float64 // -1 if not reported
+	Summary    bool
+}
+
+func parsePhc2sysLine(line string) (phc2sysUpdate, bool) {
+	atof := func(s string) float64 {
+		v, _ := strconv.ParseFloat(s, 64)
+		return v
+	}
+	delay := func(s string) float64 {
+		if s == "" {
+			return -1
+		}
+		return atof(s)
+	}
+
+	if m := phc2sysOffsetRe.FindStringSubmatch(line); m != nil {
+		state, _ := strconv.Atoi(m[3])
+		return phc2sysUpdate{Clock: m[1], Offset: atof(m[2]), ServoState: state, Frequency: atof(m[4]), Delay: delay(m[5])}, true
+	}
+	if m := phc2sysSummaryRe.FindStringSubmatch(line); m != nil {
+		return phc2sysUpdate{Clock: m[1], Offset: atof(m[2]), MaxOffset: atof(m[3]), ServoState: -1,
+			Frequency: atof(m[4]), Delay: delay(m[5]), Summary: true}, true
+	}
+	return phc2sysUpdate{}, false
+}
+
+// phc2sysRunning looks for a phc2sys process (the container needs the host PID namespace)
+func phc2sysRunning(procRoot string) bool {
+	comms, _ := filepath.Glob(filepath.Join(procRoot, "[0-9]*", "comm"))
+	for _, comm := range comms {
+		name, err := os.ReadFile(comm)
+		if err == nil && strings.TrimSpace(string(name)) == "phc2sys" {
+			return true
+		}
+	}
+	return false
+}
+
+// Phc2sysMonitor follows the phc2sys servo disciplining the system clock
+type Phc2sysMonitor struct {
+	device   string
+	logPath  string
+	onSelect func(line string) // Optional: sees every log line for source selection messages
+
+	running    *prometheus.GaugeVec
+	offset     *prometheus.GaugeVec
+	offsetMax  *prometheus.GaugeVec
+	servoState *prometheus.GaugeVec
+	frequency  *prometheus.GaugeVec
+	delay      *prometheus.GaugeVec
+	lastUpdate *prometheus.GaugeVec
+}
+
+func NewPhc2sysMonitor(device, logPath string) *Phc2sysMonitor {
+	labels := []string{"device", "clock"}
+
+	monitor := &Phc2sysMonitor{
+		device:  device,
+		logPath: logPath,
+
+		running: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_phc2sys_running",
+				Help: "phc2sys process present (1=running)",
+			},
+			[]string{"device"},
+		),
+		offset: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_phc2sys_offset_nanoseconds",
+				Help: "Offset reported by phc2sys for the disciplined clock (rms when summary_interval is set)",
+			},
+			labels,
+		),
+		offsetMax: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_phc2sys_offset_max_nanoseconds",
+				Help: "Maximum absolute offset over the phc2sys summary interval",
+			},
+			labels,
+		),
+		servoState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_phc2sys_servo_state",
+				Help: "phc2sys servo state (0=unlocked, 1=clock step, 2=locked)",
+			},
+			labels,
+		),
+		frequency: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_phc2sys_frequency_ppb",
+				Help: "Frequency adjustment applied by phc2sys in parts per billion",
+			},
+			labels,
+		),
+		delay: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_phc2sys_delay_nanoseconds",
+				Help: "Delay of the phc2sys clock readings",
+			},
+			labels,
+		),
+		lastUpdate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_phc2sys_last_update_timestamp_seconds",
+				Help: "Unix time of the last phc2sys servo update seen in its log",
+			},
+			labels,
+		),
+	}
+
+	monitor.running = register(monitor.running)
+	monitor.offset = register(monitor.offset)
+	monitor.offsetMax = register(monitor.offsetMax)
+	monitor.servoState = register(monitor.servoState)
+	monitor.frequency = register(monitor.frequency)
+	monitor.delay = register(monitor.delay)
+	monitor.lastUpdate = register(monitor.lastUpdate)
+
+	return monitor
+}
+
+func (m *Phc2sysMonitor) HandleLine(line string, now time.Time) {
+	if m.onSelect != nil {
+		m.onSelect(line)
+	}
+	update, ok := parsePhc2sysLine(line)
+	if !ok {
+		return
+	}
+	m.offset.WithLabelValues(m.device, update.Clock).Set(update.Offset)
+	m.frequency.WithLabelValues(m.device, update.Clock).Set(update.Frequency)
+	m.lastUpdate.WithLabelValues(m.device, update.Clock).Set(float64(now.Unix()))
+	if update.Summary {
+		m.offsetMax.WithLabelValues(m.device, update.Clock).Set(update.MaxOffset)
+	} else {
+		m.servoState.WithLabelValues(m.device, update.Clock).Set(float64(update.ServoState))
+	}
+	if update.Delay >= 0 {
+		m.delay.WithLabelValues(m.device, update.Clock).Set(update.Delay)
+	}
+}
+
+// Start checks for the phc2sys process every interval and, with a log path,
+// follows the log
+func (m *Phc2sysMonitor) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for ; true; <-ticker.C {
+			m.running.WithLabelValues(m.device).Set(boolToFloat(phc2sysRunning("/proc")))
+		}
+	}()
+
+	if m.logPath != "" {
+		go followFile(m.logPath, func(line string) {
+			m.HandleLine(line, time.Now())
+		})
+		log.Printf("Following phc2sys log %s", m.logPath)
+	}
+}
+
+// followFile calls handle for every line appended to path, like tail -F:
+// it starts at the end and reopens the file when it is rotated or truncated
+func followFile(path string, handle func(line string)) {
+	var (
+		file    *os.File
+		reader  *bufio.Reader
+		partial string
+		atStart bool
+	)
+	for {
+		if file == nil {
+			var err error
+			if file, err = os.Open(path); err != nil {
+				// A log created later is read from its beginning
+				atStart = true
+				time.Sleep(5 * time.Second)
+				continue
+			}
+			if !atStart {
+				file.Seek(0, io.SeekEnd)
+			}
+			reader = bufio.NewReader(file)
+			partial = ""
+		}
+
+		chunk, err := reader.ReadString('\n')
+		if err == nil {
+			handle(partial + strings.TrimRight(chunk, "\r\n"))
+			partial = ""
+			continue
+		}
+		partial += chunk
+
+		// Rotated (new inode) or truncated: read the new file from the beginning
+		time.Sleep(500 * time.Millisecond)
+		current, statErr := os.Stat(path)
+		opened, fstatErr := file.Stat()
+		position, _ := file.Seek(0, io.SeekCurrent)
+		if statErr != nil || fstatErr != nil || !os.SameFile(current, opened) || current.Size() < position {
+			file.Close()
+			file = nil
+			atStart = true
+		}
+	}
+}
@@ -0,0 +1,124 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// PTP hardware clock ioctls from <linux/ptp_clock.h>
+const (
+	ptpMaxSamples        = 25
+	ptpSysOffset         = 0x43403d05 // _IOW('=', 5, struct ptp_sys_offset)
+	ptpSysOffsetPrecise  = 0xc0403d08 // _IOWR('=', 8, struct ptp_sys_offset_precise)
+	ptpSysOffsetExtended = 0xc4c03d09 // _IOWR('=', 9, struct ptp_sys_offset_extended)
+
+	phcSamples = 9
+)
+
+type ptpClockTime struct {
+	Sec      int64
+	Nsec     uint32
+	Reserved uint32
+}
+
+func (t ptpClockTime) nanoseconds() int64 {
+	return t.Sec*1e9 + int64(t.Nsec)
+}
+
+type ptpSysOffsetRequest struct {
+	NSamples uint32
+	Rsv      [3]uint32
+	Ts       [2*ptpMaxSamples + 1]ptpClockTime
+}
+
+type ptpSysOffsetExtendedRequest struct {
+	NSamples uint32
+	Rsv      [3]uint32
+	Ts       [ptpMaxSamples][3]ptpClockTime
+}
+
+type ptpSysOffsetPreciseRequest struct {
+	Device      ptpClockTime
+	SysRealtime ptpClockTime
+	SysMonoraw  ptpClockTime
+	Rsv         [4]uint32
+}
+
+type phcDevice struct {
+	file   *os.File
+	method string
+}
+
+func openPHC(path string) (*phcDevice, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PHC %s: %w", path, err)
+	}
+	return &phcDevice{file: file}, nil
+}
+
+func (d *phcDevice) Close() error {
+	return d.file.Close()
+}
+
+func (d *phcDevice) ioctl(request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, d.file.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func unsupported(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EINVAL)
+}
+
+// ReadOffset measures PHC - CLOCK_REALTIME, preferring a hardware cross
+// timestamp, then the extended and finally the basic sandwiched readings
+func (d *phcDevice) ReadOffset() (phcOffsetSample, error) {
+	if d.method == "" || d.method == phcMethodPrecise {
+		var req ptpSysOffsetPreciseRequest
+		err := d.ioctl(ptpSysOffsetPrecise, unsafe.Pointer(&req))
+		if err == nil {
+			d.method = phcMethodPrecise
+			return phcOffsetSample{Offset: req.Device.nanoseconds() - req.SysRealtime.nanoseconds()}, nil
+		}
+		if d.method != "" || !unsupported(err) {
+			return phcOffsetSample{}, fmt.Errorf("PTP_SYS_OFFSET_PRECISE: %w", err)
+		}
+	}
+
+	if d.method == "" || d.method == phcMethodExtended {
+		req := ptpSysOffsetExtendedRequest{NSamples: phcSamples}
+		err := d.ioctl(ptpSysOffsetExtended, unsafe.Pointer(&req))
+		if err == nil {
+			d.method = phcMethodExtended
+			readings := make([][3]int64, req.NSamples)
+			for i := range readings {
+				readings[i] = [3]int64{req.Ts[i][0].nanoseconds(), req.Ts[i][1].nanoseconds(), req.Ts[i][2].nanoseconds()}
+			}
+			return selectPHCOffset(readings), nil
+		}
+		if d.method != "" || !unsupported(err) {
+			return phcOffsetSample{}, fmt.Errorf("PTP_SYS_OFFSET_EXTENDED: %w", err)
+		}
+	}
+
+	req := ptpSysOffsetRequest{NSamples: phcSamples}
+	if err := d.ioctl(ptpSysOffset, unsafe.Pointer(&req)); err != nil {
+		return phcOffsetSample{}, fmt.Errorf("PTP_SYS_OFFSET: %w", err)
+	}
+	d.method = phcMethodBasic
+	// Readings alternate system, PHC, system, ... with n PHC readings
+	readings := make([][3]int64, req.NSamples)
+	for i := range readings {
+		readings[i] = [3]int64{req.Ts[2*i].nanoseconds(), req.Ts[2*i+1].nanoseconds(), req.Ts[2*i+2].nanoseconds()}
+	}
+	return selectPHCOffset(readings), nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+type phcDevice struct {
+	method string
+}
+
+func openPHC(path string) (*phcDevice, error) {
+	return nil, errors.New("PTP hardware clocks require Linux")
+}
+
+func (d *phcDevice) Close() error {
+	return nil
+}
+
+func (d *phcDevice) ReadOffset() (phcOffsetSample, error) {
+	return phcOffsetSample{}, errors.New("PHC not supported")
+}
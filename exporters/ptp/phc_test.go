@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSelectPHCOffset(t *testing.T) {
+	// (system, PHC, system) readings; the narrowest window wins
+	readings := [][3]int64{
+		{1000, 37_000_001_500, 3000},
+		{4000, 37_000_004_300, 4400},
+		{5000, 37_000_005_000, 4000}, // system clock stepped backwards: ignored
+	}
+	got := selectPHCOffset(readings)
+	if got.Delay != 400 || got.Offset != 37_000_000_100 {
+		t.Errorf("selectPHCOffset = %+v, want offset 37000000100 delay 400", got)
+	}
+}
+
+func TestParsePhc2sysLine(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want phc2sysUpdate
+	}{
+		{
+			"phc2sys[1234.567]: CLOCK_REALTIME phc offset       -12 s2 freq  +12345 delay    510",
+			phc2sysUpdate{Clock: "CLOCK_REALTIME", Offset: -12, ServoState: 2, Frequency: 12345, Delay: 510},
+		},
+		{
+			"Oct 18 10:00:00 host phc2sys[812]: [1234.567] CLOCK_REALTIME sys offset 40 s0 freq -300",
+			phc2sysUpdate{Clock: "CLOCK_REALTIME", Offset: 40, ServoState: 0, Frequency: -300, Delay: -1},
+		},
+		{
+			"phc2sys[1234.567]: [ptp4l.0.config] eth1 phc offset 7 s2 freq -2 delay 0",
+			phc2sysUpdate{Clock: "eth1", Offset: 7, ServoState: 2, Frequency: -2, Delay: 0},
+		},
+		{
+			"phc2sys[1234.567]: CLOCK_REALTIME rms   10 max   25 freq +12345 +/-   5 delay   510 +/-   2",
+			phc2sysUpdate{Clock: "CLOCK_REALTIME", Offset: 10, MaxOffset: 25, ServoState: -1, Frequency: 12345, Delay: 510, Summary: true},
+		},
+	} {
+		got, ok := parsePhc2sysLine(tc.line)
+		if !ok || got != tc.want {
+			t.Errorf("parsePhc2sysLine(%q) = %+v, %v, want %+v", tc.line, got, ok, tc.want)
+		}
+	}
+
+	if _, ok := parsePhc2sysLine("phc2sys[1234.567]: reconfiguring after port state change"); ok {
+		t.Error("parsed a line without servo data")
+	}
+}
+
+func TestPhc2sysRunning(t *testing.T) {
+	proc := t.TempDir()
+	os.MkdirAll(filepath.Join(proc, "1"), 0755)
+	os.WriteFile(filepath.Join(proc, "1", "comm"), []byte("systemd\n"), 0644)
+	if phc2sysRunning(proc) {
+		t.Error("phc2sys reported running without the process")
+	}
+
+	os.MkdirAll(filepath.Join(proc, "812"), 0755)
+	os.WriteFile(filepath.Join(proc, "812", "comm"), []byte("phc2sys\n"), 0644)
+	if !phc2sysRunning(proc) {
+		t.Error("phc2sys process not found")
+	}
+}
+
+func TestFollowFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "phc2sys.log")
+	os.WriteFile(path, []byte("old line before start\n"), 0644)
+
+	lines := make(chan string, 10)
+	go followFile(path, func(line string) { lines <- line })
+	time.Sleep(100 * time.Millisecond)
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("followed %q, want %q", got, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("first ")
+	time.Sleep(600 * time.Millisecond)
+	f.WriteString("line\n")
+	f.Close()
+	expect("first line")
+
+	os.Rename(path, path+".1")
+	os.WriteFile(path, []byte("after rotation\n"), 0644)
+	expect("after rotation")
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IEEE 1588-2008 management messages (clause 15) as spoken by ptp4l's
+// management port, replacing the exec of `pmc` and its text output.
+
+const (
+	ptpVersion             = 2
+	messageTypeManagement  = 0x0D
+	controlFieldManagement = 0x04
+	logIntervalManagement  = 0x7F
+
+	ptpHeaderLength        = 34
+	managementHeaderLength = 14 // targetPortIdentity, hops, actionField, reserved
+	tlvHeaderLength        = 4
+
+	tlvManagement            = 0x0001
+	tlvManagementErrorStatus = 0x0002
+)
+
+type managementAction uint8
+
+const (
+	actionGet         managementAction = 0
+	actionSet         managementAction = 1
+	actionResponse    managementAction = 2
+	actionCommand     managementAction = 3
+	actionAcknowledge managementAction = 4
+)
+
+// Management IDs (IEEE 1588-2008 Table 40 and linuxptp implementation-specific IDs)
+const (
+	mgmtDefaultDataSet        uint16 = 0x2000
+	mgmtCurrentDataSet        uint16 = 0x2001
+	mgmtParentDataSet         uint16 = 0x2002
+	mgmtTimePropertiesDataSet uint16 = 0x2003
+	mgmtPortDataSet           uint16 = 0x2004
+	mgmtTimeStatusNP          uint16 = 0xC000
+	mgmtPortStatsNP           uint16 = 0xC005
+)
+
+// ClockIdentity is the EUI-64 identity of a PTP clock
+type ClockIdentity [8]byte
+
+// String formats the identity the way ptp4l and pmc print it (001122.fffe.334455)
+func (c ClockIdentity) String() string {
+	return fmt.Sprintf("%02x%02x%02x.%02x%02x.%02x%02x%02x", c[0], c[1], c[2], c[3], c[4], c[5], c[6], c[7])
+}
+
+type PortIdentity struct {
+	ClockIdentity ClockIdentity
+	PortNumber    uint16
+}
+
+func (p PortIdentity) String() string {
+	return fmt.Sprintf("%s-%d", p.ClockIdentity, p.PortNumber)
+}
+
+// allPorts addresses every port of every clock reachable by the management message
+var allPorts = PortIdentity{
+	ClockIdentity: ClockIdentity{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	PortNumber:    0xffff,
+}
+
+type ClockQuality struct {
+	ClockClass              uint8
+	ClockAccuracy           uint8
+	OffsetScaledLogVariance uint16
+}
+
+type DefaultDataSet struct {
+	TwoStepFlag   bool
+	SlaveOnly     bool
+	NumberPorts   uint16
+	Priority1     uint8
+	ClockQuality  ClockQuality
+	Priority2     uint8
+	ClockIdentity ClockIdentity
+	DomainNumber  uint8
+}
+
+type CurrentDataSet struct {
+	StepsRemoved     uint16
+	OffsetFromMaster float64 // nanoseconds
+	MeanPathDelay    float64 // nanoseconds
+}
+
+type ParentDataSet struct {
+	ParentPortIdentity                    PortIdentity
+	ParentStats                           bool
+	ObservedParentOffsetScaledLogVariance uint16
+	ObservedParentClockPhaseChangeRate    int32
+	GrandmasterPriority1                  uint8
+	GrandmasterClockQuality               ClockQuality
+	GrandmasterPriority2                  uint8
+	GrandmasterIdentity                   ClockIdentity
+}
+
+type TimePropertiesDataSet struct {
+	CurrentUTCOffset      int16
+	Leap61                bool
+	Leap59                bool
+	CurrentUTCOffsetValid bool
+	PTPTimescale          bool
+	TimeTraceable         bool
+	FrequencyTraceable    bool
+	TimeSource            uint8
+}
+
+// PortState values from IEEE 1588-2008 Table 8
+type PortState uint8
+
+const (
+	PortStateInitializing PortState = 1
+	PortStateFaulty       PortState = 2
+	PortStateDisabled     PortState = 3
+	PortStateListening    PortState = 4
+	PortStatePreMaster    PortState = 5
+	PortStateMaster       PortState = 6
+	PortStatePassive      PortState = 7
+	PortStateUncalibrated PortState = 8
+	PortStateSlave        PortState = 9
+)
+
+func (s PortState) String() string {
+	switch s {
+	case PortStateInitializing:
+		return "INITIALIZING"
+	case PortStateFaulty:
+		return "FAULTY"
+	case PortStateDisabled:
+		return "DISABLED"
+	case PortStateListening:
+		return "LISTENING"
+	case PortStatePreMaster:
+		return "PRE_MASTER"
+	case PortStateMaster:
+		return "MASTER"
+	case PortStatePassive:
+		return "PASSIVE"
+	case PortStateUncalibrated:
+		return "UNCALIBRATED"
+	case PortStateSlave:
+		return "SLAVE"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", uint8(s))
+	}
+}
+
+type PortDataSet struct {
+	PortIdentity            PortIdentity
+	PortState               PortState
+	LogMinDelayReqInterval  int8
+	PeerMeanPathDelay       float64 // nanoseconds
+	LogAnnounceInterval     int8
+	AnnounceReceiptTimeout  uint8
+	LogSyncInterval         int8
+	DelayMechanism          uint8
+	LogMinPdelayReqInterval int8
+	VersionNumber           uint8
+}
+
+// TimeStatusNP is the linuxptp TIME_STATUS_NP data set
+type TimeStatusNP struct {
+	MasterOffset               int64 // nanoseconds
+	IngressTime                int64 // nanoseconds
+	CumulativeScaledRateOffset int32
+	ScaledLastGmPhaseChange    int32
+	GMTimeBaseIndicator        uint16
+	GMPresent                  bool
+	GMIdentity                 ClockIdentity
+}
+
+// PTP message types, used to index the PORT_STATS_NP counters
+const (
+	msgSync               = 0x0
+	msgDelayReq           = 0x1
+	msgPdelayReq          = 0x2
+	msgPdelayResp         = 0x3
+	msgFollowUp           = 0x8
+	msgDelayResp          = 0x9
+	msgPdelayRespFollowUp = 0xA
+	msgAnnounce           = 0xB
+	msgSignaling          = 0xC
+	msgManagement         = 0xD
+)
+
+// PortStatsNP is the linuxptp PORT_STATS_NP data set: per message type rx/tx counters
+type PortStatsNP struct {
+	PortIdentity PortIdentity
+	RxMsgType    [16]uint64
+	TxMsgType    [16]uint64
+}
+
+// ManagementError is returned when ptp4l answers with a MANAGEMENT_ERROR_STATUS TLV
+type ManagementError struct {
+	ManagementID uint16
+	ErrorID      uint16
+}
+
+func (e *ManagementError) Error() string {
+	return fmt.Sprintf("management error 0x%04x for id 0x%04x", e.ErrorID, e.ManagementID)
+}
+
+type managementMessage struct {
+	domain       uint8
+	sourcePort   PortIdentity
+	targetPort   PortIdentity
+	sequenceID   uint16
+	action       managementAction
+	tlvType      uint16
+	managementID uint16
+	data         []byte
+}
+
+func putPortIdentity(b []byte, p PortIdentity) {
+	copy(b[0:8], p.ClockIdentity[:])
+	binary.BigEndian.PutUint16(b[8:10], p.PortNumber)
+}
+
+func readPortIdentity(b []byte) PortIdentity {
+	var p PortIdentity
+	copy(p.ClockIdentity[:], b[0:8])
+	p.PortNumber = binary.BigEndian.Uint16(b[8:10])
+	return p
+}
+
+func readClockQuality(b []byte) ClockQuality {
+	return ClockQuality{
+		ClockClass:              b[0],
+		ClockAccuracy:           b[1],
+		OffsetScaledLogVariance: binary.BigEndian.Uint16(b[2:4]),
+	}
+}
+
+// readTimeInterval converts a TimeInterval (nanoseconds scaled by 2^16) to nanoseconds
+func readTimeInterval(b []byte) float64 {
+	return float64(int64(binary.BigEndian.Uint64(b[0:8]))) / 65536
+}
+
+func (m *managementMessage) marshal() []byte {
+	data := m.data
+	if len(data)%2 != 0 {
+		data = append(data, 0) // TLV data must be an even number of octets
+	}
+
+	length := ptpHeaderLength + managementHeaderLength + tlvHeaderLength + 2 + len(data)
+	b := make([]byte, length)
+
+	b[0] = messageTypeManagement
+	b[1] = ptpVersion
+	binary.BigEndian.PutUint16(b[2:4], uint16(length))
+	b[4] = m.domain
+	putPortIdentity(b[20:30], m.sourcePort)
+	binary.BigEndian.PutUint16(b[30:32], m.sequenceID)
+	b[32] = controlFieldManagement
+	b[33] = logIntervalManagement
+
+	putPortIdentity(b[34:44], m.targetPort)
+	b[44] = 0 // startingBoundaryHops (pmc -b 0)
+	b[45] = 0 // boundaryHops
+	b[46] = uint8(m.action) & 0x0F
+
+	tlvType := m.tlvType
+	if tlvType == 0 {
+		tlvType = tlvManagement
+	}
+	binary.BigEndian.PutUint16(b[48:50], tlvType)
+	binary.BigEndian.PutUint16(b[50:52], uint16(2+len(data)))
+	binary.BigEndian.PutUint16(b[52:54], m.managementID)
+	copy(b[54:], data)
+
+	return b
+}
+
+func parseManagementMessage(b []byte) (*managementMessage, error) {
+	if len(b) < ptpHeaderLength+managementHeaderLength+tlvHeaderLength+2 {
+		return nil, fmt.Errorf("message too short (%d bytes)", len(b))
+	}
+	if b[0]&0x0F != messageTypeManagement {
+		return nil, fmt.Errorf("not a management message (type 0x%x)", b[0]&0x0F)
+	}
+	if b[1]&0x0F != ptpVersion {
+		return nil, fmt.Errorf("unsupported PTP version %d", b[1]&0x0F)
+	}
+
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length > len(b) {
+		return nil, fmt.Errorf("truncated message (%d of %d bytes)", len(b), length)
+	}
+	b = b[:length]
+
+	m := &managementMessage{
+		domain:     b[4],
+		sourcePort: readPortIdentity(b[20:30]),
+		sequenceID: binary.BigEndian.Uint16(b[30:32]),
+		targetPort: readPortIdentity(b[34:44]),
+		action:     managementAction(b[46] & 0x0F),
+		tlvType:    binary.BigEndian.Uint16(b[48:50]),
+	}
+
+	tlvLength := int(binary.BigEndian.Uint16(b[50:52]))
+	tlv := b[52:]
+	if tlvLength < 2 || tlvLength > len(tlv) {
+		return nil, fmt.Errorf("invalid TLV length %d", tlvLength)
+	}
+	tlv = tlv[:tlvLength]
+
+	switch m.tlvType {
+	case tlvManagement:
+		m.managementID = binary.BigEndian.Uint16(tlv[0:2])
+		m.data = tlv[2:]
+	case tlvManagementErrorStatus:
+		if len(tlv) < 4 {
+			return nil, errors.New("short MANAGEMENT_ERROR_STATUS TLV")
+		}
+		// The error ID comes first and the management ID second
+		m.managementID = binary.BigEndian.Uint16(tlv[2:4])
+		m.data = tlv[0:2]
+	default:
+		return nil, fmt.Errorf("unexpected TLV type 0x%04x", m.tlvType)
+	}
+
+	return m, nil
+}
+
+// PMCClient queries ptp4l over its management socket (Unix domain or UDP)
+var udsClients atomic.Uint32
+
+type PMCClient struct {
+	mu         sync.Mutex
+	conn       net.Conn
+	localPath  string // UDS client socket, removed on Close
+	source     PortIdentity
+	domain     uint8
+	timeout    time.Duration
+	sequenceID uint16
+}
+
+func newPMCClient(conn net.Conn, domain uint8, timeout time.Duration) *PMCClient {
+	// Like pmc, identify ourselves with a random clock identity and the PID as port number
+	var source PortIdentity
+	rand.Read(source.ClockIdentity[:])
+	source.PortNumber = uint16(os.Getpid())
+
+	return &PMCClient{
+		conn:    conn,
+		source:  source,
+		domain:  domain,
+		timeout: timeout,
+	}
+}
+
+// DialUDS connects to ptp4l's Unix domain management socket (uds_address, /var/run/ptp4l by default).
+// The client socket is created next to it so ptp4l can reply from inside the same mount.
+func DialUDS(socketPath string, domain uint8, timeout time.Duration) (*PMCClient, error) {
+	// Each client needs its own socket path; the collector and the sampler query in parallel
+	localPath := filepath.Join(filepath.Dir(socketPath),
+		fmt.Sprintf("st2110-ptp-exporter.%d.%d", os.Getpid(), udsClients.Add(1)))
+	os.Remove(localPath)
+
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: localPath, Net: "unixgram"},
+		&net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s (is ptp4l running?): %w", socketPath, err)
+	}
+
+	client := newPMCClient(conn, domain, timeout)
+	client.localPath = localPath
+	return client, nil
+}
+
+// DialUDP sends management messages to a PTP node over UDP (host:320).
+// The node must answer to the requesting address, as ptp4l does for unicast management.
+func DialUDP(address string, domain uint8, timeout time.Duration) (*PMCClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	return newPMCClient(conn, domain, timeout), nil
+}
+
+func (c *PMCClient) Close() error {
+	err := c.conn.Close()
+	if c.localPath != "" {
+		os.Remove(c.localPath)
+	}
+	return err
+}
+
+// get sends a GET for the management ID to the target and returns the response data field
+func (c *PMCClient) get(target PortIdentity, managementID uint16) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sequenceID++
+	request := &managementMessage{
+		domain:       c.domain,
+		sourcePort:   c.source,
+		targetPort:   target,
+		sequenceID:   c.sequenceID,
+		action:       actionGet,
+		managementID: managementID,
+	}
+
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(request.marshal()); err != nil {
+		return nil, fmt.Errorf("failed to send management request: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no response for management id 0x%04x: %w", managementID, err)
+		}
+
+		response, err := parseManagementMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		// Skip late answers to earlier requests and our own multicast echo
+		if response.sequenceID != request.sequenceID || response.managementID != managementID {
+			continue
+		}
+		if response.action != actionResponse {
+			continue
+		}
+
+		if response.tlvType == tlvManagementErrorStatus {
+			return nil, &ManagementError{
+				ManagementID: managementID,
+				ErrorID:      binary.BigEndian.Uint16(response.data),
+			}
+		}
+		return response.data, nil
+	}
+}
+
+func shortDataSet(name string, got, want int) error {
+	return fmt.Errorf("%s too short (%d of %d bytes)", name, got, want)
+}
+
+func (c *PMCClient) GetDefaultDataSet() (*DefaultDataSet, error) {
+	b, err := c.get(allPorts, mgmtDefaultDataSet)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 20 {
+		return nil, shortDataSet("DEFAULT_DATA_SET", len(b), 20)
+	}
+
+	ds := &DefaultDataSet{
+		TwoStepFlag:  b[0]&0x01 != 0,
+		SlaveOnly:    b[0]&0x02 != 0,
+		NumberPorts:  binary.BigEndian.Uint16(b[2:4]),
+		Priority1:    b[4],
+		ClockQuality: readClockQuality(b[5:9]),
+		Priority2:    b[9],
+		DomainNumber: b[18],
+	}
+	copy(ds.ClockIdentity[:], b[10:18])
+	return ds, nil
+}
+
+func (c *PMCClient) GetCurrentDataSet() (*CurrentDataSet, error) {
+	b, err := c.get(allPorts, mgmtCurrentDataSet)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 18 {
+		return nil, shortDataSet("CURRENT_DATA_SET", len(b), 18)
+	}
+
+	return &CurrentDataSet{
+		StepsRemoved:     binary.BigEndian.Uint16(b[0:2]),
+		OffsetFromMaster: readTimeInterval(b[2:10]),
+		MeanPathDelay:    readTimeInterval(b[10:18]),
+	}, nil
+}
+
+func (c *PMCClient) GetParentDataSet() (*ParentDataSet, error) {
+	b, err := c.get(allPorts, mgmtParentDataSet)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 32 {
+		return nil, shortDataSet("PARENT_DATA_SET", len(b), 32)
+	}
+
+	ds := &ParentDataSet{
+		ParentPortIdentity:                    readPortIdentity(b[0:10]),
+		ParentStats:                           b[10]&0x01 != 0,
+		ObservedParentOffsetScaledLogVariance: binary.BigEndian.Uint16(b[12:14]),
+		ObservedParentClockPhaseChangeRate:    int32(binary.BigEndian.Uint32(b[14:18])),
+		GrandmasterPriority1:                  b[18],
+		GrandmasterClockQuality:               readClockQuality(b[19:23]),
+		GrandmasterPriority2:                  b[23],
+	}
+	copy(ds.GrandmasterIdentity[:], b[24:32])
+	return ds, nil
+}
+
+func (c *PMCClient) GetTimePropertiesDataSet() (*TimePropertiesDataSet, error) {
+	b, err := c.get(allPorts, mgmtTimePropertiesDataSet)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4 {
+		return nil, shortDataSet("TIME_PROPERTIES_DATA_SET", len(b), 4)
+	}
+
+	flags := b[2]
+	return &TimePropertiesDataSet{
+		CurrentUTCOffset:      int16(binary.BigEndian.Uint16(b[0:2])),
+		Leap61:                flags&0x01 != 0,
+		Leap59:                flags&0x02 != 0,
+		CurrentUTCOffsetValid: flags&0x04 != 0,
+		PTPTimescale:          flags&0x08 != 0,
+		TimeTraceable:         flags&0x10 != 0,
+		FrequencyTraceable:    flags&0x20 != 0,
+		TimeSource:            b[3],
+	}, nil
+}
+
+// portTarget addresses a single port number on whichever clock answers
+func portTarget(port uint16) PortIdentity {
+	target := allPorts
+	target.PortNumber = port
+	return target
+}
+
+func (c *PMCClient) GetPortDataSet(port uint16) (*PortDataSet, error) {
+	b, err := c.get(portTarget(port), mgmtPortDataSet)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 26 {
+		return nil, shortDataSet("PORT_DATA_SET", len(b), 26)
+	}
+
+	return &PortDataSet{
+		PortIdentity:            readPortIdentity(b[0:10]),
+		PortState:               PortState(b[10]),
+		LogMinDelayReqInterval:  int8(b[11]),
+		PeerMeanPathDelay:       readTimeInterval(b[12:20]),
+		LogAnnounceInterval:     int8(b[20]),
+		AnnounceReceiptTimeout:  b[21],
+		LogSyncInterval:         int8(b[22]),
+		DelayMechanism:          b[23],
+		LogMinPdelayReqInterval: int8(b[24]),
+		VersionNumber:           b[25] & 0x0F,
+	}, nil
+}
+
+func (c *PMCClient) GetTimeStatusNP() (*TimeStatusNP, error) {
+	b, err := c.get(allPorts, mgmtTimeStatusNP)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 50 {
+		return nil, shortDataSet("TIME_STATUS_NP", len(b), 50)
+	}
+
+	ts := &TimeStatusNP{
+		MasterOffset:               int64(binary.BigEndian.Uint64(b[0:8])),
+		IngressTime:                int64(binary.BigEndian.Uint64(b[8:16])),
+		CumulativeScaledRateOffset: int32(binary.BigEndian.Uint32(b[16:20])),
+		ScaledLastGmPhaseChange:    int32(binary.BigEndian.Uint32(b[20:24])),
+		GMTimeBaseIndicator:        binary.BigEndian.Uint16(b[24:26]),
+		// b[26:38] lastGmPhaseChange (ScaledNs)
+		GMPresent: binary.BigEndian.Uint32(b[38:42]) != 0,
+	}
+	copy(ts.GMIdentity[:], b[42:50])
+	return ts, nil
+}
+
+func (c *PMCClient) GetPortStatsNP(port uint16) (*PortStatsNP, error) {
+	b, err := c.get(portTarget(port), mgmtPortStatsNP)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 10+2*16*8 {
+		return nil, shortDataSet("PORT_STATS_NP", len(b), 10+2*16*8)
+	}
+
+	stats := &PortStatsNP{PortIdentity: readPortIdentity(b[0:10])}
+	// linuxptp sends the counters in host byte order, not network order
+	for i := 0; i < 16; i++ {
+		stats.RxMsgType[i] = binary.LittleEndian.Uint64(b[10+i*8:])
+		stats.TxMsgType[i] = binary.LittleEndian.Uint64(b[10+128+i*8:])
+	}
+	return stats, nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakePTP4L answers management GETs on a Unix datagram or UDP socket with canned data sets
+type fakePTP4L struct {
+	t    *testing.T
+	conn net.PacketConn
+
+	mu       sync.Mutex
+	identity PortIdentity
+	data     map[uint16][]byte            // clock-level data sets by management ID
+	portData map[uint16]map[uint16][]byte // port-level data sets by management ID and port number
+	errors   map[uint16]uint16            // management ID -> MANAGEMENT_ERROR_STATUS error ID
+	silent   map[uint16]bool              // management IDs left unanswered
+	stale    bool                         // send an answer with a stale sequence ID first
+}
+
+func newFakePTP4L(t *testing.T, conn net.PacketConn) *fakePTP4L {
+	f := &fakePTP4L{
+		t:        t,
+		conn:     conn,
+		identity: PortIdentity{ClockIdentity: ClockIdentity{0x00, 0x11, 0x22, 0xff, 0xfe, 0x33, 0x44, 0x55}},
+		data:     make(map[uint16][]byte),
+		portData: make(map[uint16]map[uint16][]byte),
+		errors:   make(map[uint16]uint16),
+		silent:   make(map[uint16]bool),
+	}
+	t.Cleanup(func() { conn.Close() })
+	go f.serve()
+	return f
+}
+
+func newFakePTP4LUDS(t *testing.T) (*fakePTP4L, string) {
+	path := filepath.Join(t.TempDir(), "ptp4l")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", path, err)
+	}
+	return newFakePTP4L(t, conn), path
+}
+
+func (f *fakePTP4L) setData(id uint16, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data[id] = data
+}
+
+func (f *fakePTP4L) setPortData(id, port uint16, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.portData[id] == nil {
+		f.portData[id] = make(map[uint16][]byte)
+	}
+	f.portData[id][port] = data
+}
+
+func (f *fakePTP4L) setStale(stale bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stale = stale
+}
+
+func (f *fakePTP4L) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		request, err := parseManagementMessage(buf[:n])
+		if err != nil {
+			f.t.Errorf("fake ptp4l received invalid message: %v", err)
+			continue
+		}
+		if request.action != actionGet {
+			f.t.Errorf("fake ptp4l received action %d, want GET", request.action)
+			continue
+		}
+
+		f.mu.Lock()
+		if f.silent[request.managementID] {
+			f.mu.Unlock()
+			continue
+		}
+		response := &managementMessage{
+			domain:       request.domain,
+			sourcePort:   f.identity,
+			targetPort:   request.sourcePort,
+			sequenceID:   request.sequenceID,
+			action:       actionResponse,
+			managementID: request.managementID,
+		}
+		if errorID, ok := f.errors[request.managementID]; ok {
+			// MANAGEMENT_ERROR_STATUS carries the error ID before the management ID
+			response.tlvType = tlvManagementErrorStatus
+			response.managementID = errorID
+			response.data = []byte{byte(request.managementID >> 8), byte(request.managementID), 0, 0, 0, 0}
+		} else if ports, ok := f.portData[request.managementID]; ok {
+			response.data = ports[request.targetPort.PortNumber]
+		} else {
+			response.data = f.data[request.managementID]
+		}
+		stale := f.stale
+		f.mu.Unlock()
+
+		if stale {
+			old := *response
+			old.sequenceID--
+			f.conn.WriteTo(old.marshal(), addr)
+		}
+		f.conn.WriteTo(response.marshal(), addr)
+	}
+}
+
+func putTimeInterval(b []byte, ns float64) {
+	binary.BigEndian.PutUint64(b, uint64(int64(ns*65536)))
+}
+
+func encodeCurrentDataSet(steps uint16, offset, delay float64) []byte {
+	b := make([]byte, 18)
+	binary.BigEndian.PutUint16(b[0:2], steps)
+	putTimeInterval(b[2:10], offset)
+	putTimeInterval(b[10:18], delay)
+	return b
+}
+
+func dialFake(t *testing.T, path string) *PMCClient {
+	client, err := DialUDS(path, 0, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("DialUDS failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestGetCurrentDataSet(t *testing.T) {
+	fake, path := newFakePTP4LUDS(t)
+	fake.setData(mgmtCurrentDataSet, encodeCurrentDataSet(1, -125.5, 523))
+	client := dialFake(t, path)
+
+	ds, err := client.GetCurrentDataSet()
+	if err != nil {
+		t.Fatalf("GetCurrentDataSet failed: %v", err)
+	}
+	if ds.StepsRemoved != 1 || ds.OffsetFromMaster != -125.5 || ds.MeanPathDelay != 523 {
+		t.Errorf("unexpected CURRENT_DATA_SET: %+v", ds)
+	}
+}
+
+func TestGetDefaultAndParentDataSet(t *testing.T) {
+	fake, path := newFakePTP4LUDS(t)
+
+	def := make([]byte, 20)
+	def[0] = 0x03 // twoStep, slaveOnly
+	binary.BigEndian.PutUint16(def[2:4], 2)
+	def[4] = 128
+	copy(def[5:9], []byte{248, 0xFE, 0xFF, 0xFF})
+	def[9] = 127
+	copy(def[10:18], fake.identity.ClockIdentity[:])
+	def[18] = 127
+	fake.setData(mgmtDefaultDataSet, def)
+
+	gm := ClockIdentity{0xec, 0x46, 0x70, 0xff, 0xfe, 0x00, 0x01, 0x02}
+	parent := make([]byte, 32)
+	copy(parent[0:8], gm[:])
+	binary.BigEndian.PutUint16(parent[8:10], 3)
+	binary.BigEndian.PutUint16(parent[12:14], 0xFFFF)
+	binary.BigEndian.PutUint32(parent[14:18], 0x7FFFFFFF)
+	parent[18] = 100
+	copy(parent[19:23], []byte{6, 0x21, 0x4E, 0x5D})
+	parent[23] = 101
+	copy(parent[24:32], gm[:])
+	fake.setData(mgmtParentDataSet, parent)
+
+	client := dialFake(t, path)
+
+	ds, err := client.GetDefaultDataSet()
+	if err != nil {
+		t.Fatalf("GetDefaultDataSet failed: %v", err)
+	}
+	if !ds.TwoStepFlag || !ds.SlaveOnly || ds.NumberPorts != 2 || ds.Priority1 != 128 || ds.Priority2 != 127 ||
+		ds.ClockQuality.ClockClass != 248 || ds.DomainNumber != 127 || ds.ClockIdentity != fake.identity.ClockIdentity {
+		t.Errorf("unexpected DEFAULT_DATA_SET: %+v", ds)
+	}
+
+	pds, err := client.GetParentDataSet()
+	if err != nil {
+		t.Fatalf("GetParentDataSet failed: %v", err)
+	}
+	if pds.ParentPortIdentity.String() != "ec4670.fffe.000102-3" {
+		t.Errorf("parent port identity = %s", pds.ParentPortIdentity)
+	}
+	if pds.GrandmasterIdentity != gm || pds.GrandmasterPriority1 != 100 || pds.GrandmasterPriority2 != 101 {
+		t.Errorf("unexpected grandmaster in PARENT_DATA_SET: %+v", pds)
+	}
+	want := ClockQuality{ClockClass: 6, ClockAccuracy: 0x21, OffsetScaledLogVariance: 0x4E5D}
+	if pds.GrandmasterClockQuality != want {
+		t.Errorf("grandmaster clock quality = %+v, want %+v", pds.GrandmasterClockQuality, want)
+	}
+}
+
+func TestGetTimePropertiesDataSet(t *testing.T) {
+	fake, path := newFakePTP4LUDS(t)
+	fake.setData(mgmtTimePropertiesDataSet, []byte{0x00, 37, 0x3C, 0x20})
+	client := dialFake(t, path)
+
+	tp, err := client.GetTimePropertiesDataSet()
+	if err != nil {
+		t.Fatalf("GetTimePropertiesDataSet failed: %v", err)
+	}
+	if tp.CurrentUTCOffset != 37 || !tp.CurrentUTCOffsetValid || !tp.PTPTimescale ||
+		!tp.TimeTraceable || !tp.FrequencyTraceable || tp.Leap61 || tp.Leap59 || tp.TimeSource != 0x20 {
+		t.Errorf("unexpected TIME_PROPERTIES_DATA_SET: %+v", tp)
+	}
+}
+
+func TestGetPortDataSetTargetsPort(t *testing.T) {
+	fake, path := newFakePTP4LUDS(t)
+	for port, state := range map[uint16]PortState{1: PortStateSlave, 2: PortStatePassive} {
+		b := make([]byte, 26)
+		copy(b[0:8], fake.identity.ClockIdentity[:])
+		binary.BigEndian.PutUint16(b[8:10], port)
+		b[10] = uint8(state)
+		b[11] = 0xFD // logMinDelayReqInterval -3
+		b[20] = 0xFE // logAnnounceInterval -2
+		b[21] = 3
+		b[22] = 0xFD // logSyncInterval -3
+		b[23] = 1    // E2E
+		b[25] = 2
+		fake.setPortData(mgmtPortDataSet, port, b)
+	}
+	client := dialFake(t, path)
+
+	ds, err := client.GetPortDataSet(2)
+	if err != nil {
+		t.Fatalf("GetPortDataSet failed: %v", err)
+	}
+	if ds.PortIdentity.PortNumber != 2 || ds.PortState != PortStatePassive {
+		t.Errorf("port 2 data set = %+v", ds)
+	}
+	if ds.LogAnnounceInterval != -2 || ds.LogSyncInterval != -3 || ds.LogMinDelayReqInterval != -3 ||
+		ds.AnnounceReceiptTimeout != 3 || ds.VersionNumber != 2 {
+		t.Errorf("unexpected PORT_DATA_SET intervals: %+v", ds)
+	}
+	if ds.PortState.String() != "PASSIVE" {
+		t.Errorf("port state string = %s", ds.PortState)
+	}
+}
+
+func TestGetTimeStatusNP(t *testing.T) {
+	fake, path := newFakePTP4LUDS(t)
+	b := make([]byte, 50)
+	masterOffset := int64(-42)
+	binary.BigEndian.PutUint64(b[0:8], uint64(masterOffset))
+	binary.BigEndian.PutUint64(b[8:16], 1700000000000000000)
+	binary.BigEndian.PutUint32(b[38:42], 1)
+	copy(b[42:50], []byte{0xec, 0x46, 0x70, 0xff, 0xfe, 0x00, 0x01, 0x02})
+	fake.setData(mgmtTimeStatusNP, b)
+	client := dialFake(t, path)
+
+	ts, err := client.GetTimeStatusNP()
+	if err != nil {
+		t.Fatalf("GetTimeStatusNP failed: %v", err)
+	}
+	if ts.MasterOffset != -42 || ts.IngressTime != 1700000000000000000 || !ts.GMPresent ||
+		ts.GMIdentity.String() != "ec4670.fffe.000102" {
+		t.Errorf("unexpected TIME_STATUS_NP: %+v", ts)
+	}
+}
+
+func TestGetPortStatsNP(t *testing.T) {
+	fake, path := newFakePTP4LUDS(t)
+	b := make([]byte, 10+256)
+	binary.BigEndian.PutUint16(b[8:10], 1)
+	binary.LittleEndian.PutUint64(b[10+msgSync*8:], 1000)
+	binary.LittleEndian.PutUint64(b[10+msgAnnounce*8:], 250)
+	binary.LittleEndian.PutUint64(b[10+128+msgDelayReq*8:], 990)
+	fake.setPortData(mgmtPortStatsNP, 1, b)
+	client := dialFake(t, path)
+
+	stats, err := client.GetPortStatsNP(1)
+	if err != nil {
+		t.Fatalf("GetPortStatsNP failed: %v", err)
+	}
+	if stats.RxMsgType[msgSync] != 1000 || stats.RxMsgType[msgAnnounce] != 250 || stats.TxMsgType[msgDelayReq] != 990 {
+		t.Errorf("unexpected PORT_STATS_NP: rx=%v tx=%v", stats.RxMsgType, stats.TxMsgType)
+	}
+}
+
+func TestCountPortMessages(t *testing.T) {
+	exporter := NewPTPExporter("port-stats-test", InstanceConfig{Name: "default", Interface: "eth0"}, nil, NewEventLog(10), nil)
+	exporter.portMessages.DeletePartialMatch(prometheus.Labels{"device": "port-stats-test"})
+	syncs := func() float64 {
+		return testutil.ToFloat64(exporter.portMessages.WithLabelValues("port-stats-test", "default", "eth0", "1", "rx", "sync"))
+	}
+	stats := func(rxSync, txDelayReq uint64) *PortStatsNP {
+		s := &PortStatsNP{}
+		s.RxMsgType[msgSync] = rxSync
+		s.TxMsgType[msgDelayReq] = txDelayReq
+		return s
+	}
+
+	exporter.countPortMessages(1, stats(1000, 990))
+	exporter.countPortMessages(1, stats(1016, 1006))
+	if got := syncs(); got != 1016 {
+		t.Errorf("rx sync = %v, want 1016", got)
+	}
+	// ptp4l restarted: its counters start over
+	exporter.countPortMessages(1, stats(8, 8))
+	if got := syncs(); got != 1024 {
+		t.Errorf("rx sync after ptp4l restart = %v, want 1024", got)
+	}
+	if got := testutil.ToFloat64(exporter.portMessages.WithLabelValues("port-stats-test", "default", "eth0", "1", "tx", "delay_req")); got != 1014 {
+		t.Errorf("tx delay_req = %v, want 1014", got)
+	}
+}
+
+func TestManagementErrorStatus(t *testing.T) {
+	fake, path := newFakePTP4LUDS(t)
+	fake.mu.Lock()
+	fake.errors[mgmtTimeStatusNP] = 0x0002 // NO_SUCH_ID
+	fake.mu.Unlock()
+	client := dialFake(t, path)
+
+	_, err := client.GetTimeStatusNP()
+	var mgmtErr *ManagementError
+	if !errors.As(err, &mgmtErr) {
+		t.Fatalf("expected ManagementError, got %v", err)
+	}
+	if mgmtErr.ErrorID != 0x0002 || mgmtErr.ManagementID != mgmtTimeStatusNP {
+		t.Errorf("unexpected error: %+v", mgmtErr)
+	}
+}
+
+func TestIgnoresStaleResponses(t *testing.T) {
+	fake, path := newFakePTP4LUDS(t)
+	fake.setData(mgmtCurrentDataSet, encodeCurrentDataSet(2, 10, 20))
+	fake.setStale(true)
+	client := dialFake(t, path)
+
+	for i := 0; i < 3; i++ {
+		ds, err := client.GetCurrentDataSet()
+		if err != nil {
+			t.Fatalf("GetCurrentDataSet failed: %v", err)
+		}
+		if ds.StepsRemoved != 2 {
+			t.Errorf("unexpected CURRENT_DATA_SET: %+v", ds)
+		}
+	}
+}
+
+func TestTimeoutWithoutPTP4L(t *testing.T) {
+	fake, path := newFakePTP4LUDS(t)
+	fake.setData(mgmtCurrentDataSet, encodeCurrentDataSet(1, 0, 0))
+	client := dialFake(t, path)
+	fake.conn.Close()
+
+	if _, err := client.GetCurrentDataSet(); err == nil {
+		t.Fatal("expected an error once ptp4l is gone")
+	}
+}
+
+func TestUDPTransport(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	fake := newFakePTP4L(t, conn)
+	fake.setData(mgmtCurrentDataSet, encodeCurrentDataSet(3, 1.5, 700))
+
+	client, err := DialUDP(conn.LocalAddr().String(), 0, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer client.Close()
+
+	ds, err := client.GetCurrentDataSet()
+	if err != nil {
+		t.Fatalf("GetCurrentDataSet failed: %v", err)
+	}
+	if ds.StepsRemoved != 3 || ds.OffsetFromMaster != 1.5 || ds.MeanPathDelay != 700 {
+		t.Errorf("unexpected CURRENT_DATA_SET: %+v", ds)
+	}
+}
+
+func TestParseRejectsGarbage(t *testing.T) {
+	valid := (&managementMessage{action: actionResponse, managementID: mgmtCurrentDataSet, data: make([]byte, 18)}).marshal()
+
+	cases := map[string][]byte{
+		"short":       valid[:40],
+		"not mgmt":    append([]byte{0x00}, valid[1:]...),
+		"bad version": append([]byte{valid[0], 0x01}, valid[2:]...),
+	}
+	for name, b := range cases {
+		if _, err := parseManagementMessage(b); err == nil {
+			t.Errorf("%s: expected parse error", name)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Decoding of PTP event and general messages (IEEE 1588-2008 clause 13)
+// as captured on the wire by the passive sniffer.
+
+const (
+	ptpEventPort   = 319
+	ptpGeneralPort = 320
+	etherTypePTP   = 0x88F7
+)
+
+// Flag field bits (IEEE 1588-2008 Table 20), octet 0 in the high byte
+const (
+	flagAlternateMaster    uint16 = 0x0100
+	flagTwoStep            uint16 = 0x0200
+	flagUnicast            uint16 = 0x0400
+	flagLeap61             uint16 = 0x0001
+	flagLeap59             uint16 = 0x0002
+	flagUTCOffsetValid     uint16 = 0x0004
+	flagPTPTimescale       uint16 = 0x0008
+	flagTimeTraceable      uint16 = 0x0010
+	flagFrequencyTraceable uint16 = 0x0020
+)
+
+var messageTypeNames = map[uint8]string{
+	msgSync:               "sync",
+	msgDelayReq:           "delay_req",
+	msgPdelayReq:          "pdelay_req",
+	msgPdelayResp:         "pdelay_resp",
+	msgFollowUp:           "follow_up",
+	msgDelayResp:          "delay_resp",
+	msgPdelayRespFollowUp: "pdelay_resp_follow_up",
+	msgAnnounce:           "announce",
+	msgSignaling:          "signaling",
+	msgManagement:         "management",
+}
+
+func messageTypeName(t uint8) string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type_%d", t)
+}
+
+type PTPHeader struct {
+	TransportSpecific  uint8
+	MessageType        uint8
+	Version            uint8
+	MessageLength      uint16
+	DomainNumber       uint8
+	Flags              uint16
+	CorrectionField    int64 // nanoseconds scaled by 2^16
+	SourcePortIdentity PortIdentity
+	SequenceID         uint16
+	ControlField       uint8
+	LogMessageInterval int8
+}
+
+// PTPTimestamp is the 48-bit seconds / 32-bit nanoseconds wire timestamp
+type PTPTimestamp struct {
+	Seconds     uint64
+	Nanoseconds uint32
+}
+
+func readPTPTimestamp(b []byte) PTPTimestamp {
+	return PTPTimestamp{
+		Seconds:     uint64(binary.BigEndian.Uint16(b[0:2]))<<32 | uint64(binary.BigEndian.Uint32(b[2:6])),
+		Nanoseconds: binary.BigEndian.Uint32(b[6:10]),
+	}
+}
+
+type AnnounceBody struct {
+	OriginTimestamp         PTPTimestamp
+	CurrentUTCOffset        int16
+	GrandmasterPriority1    uint8
+	GrandmasterClockQuality ClockQuality
+	GrandmasterPriority2    uint8
+	GrandmasterIdentity     ClockIdentity
+	StepsRemoved            uint16
+	TimeSource              uint8
+}
+
+type TLV struct {
+	Type  uint16
+	Value []byte
+}
+
+type PTPMessage struct {
+	Header PTPHeader
+
+	Announce *AnnounceBody
+
+	// Sync/Delay_Req originTimestamp, Follow_Up preciseOriginTimestamp
+	// or Delay_Resp receiveTimestamp
+	Timestamp PTPTimestamp
+
+	// Delay_Resp only
+	RequestingPortIdentity PortIdentity
+
+	// TLVs following the message body
+	TLVs []TLV
+}
+
+// bodyLength is the fixed body size after the common header per message type
+func bodyLength(messageType uint8) int {
+	switch messageType {
+	case msgSync, msgDelayReq, msgFollowUp:
+		return 10
+	case msgDelayResp, msgPdelayReq, msgPdelayResp, msgPdelayRespFollowUp:
+		return 20
+	case msgAnnounce:
+		return 30
+	case msgSignaling:
+		return 10
+	case msgManagement:
+		return managementHeaderLength
+	default:
+		return 0
+	}
+}
+
+func ParsePTPMessage(b []byte) (*PTPMessage, error) {
+	if len(b) < ptpHeaderLength {
+		return nil, fmt.Errorf("PTP message too short (%d bytes)", len(b))
+	}
+
+	h := PTPHeader{
+		TransportSpecific:  b[0] >> 4,
+		MessageType:        b[0] & 0x0F,
+		Version:            b[1] & 0x0F,
+		MessageLength:      binary.BigEndian.Uint16(b[2:4]),
+		DomainNumber:       b[4],
+		Flags:              binary.BigEndian.Uint16(b[6:8]),
+		CorrectionField:    int64(binary.BigEndian.Uint64(b[8:16])),
+		SourcePortIdentity: readPortIdentity(b[20:30]),
+		SequenceID:         binary.BigEndian.Uint16(b[30:32]),
+		ControlField:       b[32],
+		LogMessageInterval: int8(b[33]),
+	}
+	if h.Version != ptpVersion {
+		return nil, fmt.Errorf("unsupported PTP version %d", h.Version)
+	}
+	if int(h.MessageLength) > len(b) || h.MessageLength < ptpHeaderLength {
+		return nil, fmt.Errorf("invalid messageLength %d (%d bytes captured)", h.MessageLength, len(b))
+	}
+	b = b[:h.MessageLength]
+
+	m := &PTPMessage{Header: h}
+	body := b[ptpHeaderLength:]
+	n := bodyLength(h.MessageType)
+	if len(body) < n {
+		return nil, fmt.Errorf("%s body too short (%d bytes)", messageTypeName(h.MessageType), len(body))
+	}
+
+	switch h.MessageType {
+	case msgSync, msgDelayReq, msgFollowUp:
+		m.Timestamp = readPTPTimestamp(body[0:10])
+	case msgDelayResp:
+		m.Timestamp = readPTPTimestamp(body[0:10])
+		m.RequestingPortIdentity = readPortIdentity(body[10:20])
+	case msgAnnounce:
+		a := &AnnounceBody{
+			OriginTimestamp:         readPTPTimestamp(body[0:10]),
+			CurrentUTCOffset:        int16(binary.BigEndian.Uint16(body[10:12])),
+			GrandmasterPriority1:    body[13],
+			GrandmasterClockQuality: readClockQuality(body[14:18]),
+			GrandmasterPriority2:    body[18],
+			StepsRemoved:            binary.BigEndian.Uint16(body[27:29]),
+			TimeSource:              body[29],
+		}
+		copy(a.GrandmasterIdentity[:], body[19:27])
+		m.Announce = a
+	}
+
+	// Suffix TLVs (e.g. ORGANIZATION_EXTENSION); malformed trailers are ignored
+	tlvs := body[n:]
+	for len(tlvs) >= tlvHeaderLength {
+		tlvType := binary.BigEndian.Uint16(tlvs[0:2])
+		length := int(binary.BigEndian.Uint16(tlvs[2:4]))
+		if tlvHeaderLength+length > len(tlvs) {
+			break
+		}
+		m.TLVs = append(m.TLVs, TLV{Type: tlvType, Value: tlvs[tlvHeaderLength : tlvHeaderLength+length]})
+		tlvs = tlvs[tlvHeaderLength+length:]
+	}
+
+	return m, nil
+}
+
+// extractPTPPayload returns the PTP message carried in an Ethernet frame:
+// L2 (EtherType 0x88F7) or UDP/IPv4 and UDP/IPv6 on ports 319/320
+func extractPTPPayload(frame []byte) ([]byte, bool) {
+	if len(frame) < 14 {
+		return nil, false
+	}
+	offset := 12
+	etherType := binary.BigEndian.Uint16(frame[offset:])
+	for etherType == 0x8100 || etherType == 0x88A8 {
+		offset += 4
+		if len(frame) < offset+2 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(frame[offset:])
+	}
+	payload := frame[offset+2:]
+
+	var udp []byte
+	switch etherType {
+	case etherTypePTP:
+		return payload, true
+
+	case 0x0800:
+		if len(payload) < 20 || payload[0]>>4 != 4 || payload[9] != 17 {
+			return nil, false
+		}
+		// Fragments never carry a complete PTP message
+		if binary.BigEndian.Uint16(payload[6:8])&0x3FFF != 0 {
+			return nil, false
+		}
+		ihl := int(payload[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(payload[2:4]))
+		if total > len(payload) || ihl > total {
+			return nil, false
+		}
+		udp = payload[ihl:total]
+
+	case 0x86DD:
+		if len(payload) < 40 || payload[6] != 17 {
+			return nil, false
+		}
+		udp = payload[40:]
+
+	default:
+		return nil, false
+	}
+
+	if len(udp) < 8 {
+		return nil, false
+	}
+	port := binary.BigEndian.Uint16(udp[2:4])
+	if port != ptpEventPort && port != ptpGeneralPort {
+		return nil, false
+	}
+	return udp[8:], true
+}
+
+// compareAnnounce orders two announced grandmasters by the BMCA data set
+// comparison (IEEE 1588-2008 9.3.4, without topology); negative means a is better
+func compareAnnounce(a, b *AnnounceBody) int {
+	ka := []int{int(a.GrandmasterPriority1), int(a.GrandmasterClockQuality.ClockClass),
+		int(a.GrandmasterClockQuality.ClockAccuracy), int(a.GrandmasterClockQuality.OffsetScaledLogVariance),
+		int(a.GrandmasterPriority2)}
+	kb := []int{int(b.GrandmasterPriority1), int(b.GrandmasterClockQuality.ClockClass),
+		int(b.GrandmasterClockQuality.ClockAccuracy), int(b.GrandmasterClockQuality.OffsetScaledLogVariance),
+		int(b.GrandmasterPriority2)}
+	for i := range ka {
+		if ka[i] != kb[i] {
+			return ka[i] - kb[i]
+		}
+	}
+	for i := range a.GrandmasterIdentity {
+		if a.GrandmasterIdentity[i] != b.GrandmasterIdentity[i] {
+			return int(a.GrandmasterIdentity[i]) - int(b.GrandmasterIdentity[i])
+		}
+	}
+	return 0
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const eventCompetingGrandmaster = "competing_grandmaster"
+
+type sniffedClockKey struct {
+	domain uint8
+	port   PortIdentity
+}
+
+// sniffedClock is every port seen sending PTP messages on the segment
+type sniffedClock struct {
+	lastSeen     time.Time
+	counts       map[uint8]uint64
+	windowCounts map[uint8]uint64
+	announce     *AnnounceBody
+	grandmaster  string
+}
+
+// PTPSniffer passively decodes the PTP traffic on an interface, independent of
+// the local ptp4l, to show every master, grandmaster and domain on the segment
+type PTPSniffer struct {
+	mu            sync.Mutex
+	instance      string
+	interfaceName string
+	timeout       time.Duration
+	events        *EventLog
+	conformance   *ST2059Checker
+	corrections   *CorrectionAnalyzer
+
+	clocks      map[sniffedClockKey]*sniffedClock
+	domains     map[uint8]bool
+	windowStart time.Time
+
+	messages                *prometheus.CounterVec
+	messageRate             *prometheus.GaugeVec
+	logMessageInterval      *prometheus.GaugeVec
+	announceInfo            *prometheus.GaugeVec
+	priority1               *prometheus.GaugeVec
+	priority2               *prometheus.GaugeVec
+	clockClass              *prometheus.GaugeVec
+	clockAccuracy           *prometheus.GaugeVec
+	offsetScaledLogVariance *prometheus.GaugeVec
+	stepsRemoved            *prometheus.GaugeVec
+	utcOffset               *prometheus.GaugeVec
+	timeSource              *prometheus.GaugeVec
+	domainClocks            *prometheus.GaugeVec
+	domainGrandmasters      *prometheus.GaugeVec
+	bestGrandmaster         *prometheus.GaugeVec
+	decodeErrors            *prometheus.CounterVec
+}
+
+func NewPTPSniffer(instance, iface string, timeout time.Duration, events *EventLog, conformance *ST2059Checker) *PTPSniffer {
+	clockLabels := []string{"ptp_instance", "interface", "domain", "clock"}
+	messageLabels := []string{"ptp_instance", "interface", "domain", "clock", "message_type"}
+	domainLabels := []string{"ptp_instance", "interface", "domain"}
+
+	gauge := func(name, help string, labels []string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	}
+
+	s := &PTPSniffer{
+		instance:      instance,
+		interfaceName: iface,
+		corrections:   NewCorrectionAnalyzer(instance, iface),
+		timeout:       timeout,
+		events:        events,
+		conformance:   conformance,
+		clocks:        make(map[sniffedClockKey]*sniffedClock),
+		domains:       make(map[uint8]bool),
+
+		messages: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_ptp_sniffer_messages_total",
+				Help: "PTP messages seen on the wire per domain, source port and message type",
+			},
+			messageLabels,
+		),
+		messageRate:        gauge("st2110_ptp_sniffer_message_rate", "Observed PTP message rate in messages per second", messageLabels),
+		logMessageInterval: gauge("st2110_ptp_sniffer_log_message_interval", "logMessageInterval advertised in the message header (log2 seconds)", messageLabels),
+		announceInfo: gauge("st2110_ptp_sniffer_announce_info", "Grandmaster announced by a master port (always 1)",
+			[]string{"ptp_instance", "interface", "domain", "clock", "grandmaster"}),
+		priority1:               gauge("st2110_ptp_sniffer_announce_priority1", "Announced grandmasterPriority1", clockLabels),
+		priority2:               gauge("st2110_ptp_sniffer_announce_priority2", "Announced grandmasterPriority2", clockLabels),
+		clockClass:              gauge("st2110_ptp_sniffer_announce_clock_class", "Announced grandmaster clockClass", clockLabels),
+		clockAccuracy:           gauge("st2110_ptp_sniffer_announce_clock_accuracy", "Announced grandmaster clockAccuracy enumeration", clockLabels),
+		offsetScaledLogVariance: gauge("st2110_ptp_sniffer_announce_offset_scaled_log_variance", "Announced grandmaster offsetScaledLogVariance", clockLabels),
+		stepsRemoved:            gauge("st2110_ptp_sniffer_announce_steps_removed", "Announced stepsRemoved", clockLabels),
+		utcOffset:               gauge("st2110_ptp_sniffer_announce_utc_offset_seconds", "Announced currentUtcOffset", clockLabels),
+		timeSource:              gauge("st2110_ptp_sniffer_announce_time_source", "Announced timeSource enumeration", clockLabels),
+		domainClocks:            gauge("st2110_ptp_sniffer_domain_clocks", "Number of ports sending PTP messages in the domain", domainLabels),
+		domainGrandmasters:      gauge("st2110_ptp_sniffer_domain_grandmasters", "Number of distinct grandmasters announced in the domain (>1 = competing grandmasters)", domainLabels),
+		bestGrandmaster: gauge("st2110_ptp_sniffer_best_grandmaster", "Grandmaster that wins the BMCA data set comparison among the announced ones (always 1)",
+			[]string{"ptp_instance", "interface", "domain", "grandmaster"}),
+		decodeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_ptp_sniffer_decode_errors_total",
+				Help: "Captured PTP frames that could not be decoded",
+			},
+			[]string{"ptp_instance", "interface"},
+		),
+	}
+
+	s.messages = register(s.messages)
+	s.messageRate = register(s.messageRate)
+	s.logMessageInterval = register(s.logMessageInterval)
+	s.announceInfo = register(s.announceInfo)
+	s.priority1 = register(s.priority1)
+	s.priority2 = register(s.priority2)
+	s.clockClass = register(s.clockClass)
+	s.clockAccuracy = register(s.clockAccuracy)
+	s.offsetScaledLogVariance = register(s.offsetScaledLogVariance)
+	s.stepsRemoved = register(s.stepsRemoved)
+	s.utcOffset = register(s.utcOffset)
+	s.timeSource = register(s.timeSource)
+	s.domainClocks = register(s.domainClocks)
+	s.domainGrandmasters = register(s.domainGrandmasters)
+	s.bestGrandmaster = register(s.bestGrandmaster)
+	s.decodeErrors = register(s.decodeErrors)
+
+	s.decodeErrors.WithLabelValues(instance, iface)
+
+	return s
+}
+
+// HandleFrame decodes one captured Ethernet frame
+func (s *PTPSniffer) HandleFrame(frame []byte, now time.Time) {
+	payload, ok := extractPTPPayload(frame)
+	if !ok {
+		return
+	}
+	msg, err := ParsePTPMessage(payload)
+	if err != nil {
+		s.decodeErrors.WithLabelValues(s.instance, s.interfaceName).Inc()
+		return
+	}
+	s.HandleMessage(msg, now)
+	s.corrections.HandleMessage(msg)
+	s.conformance.CheckMessage(s.instance, s.interfaceName, msg, now)
+}
+
+func (s *PTPSniffer) HandleMessage(msg *PTPMessage, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := msg.Header
+	key := sniffedClockKey{domain: h.DomainNumber, port: h.SourcePortIdentity}
+	clock, ok := s.clocks[key]
+	if !ok {
+		clock = &sniffedClock{
+			counts:       make(map[uint8]uint64),
+			windowCounts: make(map[uint8]uint64),
+		}
+		s.clocks[key] = clock
+		log.Printf("PTP sniffer on %s: new clock %s in domain %d (%s)",
+			s.interfaceName, h.SourcePortIdentity, h.DomainNumber, messageTypeName(h.MessageType))
+	}
+	clock.lastSeen = now
+	clock.counts[h.MessageType]++
+
+	domain := strconv.Itoa(int(h.DomainNumber))
+	port := h.SourcePortIdentity.String()
+	messageType := messageTypeName(h.MessageType)
+	s.messages.WithLabelValues(s.instance, s.interfaceName, domain, port, messageType).Inc()
+
+	// 0x7F is "not applicable" (e.g. Delay_Resp in ptp4l's unicast negotiation)
+	if h.LogMessageInterval != 0x7F {
+		s.logMessageInterval.WithLabelValues(s.instance, s.interfaceName, domain, port, messageType).Set(float64(h.LogMessageInterval))
+	}
+
+	if msg.Announce != nil {
+		s.updateAnnounce(key, clock, msg.Announce, now)
+	}
+}
+
+func (s *PTPSniffer) updateAnnounce(key sniffedClockKey, clock *sniffedClock, a *AnnounceBody, now time.Time) {
+	domain := strconv.Itoa(int(key.domain))
+	port := key.port.String()
+	gm := a.GrandmasterIdentity.String()
+
+	if clock.grandmaster != gm {
+		// A different grandmaster than every other master in the domain is a
+		// rogue or misconfigured clock until the BMCA settles
+		for otherKey, other := range s.clocks {
+			if otherKey.domain != key.domain || other.announce == nil || other.grandmaster == gm {
+				continue
+			}
+			log.Printf("⚠️  Competing grandmaster in domain %d on %s: %s announces %s, %s announces %s",
+				key.domain, s.interfaceName, port, gm, otherKey.port, other.grandmaster)
+			s.events.Add(Event{
+				Time:      now,
+				Instance:  s.instance,
+				Interface: s.interfaceName,
+				Type:      eventCompetingGrandmaster,
+				From:      other.grandmaster,
+				To:        gm,
+				Detail: fmt.Sprintf("domain=%d clock=%s priority1=%d clockClass=%d priority2=%d",
+					key.domain, port, a.GrandmasterPriority1, a.GrandmasterClockQuality.ClockClass, a.GrandmasterPriority2),
+			})
+			break
+		}
+		s.announceInfo.DeletePartialMatch(prometheus.Labels{"ptp_instance": s.instance, "interface": s.interfaceName, "domain": domain, "clock": port})
+	}
+	clock.announce = a
+	clock.grandmaster = gm
+
+	quality := a.GrandmasterClockQuality
+	s.announceInfo.WithLabelValues(s.instance, s.interfaceName, domain, port, gm).Set(1)
+	s.priority1.WithLabelValues(s.instance, s.interfaceName, domain, port).Set(float64(a.GrandmasterPriority1))
+	s.priority2.WithLabelValues(s.instance, s.interfaceName, domain, port).Set(float64(a.GrandmasterPriority2))
+	s.clockClass.WithLabelValues(s.instance, s.interfaceName, domain, port).Set(float64(quality.ClockClass))
+	s.clockAccuracy.WithLabelValues(s.instance, s.interfaceName, domain, port).Set(float64(quality.ClockAccuracy))
+	s.offsetScaledLogVariance.WithLabelValues(s.instance, s.interfaceName, domain, port).Set(float64(quality.OffsetScaledLogVariance))
+	s.stepsRemoved.WithLabelValues(s.instance, s.interfaceName, domain, port).Set(float64(a.StepsRemoved))
+	s.utcOffset.WithLabelValues(s.instance, s.interfaceName, domain, port).Set(float64(a.CurrentUTCOffset))
+	s.timeSource.WithLabelValues(s.instance, s.interfaceName, domain, port).Set(float64(a.TimeSource))
+}
+
+// Update computes message rates over the last window, ages out silent clocks
+// and recomputes the per-domain view
+func (s *PTPSniffer) Update(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := now.Sub(s.windowStart).Seconds()
+	first := s.windowStart.IsZero()
+	s.windowStart = now
+
+	type domainView struct {
+		clocks       int
+		grandmasters map[string]bool
+		best         *AnnounceBody
+	}
+	domains := make(map[uint8]*domainView)
+
+	for key, clock := range s.clocks {
+		domain := strconv.Itoa(int(key.domain))
+		port := key.port.String()
+
+		if now.Sub(clock.lastSeen) > s.timeout {
+			log.Printf("PTP sniffer on %s: clock %s in domain %d went silent", s.interfaceName, key.port, key.domain)
+			labels := prometheus.Labels{"ptp_instance": s.instance, "interface": s.interfaceName, "domain": domain, "clock": port}
+			for _, vec := range []*prometheus.GaugeVec{s.messageRate, s.logMessageInterval, s.announceInfo,
+				s.priority1, s.priority2, s.clockClass, s.clockAccuracy, s.offsetScaledLogVariance,
+				s.stepsRemoved, s.utcOffset, s.timeSource} {
+				vec.DeletePartialMatch(labels)
+			}
+			s.messages.DeletePartialMatch(labels)
+			s.conformance.Forget(s.instance, s.interfaceName, key.domain, key.port)
+			s.corrections.Forget(key.domain, key.port)
+			delete(s.clocks, key)
+			continue
+		}
+
+		for messageType, count := range clock.counts {
+			if !first && elapsed > 0 {
+				rate := float64(count-clock.windowCounts[messageType]) / elapsed
+				s.messageRate.WithLabelValues(s.instance, s.interfaceName, domain, port, messageTypeName(messageType)).Set(math.Round(rate*100) / 100)
+			}
+			clock.windowCounts[messageType] = count
+		}
+
+		view, ok := domains[key.domain]
+		if !ok {
+			view = &domainView{grandmasters: make(map[string]bool)}
+			domains[key.domain] = view
+		}
+		view.clocks++
+		if clock.announce != nil {
+			view.grandmasters[clock.grandmaster] = true
+			if view.best == nil || compareAnnounce(clock.announce, view.best) < 0 {
+				view.best = clock.announce
+			}
+		}
+	}
+
+	for domainNumber := range s.domains {
+		if _, ok := domains[domainNumber]; !ok {
+			labels := prometheus.Labels{"ptp_instance": s.instance, "interface": s.interfaceName, "domain": strconv.Itoa(int(domainNumber))}
+			s.domainClocks.DeletePartialMatch(labels)
+			s.domainGrandmasters.DeletePartialMatch(labels)
+			s.bestGrandmaster.DeletePartialMatch(labels)
+			delete(s.domains, domainNumber)
+		}
+	}
+
+	for domainNumber, view := range domains {
+		s.domains[domainNumber] = true
+		domain := strconv.Itoa(int(domainNumber))
+		s.domainClocks.WithLabelValues(s.instance, s.interfaceName, domain).Set(float64(view.clocks))
+		s.domainGrandmasters.WithLabelValues(s.instance, s.interfaceName, domain).Set(float64(len(view.grandmasters)))
+		s.bestGrandmaster.DeletePartialMatch(prometheus.Labels{"ptp_instance": s.instance, "interface": s.interfaceName, "domain": domain})
+		if view.best != nil {
+			s.bestGrandmaster.WithLabelValues(s.instance, s.interfaceName, domain, view.best.GrandmasterIdentity.String()).Set(1)
+		}
+	}
+
+	s.conformance.Update(now)
+	s.corrections.Publish()
+}
+
+// Start captures on the interface and updates rates every interval
+func (s *PTPSniffer) Start(interval time.Duration) error {
+	capture, err := openCapture(s.interfaceName)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := capture.ReadPacket(buf)
+			if err != nil {
+				log.Printf("PTP capture error on %s: %v", s.interfaceName, err)
+				time.Sleep(time.Second)
+				continue
+			}
+			s.HandleFrame(buf[:n], time.Now())
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for now := range ticker.C {
+			s.Update(now)
+		}
+	}()
+
+	log.Printf("Sniffing PTP traffic on %s", s.interfaceName)
+	return nil
+}
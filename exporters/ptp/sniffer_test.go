@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Metrics register globally, so every test shares one checker
+var testConformance = sync.OnceValue(NewST2059Checker)
+
+var (
+	sniffMaster = PortIdentity{ClockIdentity: ClockIdentity{0xec, 0x46, 0x70, 0xff, 0xfe, 0x00, 0x01, 0x02}, PortNumber: 1}
+	sniffRogue  = PortIdentity{ClockIdentity: ClockIdentity{0x00, 0x11, 0x22, 0xff, 0xfe, 0x33, 0x44, 0x55}, PortNumber: 1}
+)
+
+// encodePTPMessage builds a PTP message with the common header in front of body
+func encodePTPMessage(messageType, domain uint8, source PortIdentity, logInterval int8, body []byte) []byte {
+	b := make([]byte, ptpHeaderLength+len(body))
+	b[0] = messageType
+	b[1] = ptpVersion
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[4] = domain
+	b[6] = 0x02 // twoStep
+	binary.BigEndian.PutUint64(b[8:16], uint64(1500<<16))
+	copy(b[20:28], source.ClockIdentity[:])
+	binary.BigEndian.PutUint16(b[28:30], source.PortNumber)
+	binary.BigEndian.PutUint16(b[30:32], 42)
+	b[33] = byte(logInterval)
+	copy(b[ptpHeaderLength:], body)
+	return b
+}
+
+func encodeAnnounce(gm ClockIdentity, priority1, clockClass uint8) []byte {
+	body := make([]byte, 30)
+	binary.BigEndian.PutUint16(body[10:12], 37)
+	body[13] = priority1
+	copy(body[14:18], []byte{clockClass, 0x21, 0x4E, 0x5D})
+	body[18] = 128
+	copy(body[19:27], gm[:])
+	binary.BigEndian.PutUint16(body[27:29], 1)
+	body[29] = 0x20
+	return body
+}
+
+func udp4Frame(port uint16, payload []byte) []byte {
+	frame := make([]byte, 14+20+8+len(payload))
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+8+len(payload)))
+	ip[9] = 17
+	copy(ip[16:20], []byte{224, 0, 1, 129})
+	binary.BigEndian.PutUint16(ip[20:22], port)
+	binary.BigEndian.PutUint16(ip[22:24], port)
+	binary.BigEndian.PutUint16(ip[24:26], uint16(8+len(payload)))
+	copy(ip[28:], payload)
+	return frame
+}
+
+func TestParseAnnounce(t *testing.T) {
+	payload := encodePTPMessage(msgAnnounce, 127, sniffMaster, 1, encodeAnnounce(sniffMaster.ClockIdentity, 100, 6))
+	msg, err := ParsePTPMessage(payload)
+	if err != nil {
+		t.Fatalf("ParsePTPMessage failed: %v", err)
+	}
+
+	h := msg.Header
+	if h.MessageType != msgAnnounce || h.DomainNumber != 127 || h.SourcePortIdentity != sniffMaster ||
+		h.SequenceID != 42 || h.LogMessageInterval != 1 || h.Flags&flagTwoStep == 0 || h.CorrectionField>>16 != 1500 {
+		t.Errorf("unexpected header: %+v", h)
+	}
+	a := msg.Announce
+	if a == nil {
+		t.Fatal("announce body not decoded")
+	}
+	if a.GrandmasterIdentity != sniffMaster.ClockIdentity || a.GrandmasterPriority1 != 100 || a.GrandmasterPriority2 != 128 ||
+		a.GrandmasterClockQuality.ClockClass != 6 || a.CurrentUTCOffset != 37 || a.StepsRemoved != 1 || a.TimeSource != 0x20 {
+		t.Errorf("unexpected announce: %+v", a)
+	}
+}
+
+func TestParseDelayRespAndTLVs(t *testing.T) {
+	body := make([]byte, 20+4+6)
+	binary.BigEndian.PutUint16(body[0:2], 1)
+	binary.BigEndian.PutUint32(body[2:6], 2)
+	binary.BigEndian.PutUint32(body[6:10], 500)
+	copy(body[10:18], sniffRogue.ClockIdentity[:])
+	binary.BigEndian.PutUint16(body[18:20], 7)
+	binary.BigEndian.PutUint16(body[20:22], 0x0003) // ORGANIZATION_EXTENSION
+	binary.BigEndian.PutUint16(body[22:24], 6)
+	copy(body[24:27], []byte{0x68, 0x97, 0xE8})
+
+	msg, err := ParsePTPMessage(encodePTPMessage(msgDelayResp, 0, sniffMaster, -3, body))
+	if err != nil {
+		t.Fatalf("ParsePTPMessage failed: %v", err)
+	}
+	want := PTPTimestamp{Seconds: 1<<32 | 2, Nanoseconds: 500}
+	if msg.Timestamp != want {
+		t.Errorf("receiveTimestamp = %+v, want %+v", msg.Timestamp, want)
+	}
+	if msg.RequestingPortIdentity != (PortIdentity{ClockIdentity: sniffRogue.ClockIdentity, PortNumber: 7}) {
+		t.Errorf("requestingPortIdentity = %s", msg.RequestingPortIdentity)
+	}
+	if len(msg.TLVs) != 1 || msg.TLVs[0].Type != 0x0003 || len(msg.TLVs[0].Value) != 6 {
+		t.Errorf("unexpected TLVs: %+v", msg.TLVs)
+	}
+}
+
+func TestParseRejectsTruncatedMessages(t *testing.T) {
+	announce := encodePTPMessage(msgAnnounce, 0, sniffMaster, 1, encodeAnnounce(sniffMaster.ClockIdentity, 128, 6))
+	for _, b := range [][]byte{
+		announce[:20],
+		announce[:len(announce)-1],
+		encodePTPMessage(msgAnnounce, 0, sniffMaster, 1, make([]byte, 10)),
+	} {
+		if _, err := ParsePTPMessage(b); err == nil {
+			t.Errorf("accepted truncated message of %d bytes", len(b))
+		}
+	}
+}
+
+func TestExtractPTPPayload(t *testing.T) {
+	payload := encodePTPMessage(msgSync, 0, sniffMaster, -3, make([]byte, 10))
+
+	if got, ok := extractPTPPayload(udp4Frame(ptpEventPort, payload)); !ok || len(got) != len(payload) {
+		t.Errorf("UDP/IPv4 payload not extracted (ok=%v, %d bytes)", ok, len(got))
+	}
+	if _, ok := extractPTPPayload(udp4Frame(5004, payload)); ok {
+		t.Error("extracted payload from a non-PTP UDP port")
+	}
+
+	l2 := make([]byte, 18+len(payload))
+	binary.BigEndian.PutUint16(l2[12:14], 0x8100)
+	binary.BigEndian.PutUint16(l2[16:18], etherTypePTP)
+	copy(l2[18:], payload)
+	if got, ok := extractPTPPayload(l2); !ok || got[0] != msgSync {
+		t.Errorf("VLAN tagged L2 payload not extracted (ok=%v)", ok)
+	}
+}
+
+func TestCompareAnnounce(t *testing.T) {
+	parse := func(gm ClockIdentity, priority1, clockClass uint8) *AnnounceBody {
+		msg, err := ParsePTPMessage(encodePTPMessage(msgAnnounce, 0, sniffMaster, 1, encodeAnnounce(gm, priority1, clockClass)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg.Announce
+	}
+
+	locked := parse(sniffMaster.ClockIdentity, 128, 6)
+	holdover := parse(sniffRogue.ClockIdentity, 128, 7)
+	preferred := parse(sniffRogue.ClockIdentity, 100, 248)
+
+	if compareAnnounce(locked, holdover) >= 0 {
+		t.Error("clockClass 6 should beat clockClass 7")
+	}
+	if compareAnnounce(preferred, locked) >= 0 {
+		t.Error("lower priority1 should win before clockClass")
+	}
+	if compareAnnounce(locked, locked) != 0 {
+		t.Error("identical announces should compare equal")
+	}
+}
+
+func TestSnifferCompetingGrandmasters(t *testing.T) {
+	events := NewEventLog(10)
+	sniffer := NewPTPSniffer("default", "eth0", 15*time.Second, events, testConformance())
+	start := time.Now()
+
+	frame := func(messageType uint8, source PortIdentity, body []byte) []byte {
+		return udp4Frame(ptpGeneralPort, encodePTPMessage(messageType, 127, source, 1, body))
+	}
+
+	sniffer.Update(start)
+	for i := 0; i < 20; i++ {
+		sniffer.HandleFrame(frame(msgAnnounce, sniffMaster, encodeAnnounce(sniffMaster.ClockIdentity, 128, 6)), start)
+	}
+	sniffer.HandleFrame(frame(msgAnnounce, sniffRogue, encodeAnnounce(sniffRogue.ClockIdentity, 100, 248)), start)
+	sniffer.Update(start.Add(10 * time.Second))
+
+	if got := testutil.ToFloat64(sniffer.domainGrandmasters.WithLabelValues("default", "eth0", "127")); got != 2 {
+		t.Errorf("domain grandmasters = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(sniffer.messageRate.WithLabelValues("default", "eth0", "127", sniffMaster.String(), "announce")); got != 2 {
+		t.Errorf("announce rate = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(sniffer.bestGrandmaster.WithLabelValues("default", "eth0", "127", sniffRogue.ClockIdentity.String())); got != 1 {
+		t.Errorf("priority1 100 grandmaster should win the BMCA comparison")
+	}
+	if recent := events.Recent(eventCompetingGrandmaster); len(recent) != 1 || recent[0].To != sniffRogue.ClockIdentity.String() {
+		t.Errorf("unexpected competing grandmaster events: %+v", recent)
+	}
+
+	// Only the legitimate master keeps announcing; the rogue ages out
+	sniffer.HandleFrame(frame(msgAnnounce, sniffMaster, encodeAnnounce(sniffMaster.ClockIdentity, 128, 6)), start.Add(12*time.Second))
+	sniffer.Update(start.Add(20 * time.Second))
+
+	if got := testutil.ToFloat64(sniffer.domainGrandmasters.WithLabelValues("default", "eth0", "127")); got != 1 {
+		t.Errorf("domain grandmasters after timeout = %v, want 1", got)
+	}
+	if n := testutil.CollectAndCount(sniffer.priority1); n != 1 {
+		t.Errorf("%d priority1 series after the rogue aged out, want 1", n)
+	}
+	if got := testutil.ToFloat64(sniffer.bestGrandmaster.WithLabelValues("default", "eth0", "127", sniffMaster.ClockIdentity.String())); got != 1 {
+		t.Errorf("remaining grandmaster should be the best one")
+	}
+	if n := testutil.CollectAndCount(sniffer.bestGrandmaster, "st2110_ptp_sniffer_best_grandmaster"); n != 1 {
+		t.Errorf("%d best grandmaster series, want 1", n)
+	}
+}
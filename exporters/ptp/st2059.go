@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SMPTE ST 2059-2 profile ranges
+const (
+	st2059DomainMax              = 127
+	st2059AnnounceIntervalMin    = -3
+	st2059AnnounceIntervalMax    = 1
+	st2059SyncIntervalMin        = -7
+	st2059SyncIntervalMax        = -1
+	st2059DelayReqIntervalSpan   = 5 // logMinDelayReqInterval within logSyncInterval .. +5
+	st2059AnnounceReceiptMin     = 2
+	st2059AnnounceReceiptMax     = 10
+	st2059MaxLocalOffsetSeconds  = 14 * 3600
+	st2059LocalOffsetGranularity = 15 * 60
+
+	// The synchronization metadata is sent once per second by default
+	smpteMetadataTimeout = 5 * time.Second
+)
+
+const (
+	tlvOrganizationExtension  = 0x0003
+	smpteSyncMetadataSubtype  = 0x000001
+	smpteSyncMetadataLength   = 48
+	smpteTimeAddressFlagsMask = 0x03
+	smpteDaylightSavingMask   = 0x07
+)
+
+var smpteOrganizationID = []byte{0x68, 0x97, 0xE8}
+
+// Conformance rules exported in the rule label
+const (
+	ruleDomainNumber           = "domain_number"
+	ruleAnnounceInterval       = "announce_interval"
+	ruleSyncInterval           = "sync_interval"
+	ruleDelayReqInterval       = "delay_req_interval"
+	ruleAnnounceReceiptTimeout = "announce_receipt_timeout"
+	ruleSMPresent              = "sm_tlv_present"
+	ruleSMFrameRate            = "sm_frame_rate"
+	ruleSMMasterLockingStatus  = "sm_master_locking_status"
+	ruleSMTimeAddressFlags     = "sm_time_address_flags"
+	ruleSMLocalOffset          = "sm_local_offset"
+	ruleSMDaylightSaving       = "sm_daylight_saving"
+	ruleSMJamTimes             = "sm_jam_times"
+)
+
+// SMPTESyncMetadata is the ST 2059-2 synchronization metadata TLV
+// (ORGANIZATION_EXTENSION, organizationId 68-97-E8, subtype 1)
+type SMPTESyncMetadata struct {
+	FrameRateNumerator     uint32
+	FrameRateDenominator   uint32
+	MasterLockingStatus    uint8 // 0=not in use, 1=free run, 2=cold locking, 3=warm locking, 4=locked
+	TimeAddressFlags       uint8 // bit 0 drop frame, bit 1 color frame identification
+	CurrentLocalOffset     int32
+	JumpSeconds            int32
+	TimeOfNextJump         uint64
+	TimeOfNextJam          uint64
+	TimeOfPreviousJam      uint64
+	PreviousJamLocalOffset int32
+	DaylightSaving         uint8 // bit 0 current, bit 1 at next jump, bit 2 at previous jam
+	LeapSecondJump         uint8
+}
+
+func readUint48(b []byte) uint64 {
+	return uint64(binary.BigEndian.Uint16(b[0:2]))<<32 | uint64(binary.BigEndian.Uint32(b[2:6]))
+}
+
+// parseSMPTESyncMetadata decodes the TLV if it is the SMPTE synchronization metadata
+func parseSMPTESyncMetadata(tlv TLV) (*SMPTESyncMetadata, bool) {
+	v := tlv.Value
+	if tlv.Type != tlvOrganizationExtension || len(v) < smpteSyncMetadataLength || !bytes.Equal(v[0:3], smpteOrganizationID) {
+		return nil, false
+	}
+	if uint32(v[3])<<16|uint32(v[4])<<8|uint32(v[5]) != smpteSyncMetadataSubtype {
+		return nil, false
+	}
+	v = v[6:]
+	return &SMPTESyncMetadata{
+		FrameRateNumerator:     binary.BigEndian.Uint32(v[0:4]),
+		FrameRateDenominator:   binary.BigEndian.Uint32(v[4:8]),
+		MasterLockingStatus:    v[8],
+		TimeAddressFlags:       v[9],
+		CurrentLocalOffset:     int32(binary.BigEndian.Uint32(v[10:14])),
+		JumpSeconds:            int32(binary.BigEndian.Uint32(v[14:18])),
+		TimeOfNextJump:         readUint48(v[18:24]),
+		TimeOfNextJam:          readUint48(v[24:30]),
+		TimeOfPreviousJam:      readUint48(v[30:36]),
+		PreviousJamLocalOffset: int32(binary.BigEndian.Uint32(v[36:40])),
+		DaylightSaving:         v[40],
+		LeapSecondJump:         v[41],
+	}, true
+}
+
+func validLocalOffset(offset int32) bool {
+	return offset >= -st2059MaxLocalOffsetSeconds && offset <= st2059MaxLocalOffsetSeconds &&
+		offset%st2059LocalOffsetGranularity == 0
+}
+
+func inRange(v, min, max int) bool {
+	return v >= min && v <= max
+}
+
+type conformanceKey struct {
+	instance string
+	iface    string
+	domain   uint8
+	port     PortIdentity
+}
+
+type conformanceState struct {
+	syncInterval   int8
+	syncSeen       bool
+	announceSeen   bool
+	lastMetadata   time.Time
+	metadataChecks bool
+}
+
+// ST2059Checker validates PTP traffic and ptp4l port configuration against
+// the SMPTE ST 2059-2 profile and exports one pass/fail gauge per rule
+type ST2059Checker struct {
+	mu     sync.Mutex
+	states map[conformanceKey]*conformanceState
+
+	conformance            *prometheus.GaugeVec
+	frameRate              *prometheus.GaugeVec
+	masterLockingStatus    *prometheus.GaugeVec
+	currentLocalOffset     *prometheus.GaugeVec
+	previousJamLocalOffset *prometheus.GaugeVec
+	daylightSaving         *prometheus.GaugeVec
+	dropFrame              *prometheus.GaugeVec
+	timeOfNextJam          *prometheus.GaugeVec
+	timeOfPreviousJam      *prometheus.GaugeVec
+}
+
+func NewST2059Checker() *ST2059Checker {
+	labels := []string{"ptp_instance", "interface", "domain", "clock"}
+
+	gauge := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	}
+
+	c := &ST2059Checker{
+		states: make(map[conformanceKey]*conformanceState),
+		conformance: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_st2059_conformance",
+				Help: "SMPTE ST 2059-2 profile conformance per rule (1=pass, 0=fail)",
+			},
+			[]string{"ptp_instance", "interface", "domain", "clock", "rule"},
+		),
+		frameRate:              gauge("st2110_ptp_smpte_frame_rate", "defaultSystemFrameRate from the SMPTE synchronization metadata (frames per second)"),
+		masterLockingStatus:    gauge("st2110_ptp_smpte_master_locking_status", "masterLockingStatus (0=not in use, 1=free run, 2=cold locking, 3=warm locking, 4=locked)"),
+		currentLocalOffset:     gauge("st2110_ptp_smpte_current_local_offset_seconds", "currentLocalOffset from the SMPTE synchronization metadata"),
+		previousJamLocalOffset: gauge("st2110_ptp_smpte_previous_jam_local_offset_seconds", "previousJamLocalOffset from the SMPTE synchronization metadata"),
+		daylightSaving:         gauge("st2110_ptp_smpte_daylight_saving", "Current daylight saving flag from the SMPTE synchronization metadata"),
+		dropFrame:              gauge("st2110_ptp_smpte_drop_frame", "Drop frame time address flag from the SMPTE synchronization metadata"),
+		timeOfNextJam:          gauge("st2110_ptp_smpte_time_of_next_jam_seconds", "timeOfNextJam in PTP seconds (0=not scheduled)"),
+		timeOfPreviousJam:      gauge("st2110_ptp_smpte_time_of_previous_jam_seconds", "timeOfPreviousJam in PTP seconds"),
+	}
+
+	c.conformance = register(c.conformance)
+	c.frameRate = register(c.frameRate)
+	c.masterLockingStatus = register(c.masterLockingStatus)
+	c.currentLocalOffset = register(c.currentLocalOffset)
+	c.previousJamLocalOffset = register(c.previousJamLocalOffset)
+	c.daylightSaving = register(c.daylightSaving)
+	c.dropFrame = register(c.dropFrame)
+	c.timeOfNextJam = register(c.timeOfNextJam)
+	c.timeOfPreviousJam = register(c.timeOfPreviousJam)
+
+	return c
+}
+
+func (c *ST2059Checker) state(key conformanceKey) *conformanceState {
+	state, ok := c.states[key]
+	if !ok {
+		state = &conformanceState{}
+		c.states[key] = state
+	}
+	return state
+}
+
+func (c *ST2059Checker) setRule(key conformanceKey, rule string, pass bool) {
+	c.conformance.WithLabelValues(key.instance, key.iface, strconv.Itoa(int(key.domain)), key.port.String(), rule).Set(boolToFloat(pass))
+}
+
+// CheckMessage validates a message captured on the wire
+func (c *ST2059Checker) CheckMessage(instance, iface string, msg *PTPMessage, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h := msg.Header
+	key := conformanceKey{instance: instance, iface: iface, domain: h.DomainNumber, port: h.SourcePortIdentity}
+	state := c.state(key)
+	interval := int(h.LogMessageInterval)
+
+	c.setRule(key, ruleDomainNumber, h.DomainNumber <= st2059DomainMax)
+
+	switch h.MessageType {
+	case msgAnnounce:
+		state.announceSeen = true
+		c.setRule(key, ruleAnnounceInterval, inRange(interval, st2059AnnounceIntervalMin, st2059AnnounceIntervalMax))
+	case msgSync:
+		state.syncSeen = true
+		state.syncInterval = h.LogMessageInterval
+		c.setRule(key, ruleSyncInterval, inRange(interval, st2059SyncIntervalMin, st2059SyncIntervalMax))
+	case msgDelayResp:
+		// The master advertises logMinDelayReqInterval in Delay_Resp; 0x7F is unicast "not applicable"
+		if state.syncSeen && h.LogMessageInterval != 0x7F {
+			sync := int(state.syncInterval)
+			c.setRule(key, ruleDelayReqInterval, inRange(interval, sync, sync+st2059DelayReqIntervalSpan))
+		}
+	}
+
+	for _, tlv := range msg.TLVs {
+		if metadata, ok := parseSMPTESyncMetadata(tlv); ok {
+			state.lastMetadata = now
+			state.metadataChecks = true
+			c.checkMetadata(key, metadata)
+		}
+	}
+}
+
+func (c *ST2059Checker) checkMetadata(key conformanceKey, m *SMPTESyncMetadata) {
+	domain := strconv.Itoa(int(key.domain))
+	clock := key.port.String()
+
+	frameRateValid := m.FrameRateNumerator != 0 && (m.FrameRateDenominator == 1 || m.FrameRateDenominator == 1001)
+	if frameRateValid {
+		c.frameRate.WithLabelValues(key.instance, key.iface, domain, clock).Set(float64(m.FrameRateNumerator) / float64(m.FrameRateDenominator))
+	}
+	c.setRule(key, ruleSMFrameRate, frameRateValid)
+	c.setRule(key, ruleSMMasterLockingStatus, m.MasterLockingStatus <= 4)
+	c.setRule(key, ruleSMTimeAddressFlags, m.TimeAddressFlags&^smpteTimeAddressFlagsMask == 0)
+	c.setRule(key, ruleSMLocalOffset, validLocalOffset(m.CurrentLocalOffset) && validLocalOffset(m.PreviousJamLocalOffset))
+	c.setRule(key, ruleSMDaylightSaving, m.DaylightSaving&^smpteDaylightSavingMask == 0)
+	c.setRule(key, ruleSMJamTimes, m.TimeOfNextJam == 0 || m.TimeOfPreviousJam == 0 || m.TimeOfNextJam > m.TimeOfPreviousJam)
+
+	c.masterLockingStatus.WithLabelValues(key.instance, key.iface, domain, clock).Set(float64(m.MasterLockingStatus))
+	c.currentLocalOffset.WithLabelValues(key.instance, key.iface, domain, clock).Set(float64(m.CurrentLocalOffset))
+	c.previousJamLocalOffset.WithLabelValues(key.instance, key.iface, domain, clock).Set(float64(m.PreviousJamLocalOffset))
+	c.daylightSaving.WithLabelValues(key.instance, key.iface, domain, clock).Set(float64(m.DaylightSaving & 0x01))
+	c.dropFrame.WithLabelValues(key.instance, key.iface, domain, clock).Set(float64(m.TimeAddressFlags & 0x01))
+	c.timeOfNextJam.WithLabelValues(key.instance, key.iface, domain, clock).Set(float64(m.TimeOfNextJam))
+	c.timeOfPreviousJam.WithLabelValues(key.instance, key.iface, domain, clock).Set(float64(m.TimeOfPreviousJam))
+}
+
+// CheckPortDataSet validates the configuration of a local ptp4l port
+func (c *ST2059Checker) CheckPortDataSet(instance, iface string, domain uint8, port *PortDataSet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := conformanceKey{instance: instance, iface: iface, domain: domain, port: port.PortIdentity}
+	sync := int(port.LogSyncInterval)
+
+	c.setRule(key, ruleDomainNumber, domain <= st2059DomainMax)
+	c.setRule(key, ruleAnnounceInterval, inRange(int(port.LogAnnounceInterval), st2059AnnounceIntervalMin, st2059AnnounceIntervalMax))
+	c.setRule(key, ruleSyncInterval, inRange(sync, st2059SyncIntervalMin, st2059SyncIntervalMax))
+	c.setRule(key, ruleDelayReqInterval, inRange(int(port.LogMinDelayReqInterval), sync, sync+st2059DelayReqIntervalSpan))
+	c.setRule(key, ruleAnnounceReceiptTimeout, inRange(int(port.AnnounceReceiptTimeout), st2059AnnounceReceiptMin, st2059AnnounceReceiptMax))
+}
+
+// Update fails the metadata presence rule for masters that stopped sending it
+// (or never did)
+func (c *ST2059Checker) Update(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, state := range c.states {
+		if state.announceSeen {
+			c.setRule(key, ruleSMPresent, state.metadataChecks && now.Sub(state.lastMetadata) <= smpteMetadataTimeout)
+		}
+	}
+}
+
+// Forget drops the series of a clock that left the segment
+func (c *ST2059Checker) Forget(instance, iface string, domain uint8, port PortIdentity) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.states, conformanceKey{instance: instance, iface: iface, domain: domain, port: port})
+	labels := prometheus.Labels{"ptp_instance": instance, "interface": iface, "domain": strconv.Itoa(int(domain)), "clock": port.String()}
+	for _, vec := range []*prometheus.GaugeVec{c.conformance, c.frameRate, c.masterLockingStatus,
+		c.currentLocalOffset, c.previousJamLocalOffset, c.daylightSaving, c.dropFrame,
+		c.timeOfNextJam, c.timeOfPreviousJam} {
+		vec.DeletePartialMatch(labels)
+	}
+}
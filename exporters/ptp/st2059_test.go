@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// encodeSMPTEMetadata builds a management message carrying the SMPTE synchronization metadata TLV
+func encodeSMPTEMetadata(domain uint8, source PortIdentity, localOffset int32, lockingStatus uint8) []byte {
+	body := make([]byte, managementHeaderLength+tlvHeaderLength+smpteSyncMetadataLength)
+	tlv := body[managementHeaderLength:]
+	binary.BigEndian.PutUint16(tlv[0:2], tlvOrganizationExtension)
+	binary.BigEndian.PutUint16(tlv[2:4], smpteSyncMetadataLength)
+	v := tlv[tlvHeaderLength:]
+	copy(v[0:3], smpteOrganizationID)
+	v[5] = smpteSyncMetadataSubtype
+	v = v[6:]
+	binary.BigEndian.PutUint32(v[0:4], 30000)
+	binary.BigEndian.PutUint32(v[4:8], 1001)
+	v[8] = lockingStatus
+	v[9] = 0x01 // drop frame
+	binary.BigEndian.PutUint32(v[10:14], uint32(localOffset))
+	binary.BigEndian.PutUint16(v[26:28], 0x6000) // timeOfNextJam
+	binary.BigEndian.PutUint16(v[32:34], 0x5000) // timeOfPreviousJam
+	binary.BigEndian.PutUint32(v[36:40], uint32(localOffset))
+	v[40] = 0x01
+	return encodePTPMessage(msgManagement, domain, source, 0x7F, body)
+}
+
+func TestParseSMPTESyncMetadata(t *testing.T) {
+	msg, err := ParsePTPMessage(encodeSMPTEMetadata(127, sniffMaster, -18000, 4))
+	if err != nil {
+		t.Fatalf("ParsePTPMessage failed: %v", err)
+	}
+	if len(msg.TLVs) != 1 {
+		t.Fatalf("%d TLVs decoded, want 1", len(msg.TLVs))
+	}
+	m, ok := parseSMPTESyncMetadata(msg.TLVs[0])
+	if !ok {
+		t.Fatal("SMPTE synchronization metadata not recognised")
+	}
+	if m.FrameRateNumerator != 30000 || m.FrameRateDenominator != 1001 || m.MasterLockingStatus != 4 ||
+		m.CurrentLocalOffset != -18000 || m.TimeOfNextJam <= m.TimeOfPreviousJam || m.DaylightSaving != 1 {
+		t.Errorf("unexpected metadata: %+v", m)
+	}
+
+	other := msg.TLVs[0]
+	other.Value = append([]byte{0x00, 0x1B, 0x19}, other.Value[3:]...)
+	if _, ok := parseSMPTESyncMetadata(other); ok {
+		t.Error("accepted an ORGANIZATION_EXTENSION TLV from another organization")
+	}
+}
+
+func TestST2059Conformance(t *testing.T) {
+	checker := testConformance()
+	start := time.Now()
+
+	rule := func(domain uint8, clock PortIdentity, name string) float64 {
+		return testutil.ToFloat64(checker.conformance.WithLabelValues("default", "eth1", strconv.Itoa(int(domain)), clock.String(), name))
+	}
+	check := func(payload []byte, now time.Time) {
+		msg, err := ParsePTPMessage(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checker.CheckMessage("default", "eth1", msg, now)
+	}
+
+	announce := encodeAnnounce(sniffMaster.ClockIdentity, 128, 6)
+	check(encodePTPMessage(msgAnnounce, 127, sniffMaster, -2, announce), start)
+	check(encodePTPMessage(msgSync, 127, sniffMaster, -3, make([]byte, 10)), start)
+	check(encodePTPMessage(msgDelayResp, 127, sniffMaster, -3, make([]byte, 20)), start)
+	check(encodeSMPTEMetadata(127, sniffMaster, -18000, 4), start)
+	checker.Update(start)
+
+	for _, name := range []string{ruleDomainNumber, ruleAnnounceInterval, ruleSyncInterval, ruleDelayReqInterval,
+		ruleSMPresent, ruleSMFrameRate, ruleSMMasterLockingStatus, ruleSMTimeAddressFlags, ruleSMLocalOffset,
+		ruleSMDaylightSaving, ruleSMJamTimes} {
+		if rule(127, sniffMaster, name) != 1 {
+			t.Errorf("conforming master fails %s", name)
+		}
+	}
+
+	// Default profile intervals in a domain above 127, no metadata, odd local offset
+	check(encodePTPMessage(msgAnnounce, 200, sniffRogue, 2, announce), start)
+	check(encodePTPMessage(msgSync, 200, sniffRogue, 0, make([]byte, 10)), start)
+	check(encodePTPMessage(msgDelayResp, 200, sniffRogue, 6, make([]byte, 20)), start)
+	check(encodeSMPTEMetadata(200, sniffRogue, 100, 9), start)
+	checker.Update(start.Add(10 * time.Second))
+
+	for _, name := range []string{ruleDomainNumber, ruleAnnounceInterval, ruleSyncInterval, ruleDelayReqInterval,
+		ruleSMPresent, ruleSMMasterLockingStatus, ruleSMLocalOffset} {
+		if rule(200, sniffRogue, name) != 0 {
+			t.Errorf("non-conforming master passes %s", name)
+		}
+	}
+	if rule(127, sniffMaster, ruleSMPresent) != 0 {
+		t.Error("metadata presence should fail once the master stops sending it")
+	}
+
+	checker.CheckPortDataSet("default", "eth1", 127, &PortDataSet{
+		PortIdentity:           sniffRogue,
+		LogAnnounceInterval:    -2,
+		LogSyncInterval:        -3,
+		LogMinDelayReqInterval: -3,
+		AnnounceReceiptTimeout: 1,
+	})
+	if rule(127, sniffRogue, ruleSyncInterval) != 1 || rule(127, sniffRogue, ruleAnnounceReceiptTimeout) != 0 {
+		t.Error("unexpected PORT_DATA_SET conformance")
+	}
+
+	checker.Forget("default", "eth1", 200, sniffRogue)
+	if n := testutil.CollectAndCount(checker.masterLockingStatus); n != 1 {
+		t.Errorf("%d locking status series after Forget, want 1", n)
+	}
+}
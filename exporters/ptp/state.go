@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	eventPortStateChange  = "port_state_change"
+	eventServoStateChange = "servo_state_change"
+	eventHoldoverStart    = "holdover_start"
+	eventHoldoverEnd      = "holdover_end"
+)
+
+// Clock states exported as st2110_ptp_clock_state
+const (
+	clockStateFreerun  = 0
+	clockStateLocked   = 1
+	clockStateHoldover = 2
+)
+
+// ptp4l servo states (s0 unlocked, s1 clock step, s2 locked, s3 locked stable)
+const (
+	servoUnlocked = 0
+	servoJump     = 1
+	servoLocked   = 2
+	servoUnknown  = -1
+)
+
+var portStates = []PortState{
+	PortStateInitializing, PortStateFaulty, PortStateDisabled, PortStateListening, PortStatePreMaster,
+	PortStateMaster, PortStatePassive, PortStateUncalibrated, PortStateSlave,
+}
+
+// ptp4l logs its servo with -m / syslog, e.g.
+//
+//	ptp4l[1234.567]: master offset        -5 s2 freq   -1234 path delay       612
+var ptp4lServoRe = regexp.MustCompile(`ptp4l.*?:\s+(?:\[[^\]]*\]\s+)?master offset\s+(-?\d+) s(\d) freq\s+([-+]?\d+)`)
+
+type ptp4lServoUpdate struct {
+	Offset     float64
+	ServoState int
+	Frequency  float64
+}
+
+func parsePtp4lLine(line string) (ptp4lServoUpdate, bool) {
+	m := ptp4lServoRe.FindStringSubmatch(line)
+	if m == nil {
+		return ptp4lServoUpdate{}, false
+	}
+	offset, _ := strconv.ParseFloat(m[1], 64)
+	state, _ := strconv.Atoi(m[2])
+	frequency, _ := strconv.ParseFloat(m[3], 64)
+	return ptp4lServoUpdate{Offset: offset, ServoState: state, Frequency: frequency}, true
+}
+
+func servoStateName(state int) string {
+	if state == servoUnknown {
+		return "unknown"
+	}
+	return fmt.Sprintf("s%d", state)
+}
+
+// holdoverEstimate is how long the clock stays within budget after losing its
+// master, with the time error growing from offset at drift ppb (= ns/s)
+func holdoverEstimate(offset, budget, drift float64) time.Duration {
+	margin := budget - math.Abs(offset)
+	if margin <= 0 {
+		return 0
+	}
+	if drift <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(margin / drift * float64(time.Second))
+}
+
+type portStateEntry struct {
+	state PortState
+	since time.Time
+}
+
+// StateTracker follows the port and servo states of a ptp4l instance and
+// estimates how long the clock can hold over within the time error budget
+type StateTracker struct {
+	mu            sync.Mutex
+	device        string
+	instance      string
+	interfaceName string
+	events        *EventLog
+	budget        float64 // time error budget in nanoseconds
+	drift         float64 // assumed frequency drift in holdover, ppb
+
+	ports        map[uint16]*portStateEntry
+	servo        int
+	servoSince   time.Time
+	servoFromLog bool
+
+	lastOffset     float64
+	wasLocked      bool
+	inHoldover     bool
+	holdoverStart  time.Time
+	holdoverOffset float64
+
+	portState         *prometheus.GaugeVec
+	portStateSeconds  *prometheus.GaugeVec
+	portTransitions   *prometheus.CounterVec
+	servoState        *prometheus.GaugeVec
+	servoStateSeconds *prometheus.GaugeVec
+	servoTransitions  *prometheus.CounterVec
+	holdoverActive    *prometheus.GaugeVec
+	holdoverSeconds   *prometheus.GaugeVec
+	holdoverEstimate  *prometheus.GaugeVec
+	holdoverRemaining *prometheus.GaugeVec
+	holdoverTimeError *prometheus.GaugeVec
+}
+
+func NewStateTracker(device, instance, iface string, events *EventLog, budget time.Duration, drift float64) *StateTracker {
+	labels := []string{"device", "ptp_instance", "interface"}
+	portLabels := []string{"device", "ptp_instance", "interface", "port"}
+
+	gauge := func(name, help string, labels []string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	}
+
+	t := &StateTracker{
+		device:        device,
+		instance:      instance,
+		interfaceName: iface,
+		events:        events,
+		budget:        float64(budget.Nanoseconds()),
+		drift:         drift,
+		ports:         make(map[uint16]*portStateEntry),
+		servo:         servoUnknown,
+
+		portState: gauge("st2110_ptp_port_state",
+			"ptp4l port state (1 for the current state)",
+			[]string{"device", "ptp_instance", "interface", "port", "state"}),
+		portStateSeconds: gauge("st2110_ptp_port_state_seconds",
+			"Time the port has been in its current state", portLabels),
+		portTransitions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_ptp_port_state_transitions_total",
+				Help: "ptp4l port state transitions",
+			},
+			[]string{"device", "ptp_instance", "interface", "port", "from", "to"},
+		),
+		servoState: gauge("st2110_ptp_servo_state",
+			"ptp4l servo state (0=unlocked, 1=clock step, 2=locked, 3=locked stable; -1=unknown)", labels),
+		servoStateSeconds: gauge("st2110_ptp_servo_state_seconds",
+			"Time the servo has been in its current state", labels),
+		servoTransitions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_ptp_servo_state_transitions_total",
+				Help: "ptp4l servo state transitions",
+			},
+			[]string{"device", "ptp_instance", "interface", "from", "to"},
+		),
+		holdoverActive: gauge("st2110_ptp_holdover_active",
+			"Clock lost its master and is holding over within the time error budget (1=holdover)", labels),
+		holdoverSeconds: gauge("st2110_ptp_holdover_seconds",
+			"Time since the clock lost its master (0 when locked)", labels),
+		holdoverEstimate: gauge("st2110_ptp_holdover_estimate_seconds",
+			"Estimated holdover within the time error budget from the last locked offset and the drift assumption", labels),
+		holdoverRemaining: gauge("st2110_ptp_holdover_remaining_seconds",
+			"Estimated holdover left before the time error budget is exceeded", labels),
+		holdoverTimeError: gauge("st2110_ptp_holdover_time_error_nanoseconds",
+			"Estimated time error accumulated in holdover", labels),
+	}
+
+	t.portState = register(t.portState)
+	t.portStateSeconds = register(t.portStateSeconds)
+	t.portTransitions = register(t.portTransitions)
+	t.servoState = register(t.servoState)
+	t.servoStateSeconds = register(t.servoStateSeconds)
+	t.servoTransitions = register(t.servoTransitions)
+	t.holdoverActive = register(t.holdoverActive)
+	t.holdoverSeconds = register(t.holdoverSeconds)
+	t.holdoverEstimate = register(t.holdoverEstimate)
+	t.holdoverRemaining = register(t.holdoverRemaining)
+	t.holdoverTimeError = register(t.holdoverTimeError)
+
+	return t
+}
+
+func (t *StateTracker) addEvent(now time.Time, eventType, from, to, detail string) {
+	t.events.Add(Event{
+		Time:      now,
+		Device:    t.device,
+		Instance:  t.instance,
+		Interface: t.interfaceName,
+		Type:      eventType,
+		From:      from,
+		To:        to,
+		Detail:    detail,
+	})
+}
+
+// UpdatePort records the state of a port from PORT_DATA_SET
+func (t *StateTracker) UpdatePort(port uint16, state PortState, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	portLabel := strconv.Itoa(int(port))
+	entry, ok := t.ports[port]
+	if !ok {
+		entry = &portStateEntry{state: state, since: now}
+		t.ports[port] = entry
+	} else if entry.state != state {
+		log.Printf("PTP instance %s port %d: %s -> %s", t.instance, port, entry.state, state)
+		t.portTransitions.WithLabelValues(t.device, t.instance, t.interfaceName, portLabel, entry.state.String(), state.String()).Inc()
+		t.addEvent(now, eventPortStateChange, entry.state.String(), state.String(), "port="+portLabel)
+		entry.state, entry.since = state, now
+	}
+
+	for _, s := range portStates {
+		t.portState.WithLabelValues(t.device, t.instance, t.interfaceName, portLabel, s.String()).Set(boolToFloat(s == state))
+	}
+}
+
+// HandleLogLine takes the servo state from a ptp4l log line; once the log
+// is seen it replaces the state inferred from the port states
+func (t *StateTracker) HandleLogLine(line string, now time.Time) {
+	update, ok := parsePtp4lLine(line)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.servoFromLog = true
+	t.setServo(update.ServoState, now)
+}
+
+func (t *StateTracker) setServo(state int, now time.Time) {
+	if state == t.servo {
+		return
+	}
+	if t.servo != servoUnknown {
+		from, to := servoStateName(t.servo), servoStateName(state)
+		log.Printf("PTP instance %s servo: %s -> %s", t.instance, from, to)
+		t.servoTransitions.WithLabelValues(t.device, t.instance, t.interfaceName, from, to).Inc()
+		t.addEvent(now, eventServoStateChange, from, to, "")
+	}
+	t.servo, t.servoSince = state, now
+}
+
+// slave reports whether any port tracks a master; ptp4l only moves a port from
+// UNCALIBRATED to SLAVE once its servo has locked
+func (t *StateTracker) slave() bool {
+	for _, entry := range t.ports {
+		if entry.state == PortStateSlave {
+			return true
+		}
+	}
+	return false
+}
+
+// Update derives the clock state after a poll; reachable is false when ptp4l
+// could not be queried, offset is the last offsetFromMaster
+func (t *StateTracker) Update(reachable, gmPresent bool, offset float64, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.servoSince.IsZero() {
+		t.servoSince = now
+	}
+	if !t.servoFromLog {
+		switch {
+		case !reachable:
+			t.setServo(servoUnknown, now)
+		case t.slave():
+			t.setServo(servoLocked, now)
+		default:
+			t.setServo(servoUnlocked, now)
+		}
+	}
+
+	locked := reachable && gmPresent && t.slave() && t.servo >= servoLocked
+	state := clockStateFreerun
+	switch {
+	case locked:
+		if t.inHoldover {
+			log.Printf("PTP instance %s relocked after %s in holdover", t.instance, now.Sub(t.holdoverStart).Round(time.Second))
+			t.addEvent(now, eventHoldoverEnd, "holdover", "locked",
+				fmt.Sprintf("duration=%s", now.Sub(t.holdoverStart).Round(time.Second)))
+			t.inHoldover = false
+		}
+		t.wasLocked = true
+		t.lastOffset = offset
+		state = clockStateLocked
+	case t.wasLocked:
+		if !t.inHoldover {
+			log.Printf("⚠️  PTP instance %s lost lock, entering holdover", t.instance)
+			t.addEvent(now, eventHoldoverStart, "locked", "holdover",
+				fmt.Sprintf("offset=%.0fns", t.lastOffset))
+			t.inHoldover = true
+			t.holdoverStart = now
+			t.holdoverOffset = t.lastOffset
+		}
+		timeError := math.Abs(t.holdoverOffset) + t.drift*now.Sub(t.holdoverStart).Seconds()
+		if timeError > t.budget {
+			log.Printf("⚠️  PTP instance %s exceeded its holdover budget, free running", t.instance)
+			t.addEvent(now, eventHoldoverEnd, "holdover", "freerun",
+				fmt.Sprintf("duration=%s time_error=%.0fns", now.Sub(t.holdoverStart).Round(time.Second), timeError))
+			t.inHoldover = false
+			t.wasLocked = false
+		} else {
+			state = clockStateHoldover
+		}
+	}
+
+	t.publish(now)
+	return state
+}
+
+func (t *StateTracker) publish(now time.Time) {
+	for port, entry := range t.ports {
+		t.portStateSeconds.WithLabelValues(t.device, t.instance, t.interfaceName, strconv.Itoa(int(port))).Set(now.Sub(entry.since).Seconds())
+	}
+	t.servoState.WithLabelValues(t.device, t.instance, t.interfaceName).Set(float64(t.servo))
+	t.servoStateSeconds.WithLabelValues(t.device, t.instance, t.interfaceName).Set(now.Sub(t.servoSince).Seconds())
+
+	offset := t.lastOffset
+	var elapsed time.Duration
+	if t.inHoldover {
+		offset = t.holdoverOffset
+		elapsed = now.Sub(t.holdoverStart)
+	}
+	estimate := holdoverEstimate(offset, t.budget, t.drift)
+	t.holdoverActive.WithLabelValues(t.device, t.instance, t.interfaceName).Set(boolToFloat(t.inHoldover))
+	t.holdoverSeconds.WithLabelValues(t.device, t.instance, t.interfaceName).Set(elapsed.Seconds())
+	t.holdoverEstimate.WithLabelValues(t.device, t.instance, t.interfaceName).Set(estimate.Seconds())
+	t.holdoverRemaining.WithLabelValues(t.device, t.instance, t.interfaceName).Set(math.Max(0, (estimate - elapsed).Seconds()))
+	t.holdoverTimeError.WithLabelValues(t.device, t.instance, t.interfaceName).Set(math.Abs(offset) + t.drift*elapsed.Seconds())
+}
+
+// Start follows the ptp4l log for the servo state
+func (t *StateTracker) Start(logPath string) {
+	go followFile(logPath, func(line string) {
+		t.HandleLogLine(line, time.Now())
+	})
+	log.Printf("Following ptp4l log %s for instance %s", logPath, t.instance)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParsePtp4lLine(t *testing.T) {
+	got, ok := parsePtp4lLine("ptp4l[1234.567]: master offset        -5 s2 freq   -1234 path delay       612")
+	if !ok || got != (ptp4lServoUpdate{Offset: -5, ServoState: 2, Frequency: -1234}) {
+		t.Errorf("parsePtp4lLine = %+v, %v", got, ok)
+	}
+	if _, ok := parsePtp4lLine("ptp4l[1234.567]: port 1 (eth0): UNCALIBRATED to SLAVE on MASTER_CLOCK_SELECTED"); ok {
+		t.Error("parsed a line without servo data")
+	}
+}
+
+func TestHoldoverEstimate(t *testing.T) {
+	// 1µs budget, 200ns already used, 10 ppb: 80s
+	if got := holdoverEstimate(-200, 1000, 10); got != 80*time.Second {
+		t.Errorf("holdoverEstimate = %v, want 80s", got)
+	}
+	if got := holdoverEstimate(1500, 1000, 10); got != 0 {
+		t.Errorf("holdoverEstimate over budget = %v, want 0", got)
+	}
+}
+
+func TestStateTrackerHoldover(t *testing.T) {
+	events := NewEventLog(20)
+	tracker := NewStateTracker("state-test", "red", "eth1", events, time.Microsecond, 10)
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	holdover := func() float64 {
+		return testutil.ToFloat64(tracker.holdoverActive.WithLabelValues("state-test", "red", "eth1"))
+	}
+
+	tracker.UpdatePort(1, PortStateListening, at(0))
+	if state := tracker.Update(true, false, 0, at(0)); state != clockStateFreerun {
+		t.Errorf("listening port: clock state %d, want FREERUN", state)
+	}
+	tracker.UpdatePort(1, PortStateUncalibrated, at(1))
+	tracker.UpdatePort(1, PortStateSlave, at(2))
+	if state := tracker.Update(true, true, -200, at(2)); state != clockStateLocked {
+		t.Errorf("slave port: clock state %d, want LOCKED", state)
+	}
+
+	// ptp4l goes away: holdover until 800ns of drift at 10 ppb (80s)
+	if state := tracker.Update(false, false, 0, at(10)); state != clockStateHoldover || holdover() != 1 {
+		t.Errorf("lost ptp4l: clock state %d, want HOLDOVER", state)
+	}
+	if got := testutil.ToFloat64(tracker.holdoverRemaining.WithLabelValues("state-test", "red", "eth1")); got != 80 {
+		t.Errorf("holdover remaining = %v, want 80", got)
+	}
+	if state := tracker.Update(false, false, 0, at(100)); state != clockStateFreerun || holdover() != 0 {
+		t.Errorf("budget exceeded: clock state %d, want FREERUN", state)
+	}
+
+	if got := testutil.ToFloat64(tracker.portTransitions.WithLabelValues("state-test", "red", "eth1", "1", "UNCALIBRATED", "SLAVE")); got != 1 {
+		t.Errorf("UNCALIBRATED -> SLAVE transitions = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tracker.portState.WithLabelValues("state-test", "red", "eth1", "1", "SLAVE")); got != 1 {
+		t.Errorf("SLAVE state gauge = %v, want 1", got)
+	}
+
+	recorder := httptest.NewRecorder()
+	events.Filter(eventHoldoverStart, eventHoldoverEnd).ServeHTTP(recorder, httptest.NewRequest("GET", "/transitions?instance=red", nil))
+	var timeline []Event
+	json.Unmarshal(recorder.Body.Bytes(), &timeline)
+	if len(timeline) != 2 || timeline[0].Type != eventHoldoverStart || timeline[1].To != "freerun" {
+		t.Errorf("unexpected holdover timeline: %+v", timeline)
+	}
+}
+
+func TestClockStateWithoutTimeStatus(t *testing.T) {
+	fake, path := newFakePTP4LUDS(t)
+	fake.setData(mgmtCurrentDataSet, encodeCurrentDataSet(1, -200, 600))
+	gm := ClockIdentity{0xec, 0x46, 0x70, 0xff, 0xfe, 0x00, 0x01, 0x02}
+	parent := make([]byte, 32)
+	copy(parent[0:8], gm[:])
+	copy(parent[24:32], gm[:])
+	fake.setData(mgmtParentDataSet, parent)
+	fake.mu.Lock()
+	fake.errors[mgmtTimeStatusNP] = 0x0006 // NOT_SUPPORTED
+	fake.mu.Unlock()
+
+	dial := func() (*PMCClient, error) { return DialUDS(path, 0, 200*time.Millisecond) }
+	exporter := NewPTPExporter("time-status-test", InstanceConfig{Name: "red", Interface: "eth1"}, dial, NewEventLog(10), nil)
+	exporter.state = NewStateTracker("time-status-test", "red", "eth1", NewEventLog(10), time.Microsecond, 10)
+	t.Cleanup(exporter.disconnect)
+	state := func() float64 {
+		return testutil.ToFloat64(exporter.clockState.WithLabelValues("time-status-test", "red", "eth1"))
+	}
+
+	// A target without the linuxptp extension locks on a SLAVE port with a
+	// grandmaster in PARENT_DATA_SET
+	exporter.state.UpdatePort(1, PortStateSlave, time.Now())
+	exporter.CollectPTPMetrics()
+	if state() != clockStateLocked {
+		t.Errorf("clock state with TIME_STATUS_NP not supported = %v, want LOCKED", state())
+	}
+	exporter.CollectPTPMetrics()
+	if !exporter.timeStatusUnsupported || state() != clockStateLocked {
+		t.Errorf("clock state on the next poll = %v, want LOCKED", state())
+	}
+
+	// An unanswered query doesn't keep the last state
+	fake.mu.Lock()
+	delete(fake.errors, mgmtTimeStatusNP)
+	fake.silent[mgmtTimeStatusNP] = true
+	fake.mu.Unlock()
+	exporter.CollectPTPMetrics()
+	if state() != clockStateHoldover {
+		t.Errorf("clock state without a TIME_STATUS_NP answer = %v, want HOLDOVER", state())
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Observation intervals for MTIE and TDEV (ITU-T G.8260 style masks)
+var tieObservationIntervals = []time.Duration{
+	1 * time.Second,
+	10 * time.Second,
+	100 * time.Second,
+	1000 * time.Second,
+}
+
+// TDEV(τ) needs three τ of history
+const tieHistoryFactor = 3
+
+// windowSummary holds the statistics of one window of samples
+type windowSummary struct {
+	Min, Max, Mean, StdDev float64
+	P50, P90, P99          float64
+}
+
+func summarize(values []float64) windowSummary {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(len(sorted))
+	var squares float64
+	for _, v := range sorted {
+		squares += (v - mean) * (v - mean)
+	}
+
+	percentile := func(p float64) float64 {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+
+	return windowSummary{
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+		Mean:   mean,
+		StdDev: math.Sqrt(squares / float64(len(sorted))),
+		P50:    percentile(0.50),
+		P90:    percentile(0.90),
+		P99:    percentile(0.99),
+	}
+}
+
+// mtie is the maximum peak-to-peak time error over all windows of n sample
+// intervals (n+1 samples), using monotonic deques for O(N)
+func mtie(x []float64, n int) float64 {
+	if n < 1 || len(x) < n+1 {
+		return math.NaN()
+	}
+	var maxQ, minQ []int
+	var result float64
+	for i := range x {
+		for len(maxQ) > 0 && x[maxQ[len(maxQ)-1]] <= x[i] {
+			maxQ = maxQ[:len(maxQ)-1]
+		}
+		maxQ = append(maxQ, i)
+		for len(minQ) > 0 && x[minQ[len(minQ)-1]] >= x[i] {
+			minQ = minQ[:len(minQ)-1]
+		}
+		minQ = append(minQ, i)
+
+		if maxQ[0] <= i-n-1 {
+			maxQ = maxQ[1:]
+		}
+		if minQ[0] <= i-n-1 {
+			minQ = minQ[1:]
+		}
+		if i >= n {
+			result = math.Max(result, x[maxQ[0]]-x[minQ[0]])
+		}
+	}
+	return result
+}
+
+// tdev is the time deviation at τ = n sample intervals (ITU-T G.810):
+// sqrt( 1/(6n²(N-3n+1)) Σj [ Σi=j..j+n-1 (x[i+2n] - 2x[i+n] + x[i]) ]² )
+func tdev(x []float64, n int) float64 {
+	N := len(x)
+	if n < 1 || N < 3*n {
+		return math.NaN()
+	}
+	prefix := make([]float64, N+1)
+	for i, v := range x {
+		prefix[i+1] = prefix[i] + v
+	}
+	sum := func(from, to int) float64 { return prefix[to] - prefix[from] }
+
+	var total float64
+	terms := N - 3*n + 1
+	for j := 0; j < terms; j++ {
+		inner := sum(j+2*n, j+3*n) - 2*sum(j+n, j+2*n) + sum(j, j+n)
+		total += inner * inner
+	}
+	return math.Sqrt(total / (6 * float64(n) * float64(n) * float64(terms)))
+}
+
+// TimingStats samples offsetFromMaster and meanPathDelay faster than the
+// scrape interval and publishes their distribution and time-error metrics
+type TimingStats struct {
+	mu             sync.Mutex
+	device         string
+	instance       string
+	interfaceName  string
+	sampleInterval time.Duration
+
+	offsets []float64
+	delays  []float64
+	history []float64 // offset time error series, sampleInterval apart
+
+	samples            *prometheus.CounterVec
+	offsetHistogram    *prometheus.HistogramVec
+	delayHistogram     *prometheus.HistogramVec
+	offsetWindow       *prometheus.GaugeVec
+	delayWindow        *prometheus.GaugeVec
+	maxTimeIntervalErr *prometheus.GaugeVec
+	timeDeviation      *prometheus.GaugeVec
+}
+
+func NewTimingStats(device, instance, iface string, sampleInterval time.Duration) *TimingStats {
+	labels := []string{"device", "ptp_instance", "interface"}
+
+	stats := &TimingStats{
+		device:         device,
+		instance:       instance,
+		interfaceName:  iface,
+		sampleInterval: sampleInterval,
+
+		samples: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "st2110_ptp_samples_total",
+				Help: "Offset and path delay samples taken from ptp4l",
+			},
+			labels,
+		),
+		offsetHistogram: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "st2110_ptp_offset_distribution_nanoseconds",
+				Help:    "Distribution of offsetFromMaster samples in nanoseconds",
+				Buckets: []float64{-10000, -1000, -500, -250, -100, -50, -25, -10, 0, 10, 25, 50, 100, 250, 500, 1000, 10000},
+			},
+			labels,
+		),
+		delayHistogram: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "st2110_ptp_mean_path_delay_distribution_nanoseconds",
+				Help:    "Distribution of meanPathDelay samples in nanoseconds",
+				Buckets: prometheus.ExponentialBuckets(100, 2, 12),
+			},
+			labels,
+		),
+		offsetWindow: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_offset_window_nanoseconds",
+				Help: "offsetFromMaster statistics over the last window (min, max, mean, stddev, p50, p90, p99)",
+			},
+			[]string{"device", "ptp_instance", "interface", "stat"},
+		),
+		delayWindow: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_mean_path_delay_window_nanoseconds",
+				Help: "meanPathDelay statistics over the last window (min, max, mean, stddev, p50, p90, p99)",
+			},
+			[]string{"device", "ptp_instance", "interface", "stat"},
+		),
+		maxTimeIntervalErr: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_mtie_nanoseconds",
+				Help: "Maximum time interval error of offsetFromMaster per observation interval",
+			},
+			[]string{"device", "ptp_instance", "interface", "tau"},
+		),
+		timeDeviation: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "st2110_ptp_tdev_nanoseconds",
+				Help: "Time deviation of offsetFromMaster per observation interval",
+			},
+			[]string{"device", "ptp_instance", "interface", "tau"},
+		),
+	}
+
+	stats.samples = register(stats.samples)
+	stats.offsetHistogram = register(stats.offsetHistogram)
+	stats.delayHistogram = register(stats.delayHistogram)
+	stats.offsetWindow = register(stats.offsetWindow)
+	stats.delayWindow = register(stats.delayWindow)
+	stats.maxTimeIntervalErr = register(stats.maxTimeIntervalErr)
+	stats.timeDeviation = register(stats.timeDeviation)
+
+	return stats
+}
+
+func (s *TimingStats) Add(offset, delay float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples.WithLabelValues(s.device, s.instance, s.interfaceName).Inc()
+	s.offsetHistogram.WithLabelValues(s.device, s.instance, s.interfaceName).Observe(offset)
+	s.delayHistogram.WithLabelValues(s.device, s.instance, s.interfaceName).Observe(delay)
+	s.offsets = append(s.offsets, offset)
+	s.delays = append(s.delays, delay)
+
+	// Keep enough history for the longest TDEV, trimming in batches
+	maxSamples := tieHistoryFactor * int(tieObservationIntervals[len(tieObservationIntervals)-1]/s.sampleInterval)
+	s.history = append(s.history, offset)
+	if len(s.history) > 2*maxSamples {
+		s.history = append(s.history[:0], s.history[len(s.history)-maxSamples:]...)
+	}
+}
+
+// Reset drops the time-error history, e.g. after a grandmaster change when
+// the series is no longer continuous
+func (s *TimingStats) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.history = s.history[:0]
+	s.maxTimeIntervalErr.DeletePartialMatch(prometheus.Labels{"device": s.device, "ptp_instance": s.instance})
+	s.timeDeviation.DeletePartialMatch(prometheus.Labels{"device": s.device, "ptp_instance": s.instance})
+}
+
+// Publish exports the statistics of the window that just ended and the
+// time-error metrics over the history, then starts a new window
+func (s *TimingStats) Publish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.offsets) == 0 {
+		return
+	}
+	publishSummary(s.offsetWindow, s.device, s.instance, s.interfaceName, summarize(s.offsets))
+	publishSummary(s.delayWindow, s.device, s.instance, s.interfaceName, summarize(s.delays))
+	s.offsets = s.offsets[:0]
+	s.delays = s.delays[:0]
+
+	for _, tau := range tieObservationIntervals {
+		n := int(tau / s.sampleInterval)
+		label := fmt.Sprintf("%gs", tau.Seconds())
+		if v := mtie(s.history, n); !math.IsNaN(v) {
+			s.maxTimeIntervalErr.WithLabelValues(s.device, s.instance, s.interfaceName, label).Set(v)
+		}
+		if v := tdev(s.history, n); !math.IsNaN(v) {
+			s.timeDeviation.WithLabelValues(s.device, s.instance, s.interfaceName, label).Set(v)
+		}
+	}
+}
+
+func publishSummary(vec *prometheus.GaugeVec, device, instance, iface string, summary windowSummary) {
+	vec.WithLabelValues(device, instance, iface, "min").Set(summary.Min)
+	vec.WithLabelValues(device, instance, iface, "max").Set(summary.Max)
+	vec.WithLabelValues(device, instance, iface, "mean").Set(summary.Mean)
+	vec.WithLabelValues(device, instance, iface, "stddev").Set(summary.StdDev)
+	vec.WithLabelValues(device, instance, iface, "p50").Set(summary.P50)
+	vec.WithLabelValues(device, instance, iface, "p90").Set(summary.P90)
+	vec.WithLabelValues(device, instance, iface, "p99").Set(summary.P99)
+}
+
+// Start polls CURRENT_DATA_SET every sample interval on its own management
+// client and publishes the statistics every window
+func (s *TimingStats) Start(dial func() (*PMCClient, error), window time.Duration) {
+	go func() {
+		var client *PMCClient
+		failing := false // Logged once per outage rather than every sample
+		ticker := time.NewTicker(s.sampleInterval)
+		for range ticker.C {
+			if client == nil {
+				var err error
+				if client, err = dial(); err != nil {
+					continue
+				}
+			}
+			current, err := client.GetCurrentDataSet()
+			if err != nil {
+				if !failing {
+					log.Printf("Failed to sample CURRENT_DATA_SET: %v", err)
+				}
+				failing = true
+				client.Close()
+				client = nil
+				continue
+			}
+			if failing {
+				log.Printf("Sampling CURRENT_DATA_SET again")
+			}
+			failing = false
+			s.Add(current.OffsetFromMaster, current.MeanPathDelay)
+		}
+	}()
+
+	go func() {
+		for range time.Tick(window) {
+			s.Publish()
+		}
+	}()
+}
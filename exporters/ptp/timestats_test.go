@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSummarize(t *testing.T) {
+	values := make([]float64, 100)
+	for i := range values {
+		values[i] = float64(100 - i) // 100 .. 1, unsorted on purpose
+	}
+	s := summarize(values)
+	if s.Min != 1 || s.Max != 100 || s.Mean != 50.5 || s.P50 != 50 || s.P90 != 90 || s.P99 != 99 {
+		t.Errorf("unexpected summary: %+v", s)
+	}
+	if math.Abs(s.StdDev-28.866) > 0.001 {
+		t.Errorf("stddev = %v, want 28.866", s.StdDev)
+	}
+	if values[0] != 100 {
+		t.Error("summarize reordered its input")
+	}
+}
+
+func TestMTIE(t *testing.T) {
+	// Constant frequency offset: the time error grows by 1 ns per sample
+	ramp := make([]float64, 50)
+	for i := range ramp {
+		ramp[i] = float64(i)
+	}
+	if got := mtie(ramp, 10); got != 10 {
+		t.Errorf("MTIE of a ramp = %v, want 10", got)
+	}
+
+	spike := make([]float64, 50)
+	spike[30] = 40
+	spike[31] = -20
+	if got := mtie(spike, 1); got != 60 {
+		t.Errorf("MTIE(1) across a spike = %v, want 60", got)
+	}
+	if got := mtie(spike, 49); got != 60 {
+		t.Errorf("MTIE over the whole series = %v, want 60", got)
+	}
+	if !math.IsNaN(mtie(spike, 50)) {
+		t.Error("MTIE should be undefined without enough samples")
+	}
+}
+
+func TestTDEV(t *testing.T) {
+	// A frequency offset (linear time error) is removed by the second difference
+	linear := make([]float64, 300)
+	quadratic := make([]float64, 300)
+	for i := range linear {
+		linear[i] = 3 * float64(i)
+		quadratic[i] = float64(i * i)
+	}
+	if got := tdev(linear, 10); got != 0 {
+		t.Errorf("TDEV of a linear time error = %v, want 0", got)
+	}
+
+	// Constant frequency drift: every second difference is 2n², so TDEV = n²·sqrt(2/3)
+	n := 10
+	want := float64(n*n) * math.Sqrt(2.0/3.0)
+	if got := tdev(quadratic, n); math.Abs(got-want) > 1e-6 {
+		t.Errorf("TDEV of a quadratic time error = %v, want %v", got, want)
+	}
+	if !math.IsNaN(tdev(quadratic, 101)) {
+		t.Error("TDEV should be undefined without three τ of history")
+	}
+}
+
+func TestTimingStatsPublish(t *testing.T) {
+	stats := NewTimingStats("camera-1", "default", "eth0", 100*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		stats.Add(float64(i%5)-2, 1000)
+	}
+	stats.Publish()
+
+	if got := testutil.ToFloat64(stats.offsetWindow.WithLabelValues("camera-1", "default", "eth0", "max")); got != 2 {
+		t.Errorf("window max offset = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(stats.delayWindow.WithLabelValues("camera-1", "default", "eth0", "stddev")); got != 0 {
+		t.Errorf("window path delay stddev = %v, want 0", got)
+	}
+	// 10 s of samples: MTIE(1s) is known, MTIE(10s) needs one more sample
+	if got := testutil.ToFloat64(stats.maxTimeIntervalErr.WithLabelValues("camera-1", "default", "eth0", "1s")); got != 4 {
+		t.Errorf("MTIE(1s) = %v, want 4", got)
+	}
+	if n := testutil.CollectAndCount(stats.maxTimeIntervalErr); n != 1 {
+		t.Errorf("%d MTIE series, want only tau=1s", n)
+	}
+
+	stats.Reset()
+	if n := testutil.CollectAndCount(stats.timeDeviation); n != 0 {
+		t.Errorf("%d TDEV series after Reset, want 0", n)
+	}
+}